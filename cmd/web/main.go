@@ -2,28 +2,104 @@ package main
 
 import (
 	"encoding/gob"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"time"
+	_ "time/tzdata"
 
+	"github.com/ashrielbrian/go_bookings/internal/clock"
 	"github.com/ashrielbrian/go_bookings/internal/config"
 	"github.com/ashrielbrian/go_bookings/internal/driver"
+	"github.com/ashrielbrian/go_bookings/internal/events"
 	"github.com/ashrielbrian/go_bookings/internal/handlers"
 	"github.com/ashrielbrian/go_bookings/internal/helpers"
 	"github.com/ashrielbrian/go_bookings/internal/models"
+	"github.com/ashrielbrian/go_bookings/internal/ratelimit"
 	"github.com/ashrielbrian/go_bookings/internal/render"
+	"github.com/ashrielbrian/go_bookings/internal/repository/cache"
+	"github.com/ashrielbrian/go_bookings/internal/storage"
+	"github.com/ashrielbrian/go_bookings/internal/webhooks"
 
 	"github.com/alexedwards/scs/v2"
 )
 
 const portNumber = ":8080"
 
-var app = config.AppConfig{}
+// the database connected to unless the -dsn flag says otherwise, for each of the dialects the -db flag selects
+var defaultDSNs = map[string]string{
+	driver.Postgres: "host=localhost port=5432 dbname=bookings user=briant password=",
+	driver.SQLite:   "bookings.db",
+}
+
+// prices are stored in this currency; guests may choose to see them converted
+const baseCurrency = "USD"
+
+// uploaded files are stored in uploadsDir and served from uploadsURL
+const uploadsDir = "./uploads"
+const uploadsURL = "/uploads"
+
+// app's clock is set here rather than in run, so that the migrate and seed commands use it too
+var app = config.AppConfig{Clock: clock.Real{}}
 var session *scs.SessionManager
 
+// migrateOnStart is set by the -auto-migrate flag
+var migrateOnStart bool
+
+// dbDialect and dsn are set by the -db and -dsn flags
+var dbDialect = driver.Postgres
+var dsn string
+
+// dbOptions configures the database connection pool; the -db-* flags override the defaults
+var dbOptions = driver.DefaultOptions()
+
+// useCache is set by the -cache flag, and cacheOptions by the -cache-* flags
+var useCache bool
+var cacheOptions = cache.DefaultOptions()
+
+// timezone is set by the -timezone flag: the property's time zone, which decides what today is for bookings
+var timezone = "UTC"
+
 func main() {
+	flag.StringVar(&dbDialect, "db", dbDialect, "database to use, postgres or sqlite")
+	flag.StringVar(&dsn, "dsn", "", "database connection string, or file for sqlite (defaults to the development database)")
+	flag.BoolVar(&migrateOnStart, "auto-migrate", false, "apply pending migrations on startup (development only)")
+	flag.IntVar(&dbOptions.MaxOpenConns, "db-max-open", dbOptions.MaxOpenConns, "maximum open database connections")
+	flag.IntVar(&dbOptions.MaxIdleConns, "db-max-idle", dbOptions.MaxIdleConns, "maximum idle database connections")
+	flag.DurationVar(&dbOptions.ConnMaxLifetime, "db-max-lifetime", dbOptions.ConnMaxLifetime, "maximum time a database connection is reused")
+	flag.DurationVar(&dbOptions.ConnMaxIdleTime, "db-max-idle-time", dbOptions.ConnMaxIdleTime, "maximum time a database connection stays idle")
+	flag.DurationVar(&dbOptions.MaxWait, "db-max-wait", dbOptions.MaxWait, "how long to wait for the database on startup")
+	flag.BoolVar(&useCache, "cache", false, "cache availability searches and rooms in memory")
+	flag.DurationVar(&cacheOptions.AvailabilityTTL, "cache-availability-ttl", cacheOptions.AvailabilityTTL, "how long availability searches are cached")
+	flag.DurationVar(&cacheOptions.RoomTTL, "cache-room-ttl", cacheOptions.RoomTTL, "how long rooms are cached")
+	flag.StringVar(&timezone, "timezone", timezone, "the property's IANA time zone, eg. Europe/London")
+	flag.Parse()
+
+	if dsn == "" {
+		dsn = defaultDSNs[dbDialect]
+	}
+
+	// the commands report waiting for the database; run replaces these with the application's logs
+	dbOptions.InfoLog = log.New(os.Stdout, "", 0)
+	dbOptions.ErrorLog = log.New(os.Stderr, "", 0)
+
+	switch flag.Arg(0) {
+	case "migrate":
+		err := runMigrate(flag.Args()[1:], os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "seed":
+		err := runSeed(flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	db, err := run()
 
 	if err != nil {
@@ -32,6 +108,20 @@ func main() {
 
 	defer db.SQL.Close()
 
+	done := make(chan struct{})
+	defer close(done)
+	go db.Monitor(30*time.Second, done)
+	go handlers.Repo.PurgeIdempotencyKeys(time.Hour, done)
+	worker := webhooks.NewWorker(handlers.Repo.DB, app.ErrorLog)
+	worker.Clock = app.Clock
+	go worker.Run(5*time.Second, done)
+
+	bus := events.NewBus()
+	handlers.Repo.Subscribe(bus)
+	dispatcher := events.NewDispatcher(handlers.Repo.DB, bus, app.ErrorLog)
+	dispatcher.Clock = app.Clock
+	go dispatcher.Run(time.Second, done)
+
 	fmt.Printf("Application listening on port %s", portNumber)
 	srv := http.Server{
 		Addr:    portNumber,
@@ -56,6 +146,14 @@ func run() (*driver.DB, error) {
 	// change this to true when deploying to production
 	app.InProduction = false
 
+	app.BaseCurrency = baseCurrency
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown -timezone %q: %w", timezone, err)
+	}
+	app.Location = loc
+
 	session = scs.New()
 	session.Lifetime = 24 * time.Hour
 	session.Cookie.Persist = true                  // allows user session to remain after browser window closes
@@ -64,17 +162,26 @@ func run() (*driver.DB, error) {
 
 	app.Session = session
 
+	app.UseCache = true
+	app.InfoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
+	app.ErrorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+
 	// connect to database
 	log.Println("Connecting to database...")
-	db, err := driver.ConnectSQL("host=localhost port=5432 dbname=bookings user=briant password=")
+	dbOptions.InfoLog = app.InfoLog
+	dbOptions.ErrorLog = app.ErrorLog
 
+	db, err := driver.Connect(dbDialect, dsn, dbOptions)
 	if err != nil {
-		log.Fatal("Cannot connect to database! Dying...")
+		return nil, err
 	}
 
-	app.UseCache = true
-	app.InfoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-	app.ErrorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+	if migrateOnStart {
+		err = autoMigrate(db)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	tc, err := render.CreateTemplateCache()
 
@@ -84,8 +191,28 @@ func run() (*driver.DB, error) {
 	}
 
 	app.TemplateCache = tc
+	app.Storage = storage.NewLocal(uploadsDir, uploadsURL)
+
+	// limits are per client, or per API key for the api group
+	app.RateLimits = map[string]ratelimit.Limit{
+		"public":  ratelimit.Every(300, time.Minute, 60),
+		"search":  ratelimit.Every(30, time.Minute, 10),
+		"booking": ratelimit.Every(5, time.Minute, 5),
+		"api":     ratelimit.Every(600, time.Minute, 100),
+	}
+	app.RateLimitStore = ratelimit.NewMemory()
+
+	// X-Forwarded-For is only believed from a reverse proxy running on this machine
+	app.TrustedProxies, err = ratelimit.ParseNetworks([]string{"127.0.0.1", "::1"})
+	if err != nil {
+		return nil, err
+	}
 
 	repo := handlers.NewRepository(&app, db)
+	if useCache {
+		cacheOptions.Clock = app.Clock
+		repo.DB = cache.New(repo.DB, cacheOptions)
+	}
 	render.NewRenderer(&app)
 	handlers.NewHandlers(repo)
 	helpers.NewHelpers(&app)
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"math"
 	"net/http"
+	"regexp"
+	"strconv"
 
+	"github.com/ashrielbrian/go_bookings/internal/handlers"
+	"github.com/ashrielbrian/go_bookings/internal/helpers"
+	"github.com/ashrielbrian/go_bookings/internal/ratelimit"
 	"github.com/justinas/nosurf"
 )
 
@@ -19,7 +25,94 @@ func NoSurf(next http.Handler) http.Handler {
 	return csrfHandler
 }
 
+// roomImagesPath matches the room image upload, which accepts larger bodies than the other forms
+var roomImagesPath = regexp.MustCompile(`^/admin/rooms/[^/]+/images$`)
+
+// LimitBody caps the size of request bodies. NoSurf reads the form to find its CSRF token, so the cap only covers the
+// whole body when it comes before NoSurf
+func LimitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := int64(handlers.MaxUploadSize)
+		if roomImagesPath.MatchString(r.URL.Path) {
+			limit = handlers.MaxImagesUploadSize
+		}
+
+		if r.ContentLength > limit {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
 // SessionLoad loads and saves the session on every request
 func SessionLoad(next http.Handler) http.Handler {
 	return session.LoadAndSave(next)
 }
+
+// Auth redirects to the login page unless the user is logged in
+func Auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !helpers.IsAuthenticated(r) {
+			session.Put(r.Context(), "error", "Log in first!")
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CacheControl sets the Cache-Control header of every response to value
+func CacheControl(value string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", value)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RateLimit limits the requests made to a route group, using the group's limit in app.RateLimits. Requests
+// authenticated with an API key count against the key; others count against the client's IP address. Each group
+// has its own buckets, so a request passing through several groups must be allowed by all of them
+func RateLimit(group string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit, ok := app.RateLimits[group]
+			if !ok || app.RateLimitStore == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			apiKey, isAPI := handlers.APIKeyFromContext(r.Context())
+
+			key := group + ":ip:" + ratelimit.ClientIP(r, app.TrustedProxies)
+			if isAPI {
+				key = group + ":key:" + apiKey.Prefix
+			}
+
+			allowed, retryAfter, err := app.RateLimitStore.Take(key, limit, app.Now())
+			if err != nil {
+				// a broken store shouldn't take the site down with it
+				app.ErrorLog.Println(err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+				if isAPI {
+					handlers.WriteAPIError(w, http.StatusTooManyRequests, "rate_limited", "Too many requests.")
+				} else {
+					http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				}
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -2,8 +2,16 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/handlers"
+	"github.com/ashrielbrian/go_bookings/internal/ratelimit"
 )
 
 func TestNoSurf(t *testing.T) {
@@ -29,3 +37,111 @@ func TestSessionLoad(t *testing.T) {
 		t.Error(fmt.Sprintf("Expected type http.Handler, instead got %T", v))
 	}
 }
+
+func TestRateLimit(t *testing.T) {
+	app.RateLimits = map[string]ratelimit.Limit{"booking": ratelimit.Every(1, time.Minute, 2)}
+	app.RateLimitStore = ratelimit.NewMemory()
+	app.TrustedProxies, _ = ratelimit.ParseNetworks([]string{"127.0.0.1"})
+	app.ErrorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime)
+	defer func() {
+		app.RateLimits = nil
+		app.RateLimitStore = nil
+		app.TrustedProxies = nil
+	}()
+
+	var mh myHandler
+	limited := RateLimit("booking")(&mh)
+	unlimited := RateLimit("public")(&mh)
+
+	request := func(h http.Handler, remoteAddr, xff string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/make-reservation", nil)
+		req.RemoteAddr = remoteAddr
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		return rr
+	}
+
+	for i := 0; i < 2; i++ {
+		if rr := request(limited, "203.0.113.9:1000", ""); rr.Code != http.StatusOK {
+			t.Fatalf("request %d: expected status code 200, got %d", i+1, rr.Code)
+		}
+	}
+
+	rr := request(limited, "203.0.113.9:1000", "")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status code 429, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected Retry-After of 60 seconds, got %q", rr.Header().Get("Retry-After"))
+	}
+
+	if rr := request(limited, "203.0.113.10:1000", ""); rr.Code != http.StatusOK {
+		t.Errorf("expected other clients to be allowed, got %d", rr.Code)
+	}
+
+	// clients behind a trusted proxy are told apart by X-Forwarded-For
+	if rr := request(limited, "127.0.0.1:1000", "198.51.100.1"); rr.Code != http.StatusOK {
+		t.Errorf("expected a client behind the proxy to be allowed, got %d", rr.Code)
+	}
+	if rr := request(limited, "127.0.0.1:1000", "203.0.113.9"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected a limited client behind the proxy to be refused, got %d", rr.Code)
+	}
+
+	for i := 0; i < 5; i++ {
+		if rr := request(unlimited, "203.0.113.9:1000", ""); rr.Code != http.StatusOK {
+			t.Fatalf("expected groups without a limit not to be limited, got %d", rr.Code)
+		}
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	h := LimitBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		}
+	}))
+
+	tests := []struct {
+		name     string
+		path     string
+		size     int64
+		chunked  bool
+		expected int
+	}{
+		{"form within the cap", "/admin/exchange-rates/import", handlers.MaxUploadSize, false, http.StatusOK},
+		{"form over the cap", "/admin/exchange-rates/import", handlers.MaxUploadSize + 1, false, http.StatusRequestEntityTooLarge},
+		{"chunked form over the cap", "/admin/exchange-rates/import", handlers.MaxUploadSize + 1, true, http.StatusRequestEntityTooLarge},
+		{"room images within their cap", "/admin/rooms/1/images", handlers.MaxImagesUploadSize, false, http.StatusOK},
+		{"room images over their cap", "/admin/rooms/1/images", handlers.MaxImagesUploadSize + 1, false, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", tt.path, io.LimitReader(zeros{}, tt.size))
+		req.ContentLength = tt.size
+		if tt.chunked {
+			req.ContentLength = -1
+		}
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expected {
+			t.Errorf("%s: expected status code %d, got %d", tt.name, tt.expected, rr.Code)
+		}
+	}
+}
+
+// zeros is an endless reader of zero bytes
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/ashrielbrian/go_bookings/internal/driver"
+	"github.com/ashrielbrian/go_bookings/internal/migrate"
+	"github.com/ashrielbrian/go_bookings/migrations"
+)
+
+const migrateUsage = `usage: go_bookings migrate <command>
+
+commands:
+  up            apply every pending migration
+  down [n]      revert the latest n migrations (default 1)
+  status        list the migrations and whether they have been applied
+  to <version>  apply or revert migrations until version is the latest applied (0 reverts all)`
+
+// migrateCommand is a parsed migrate subcommand
+type migrateCommand struct {
+	action string
+	n      int64
+}
+
+// parseMigrateArgs parses the arguments following "migrate"
+func parseMigrateArgs(args []string) (migrateCommand, error) {
+	if len(args) == 0 {
+		return migrateCommand{}, errors.New(migrateUsage)
+	}
+
+	cmd := migrateCommand{action: args[0]}
+
+	switch {
+	case (cmd.action == "up" || cmd.action == "status") && len(args) == 1:
+		return cmd, nil
+	case cmd.action == "down" && len(args) == 1:
+		cmd.n = 1
+		return cmd, nil
+	case cmd.action == "down" && len(args) == 2:
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || n < 1 {
+			return cmd, fmt.Errorf("down takes a number of migrations to revert, got %q", args[1])
+		}
+		cmd.n = n
+		return cmd, nil
+	case cmd.action == "to" && len(args) == 2:
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || n < 0 {
+			return cmd, fmt.Errorf("to takes a migration version, got %q", args[1])
+		}
+		cmd.n = n
+		return cmd, nil
+	}
+
+	return cmd, errors.New(migrateUsage)
+}
+
+// runMigrate runs the migrate subcommand, writing its output to out
+func runMigrate(args []string, out io.Writer) error {
+	cmd, err := parseMigrateArgs(args)
+	if err != nil {
+		return err
+	}
+
+	db, err := driver.Connect(dbDialect, dsn, dbOptions)
+	if err != nil {
+		return err
+	}
+	defer db.SQL.Close()
+
+	m, err := newMigrator(db, log.New(out, "", 0))
+	if err != nil {
+		return err
+	}
+
+	var n int
+	switch cmd.action {
+	case "status":
+		return printMigrationStatus(m, out)
+	case "up":
+		n, err = m.Up()
+	case "down":
+		n, err = m.Down(int(cmd.n))
+	case "to":
+		n, err = m.To(cmd.n)
+	}
+
+	fmt.Fprintf(out, "%d migrations run\n", n)
+
+	return err
+}
+
+// printMigrationStatus writes a table of the migrations and their state
+func printMigrationStatus(m *migrate.Migrator, out io.Writer) error {
+	statuses, err := m.Status()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tSTATE\tAPPLIED AT")
+
+	for _, s := range statuses {
+		state, appliedAt := "pending", ""
+		if s.Applied {
+			state, appliedAt = "applied", s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		if s.Modified {
+			state = "modified"
+		}
+		if s.Missing {
+			state = "missing"
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", s.Version, s.Name, state, appliedAt)
+	}
+
+	return w.Flush()
+}
+
+// autoMigrate applies pending migrations on startup. It is meant for development, where it saves running the
+// migrate command after pulling new migrations
+func autoMigrate(db *driver.DB) error {
+	if app.InProduction {
+		return errors.New("-auto-migrate can't be used in production; run the migrate command instead")
+	}
+
+	m, err := newMigrator(db, app.InfoLog)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.Up()
+
+	return err
+}
+
+// newMigrator creates a migrator with the embedded migrations for the database's dialect
+func newMigrator(db *driver.DB, infoLog *log.Logger) (*migrate.Migrator, error) {
+	fsys, err := migrations.For(db.Dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := migrate.New(db.SQL, db.Dialect, fsys, infoLog)
+	if err != nil {
+		return nil, err
+	}
+	m.Clock = app.Clock
+
+	return m, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestParseMigrateArgs(t *testing.T) {
+	tests := []struct {
+		args      []string
+		action    string
+		n         int64
+		expectErr bool
+	}{
+		{[]string{"up"}, "up", 0, false},
+		{[]string{"status"}, "status", 0, false},
+		{[]string{"down"}, "down", 1, false},
+		{[]string{"down", "3"}, "down", 3, false},
+		{[]string{"to", "20261019120000"}, "to", 20261019120000, false},
+		{[]string{"to", "0"}, "to", 0, false},
+		{nil, "", 0, true},
+		{[]string{"sideways"}, "", 0, true},
+		{[]string{"up", "2"}, "", 0, true},
+		{[]string{"down", "0"}, "", 0, true},
+		{[]string{"down", "x"}, "", 0, true},
+		{[]string{"to"}, "", 0, true},
+		{[]string{"to", "-1"}, "", 0, true},
+	}
+
+	for _, tt := range tests {
+		cmd, err := parseMigrateArgs(tt.args)
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("%v: expected an error", tt.args)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", tt.args, err)
+			continue
+		}
+		if cmd.action != tt.action || cmd.n != tt.n {
+			t.Errorf("%v: expected %s %d, got %s %d", tt.args, tt.action, tt.n, cmd.action, cmd.n)
+		}
+	}
+}
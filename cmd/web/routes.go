@@ -3,6 +3,7 @@ package main
 import (
 	"net/http"
 
+	"github.com/ashrielbrian/go_bookings/internal/apikeys"
 	"github.com/ashrielbrian/go_bookings/internal/config"
 	"github.com/ashrielbrian/go_bookings/internal/handlers"
 
@@ -13,30 +14,113 @@ import (
 func routes(a *config.AppConfig) http.Handler {
 	mux := chi.NewRouter()
 	mux.Use(middleware.Recoverer)
-	mux.Use(NoSurf)
-	mux.Use(SessionLoad)
 
+	// the API is stateless, so it sits outside the session and CSRF middleware used by the site
+	mux.Get("/api/openapi.json", handlers.Repo.APIOpenAPI)
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.Use(handlers.Repo.APIKeyAuth)
+		mux.Use(RateLimit("api"))
+		mux.NotFound(handlers.Repo.APINotFound)
+		mux.MethodNotAllowed(handlers.Repo.APIMethodNotAllowed)
+
+		mux.With(handlers.RequireScope(apikeys.ScopeRoomsRead)).Get("/rooms", handlers.Repo.APIRooms)
+		mux.With(handlers.RequireScope(apikeys.ScopeRoomsRead)).Get("/rooms/{id}", handlers.Repo.APIRoom)
+		mux.With(handlers.RequireScope(apikeys.ScopeAvailabilityRead)).Get("/availability", handlers.Repo.APIAvailability)
+		mux.With(handlers.RequireScope(apikeys.ScopeReservationsWrite), handlers.Repo.APIIdempotency).Post("/reservations", handlers.Repo.APICreateReservation)
+		mux.With(handlers.RequireScope(apikeys.ScopeReservationsRead)).Get("/reservations/{code}", handlers.Repo.APIReservation)
+	})
+
+	// static files don't need a session, and are requested too often alongside each page to be rate limited
+	fileServer := http.FileServer(http.Dir("./static/"))
+	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
+
+	// uploaded files get unique names, so they can be cached indefinitely
+	uploadServer := http.FileServer(http.Dir(uploadsDir))
+	mux.With(CacheControl("public, max-age=31536000, immutable")).
+		Handle(uploadsURL+"/*", http.StripPrefix(uploadsURL, uploadServer))
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(RateLimit("public"))
+		mux.Use(LimitBody)
+		mux.Use(NoSurf)
+		mux.Use(SessionLoad)
+		siteRoutes(mux)
+	})
+
+	return mux
+}
+
+// siteRoutes registers the pages of the site
+func siteRoutes(mux chi.Router) {
 	mux.Get("/", handlers.Repo.Home)
 	mux.Get("/about", handlers.Repo.About)
 	mux.Get("/contact", handlers.Repo.Contact)
 
 	mux.Get("/search-availability", handlers.Repo.Availability)
-	mux.Post("/search-availability-json", handlers.Repo.AvailabilityJSON)
-	mux.Post("/search-availability", handlers.Repo.PostAvailability)
+	mux.With(RateLimit("search")).Post("/search-availability-json", handlers.Repo.AvailabilityJSON)
+	mux.With(RateLimit("search")).Post("/search-availability", handlers.Repo.PostAvailability)
+	mux.With(RateLimit("search")).Get("/search-availability/results", handlers.Repo.AvailabilityResults)
+
+	mux.Get("/rooms", handlers.Repo.Rooms)
+	mux.Get("/rooms/{slug}", handlers.Repo.Room)
+	mux.With(RateLimit("search")).Get("/rooms/{slug}/availability", handlers.Repo.RoomAvailability)
 
-	mux.Get("/generals-quarters", handlers.Repo.Generals)
-	mux.Get("/majors-suite", handlers.Repo.Majors)
+	// the room pages used to be hand-written; keep their old addresses working
+	mux.Handle("/generals-quarters", http.RedirectHandler("/rooms/generals-quarters", http.StatusMovedPermanently))
+	mux.Handle("/majors-suite", http.RedirectHandler("/rooms/majors-suite", http.StatusMovedPermanently))
 
 	mux.Get("/make-reservation", handlers.Repo.Reservation)
 	mux.Get("/reservation-summary", handlers.Repo.ReservationSummary)
-	mux.Post("/make-reservation", handlers.Repo.PostReservation)
+	mux.With(RateLimit("booking")).Post("/make-reservation", handlers.Repo.PostReservation)
 
 	mux.Get("/choose-room/{id}", handlers.Repo.ChooseRoom)
 	mux.Get("/book-room", handlers.Repo.BookRoom)
 
-	// serve static files
-	fileServer := http.FileServer(http.Dir("./static/"))
-	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
+	mux.Post("/set-currency", handlers.Repo.SetCurrency)
 
-	return mux
+	mux.Get("/user/login", handlers.Repo.ShowLogin)
+	mux.Post("/user/login", handlers.Repo.PostShowLogin)
+	mux.Get("/user/logout", handlers.Repo.Logout)
+
+	mux.Route("/admin", func(mux chi.Router) {
+		mux.Use(Auth)
+
+		mux.Get("/exchange-rates", handlers.Repo.AdminExchangeRates)
+		mux.Post("/exchange-rates", handlers.Repo.AdminPostExchangeRate)
+		mux.Post("/exchange-rates/import", handlers.Repo.AdminImportExchangeRates)
+
+		mux.Get("/rooms", handlers.Repo.AdminRooms)
+		mux.Get("/rooms/new", handlers.Repo.AdminNewRoom)
+		mux.Post("/rooms/new", handlers.Repo.AdminPostNewRoom)
+		mux.Get("/rooms/{id}", handlers.Repo.AdminShowRoom)
+		mux.Post("/rooms/{id}", handlers.Repo.AdminPostShowRoom)
+		mux.Post("/rooms/{id}/retire", handlers.Repo.AdminRetireRoom)
+
+		mux.Get("/rooms/{id}/images", handlers.Repo.AdminRoomImages)
+		mux.Post("/rooms/{id}/images", handlers.Repo.AdminPostRoomImages)
+		mux.Post("/rooms/{id}/images/{imageID}", handlers.Repo.AdminPostRoomImage)
+		mux.Post("/rooms/{id}/images/{imageID}/delete", handlers.Repo.AdminDeleteRoomImage)
+
+		mux.Get("/rooms/{id}/rules", handlers.Repo.AdminRoomRules)
+		mux.Post("/rooms/{id}/rules", handlers.Repo.AdminPostRoomRule)
+		mux.Post("/rooms/{id}/rules/{ruleID}/delete", handlers.Repo.AdminDeleteRoomRule)
+		mux.Post("/rooms/{id}/blocks", handlers.Repo.AdminPostRoomBlock)
+
+		mux.Get("/reservations", handlers.Repo.AdminReservations)
+		mux.Get("/reservations/{code}", handlers.Repo.AdminReservation)
+		mux.Post("/reservations/{code}", handlers.Repo.AdminPostReservation)
+		mux.Post("/reservations/{code}/cancel", handlers.Repo.AdminCancelReservation)
+
+		mux.Get("/api-keys", handlers.Repo.AdminAPIKeys)
+		mux.Post("/api-keys", handlers.Repo.AdminPostAPIKey)
+		mux.Post("/api-keys/{id}/revoke", handlers.Repo.AdminRevokeAPIKey)
+		mux.Post("/partners", handlers.Repo.AdminPostPartner)
+
+		mux.Get("/webhooks", handlers.Repo.AdminWebhooks)
+		mux.Post("/webhooks", handlers.Repo.AdminPostWebhook)
+		mux.Get("/webhooks/{id}", handlers.Repo.AdminWebhook)
+		mux.Post("/webhooks/{id}/delete", handlers.Repo.AdminDeleteWebhook)
+
+		mux.Get("/cache", handlers.Repo.AdminCacheStats)
+	})
 }
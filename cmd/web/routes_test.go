@@ -2,9 +2,12 @@ package main
 
 import (
 	"fmt"
+	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/ashrielbrian/go_bookings/internal/config"
+	"github.com/ashrielbrian/go_bookings/internal/handlers"
 	"github.com/go-chi/chi/v5"
 )
 
@@ -20,3 +23,42 @@ func TestRoutes(t *testing.T) {
 		t.Error(fmt.Sprintf("Expected type *chi.Mux, instead got %T", v))
 	}
 }
+
+// TestAPIRoutesDocumented fails when an API route is added without describing it in the OpenAPI document
+func TestAPIRoutesDocumented(t *testing.T) {
+	var app config.AppConfig
+
+	mux := routes(&app).(chi.Routes)
+	spec := handlers.APISpec()
+
+	documented := 0
+
+	err := chi.Walk(mux, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		if !strings.HasPrefix(route, "/api/v1/") {
+			return nil
+		}
+
+		if !spec.Has(method, route) {
+			t.Errorf("%s %s is missing from the OpenAPI document", method, route)
+		}
+		documented++
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if documented == 0 {
+		t.Error("expected API routes")
+	}
+
+	for path, item := range spec.Paths {
+		for method := range item {
+			if !mux.Match(chi.NewRouteContext(), strings.ToUpper(method), path) {
+				t.Errorf("%s %s is documented but not routed", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+
+	"github.com/ashrielbrian/go_bookings/internal/driver"
+	"github.com/ashrielbrian/go_bookings/internal/seed"
+)
+
+// defaultFixture is loaded by the seed command when no file is given
+const defaultFixture = "fixtures/dev.yml"
+
+// runSeed runs the seed subcommand, which loads a fixture file into the database
+func runSeed(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: go_bookings seed [fixture file]")
+	}
+
+	path := defaultFixture
+	if len(args) == 1 {
+		path = args[0]
+	}
+
+	fixture, err := seed.Load(path)
+	if err != nil {
+		return err
+	}
+
+	db, err := driver.Connect(dbDialect, dsn, dbOptions)
+	if err != nil {
+		return err
+	}
+	defer db.SQL.Close()
+
+	_, err = seed.Seed(db.SQL, db.Dialect, fixture, baseCurrency, app.Clock, log.New(os.Stdout, "", 0))
+
+	return err
+}
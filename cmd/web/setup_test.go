@@ -4,9 +4,13 @@ import (
 	"net/http"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
+	// don't wait long for a database that isn't there
+	dbOptions.MaxWait = time.Second
+
 	os.Exit(m.Run())
 }
 
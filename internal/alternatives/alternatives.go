@@ -0,0 +1,219 @@
+// Package alternatives suggests other stays when no room is free for the dates a guest searched for: the same
+// length of stay a few days earlier or later, a shorter stay within the dates, or the dates themselves split
+// between two rooms
+package alternatives
+
+import (
+	"sort"
+
+	"github.com/ashrielbrian/go_bookings/internal/dates"
+	"github.com/ashrielbrian/go_bookings/internal/models"
+)
+
+// The kinds of alternative
+const (
+	Shifted = "shifted" // as many nights, on other dates
+	Shorter = "shorter" // fewer nights, within the dates searched for
+	Split   = "split"   // the dates searched for, moving from one room to another part way through
+)
+
+// kindRank orders alternatives of different kinds that are as close to the dates searched for
+var kindRank = map[string]int{Split: 0, Shifted: 1, Shorter: 2}
+
+// Options sets how far Find looks
+type Options struct {
+	// Days is how many days earlier or later than the dates searched for a stay may be moved
+	Days int
+	// Max is the most alternatives Find returns
+	Max int
+	// Allowed reports whether a room may be booked from start to end, eg. under its stay rules. It may be nil to
+	// allow every stay
+	Allowed func(room models.Room, start, end dates.Date) bool
+}
+
+// Stay is a room booked for some nights
+type Stay struct {
+	Room      models.Room
+	StartDate dates.Date
+	EndDate   dates.Date
+}
+
+// Nights returns the number of nights in the stay
+func (s Stay) Nights() int {
+	return nights(s.StartDate, s.EndDate)
+}
+
+// Alternative is a suggested stay
+type Alternative struct {
+	Kind      string
+	StartDate dates.Date
+	EndDate   dates.Date
+	// Rooms are the rooms free for the whole stay, for shifted and shorter stays
+	Rooms []models.Room
+	// Stays are the two parts of a split stay
+	Stays []Stay
+	// Distance is how far the alternative is from the dates searched for: the days a shifted stay was moved, or
+	// the nights a shorter stay lost. A split stay keeps the dates, so it is 0
+	Distance int
+}
+
+// Nights returns the number of nights in the alternative
+func (a Alternative) Nights() int {
+	return nights(a.StartDate, a.EndDate)
+}
+
+// Window returns the days whose availability Find needs, from start up to, but not including, end
+func Window(start, end dates.Date, opts Options) (dates.Date, dates.Date) {
+	return start.AddDate(0, 0, -opts.Days), end.AddDate(0, 0, opts.Days)
+}
+
+// Find suggests alternatives to a stay from start to end, closest first. rooms are the rooms that suit the party,
+// and days holds their availability, by room ID, over the days Window returns; nights missing from it are taken
+// to be booked. No alternative arrives before today
+func Find(start, end dates.Date, rooms []models.Room, days map[int][]models.DayAvailability, today dates.Date,
+	opts Options) []Alternative {
+	n := nights(start, end)
+	if n < 1 {
+		return nil
+	}
+
+	from, _ := Window(start, end, opts)
+	a := availability{from: from, rooms: rooms, booked: make([][]int, len(rooms)), allowed: opts.Allowed}
+	for i, room := range rooms {
+		a.booked[i] = bookedBefore(from, n+2*opts.Days, days[room.ID])
+	}
+
+	var found []Alternative
+
+	for k := 1; k <= opts.Days; k++ {
+		for _, shift := range []int{-k, k} {
+			s, e := start.AddDate(0, 0, shift), end.AddDate(0, 0, shift)
+			if s.Before(today) {
+				continue
+			}
+			if free := a.freeRooms(s, e); len(free) > 0 {
+				found = append(found, Alternative{Kind: Shifted, StartDate: s, EndDate: e, Rooms: free, Distance: k})
+			}
+		}
+	}
+
+	// only the longest shorter stays are suggested
+	for length := n - 1; length > 0; length-- {
+		ok := false
+		for s := start; !s.AddDate(0, 0, length).After(end); s = s.AddDate(0, 0, 1) {
+			if s.Before(today) {
+				continue
+			}
+			e := s.AddDate(0, 0, length)
+			if free := a.freeRooms(s, e); len(free) > 0 {
+				found = append(found, Alternative{Kind: Shorter, StartDate: s, EndDate: e, Rooms: free, Distance: n - length})
+				ok = true
+			}
+		}
+		if ok {
+			break
+		}
+	}
+
+	if !start.Before(today) {
+		for d := start.AddDate(0, 0, 1); d.Before(end); d = d.AddDate(0, 0, 1) {
+			if stays, ok := a.split(start, d, end); ok {
+				found = append(found, Alternative{Kind: Split, StartDate: start, EndDate: end, Stays: stays})
+			}
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].Distance != found[j].Distance {
+			return found[i].Distance < found[j].Distance
+		}
+		if kindRank[found[i].Kind] != kindRank[found[j].Kind] {
+			return kindRank[found[i].Kind] < kindRank[found[j].Kind]
+		}
+		return found[i].StartDate.Before(found[j].StartDate)
+	})
+
+	if len(found) > opts.Max {
+		found = found[:opts.Max]
+	}
+
+	return found
+}
+
+// availability answers whether rooms are free for a run of nights
+type availability struct {
+	from  dates.Date
+	rooms []models.Room
+	// booked[i][d] counts the booked nights of rooms[i] among the first d nights from from
+	booked  [][]int
+	allowed func(room models.Room, start, end dates.Date) bool
+}
+
+// bookedBefore returns the running count of booked nights over the n nights from from
+func bookedBefore(from dates.Date, n int, days []models.DayAvailability) []int {
+	free := make([]bool, n)
+	for _, d := range days {
+		i := nights(from, d.Date)
+		if i >= 0 && i < n {
+			free[i] = d.Available
+		}
+	}
+
+	counts := make([]int, n+1)
+	for i := 0; i < n; i++ {
+		counts[i+1] = counts[i]
+		if !free[i] {
+			counts[i+1]++
+		}
+	}
+
+	return counts
+}
+
+// isFree reports whether rooms[i] is free every night from s up to e, and may be booked for them
+func (a availability) isFree(i int, s, e dates.Date) bool {
+	first, last := nights(a.from, s), nights(a.from, e)
+	if first < 0 || last >= len(a.booked[i]) {
+		return false
+	}
+	if a.booked[i][last]-a.booked[i][first] != 0 {
+		return false
+	}
+
+	return a.allowed == nil || a.allowed(a.rooms[i], s, e)
+}
+
+// freeRooms returns the rooms free every night from s up to e
+func (a availability) freeRooms(s, e dates.Date) []models.Room {
+	var free []models.Room
+	for i, room := range a.rooms {
+		if a.isFree(i, s, e) {
+			free = append(free, room)
+		}
+	}
+	return free
+}
+
+// split finds a room free from start up to d and another free from d up to end
+func (a availability) split(start, d, end dates.Date) ([]Stay, bool) {
+	for i, first := range a.rooms {
+		if !a.isFree(i, start, d) {
+			continue
+		}
+		for j, second := range a.rooms {
+			if i != j && a.isFree(j, d, end) {
+				return []Stay{
+					{Room: first, StartDate: start, EndDate: d},
+					{Room: second, StartDate: d, EndDate: end},
+				}, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// nights returns the number of nights from start to end
+func nights(start, end dates.Date) int {
+	return end.Sub(start)
+}
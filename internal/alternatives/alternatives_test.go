@@ -0,0 +1,195 @@
+package alternatives
+
+import (
+	"testing"
+
+	"github.com/ashrielbrian/go_bookings/internal/dates"
+	"github.com/ashrielbrian/go_bookings/internal/models"
+)
+
+func date(t *testing.T, s string) dates.Date {
+	t.Helper()
+
+	d, err := dates.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+// calendar returns a room's availability over the window, with the nights from each pair of dates in booked
+// unavailable
+func calendar(t *testing.T, from, to dates.Date, booked ...string) []models.DayAvailability {
+	t.Helper()
+
+	var days []models.DayAvailability
+	for d := from; d.Before(to); d = d.AddDate(0, 0, 1) {
+		day := models.DayAvailability{Date: d, Available: true}
+		for i := 0; i < len(booked); i += 2 {
+			if !d.Before(date(t, booked[i])) && d.Before(date(t, booked[i+1])) {
+				day.Available = false
+			}
+		}
+		days = append(days, day)
+	}
+
+	return days
+}
+
+var opts = Options{Days: 3, Max: 10}
+
+var rooms = []models.Room{{ID: 1, RoomName: "General's Quarters"}, {ID: 2, RoomName: "Major's Suite"}}
+
+func TestFind_Shifted(t *testing.T) {
+	start, end := date(t, "2050-01-10"), date(t, "2050-01-13")
+	from, to := Window(start, end, opts)
+
+	// room 1 is booked from the 8th to the 13th, room 2 from the 10th to the 15th
+	days := map[int][]models.DayAvailability{
+		1: calendar(t, from, to, "2050-01-08", "2050-01-13"),
+		2: calendar(t, from, to, "2050-01-10", "2050-01-15"),
+	}
+
+	found := Find(start, end, rooms, days, date(t, "2050-01-01"), opts)
+
+	// neither room is free for any part of the stay, so only a stay moved 3 days either way will do: room 2
+	// before its booking and room 1 after its own
+	if len(found) != 2 {
+		t.Fatalf("expected 2 alternatives, got %+v", found)
+	}
+	for i, want := range []struct {
+		start  string
+		roomID int
+	}{{"2050-01-07", 2}, {"2050-01-13", 1}} {
+		a := found[i]
+		if !a.StartDate.Equal(date(t, want.start)) || a.Distance != 3 || len(a.Rooms) != 1 || a.Rooms[0].ID != want.roomID {
+			t.Errorf("expected room %d from %s, got %s from %s, distance %d, rooms %+v", want.roomID, want.start,
+				a.Kind, a.StartDate.Format("2006-01-02"), a.Distance, a.Rooms)
+		}
+	}
+	for _, a := range found {
+		if a.Kind != Shifted {
+			t.Errorf("expected only shifted stays, got a %s stay", a.Kind)
+		}
+		if a.Nights() != 3 {
+			t.Errorf("expected 3 nights, got %d", a.Nights())
+		}
+	}
+}
+
+func TestFind_Split(t *testing.T) {
+	start, end := date(t, "2050-01-10"), date(t, "2050-01-14")
+	from, to := Window(start, end, opts)
+
+	// neither room is free long enough on any nearby dates, but together they cover the stay
+	days := map[int][]models.DayAvailability{
+		1: calendar(t, from, to, "2050-01-05", "2050-01-10", "2050-01-12", "2050-01-20"),
+		2: calendar(t, from, to, "2050-01-05", "2050-01-12", "2050-01-14", "2050-01-20"),
+	}
+
+	found := Find(start, end, rooms, days, date(t, "2050-01-01"), opts)
+	if len(found) == 0 || found[0].Kind != Split {
+		t.Fatalf("expected a split stay first, got %+v", found)
+	}
+
+	stays := found[0].Stays
+	if len(stays) != 2 || stays[0].Room.ID != 1 || stays[1].Room.ID != 2 ||
+		!stays[0].EndDate.Equal(date(t, "2050-01-12")) || !stays[1].StartDate.Equal(date(t, "2050-01-12")) {
+		t.Errorf("expected room 1 then room 2 from the 12th, got %+v", stays)
+	}
+	if stays[0].Nights()+stays[1].Nights() != 4 {
+		t.Errorf("expected the split stay to cover 4 nights, got %d and %d", stays[0].Nights(), stays[1].Nights())
+	}
+
+	// the shorter stays come next, keeping as many nights as possible
+	if len(found) != 3 {
+		t.Errorf("expected a split stay and two shorter ones, got %d alternatives", len(found))
+	}
+	for _, a := range found[1:] {
+		if a.Kind != Shorter || a.Nights() != 2 || a.Distance != 2 {
+			t.Errorf("expected 2 night stays, got a %d night %s stay", a.Nights(), a.Kind)
+		}
+	}
+}
+
+func TestFind_Today(t *testing.T) {
+	start, end := date(t, "2050-01-10"), date(t, "2050-01-12")
+	from, to := Window(start, end, opts)
+
+	days := map[int][]models.DayAvailability{
+		1: calendar(t, from, to, "2050-01-10", "2050-01-12"),
+	}
+
+	found := Find(start, end, rooms[:1], days, date(t, "2050-01-09"), opts)
+	for _, a := range found {
+		if a.StartDate.Before(date(t, "2050-01-09")) {
+			t.Errorf("expected no stays arriving before today, got one on %s", a.StartDate.Format("2006-01-02"))
+		}
+	}
+	// a day either way still overlaps the booking, and 2 or 3 days earlier is in the past
+	if len(found) != 2 {
+		t.Errorf("expected stays shifted 2 and 3 days later, got %d", len(found))
+	}
+}
+
+func TestFind_Nothing(t *testing.T) {
+	start, end := date(t, "2050-01-10"), date(t, "2050-01-12")
+	from, to := Window(start, end, opts)
+
+	days := map[int][]models.DayAvailability{
+		1: calendar(t, from, to, "2050-01-01", "2050-01-31"),
+	}
+
+	if found := Find(start, end, rooms[:1], days, date(t, "2050-01-01"), opts); len(found) != 0 {
+		t.Errorf("expected no alternatives, got %+v", found)
+	}
+	if found := Find(start, end, nil, nil, date(t, "2050-01-01"), opts); len(found) != 0 {
+		t.Errorf("expected no alternatives without rooms, got %+v", found)
+	}
+	if found := Find(end, start, rooms, nil, date(t, "2050-01-01"), opts); len(found) != 0 {
+		t.Errorf("expected no alternatives for an empty stay, got %+v", found)
+	}
+}
+
+func TestFind_Max(t *testing.T) {
+	start, end := date(t, "2050-01-10"), date(t, "2050-01-12")
+	from, to := Window(start, end, opts)
+
+	days := map[int][]models.DayAvailability{
+		1: calendar(t, from, to, "2050-01-10", "2050-01-12"),
+	}
+
+	found := Find(start, end, rooms[:1], days, date(t, "2050-01-01"), Options{Days: 3, Max: 2})
+	if len(found) != 2 {
+		t.Fatalf("expected 2 alternatives, got %d", len(found))
+	}
+	// two days either way, since one still overlaps the booking; earlier first
+	if !found[0].StartDate.Equal(date(t, "2050-01-08")) || !found[1].StartDate.Equal(date(t, "2050-01-12")) {
+		t.Errorf("expected stays from the 8th and 12th, got %s and %s", found[0].StartDate.Format("2006-01-02"),
+			found[1].StartDate.Format("2006-01-02"))
+	}
+}
+
+func TestFind_Allowed(t *testing.T) {
+	start, end := date(t, "2050-01-10"), date(t, "2050-01-12")
+	from, to := Window(start, end, opts)
+
+	days := map[int][]models.DayAvailability{
+		1: calendar(t, from, to),
+		2: calendar(t, from, to),
+	}
+
+	// room 1 only takes arrivals on the 12th, and room 2 nothing at all
+	allowed := Options{Days: 3, Max: 10, Allowed: func(room models.Room, s, e dates.Date) bool {
+		return room.ID == 1 && s.Equal(date(t, "2050-01-12"))
+	}}
+
+	found := Find(start, end, rooms, days, date(t, "2050-01-01"), allowed)
+	if len(found) != 1 {
+		t.Fatalf("expected 1 alternative, got %+v", found)
+	}
+	if a := found[0]; a.Kind != Shifted || !a.StartDate.Equal(date(t, "2050-01-12")) || len(a.Rooms) != 1 || a.Rooms[0].ID != 1 {
+		t.Errorf("expected room 1 from the 12th, got %+v", a)
+	}
+}
@@ -0,0 +1,104 @@
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// keyPrefix marks a string as one of our API keys, which makes leaked keys easy to search for
+const keyPrefix = "gb_"
+
+// prefixLength is the length of the public part of a key, used to look the key up and to identify it in the admin pages
+const prefixLength = 8
+
+// secretLength is the length of the private part of a key
+const secretLength = 32
+
+// alphabet is used for both parts of a key
+const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// Scopes that can be granted to a key
+const (
+	ScopeRoomsRead         = "rooms:read"
+	ScopeAvailabilityRead  = "availability:read"
+	ScopeReservationsRead  = "reservations:read"
+	ScopeReservationsWrite = "reservations:write"
+)
+
+// Scopes lists every scope, in the order they are shown to admins
+var Scopes = []string{ScopeRoomsRead, ScopeAvailabilityRead, ScopeReservationsRead, ScopeReservationsWrite}
+
+// ErrMalformed is returned when a string is not shaped like an API key
+var ErrMalformed = errors.New("malformed API key")
+
+// Generate returns a new key along with its prefix and hash. Only the prefix and hash should be stored;
+// the key itself is shown to the admin once and can't be recovered
+func Generate() (key, prefix, hash string, err error) {
+	prefix, err = randomString(prefixLength)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	secret, err := randomString(secretLength)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	key = keyPrefix + prefix + "_" + secret
+
+	return key, prefix, Hash(key), nil
+}
+
+// Prefix returns the public part of a key
+func Prefix(key string) (string, error) {
+	if !strings.HasPrefix(key, keyPrefix) {
+		return "", ErrMalformed
+	}
+
+	parts := strings.Split(strings.TrimPrefix(key, keyPrefix), "_")
+	if len(parts) != 2 || len(parts[0]) != prefixLength || len(parts[1]) == 0 {
+		return "", ErrMalformed
+	}
+
+	return parts[0], nil
+}
+
+// Hash returns the hash stored for a key. Keys are long and random, so a fast hash is enough
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify reports whether key matches a stored hash
+func Verify(key, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(Hash(key)), []byte(hash)) == 1
+}
+
+// IsScope reports whether s is a known scope
+func IsScope(s string) bool {
+	for _, scope := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+
+	return string(b), nil
+}
@@ -0,0 +1,57 @@
+package apikeys
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	key, prefix, hash, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(key, "gb_"+prefix+"_") {
+		t.Errorf("expected key %q to start with its prefix %q", key, prefix)
+	}
+
+	if strings.Contains(hash, key) || hash != Hash(key) {
+		t.Errorf("unexpected hash %q", hash)
+	}
+
+	got, err := Prefix(key)
+	if err != nil || got != prefix {
+		t.Errorf("expected prefix %q, got %q (%v)", prefix, got, err)
+	}
+
+	if !Verify(key, hash) {
+		t.Error("expected key to match its hash")
+	}
+
+	if Verify(key+"x", hash) {
+		t.Error("expected a different key not to match")
+	}
+
+	other, _, _, _ := Generate()
+	if other == key {
+		t.Error("expected keys to be unique")
+	}
+}
+
+func TestPrefix_Malformed(t *testing.T) {
+	for _, key := range []string{"", "abc", "gb_", "gb_short_secret", "xx_abcdefgh_secret", "gb_abcdefgh_", "gb_abcdefgh_a_b"} {
+		if _, err := Prefix(key); err != ErrMalformed {
+			t.Errorf("key %q: expected ErrMalformed, got %v", key, err)
+		}
+	}
+}
+
+func TestIsScope(t *testing.T) {
+	if !IsScope(ScopeReservationsWrite) {
+		t.Error("expected reservations:write to be a scope")
+	}
+
+	if IsScope("admin") {
+		t.Error("expected admin not to be a scope")
+	}
+}
@@ -0,0 +1,96 @@
+// Package calendar lays out a month of a room's availability in weeks, for the calendar on the room page
+package calendar
+
+import (
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/dates"
+	"github.com/ashrielbrian/go_bookings/internal/models"
+)
+
+// MonthLayout is the format of the months in calendar links, eg. 2026-11
+const MonthLayout = "2006-01"
+
+// Day is a day of the calendar
+type Day struct {
+	Date dates.Date
+	// InMonth is false for the days of the months before and after that fill the first and last weeks
+	InMonth bool
+	// Available is whether the room is free for the night beginning on Date. Past days are never available
+	Available bool
+	Past      bool
+}
+
+// Month is a month of a room's availability, in weeks from Sunday to Saturday
+type Month struct {
+	// First is the first day of the month
+	First dates.Date
+	Weeks [][]Day
+	// HasPrev is false for the current month, since earlier months can't be booked
+	HasPrev bool
+}
+
+// Prev returns the first day of the month before
+func (m Month) Prev() dates.Date {
+	return m.First.AddDate(0, -1, 0)
+}
+
+// Next returns the first day of the month after
+func (m Month) Next() dates.Date {
+	return m.First.AddDate(0, 1, 0)
+}
+
+// FirstOfMonth returns the first day of the month of d
+func FirstOfMonth(d dates.Date) dates.Date {
+	return dates.New(d.Year(), d.Month(), 1)
+}
+
+// ParseMonth parses a month in MonthLayout, returning its first day
+func ParseMonth(s string) (dates.Date, error) {
+	t, err := time.Parse(MonthLayout, s)
+	if err != nil {
+		return dates.Date{}, err
+	}
+	return dates.Of(t), nil
+}
+
+// Range returns the days the calendar of the month beginning on first covers: from the Sunday on or before first
+// up to, but not including, the Sunday after the month's last day
+func Range(first dates.Date) (dates.Date, dates.Date) {
+	start := first.AddDate(0, 0, -int(first.Weekday()))
+
+	last := first.AddDate(0, 1, -1)
+	end := last.AddDate(0, 0, 7-int(last.Weekday()))
+
+	return start, end
+}
+
+// New lays out the month beginning on first. days holds the room's availability for the dates Range returns;
+// days missing from it are shown unavailable. today is the first day that can be booked
+func New(first dates.Date, days []models.DayAvailability, today dates.Date) Month {
+	available := make(map[dates.Date]bool, len(days))
+	for _, d := range days {
+		available[d.Date] = d.Available
+	}
+
+	m := Month{First: first, HasPrev: first.After(FirstOfMonth(today))}
+
+	start, end := Range(first)
+	var week []Day
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		day := Day{
+			Date:    d,
+			InMonth: d.Month() == first.Month(),
+			Past:    d.Before(today),
+		}
+		day.Available = !day.Past && available[d]
+
+		week = append(week, day)
+		if len(week) == 7 {
+			m.Weeks = append(m.Weeks, week)
+			week = nil
+		}
+	}
+
+	return m
+}
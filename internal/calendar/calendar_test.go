@@ -0,0 +1,97 @@
+package calendar
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/dates"
+	"github.com/ashrielbrian/go_bookings/internal/models"
+)
+
+func date(t *testing.T, s string) dates.Date {
+	t.Helper()
+
+	d, err := dates.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+func TestRange(t *testing.T) {
+	tests := []struct {
+		month      string
+		start, end string
+	}{
+		// begins on a Sunday
+		{"2026-11", "2026-11-01", "2026-12-06"},
+		// ends on a Saturday
+		{"2027-07", "2027-06-27", "2027-08-01"},
+		{"2026-02", "2026-02-01", "2026-03-01"},
+		{"2026-12", "2026-11-29", "2027-01-03"},
+	}
+
+	for _, tt := range tests {
+		first, err := ParseMonth(tt.month)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start, end := Range(first)
+		if !start.Equal(date(t, tt.start)) || !end.Equal(date(t, tt.end)) {
+			t.Errorf("%s: expected %s to %s, got %s to %s", tt.month, tt.start, tt.end,
+				start.Format("2006-01-02"), end.Format("2006-01-02"))
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	first := date(t, "2026-12-01")
+	start, end := Range(first)
+
+	var days []models.DayAvailability
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		days = append(days, models.DayAvailability{Date: d, Available: d.Day() != 25})
+	}
+
+	m := New(first, days, date(t, "2026-12-10"))
+
+	if len(m.Weeks) != 5 {
+		t.Fatalf("expected 5 weeks, got %d", len(m.Weeks))
+	}
+	for _, week := range m.Weeks {
+		if len(week) != 7 || week[0].Date.Weekday() != time.Sunday {
+			t.Fatalf("expected weeks from Sunday to Saturday, got %d days from %s", len(week), week[0].Date.Weekday())
+		}
+	}
+
+	check := func(s string, inMonth, available, past bool) {
+		t.Helper()
+
+		for _, week := range m.Weeks {
+			for _, d := range week {
+				if d.Date.Equal(date(t, s)) {
+					if d.InMonth != inMonth || d.Available != available || d.Past != past {
+						t.Errorf("%s: expected in month %v, available %v, past %v, got %+v", s, inMonth, available, past, d)
+					}
+					return
+				}
+			}
+		}
+		t.Errorf("%s is not in the calendar", s)
+	}
+
+	check("2026-11-30", false, false, true)
+	check("2026-12-09", true, false, true)
+	check("2026-12-10", true, true, false)
+	check("2026-12-25", true, false, false)
+	check("2027-01-02", false, true, false)
+
+	if m.HasPrev {
+		t.Error("expected no link to months before the current one")
+	}
+	if !New(date(t, "2027-01-01"), nil, date(t, "2026-12-10")).HasPrev {
+		t.Error("expected a link to the current month")
+	}
+}
@@ -0,0 +1,34 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2026, 11, 1, 10, 0, 0, 0, time.UTC)
+	c := NewFake(start)
+
+	if !c.Now().Equal(start) {
+		t.Errorf("expected %s, got %s", start, c.Now())
+	}
+
+	c.Advance(90 * time.Minute)
+	if expected := start.Add(90 * time.Minute); !c.Now().Equal(expected) {
+		t.Errorf("expected %s, got %s", expected, c.Now())
+	}
+
+	later := time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.Set(later)
+	if !c.Now().Equal(later) {
+		t.Errorf("expected %s, got %s", later, c.Now())
+	}
+}
+
+func TestReal(t *testing.T) {
+	before := time.Now()
+	now := Real{}.Now()
+	if now.Before(before) || now.After(time.Now()) {
+		t.Errorf("expected the current time, got %s", now)
+	}
+}
@@ -3,8 +3,13 @@ package config
 import (
 	"html/template"
 	"log"
+	"net"
+	"time"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/ashrielbrian/go_bookings/internal/clock"
+	"github.com/ashrielbrian/go_bookings/internal/ratelimit"
+	"github.com/ashrielbrian/go_bookings/internal/storage"
 )
 
 type AppConfig struct {
@@ -14,4 +19,25 @@ type AppConfig struct {
 	ErrorLog      *log.Logger
 	InProduction  bool
 	Session       *scs.SessionManager
+	BaseCurrency  string
+	Storage       storage.Storage
+
+	// Location is the property's time zone; the dates of stays are dates there
+	Location *time.Location
+	// Clock tells the time to the handlers and repositories; without one they use the system clock
+	Clock clock.Clock
+
+	// RateLimits holds the limit for each rate limited route group; groups without one aren't limited
+	RateLimits     map[string]ratelimit.Limit
+	RateLimitStore ratelimit.Store
+	// TrustedProxies are the proxies whose X-Forwarded-For headers are believed
+	TrustedProxies []*net.IPNet
+}
+
+// Now returns the time on the app's clock, or the system clock's when a has no clock
+func (a *AppConfig) Now() time.Time {
+	if a == nil || a.Clock == nil {
+		return time.Now()
+	}
+	return a.Clock.Now()
 }
@@ -0,0 +1,179 @@
+package currency
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Info describes how a currency is displayed
+type Info struct {
+	Code     string
+	Symbol   string
+	Decimals int
+}
+
+var supported = map[string]Info{
+	"USD": {Code: "USD", Symbol: "$", Decimals: 2},
+	"EUR": {Code: "EUR", Symbol: "€", Decimals: 2},
+	"GBP": {Code: "GBP", Symbol: "£", Decimals: 2},
+	"AUD": {Code: "AUD", Symbol: "A$", Decimals: 2},
+	"CAD": {Code: "CAD", Symbol: "C$", Decimals: 2},
+	"SGD": {Code: "SGD", Symbol: "S$", Decimals: 2},
+	"JPY": {Code: "JPY", Symbol: "¥", Decimals: 0},
+}
+
+// IsSupported reports whether code is a currency we know how to display
+func IsSupported(code string) bool {
+	_, ok := supported[strings.ToUpper(code)]
+	return ok
+}
+
+// Supported returns the supported currency codes in alphabetical order
+func Supported() []string {
+	codes := make([]string, 0, len(supported))
+	for code := range supported {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// Lookup returns the display information for a currency code
+func Lookup(code string) (Info, bool) {
+	info, ok := supported[strings.ToUpper(code)]
+	return info, ok
+}
+
+// Convert converts an amount in the base currency's minor units into the target
+// currency's minor units using rate (units of target per unit of base)
+func Convert(amount int, rate float64, from, to string) int {
+	fromInfo, ok := Lookup(from)
+	if !ok {
+		fromInfo = Info{Decimals: 2}
+	}
+	toInfo, ok := Lookup(to)
+	if !ok {
+		toInfo = Info{Decimals: 2}
+	}
+
+	major := float64(amount) / math.Pow10(fromInfo.Decimals)
+	return int(math.Round(major * rate * math.Pow10(toInfo.Decimals)))
+}
+
+// Format formats an amount in minor units for display, eg. Format(123456, "USD") is "$1,234.56"
+func Format(amount int, code string) string {
+	info, ok := Lookup(code)
+	if !ok {
+		info = Info{Code: strings.ToUpper(code), Symbol: strings.ToUpper(code) + " ", Decimals: 2}
+	}
+
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	unit := int(math.Pow10(info.Decimals))
+	whole := groupThousands(strconv.Itoa(amount / unit))
+
+	if info.Decimals == 0 {
+		return fmt.Sprintf("%s%s%s", sign, info.Symbol, whole)
+	}
+
+	return fmt.Sprintf("%s%s%s.%0*d", sign, info.Symbol, whole, info.Decimals, amount%unit)
+}
+
+// FormatDecimal formats an amount in minor units as a plain decimal number, eg. FormatDecimal(123456, "USD") is "1234.56"
+func FormatDecimal(amount int, code string) string {
+	info, ok := Lookup(code)
+	if !ok {
+		info = Info{Decimals: 2}
+	}
+
+	return strconv.FormatFloat(float64(amount)/math.Pow10(info.Decimals), 'f', info.Decimals, 64)
+}
+
+// ParseAmount parses a decimal amount such as "120.50" into minor units of the currency
+func ParseAmount(s, code string) (int, error) {
+	info, ok := Lookup(code)
+	if !ok {
+		info = Info{Decimals: 2}
+	}
+
+	major, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+
+	return int(math.Round(major * math.Pow10(info.Decimals))), nil
+}
+
+// groupThousands inserts a comma between every group of three digits
+func groupThousands(digits string) string {
+	if len(digits) <= 3 {
+		return digits
+	}
+
+	var b strings.Builder
+	lead := len(digits) % 3
+	if lead > 0 {
+		b.WriteString(digits[:lead])
+	}
+
+	for i := lead; i < len(digits); i += 3 {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(digits[i : i+3])
+	}
+
+	return b.String()
+}
+
+// ParseRates reads exchange rates from CSV with rows of the form "currency,rate".
+// A header row starting with "currency" is skipped.
+func ParseRates(r io.Reader) (map[string]float64, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	rates := make(map[string]float64)
+
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToUpper(strings.TrimSpace(record[0]))
+		if line == 1 && code == "CURRENCY" {
+			continue
+		}
+
+		if !IsSupported(code) {
+			return nil, fmt.Errorf("line %d: unsupported currency %q", line, record[0])
+		}
+
+		rate, err := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("line %d: invalid rate %q", line, record[1])
+		}
+
+		rates[code] = rate
+	}
+
+	if len(rates) == 0 {
+		return nil, errors.New("no exchange rates found")
+	}
+
+	return rates, nil
+}
@@ -0,0 +1,80 @@
+package currency
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	var tests = []struct {
+		amount   int
+		code     string
+		expected string
+	}{
+		{123456, "USD", "$1,234.56"},
+		{5, "EUR", "€0.05"},
+		{-250000, "GBP", "-£2,500.00"},
+		{1234567, "JPY", "¥1,234,567"},
+		{100, "xyz", "XYZ 1.00"},
+	}
+
+	for _, e := range tests {
+		got := Format(e.amount, e.code)
+		if got != e.expected {
+			t.Errorf("Format(%d, %s): expected %s, got %s", e.amount, e.code, e.expected, got)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	if got := Convert(10000, 0.9, "USD", "EUR"); got != 9000 {
+		t.Errorf("expected 9000, got %d", got)
+	}
+
+	if got := Convert(10000, 150.255, "USD", "JPY"); got != 15026 {
+		t.Errorf("expected 15026, got %d", got)
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	amount, err := ParseAmount(" 120.5 ", "USD")
+	if err != nil || amount != 12050 {
+		t.Errorf("expected 12050, got %d (%v)", amount, err)
+	}
+
+	amount, err = ParseAmount("980", "JPY")
+	if err != nil || amount != 980 {
+		t.Errorf("expected 980, got %d (%v)", amount, err)
+	}
+
+	if _, err := ParseAmount("abc", "USD"); err == nil {
+		t.Error("expected error for invalid amount")
+	}
+
+	if got := FormatDecimal(12050, "USD"); got != "120.50" {
+		t.Errorf("expected 120.50, got %s", got)
+	}
+}
+
+func TestParseRates(t *testing.T) {
+	rates, err := ParseRates(strings.NewReader("currency,rate\nEUR, 0.92\ngbp,0.79\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rates["EUR"] != 0.92 || rates["GBP"] != 0.79 {
+		t.Errorf("unexpected rates %v", rates)
+	}
+
+	if _, err := ParseRates(strings.NewReader("ABC,1.0\n")); err == nil {
+		t.Error("expected error for unsupported currency")
+	}
+
+	if _, err := ParseRates(strings.NewReader("EUR,-1\n")); err == nil {
+		t.Error("expected error for negative rate")
+	}
+
+	if _, err := ParseRates(strings.NewReader("")); err == nil {
+		t.Error("expected error for empty file")
+	}
+}
@@ -0,0 +1,200 @@
+// Package dates holds Date, a calendar date without a time of day or time zone, for the arrival and departure
+// dates of stays. A stay's nights are counted in dates rather than hours, so a night lost or gained when the clocks
+// change is still one night
+package dates
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Layout is the format of dates in forms, URLs, JSON and the database, eg. 2026-11-01
+const Layout = "2006-01-02"
+
+// Date is a calendar date. The zero Date is no date at all, and IsZero reports it
+type Date struct {
+	// t is midnight UTC of the date, so that dates compare and subtract exactly
+	t time.Time
+}
+
+// New returns the date of year, month and day, normalised like time.Date: 31 November is 1 December
+func New(year int, month time.Month, day int) Date {
+	return Date{t: time.Date(year, month, day, 0, 0, 0, 0, time.UTC)}
+}
+
+// Of returns the date of t in t's location
+func Of(t time.Time) Date {
+	return New(t.Year(), t.Month(), t.Day())
+}
+
+// Today returns the date it is at now in loc, the property's time zone. A nil loc is UTC
+func Today(now time.Time, loc *time.Location) Date {
+	if loc == nil {
+		loc = time.UTC
+	}
+	return Of(now.In(loc))
+}
+
+// Parse parses a date in Layout
+func Parse(s string) (Date, error) {
+	t, err := time.Parse(Layout, s)
+	if err != nil {
+		return Date{}, err
+	}
+	return Date{t: t}, nil
+}
+
+// IsZero reports whether d is the zero Date
+func (d Date) IsZero() bool {
+	return d.t.IsZero()
+}
+
+// Year returns the year of d
+func (d Date) Year() int {
+	return d.t.Year()
+}
+
+// Month returns the month of d
+func (d Date) Month() time.Month {
+	return d.t.Month()
+}
+
+// Day returns the day of the month of d
+func (d Date) Day() int {
+	return d.t.Day()
+}
+
+// Weekday returns the day of the week of d
+func (d Date) Weekday() time.Weekday {
+	return d.t.Weekday()
+}
+
+// AddDate returns d moved by years, months and days, normalised like time.AddDate
+func (d Date) AddDate(years, months, days int) Date {
+	return Date{t: d.t.AddDate(years, months, days)}
+}
+
+// Sub returns the number of days from u to d, which is the number of nights of a stay arriving on u and
+// leaving on d
+func (d Date) Sub(u Date) int {
+	return int(d.t.Sub(u.t).Hours() / 24)
+}
+
+// Before reports whether d is before u
+func (d Date) Before(u Date) bool {
+	return d.t.Before(u.t)
+}
+
+// After reports whether d is after u
+func (d Date) After(u Date) bool {
+	return d.t.After(u.t)
+}
+
+// Equal reports whether d and u are the same date
+func (d Date) Equal(u Date) bool {
+	return d.t.Equal(u.t)
+}
+
+// Format formats d like time.Format. Layouts with a time of day show midnight
+func (d Date) Format(layout string) string {
+	return d.t.Format(layout)
+}
+
+// String formats d in Layout, or returns an empty string for the zero Date
+func (d Date) String() string {
+	if d.IsZero() {
+		return ""
+	}
+	return d.t.Format(Layout)
+}
+
+// Time returns midnight UTC of d
+func (d Date) Time() time.Time {
+	return d.t
+}
+
+// In returns the time d begins in loc. On a day the clocks go forward at midnight that is the first minute of the
+// day, rather than an hour that didn't happen
+func (d Date) In(loc *time.Location) time.Time {
+	return d.At(0, 0, loc)
+}
+
+// At returns hour:min on d in loc, eg. a check-in time at the property
+func (d Date) At(hour, min int, loc *time.Location) time.Time {
+	t := time.Date(d.Year(), d.Month(), d.Day(), hour, min, 0, 0, loc)
+	if Of(t) != d {
+		// hour:min fell in the gap when the clocks went forward, and time.Date normalised it into the previous
+		// day; the clocks going forward moves the time later instead
+		t = time.Date(d.Year(), d.Month(), d.Day(), hour+1, min, 0, 0, loc)
+	}
+	return t
+}
+
+// MarshalText formats d in Layout, for JSON and forms
+func (d Date) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText parses a date in Layout. An empty string is the zero Date
+func (d *Date) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*d = Date{}
+		return nil
+	}
+
+	parsed, err := Parse(string(text))
+	if err != nil {
+		return fmt.Errorf("dates: %q is not a date like %s", text, Layout)
+	}
+
+	*d = parsed
+	return nil
+}
+
+// GobEncode encodes d for sessions
+func (d Date) GobEncode() ([]byte, error) {
+	return d.MarshalText()
+}
+
+// GobDecode decodes a date encoded by GobEncode
+func (d *Date) GobDecode(data []byte) error {
+	return d.UnmarshalText(data)
+}
+
+// Value stores d as midnight UTC, which both database drivers write to date columns as the date itself. The zero
+// Date is stored as null
+func (d Date) Value() (driver.Value, error) {
+	if d.IsZero() {
+		return nil, nil
+	}
+	return d.t, nil
+}
+
+// Scan reads a date column, which the drivers return as a time or, from SQLite, possibly as text. A null is the
+// zero Date
+func (d *Date) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*d = Date{}
+	case time.Time:
+		// the drivers return dates at midnight UTC; the date is kept as written, whatever the location
+		*d = New(v.Year(), v.Month(), v.Day())
+	case string:
+		return d.scanText(v)
+	case []byte:
+		return d.scanText(string(v))
+	default:
+		return fmt.Errorf("dates: can't scan %T into a Date", src)
+	}
+	return nil
+}
+
+// scanText reads the date at the start of a date or timestamp column stored as text
+func (d *Date) scanText(s string) error {
+	if len(s) < len(Layout) {
+		return errors.New("dates: can't scan " + s + " into a Date")
+	}
+	return d.UnmarshalText([]byte(s[:len(Layout)]))
+}
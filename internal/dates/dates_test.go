@@ -0,0 +1,140 @@
+package dates
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func mustParse(t *testing.T, s string) Date {
+	t.Helper()
+
+	d, err := Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+func location(t *testing.T, name string) *time.Location {
+	t.Helper()
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return loc
+}
+
+func TestToday(t *testing.T) {
+	sydney := location(t, "Australia/Sydney")
+	now := time.Date(2026, 11, 1, 20, 0, 0, 0, time.UTC)
+
+	if got := Today(now, sydney); got != New(2026, 11, 2) {
+		t.Errorf("expected 2026-11-02 in Sydney, got %s", got)
+	}
+	if got := Today(now, nil); got != New(2026, 11, 1) {
+		t.Errorf("expected 2026-11-01 in UTC, got %s", got)
+	}
+}
+
+func TestSub_DST(t *testing.T) {
+	// the clocks in New York go forward on 8 March 2026 and back on 1 November 2026, but every stay over either
+	// is still counted in whole nights
+	for _, e := range []struct{ start, end string }{{"2026-03-07", "2026-03-09"}, {"2026-10-31", "2026-11-02"}} {
+		start, end := mustParse(t, e.start), mustParse(t, e.end)
+		if n := end.Sub(start); n != 2 {
+			t.Errorf("%s to %s: expected 2 nights, got %d", e.start, e.end, n)
+		}
+		if n := Of(end.In(location(t, "America/New_York"))).Sub(start); n != 2 {
+			t.Errorf("%s to %s: expected 2 nights through New York time, got %d", e.start, e.end, n)
+		}
+	}
+}
+
+func TestAt(t *testing.T) {
+	newYork := location(t, "America/New_York")
+
+	checkIn := mustParse(t, "2026-03-08").At(15, 0, newYork)
+	if checkIn.Hour() != 15 || Of(checkIn) != New(2026, 3, 8) {
+		t.Errorf("expected 15:00 on 8 March, got %s", checkIn)
+	}
+
+	// Havana's clocks went forward at midnight on 8 March 2026, so the day began at 01:00
+	havana := location(t, "America/Havana")
+	start := mustParse(t, "2026-03-08").In(havana)
+	if Of(start) != New(2026, 3, 8) {
+		t.Errorf("expected the start of 8 March, got %s", start)
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	type stay struct {
+		StartDate Date `json:"start_date"`
+		EndDate   Date `json:"end_date"`
+	}
+	in := stay{StartDate: mustParse(t, "2026-11-01")}
+
+	js, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(js) != `{"start_date":"2026-11-01","end_date":""}` {
+		t.Errorf("unexpected JSON %s", js)
+	}
+
+	var out stay
+	if err := json.Unmarshal(js, &out); err != nil || out != in {
+		t.Errorf("expected %+v back from JSON, got %+v, %v", in, out, err)
+	}
+	if err := json.Unmarshal([]byte(`{"start_date":"tomorrow"}`), &out); err == nil {
+		t.Error("expected a malformed date to be refused")
+	}
+
+	var buf bytes.Buffer
+	out = stay{}
+	if err := gob.NewEncoder(&buf).Encode(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewDecoder(&buf).Decode(&out); err != nil || out != in {
+		t.Errorf("expected %+v back from gob, got %+v, %v", in, out, err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	var tests = []struct {
+		src      interface{}
+		expected Date
+	}{
+		{time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), New(2026, 11, 1)},
+		{time.Date(2026, 11, 1, 0, 0, 0, 0, time.FixedZone("", 8*3600)), New(2026, 11, 1)},
+		{"2026-11-01 00:00:00+00:00", New(2026, 11, 1)},
+		{[]byte("2026-11-01"), New(2026, 11, 1)},
+		{nil, Date{}},
+	}
+
+	for _, e := range tests {
+		var d Date
+		if err := d.Scan(e.src); err != nil || d != e.expected {
+			t.Errorf("Scan(%v): expected %s, got %s, %v", e.src, e.expected, d, err)
+		}
+	}
+
+	var d Date
+	if err := d.Scan(42); err == nil {
+		t.Error("expected an int to be refused")
+	}
+
+	v, err := New(2026, 11, 1).Value()
+	if err != nil || !v.(time.Time).Equal(time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected midnight UTC, got %v, %v", v, err)
+	}
+	if v, _ := (Date{}).Value(); v != nil {
+		t.Errorf("expected the zero date to be stored as null, got %v", v)
+	}
+}
@@ -1,65 +1,221 @@
 package driver
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"strings"
 	"time"
 
 	_ "github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4"
 	_ "github.com/jackc/pgx/v4/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+// The supported SQL dialects
+const (
+	Postgres = "postgres"
+	SQLite   = "sqlite"
 )
 
 // DB holds the database connection pool
 type DB struct {
 	SQL *sql.DB
+	// Dialect is the kind of database connected to, Postgres or SQLite
+	Dialect string
+
+	opts Options
+	// healthy and lastStats are used by Monitor to log only what has changed since its last check
+	healthy   bool
+	lastStats sql.DBStats
 }
 
-var dbConn = &DB{}
+// Options configures the connection pool and how long to wait for the database on startup
+type Options struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
 
-const maxOpenDBConn = 10
-const maxIdleDBConn = 5
-const maxDBLifetime = 5 * time.Minute
+	// MaxWait is how long Connect keeps retrying a database that isn't up yet
+	MaxWait time.Duration
+	// RetryInterval is the wait after the first failed attempt; it doubles after each further failure, up to maxRetryInterval
+	RetryInterval time.Duration
 
-func ConnectSQL(dsn string) (*DB, error) {
-	d, err := NewDatabase(dsn)
+	// InfoLog receives retry and recovery messages, and ErrorLog pool problems. Both default to discarding
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+}
 
-	if err != nil {
-		panic(err)
+// maxRetryInterval caps the wait between connection attempts
+const maxRetryInterval = 5 * time.Second
+
+// pingTimeout limits each attempt to reach the database
+const pingTimeout = 5 * time.Second
+
+// DefaultOptions returns the pool settings used unless configured otherwise
+func DefaultOptions() Options {
+	return Options{
+		MaxOpenConns:    10,
+		MaxIdleConns:    5,
+		ConnMaxLifetime: 5 * time.Minute,
+		ConnMaxIdleTime: time.Minute,
+		MaxWait:         30 * time.Second,
+		RetryInterval:   500 * time.Millisecond,
 	}
+}
 
-	d.SetMaxOpenConns(maxOpenDBConn)
-	d.SetMaxIdleConns(maxIdleDBConn)
-	d.SetConnMaxLifetime(maxDBLifetime)
+// sqlitePragmas are set on every SQLite connection unless the DSN sets them itself. Foreign keys are off by default
+// in SQLite, and the busy timeout makes a writer wait for another instead of failing at once
+var sqlitePragmas = []string{"foreign_keys(1)", "busy_timeout(5000)", "journal_mode(WAL)"}
+
+// ConnectSQL connects to a Postgres database with the default options
+func ConnectSQL(dsn string) (*DB, error) {
+	return Connect(Postgres, dsn, DefaultOptions())
+}
 
-	dbConn.SQL = d
+// Connect connects to a database of the given dialect, retrying with exponential backoff until it answers or
+// opts.MaxWait has passed. For SQLite, dsn is the path of the database file, optionally followed by the
+// driver's query parameters
+func Connect(dialect, dsn string, opts Options) (*DB, error) {
+	var db *DB
+	var err error
 
-	err = testDB(d)
+	switch dialect {
+	case Postgres:
+		db, err = connect("pgx", dsn, opts)
+	case SQLite:
+		db, err = connect("sqlite", sqliteDSN(dsn), opts)
+	default:
+		return nil, fmt.Errorf("unknown database dialect %q", dialect)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return dbConn, nil
+
+	db.Dialect = dialect
+
+	return db, nil
 }
 
-// testDB tries to ping the database
-func testDB(d *sql.DB) error {
-	err := d.Ping()
+// sqliteDSN adds the default pragmas, those the DSN doesn't already set, and the options the repository relies
+// on: times are written in one format so that they compare as text, and transactions take the write lock when
+// they begin, so that two of them can't each wait for the other to release its read lock
+func sqliteDSN(dsn string) string {
+	var params []string
+	for _, pragma := range sqlitePragmas {
+		name := pragma[:strings.Index(pragma, "(")]
+		if !strings.Contains(dsn, "_pragma="+name) {
+			params = append(params, "_pragma="+pragma)
+		}
+	}
+	if !strings.Contains(dsn, "_time_format=") {
+		params = append(params, "_time_format=sqlite")
+	}
+	if !strings.Contains(dsn, "_txlock=") {
+		params = append(params, "_txlock=immediate")
+	}
 
-	if err != nil {
-		return err
+	if len(params) == 0 {
+		return dsn
 	}
-	return nil
+
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+
+	return dsn + sep + strings.Join(params, "&")
 }
 
-// NewDatabase creates a new database for the application
-func NewDatabase(dsn string) (*sql.DB, error) {
-	db, err := sql.Open("pgx", dsn)
+func connect(driverName, dsn string, opts Options) (*DB, error) {
+	if opts.InfoLog == nil {
+		opts.InfoLog = log.New(io.Discard, "", 0)
+	}
+	if opts.ErrorLog == nil {
+		opts.ErrorLog = log.New(io.Discard, "", 0)
+	}
 
+	d, err := sql.Open(driverName, dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	if err = db.Ping(); err != nil {
-		return nil, err
+	d.SetMaxOpenConns(opts.MaxOpenConns)
+	d.SetMaxIdleConns(opts.MaxIdleConns)
+	d.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	d.SetConnMaxIdleTime(opts.ConnMaxIdleTime)
+
+	deadline := time.Now().Add(opts.MaxWait)
+	wait := opts.RetryInterval
+
+	for attempt := 1; ; attempt++ {
+		err = ping(d)
+		if err == nil {
+			break
+		}
+
+		if time.Now().Add(wait).After(deadline) {
+			d.Close()
+			return nil, fmt.Errorf("database still unreachable after %d attempts: %w", attempt, err)
+		}
+
+		opts.InfoLog.Printf("Database not ready (attempt %d): %v; retrying in %s", attempt, err, wait)
+		time.Sleep(wait)
+
+		wait *= 2
+		if wait > maxRetryInterval {
+			wait = maxRetryInterval
+		}
 	}
-	return db, nil
+
+	return &DB{SQL: d, opts: opts, healthy: true, lastStats: d.Stats()}, nil
+}
+
+// ping checks that the database answers
+func ping(d *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+
+	return d.PingContext(ctx)
+}
+
+// Monitor checks the database every interval until done is closed. It logs when the database stops or starts
+// answering, and when requests had to wait for a connection because the pool was exhausted, but never stops the
+// application: the pool reconnects by itself once the database is back
+func (d *DB) Monitor(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			d.check()
+		}
+	}
+}
+
+// check pings the database and looks at the pool statistics gathered since the last check
+func (d *DB) check() {
+	err := ping(d.SQL)
+	switch {
+	case err != nil && d.healthy:
+		d.opts.ErrorLog.Printf("Database unreachable: %v", err)
+	case err == nil && !d.healthy:
+		d.opts.InfoLog.Println("Database reachable again")
+	}
+	d.healthy = err == nil
+
+	stats := d.SQL.Stats()
+	waits := stats.WaitCount - d.lastStats.WaitCount
+	if waits > 0 {
+		d.opts.ErrorLog.Printf("Connection pool exhausted: %d requests waited %s in total for one of %d connections",
+			waits, stats.WaitDuration-d.lastStats.WaitDuration, stats.MaxOpenConnections)
+	}
+	d.lastStats = stats
 }
@@ -0,0 +1,136 @@
+package driver
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyDriver refuses connections while down is set
+type flakyDriver struct {
+	mu       sync.Mutex
+	down     bool
+	failures int // connections refused before coming up, when down isn't set
+	attempts int
+}
+
+func (d *flakyDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.attempts++
+	if d.down || d.attempts <= d.failures {
+		return nil, errors.New("connection refused")
+	}
+	return conn{}, nil
+}
+
+func (d *flakyDriver) setDown(down bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.down = down
+}
+
+type conn struct{}
+
+func (conn) Prepare(query string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (conn) Close() error                              { return nil }
+func (conn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+var drivers = struct {
+	sync.Mutex
+	n int
+}{}
+
+// registerFlaky registers a new flaky driver, since drivers can't be unregistered
+func registerFlaky(d *flakyDriver) string {
+	drivers.Lock()
+	defer drivers.Unlock()
+
+	drivers.n++
+	name := fmt.Sprintf("flaky%d", drivers.n)
+	sql.Register(name, d)
+
+	return name
+}
+
+func testOptions(buf *bytes.Buffer) Options {
+	opts := DefaultOptions()
+	opts.RetryInterval = time.Millisecond
+	opts.MaxWait = time.Second
+	opts.InfoLog = log.New(buf, "", 0)
+	opts.ErrorLog = log.New(buf, "", 0)
+	return opts
+}
+
+func TestConnect_Retries(t *testing.T) {
+	fake := &flakyDriver{failures: 3}
+	var buf bytes.Buffer
+
+	db, err := connect(registerFlaky(fake), "", testOptions(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.SQL.Close()
+
+	if fake.attempts != 4 {
+		t.Errorf("expected 4 attempts, got %d", fake.attempts)
+	}
+	if n := strings.Count(buf.String(), "Database not ready"); n != 3 {
+		t.Errorf("expected 3 retries to be logged, got %d:\n%s", n, buf.String())
+	}
+	if db.SQL.Stats().MaxOpenConnections != 10 {
+		t.Errorf("expected the pool to be configured, got %+v", db.SQL.Stats())
+	}
+}
+
+func TestConnect_GivesUp(t *testing.T) {
+	fake := &flakyDriver{down: true}
+	var buf bytes.Buffer
+
+	opts := testOptions(&buf)
+	opts.MaxWait = 20 * time.Millisecond
+
+	start := time.Now()
+	_, err := connect(registerFlaky(fake), "", opts)
+	if err == nil || !strings.Contains(err.Error(), "still unreachable") {
+		t.Errorf("expected to give up, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("expected to give up after about 20ms, took %s", time.Since(start))
+	}
+}
+
+func TestDB_Check(t *testing.T) {
+	fake := &flakyDriver{}
+	var buf bytes.Buffer
+
+	db, err := connect(registerFlaky(fake), "", testOptions(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.SQL.Close()
+
+	// the pool keeps a healthy connection, so close it to make the next ping dial again
+	db.SQL.SetMaxIdleConns(0)
+
+	fake.setDown(true)
+	db.check()
+	db.check()
+	if n := strings.Count(buf.String(), "Database unreachable"); n != 1 {
+		t.Errorf("expected the outage to be logged once, got %d:\n%s", n, buf.String())
+	}
+
+	fake.setDown(false)
+	db.check()
+	if !strings.Contains(buf.String(), "Database reachable again") {
+		t.Errorf("expected the recovery to be logged, got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,188 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/clock"
+	"github.com/ashrielbrian/go_bookings/internal/dates"
+	"github.com/ashrielbrian/go_bookings/internal/models"
+)
+
+// Domain event types
+const (
+	ReservationCreated   = "reservation.created"
+	ReservationUpdated   = "reservation.updated"
+	ReservationCancelled = "reservation.cancelled"
+	BlockCreated         = "block.created"
+)
+
+// Reservation is the payload of reservation events. Subscribers look up anything else they need, so that they
+// see the reservation as it is when they run
+type Reservation struct {
+	ReservationID int    `json:"reservation_id"`
+	Code          string `json:"code"`
+}
+
+// Block is the payload of block events, for restrictions blocking a room's dates that aren't for a reservation.
+// It holds the whole block, since blocks aren't looked up on their own
+type Block struct {
+	RoomRestrictionID int        `json:"room_restriction_id"`
+	RoomID            int        `json:"room_id"`
+	StartDate         dates.Date `json:"start_date"`
+	EndDate           dates.Date `json:"end_date"`
+}
+
+// Decode decodes an event's payload into v
+func Decode(e models.OutboxEvent, v interface{}) error {
+	err := json.Unmarshal([]byte(e.Payload), v)
+	if err != nil {
+		return fmt.Errorf("decoding %s event %d: %w", e.Type, e.ID, err)
+	}
+	return nil
+}
+
+// Handler handles an event. Events are delivered at least once, so handlers must cope with seeing an event again
+type Handler func(e models.OutboxEvent) error
+
+// Bus passes events to the handlers subscribed to their type
+type Bus struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+}
+
+// NewBus creates a bus with no subscribers
+func NewBus() *Bus {
+	return &Bus{handlers: make(map[string][]Handler)}
+}
+
+// Subscribe registers a handler for an event type
+func (b *Bus) Subscribe(eventType string, h Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers[eventType] = append(b.handlers[eventType], h)
+}
+
+// Publish passes an event to each of its handlers. Every handler is run even if an earlier one fails; the first
+// error is returned so that the event can be published again later
+func (b *Bus) Publish(e models.OutboxEvent) error {
+	b.mu.RLock()
+	handlers := b.handlers[e.Type]
+	b.mu.RUnlock()
+
+	var firstErr error
+	for _, h := range handlers {
+		err := h(e)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Store is the part of the repository holding the outbox
+type Store interface {
+	PendingOutboxEvents(limit int, lease time.Duration) ([]models.OutboxEvent, error)
+	MarkOutboxEventPublished(id int) error
+	RetryOutboxEvent(e models.OutboxEvent) error
+}
+
+// Dispatch settings
+const (
+	// batchSize is how many events are published each time the dispatcher polls
+	batchSize = 50
+	// lease is how long an event is held by the dispatcher publishing it. An event whose dispatcher stops before
+	// recording the outcome is published again once its lease runs out
+	lease = time.Minute
+	// retryBase is the wait after an event first fails to publish; it doubles after each further failure
+	retryBase = 10 * time.Second
+	// maxRetry caps the wait between attempts. Events are retried until they are published
+	maxRetry = time.Hour
+)
+
+// Retry returns how long to wait before publishing an event again after it has failed attempts times
+func Retry(attempts int) time.Duration {
+	if attempts < 1 {
+		return 0
+	}
+
+	wait := retryBase
+	for i := 1; i < attempts; i++ {
+		wait *= 2
+		if wait >= maxRetry {
+			return maxRetry
+		}
+	}
+
+	return wait
+}
+
+// Dispatcher publishes the events recorded in the outbox
+type Dispatcher struct {
+	Store    Store
+	Bus      *Bus
+	ErrorLog *log.Logger
+	// Clock schedules the retries of events that fail to publish
+	Clock clock.Clock
+}
+
+// NewDispatcher creates a dispatcher publishing the events in store to bus
+func NewDispatcher(store Store, bus *Bus, errorLog *log.Logger) *Dispatcher {
+	return &Dispatcher{
+		Store:    store,
+		Bus:      bus,
+		ErrorLog: errorLog,
+		Clock:    clock.Real{},
+	}
+}
+
+// Run publishes pending events every interval until done is closed
+func (d *Dispatcher) Run(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			d.RunOnce()
+		}
+	}
+}
+
+// RunOnce publishes the events that are pending now
+func (d *Dispatcher) RunOnce() {
+	pending, err := d.Store.PendingOutboxEvents(batchSize, lease)
+	if err != nil {
+		d.ErrorLog.Println(err)
+		return
+	}
+
+	for _, e := range pending {
+		err = d.Bus.Publish(e)
+		if err == nil {
+			err = d.Store.MarkOutboxEventPublished(e.ID)
+			if err != nil {
+				d.ErrorLog.Println(err)
+			}
+			continue
+		}
+
+		d.ErrorLog.Println(err)
+
+		e.Attempts++
+		e.LastError = err.Error()
+		e.NextAttemptAt = d.Clock.Now().Add(Retry(e.Attempts))
+
+		err = d.Store.RetryOutboxEvent(e)
+		if err != nil {
+			d.ErrorLog.Println(err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package events
+
+import (
+	"errors"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/models"
+)
+
+func TestBus_Publish(t *testing.T) {
+	bus := NewBus()
+
+	var calls []string
+	bus.Subscribe(ReservationCreated, func(e models.OutboxEvent) error {
+		calls = append(calls, "failing")
+		return errors.New("boom")
+	})
+	bus.Subscribe(ReservationCreated, func(e models.OutboxEvent) error {
+		calls = append(calls, "ok")
+		return nil
+	})
+
+	err := bus.Publish(models.OutboxEvent{Type: ReservationCreated})
+	if err == nil || err.Error() != "boom" {
+		t.Errorf("expected the handler's error, got %v", err)
+	}
+	if len(calls) != 2 {
+		t.Errorf("expected every handler to run, got %v", calls)
+	}
+
+	if err := bus.Publish(models.OutboxEvent{Type: "room.created"}); err != nil {
+		t.Errorf("expected an event without handlers to publish, got %v", err)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	var payload Reservation
+
+	err := Decode(models.OutboxEvent{Payload: `{"reservation_id":1,"code":"TESTCODE"}`}, &payload)
+	if err != nil || payload.ReservationID != 1 || payload.Code != "TESTCODE" {
+		t.Errorf("unexpected payload %+v (%v)", payload, err)
+	}
+
+	if err := Decode(models.OutboxEvent{Payload: "nope"}, &payload); err == nil {
+		t.Error("expected an error decoding an invalid payload")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{0, 0},
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{9, 2560 * time.Second},
+		{10, time.Hour},
+		{100, time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := Retry(tt.attempts); got != tt.expected {
+			t.Errorf("Retry(%d): expected %s, got %s", tt.attempts, tt.expected, got)
+		}
+	}
+}
+
+type fakeStore struct {
+	pending   []models.OutboxEvent
+	published []int
+	retried   []models.OutboxEvent
+}
+
+func (s *fakeStore) PendingOutboxEvents(limit int, lease time.Duration) ([]models.OutboxEvent, error) {
+	pending := s.pending
+	s.pending = nil
+	return pending, nil
+}
+
+func (s *fakeStore) MarkOutboxEventPublished(id int) error {
+	s.published = append(s.published, id)
+	return nil
+}
+
+func (s *fakeStore) RetryOutboxEvent(e models.OutboxEvent) error {
+	s.retried = append(s.retried, e)
+	return nil
+}
+
+func TestDispatcher_RunOnce(t *testing.T) {
+	bus := NewBus()
+	bus.Subscribe(ReservationCreated, func(e models.OutboxEvent) error {
+		if e.ID == 2 {
+			return errors.New("boom")
+		}
+		return nil
+	})
+
+	store := &fakeStore{pending: []models.OutboxEvent{
+		{ID: 1, Type: ReservationCreated},
+		{ID: 2, Type: ReservationCreated, Attempts: 1},
+	}}
+
+	NewDispatcher(store, bus, log.New(os.Stdout, "", 0)).RunOnce()
+
+	if len(store.published) != 1 || store.published[0] != 1 {
+		t.Errorf("expected event 1 to be published, got %v", store.published)
+	}
+
+	if len(store.retried) != 1 {
+		t.Fatalf("expected event 2 to be retried, got %v", store.retried)
+	}
+
+	e := store.retried[0]
+	if e.ID != 2 || e.Attempts != 2 || e.LastError != "boom" {
+		t.Errorf("unexpected retried event %+v", e)
+	}
+	if wait := time.Until(e.NextAttemptAt); wait < 15*time.Second || wait > 20*time.Second {
+		t.Errorf("expected a retry in 20s, got %s", wait)
+	}
+}
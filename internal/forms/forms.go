@@ -3,9 +3,12 @@ package forms
 import (
 	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/asaskevich/govalidator"
+
+	"github.com/ashrielbrian/go_bookings/internal/dates"
 )
 
 type Form struct {
@@ -60,3 +63,43 @@ func (f *Form) IsEmail(field string) bool {
 	}
 	return true
 }
+
+// IntRange checks that a field is a whole number between min and max inclusive
+func (f *Form) IntRange(field string, min, max int) bool {
+	x, err := strconv.Atoi(strings.TrimSpace(f.Get(field)))
+
+	if err != nil || x < min || x > max {
+		f.Errors.Add(field, fmt.Sprintf("This field must be a whole number between %d and %d", min, max))
+		return false
+	}
+	return true
+}
+
+// Stay parses the arrival and departure dates of a stay from startField and endField, checking that the stay ends
+// after it starts and doesn't start before today, the date at the property. Missing fields are left to Required
+func (f *Form) Stay(startField, endField string, today dates.Date) (dates.Date, dates.Date) {
+	start := f.date(startField)
+	end := f.date(endField)
+
+	if !start.IsZero() && start.Before(today) {
+		f.Errors.Add(startField, "This date can't be in the past")
+	}
+	if !start.IsZero() && !end.IsZero() && !end.After(start) {
+		f.Errors.Add(endField, "This date must be after the start date")
+	}
+
+	return start, end
+}
+
+// date parses a field in dates.Layout, adding an error when it is malformed
+func (f *Form) date(field string) dates.Date {
+	if !f.Has(field) {
+		return dates.Date{}
+	}
+
+	d, err := dates.Parse(strings.TrimSpace(f.Get(field)))
+	if err != nil {
+		f.Errors.Add(field, "This field must be a date in YYYY-MM-DD format")
+	}
+	return d
+}
@@ -5,6 +5,8 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+
+	"github.com/ashrielbrian/go_bookings/internal/dates"
 )
 
 func TestForm_Valid(t *testing.T) {
@@ -127,3 +129,68 @@ func TestForm_Email(t *testing.T) {
 	}
 
 }
+
+func TestForm_IntRange(t *testing.T) {
+	postedData := url.Values{
+		"pass":      []string{"3"},
+		"too_small": []string{"0"},
+		"too_large": []string{"11"},
+		"not_int":   []string{"two"},
+	}
+
+	form := New(postedData)
+
+	if !form.IntRange("pass", 1, 10) {
+		t.Error("Expected int in range to pass; failed instead.")
+	}
+	if form.IntRange("too_small", 1, 10) {
+		t.Error("Expected int below range to fail; passed instead.")
+	}
+	if form.IntRange("too_large", 1, 10) {
+		t.Error("Expected int above range to fail; passed instead.")
+	}
+	if form.IntRange("not_int", 1, 10) {
+		t.Error("Expected non-integer to fail; passed instead.")
+	}
+	if form.IntRange("nonexistent", 1, 10) {
+		t.Error("Expected missing field to fail; passed instead.")
+	}
+	if form.Errors.Get("pass") != "" {
+		t.Error("Expected no error for field in range.")
+	}
+}
+
+func TestForm_Stay(t *testing.T) {
+	today := dates.New(2026, 11, 1)
+
+	var tests = []struct {
+		name       string
+		start, end string
+		field      string
+	}{
+		{"valid", "2026-11-01", "2026-11-03", ""},
+		{"malformed start", "01/11/2026", "2026-11-03", "start"},
+		{"malformed end", "2026-11-01", "tomorrow", "end"},
+		{"end before start", "2026-11-03", "2026-11-01", "end"},
+		{"same day", "2026-11-03", "2026-11-03", "end"},
+		{"in the past", "2026-10-31", "2026-11-03", "start"},
+	}
+
+	for _, e := range tests {
+		form := New(url.Values{"start": {e.start}, "end": {e.end}})
+		start, end := form.Stay("start", "end", today)
+
+		if e.field == "" {
+			if !form.Valid() {
+				t.Errorf("%s: expected a valid stay, got %v", e.name, form.Errors)
+			}
+			if start != today || end != dates.New(2026, 11, 3) {
+				t.Errorf("%s: unexpected dates %s to %s", e.name, start, end)
+			}
+			continue
+		}
+		if form.Errors.Get(e.field) == "" {
+			t.Errorf("%s: expected an error for %s, got %v", e.name, e.field, form.Errors)
+		}
+	}
+}
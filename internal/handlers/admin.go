@@ -0,0 +1,1266 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/apikeys"
+	"github.com/ashrielbrian/go_bookings/internal/currency"
+	"github.com/ashrielbrian/go_bookings/internal/dates"
+	"github.com/ashrielbrian/go_bookings/internal/forms"
+	"github.com/ashrielbrian/go_bookings/internal/helpers"
+	"github.com/ashrielbrian/go_bookings/internal/images"
+	"github.com/ashrielbrian/go_bookings/internal/models"
+	"github.com/ashrielbrian/go_bookings/internal/render"
+	"github.com/ashrielbrian/go_bookings/internal/repository"
+	"github.com/ashrielbrian/go_bookings/internal/repository/cache"
+	"github.com/ashrielbrian/go_bookings/internal/webhooks"
+	"github.com/go-chi/chi/v5"
+)
+
+// MaxUploadSize is the largest multipart body accepted by the admin upload forms
+const MaxUploadSize = 10 << 20
+
+// AdminExchangeRates lists the stored exchange rates
+func (m *Repository) AdminExchangeRates(w http.ResponseWriter, r *http.Request) {
+	rates, err := m.DB.AllExchangeRates()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["rates"] = rates
+	data["currencies"] = currency.Supported()
+
+	render.Template(w, r, "admin-exchange-rates.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+		Data: data,
+	})
+}
+
+// AdminPostExchangeRate sets the exchange rate for a single currency
+func (m *Repository) AdminPostExchangeRate(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("currency", "rate")
+
+	code := strings.ToUpper(form.Get("currency"))
+	if form.Has("currency") && (!currency.IsSupported(code) || code == m.App.BaseCurrency) {
+		form.Errors.Add("currency", "Unsupported currency")
+	}
+
+	rate, err := strconv.ParseFloat(form.Get("rate"), 64)
+	if form.Has("rate") && (err != nil || rate <= 0) {
+		form.Errors.Add("rate", "Rate must be a positive number")
+	}
+
+	if !form.Valid() {
+		rates, err := m.DB.AllExchangeRates()
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		data := make(map[string]interface{})
+		data["rates"] = rates
+		data["currencies"] = currency.Supported()
+
+		render.Template(w, r, "admin-exchange-rates.page.tmpl", &models.TemplateData{
+			Form: form,
+			Data: data,
+		})
+		return
+	}
+
+	err = m.DB.UpsertExchangeRate(code, rate)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Exchange rate saved")
+	http.Redirect(w, r, "/admin/exchange-rates", http.StatusSeeOther)
+}
+
+// AdminImportExchangeRates imports exchange rates from an uploaded CSV file of "currency,rate" rows
+func (m *Repository) AdminImportExchangeRates(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+
+	err := r.ParseMultipartForm(MaxUploadSize)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Could not read the uploaded file")
+		http.Redirect(w, r, "/admin/exchange-rates", http.StatusSeeOther)
+		return
+	}
+
+	file, _, err := r.FormFile("rates")
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Please choose a CSV file to import")
+		http.Redirect(w, r, "/admin/exchange-rates", http.StatusSeeOther)
+		return
+	}
+	defer file.Close()
+
+	rates, err := currency.ParseRates(file)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid exchange rate file: "+err.Error())
+		http.Redirect(w, r, "/admin/exchange-rates", http.StatusSeeOther)
+		return
+	}
+
+	for code, rate := range rates {
+		if code == m.App.BaseCurrency {
+			continue
+		}
+
+		err = m.DB.UpsertExchangeRate(code, rate)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Exchange rates imported")
+	http.Redirect(w, r, "/admin/exchange-rates", http.StatusSeeOther)
+}
+
+// AdminRooms lists every room, including retired ones
+func (m *Repository) AdminRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms(true)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["rooms"] = rooms
+
+	render.Template(w, r, "admin-rooms.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminNewRoom renders the form to add a room
+func (m *Repository) AdminNewRoom(w http.ResponseWriter, r *http.Request) {
+	room := models.Room{CheckInTime: models.DefaultCheckInTime, CheckOutTime: models.DefaultCheckOutTime}
+	m.renderRoomForm(w, r, room, forms.New(nil))
+}
+
+// AdminPostNewRoom adds a room
+func (m *Repository) AdminPostNewRoom(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	room, amenityIDs, form := m.roomFromForm(r)
+	if !form.Valid() {
+		m.renderRoomForm(w, r, room, form)
+		return
+	}
+
+	room.ID, err = m.DB.InsertRoom(room)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.SetRoomAmenities(room.ID, amenityIDs)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Room added")
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
+
+// AdminShowRoom renders the form to edit a room
+func (m *Repository) AdminShowRoom(w http.ResponseWriter, r *http.Request) {
+	room, ok := m.adminRoom(w, r)
+	if !ok {
+		return
+	}
+
+	m.renderRoomForm(w, r, room, forms.New(nil))
+}
+
+// AdminPostShowRoom updates a room
+func (m *Repository) AdminPostShowRoom(w http.ResponseWriter, r *http.Request) {
+	existing, ok := m.adminRoom(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	room, amenityIDs, form := m.roomFromForm(r)
+	room.ID = existing.ID
+	room.Retired = existing.Retired
+	room.Images = existing.Images
+
+	if !form.Valid() {
+		m.renderRoomForm(w, r, room, form)
+		return
+	}
+
+	err = m.DB.UpdateRoom(room)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.DB.SetRoomAmenities(room.ID, amenityIDs)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Room updated")
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
+
+// AdminRetireRoom retires a room, or brings a retired room back when the form's retired field is "0"
+func (m *Repository) AdminRetireRoom(w http.ResponseWriter, r *http.Request) {
+	room, ok := m.adminRoom(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	retired := r.Form.Get("retired") != "0"
+
+	err = m.DB.SetRoomRetired(room.ID, retired)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if retired {
+		m.App.Session.Put(r.Context(), "flash", room.RoomName+" retired")
+	} else {
+		m.App.Session.Put(r.Context(), "flash", room.RoomName+" restored")
+	}
+
+	http.Redirect(w, r, "/admin/rooms", http.StatusSeeOther)
+}
+
+// adminRoom loads the room identified by the id URL parameter, writing an error response if it can't
+func (m *Repository) adminRoom(w http.ResponseWriter, r *http.Request) (models.Room, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return models.Room{}, false
+	}
+
+	room, err := m.DB.GetRoomByID(id)
+	if errors.Is(err, repository.ErrNotFound) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return room, false
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return room, false
+	}
+
+	return room, true
+}
+
+// maxTurnoverDays is the most days that can be kept free between stays in a room
+const maxTurnoverDays = 14
+
+// timeFromForm reads a check-in or check-out time in models.TimeLayout from field, or def when it is empty
+func timeFromForm(form *forms.Form, field, def string) string {
+	if !form.Has(field) {
+		return def
+	}
+
+	t, err := time.Parse(models.TimeLayout, strings.TrimSpace(form.Get(field)))
+	if err != nil {
+		form.Errors.Add(field, "Enter a time as HH:MM")
+		return form.Get(field)
+	}
+	return t.Format(models.TimeLayout)
+}
+
+// roomFromForm builds a room and its amenity IDs from the posted room form, validating it
+func (m *Repository) roomFromForm(r *http.Request) (models.Room, []int, *forms.Form) {
+	form := forms.New(r.PostForm)
+	form.Required("room_name", "price", "max_occupancy")
+
+	room := models.Room{
+		RoomName:    strings.TrimSpace(form.Get("room_name")),
+		Slug:        helpers.Slugify(form.Get("slug")),
+		Description: strings.TrimSpace(form.Get("description")),
+		BedTypes:    strings.TrimSpace(form.Get("bed_types")),
+	}
+
+	if room.Slug == "" {
+		room.Slug = helpers.Slugify(room.RoomName)
+	}
+
+	if form.Has("room_name") && room.Slug == "" {
+		form.Errors.Add("slug", "The URL name must contain letters or numbers")
+	}
+
+	price, err := currency.ParseAmount(form.Get("price"), m.App.BaseCurrency)
+	if form.Has("price") && (err != nil || price <= 0) {
+		form.Errors.Add("price", "Price must be a positive amount")
+	}
+	room.Price = price
+
+	occupancy, err := strconv.Atoi(form.Get("max_occupancy"))
+	if form.Has("max_occupancy") && (err != nil || occupancy < 1) {
+		form.Errors.Add("max_occupancy", "Capacity must be at least 1")
+	}
+	room.MaxOccupancy = occupancy
+
+	if form.Has("size_sqm") {
+		size, err := strconv.Atoi(form.Get("size_sqm"))
+		if err != nil || size < 0 {
+			form.Errors.Add("size_sqm", "Size must be a whole number of square metres")
+		}
+		room.SizeSqm = size
+	}
+
+	room.CheckInTime = timeFromForm(form, "check_in_time", models.DefaultCheckInTime)
+	room.CheckOutTime = timeFromForm(form, "check_out_time", models.DefaultCheckOutTime)
+	if form.Errors.Get("check_in_time") == "" && form.Errors.Get("check_out_time") == "" &&
+		room.CheckOutTime >= room.CheckInTime {
+		form.Errors.Add("check_out_time", "Check-out must be before check-in, so rooms can be turned over in a day")
+	}
+
+	for field, dst := range map[string]*int{
+		"early_check_in_price": &room.EarlyCheckInPrice,
+		"late_check_out_price": &room.LateCheckOutPrice,
+	} {
+		if !form.Has(field) {
+			continue
+		}
+		amount, err := currency.ParseAmount(form.Get(field), m.App.BaseCurrency)
+		if err != nil || amount < 0 {
+			form.Errors.Add(field, "Price must be an amount, or 0 not to offer it")
+		}
+		*dst = amount
+	}
+
+	if form.Has("turnover_days") {
+		days, err := strconv.Atoi(form.Get("turnover_days"))
+		if err != nil || days < 0 || days > maxTurnoverDays {
+			form.Errors.Add("turnover_days", fmt.Sprintf("Turnover must be a whole number of days up to %d", maxTurnoverDays))
+		}
+		room.TurnoverDays = days
+	}
+
+	var amenityIDs []int
+	for _, v := range form.Values["amenities"] {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			continue
+		}
+		amenityIDs = append(amenityIDs, id)
+		room.Amenities = append(room.Amenities, models.Amenity{ID: id})
+	}
+
+	return room, amenityIDs, form
+}
+
+// renderRoomForm renders the add/edit room form
+func (m *Repository) renderRoomForm(w http.ResponseWriter, r *http.Request, room models.Room, form *forms.Form) {
+	amenities, err := m.DB.AllAmenities()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	selected := make(map[int]bool)
+	for _, a := range room.Amenities {
+		selected[a.ID] = true
+	}
+
+	stringMap := make(map[string]string)
+	if room.Price > 0 {
+		stringMap["price"] = currency.FormatDecimal(room.Price, m.App.BaseCurrency)
+	} else {
+		stringMap["price"] = form.Get("price")
+	}
+	for field, amount := range map[string]int{
+		"early_check_in_price": room.EarlyCheckInPrice,
+		"late_check_out_price": room.LateCheckOutPrice,
+	} {
+		if form.Has(field) && form.Errors.Get(field) != "" {
+			stringMap[field] = form.Get(field)
+		} else {
+			stringMap[field] = currency.FormatDecimal(amount, m.App.BaseCurrency)
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["room"] = room
+	data["amenities"] = amenities
+	data["selected_amenities"] = selected
+
+	render.Template(w, r, "admin-room.page.tmpl", &models.TemplateData{
+		Form:      form,
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// maxImagesPerUpload is the number of images that can be uploaded in one request
+const maxImagesPerUpload = 5
+
+// MaxImagesUploadSize is the largest body accepted by the room image upload, which takes several images at once
+const MaxImagesUploadSize = maxImagesPerUpload*images.MaxUploadSize + MaxUploadSize
+
+// AdminRoomImages renders the image gallery manager of a room
+func (m *Repository) AdminRoomImages(w http.ResponseWriter, r *http.Request) {
+	room, ok := m.adminRoom(w, r)
+	if !ok {
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["room"] = room
+
+	intMap := make(map[string]int)
+	intMap["max_images"] = maxImagesPerUpload
+	intMap["max_size_mb"] = images.MaxUploadSize >> 20
+
+	render.Template(w, r, "admin-room-images.page.tmpl", &models.TemplateData{
+		Data:   data,
+		IntMap: intMap,
+	})
+}
+
+// AdminPostRoomImages uploads images to a room's gallery, storing a web sized image and a thumbnail of each
+func (m *Repository) AdminPostRoomImages(w http.ResponseWriter, r *http.Request) {
+	room, ok := m.adminRoom(w, r)
+	if !ok {
+		return
+	}
+
+	redirect := fmt.Sprintf("/admin/rooms/%d/images", room.ID)
+
+	// the body is capped by the LimitBody middleware, as NoSurf reads the form before the handler runs
+	err := r.ParseMultipartForm(MaxUploadSize)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "The upload is too large")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files := r.MultipartForm.File["images"]
+	if len(files) == 0 {
+		m.App.Session.Put(r.Context(), "error", "Please choose at least one image")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	if len(files) > maxImagesPerUpload {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Upload at most %d images at a time", maxImagesPerUpload))
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	// every file is decoded before any is saved, so that one bad file doesn't leave half the batch uploaded
+	batch := make([]map[string][]byte, 0, len(files))
+	for _, fh := range files {
+		file, err := fh.Open()
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		variants, err := images.Variants(file, images.Web, images.Thumbnail)
+		file.Close()
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", fmt.Sprintf("%s: %s", fh.Filename, err))
+			http.Redirect(w, r, redirect, http.StatusSeeOther)
+			return
+		}
+
+		batch = append(batch, variants)
+	}
+
+	caption := strings.TrimSpace(r.FormValue("caption"))
+	sortOrder := len(room.Images)
+
+	// the images saved so far are removed when a later one fails, so that the batch is uploaded whole or not at all
+	var saved []models.RoomImage
+	fail := func(img models.RoomImage, err error) {
+		m.deleteImageFiles(img)
+		for _, s := range saved {
+			if err := m.DB.DeleteRoomImage(s.ID); err != nil {
+				m.App.ErrorLog.Println(err)
+			}
+			m.deleteImageFiles(s)
+		}
+		helpers.ServerError(w, err)
+	}
+
+	for _, variants := range batch {
+		img := models.RoomImage{
+			RoomID:     room.ID,
+			StorageKey: fmt.Sprintf("rooms/%d/%s", room.ID, randomToken()),
+			Caption:    caption,
+			SortOrder:  sortOrder,
+		}
+
+		img.URL, err = m.App.Storage.Save(imageKey(img, images.Web), bytes.NewReader(variants[images.Web.Name]))
+		if err != nil {
+			fail(img, err)
+			return
+		}
+
+		img.ThumbnailURL, err = m.App.Storage.Save(imageKey(img, images.Thumbnail), bytes.NewReader(variants[images.Thumbnail.Name]))
+		if err != nil {
+			fail(img, err)
+			return
+		}
+
+		img.ID, err = m.DB.InsertRoomImage(img)
+		if err != nil {
+			fail(img, err)
+			return
+		}
+
+		saved = append(saved, img)
+		sortOrder++
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%d image(s) uploaded", len(files)))
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// AdminPostRoomImage updates the caption and position of a room image
+func (m *Repository) AdminPostRoomImage(w http.ResponseWriter, r *http.Request) {
+	img, ok := m.adminRoomImage(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	img.Caption = strings.TrimSpace(r.Form.Get("caption"))
+
+	sortOrder, err := strconv.Atoi(r.Form.Get("sort_order"))
+	if err == nil {
+		img.SortOrder = sortOrder
+	}
+
+	err = m.DB.UpdateRoomImage(img)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Image updated")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/images", img.RoomID), http.StatusSeeOther)
+}
+
+// AdminDeleteRoomImage removes an image from a room's gallery
+func (m *Repository) AdminDeleteRoomImage(w http.ResponseWriter, r *http.Request) {
+	img, ok := m.adminRoomImage(w, r)
+	if !ok {
+		return
+	}
+
+	err := m.DB.DeleteRoomImage(img.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.deleteImageFiles(img)
+
+	m.App.Session.Put(r.Context(), "flash", "Image deleted")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/images", img.RoomID), http.StatusSeeOther)
+}
+
+// adminRoomImage loads the image identified by the id and imageID URL parameters, writing an error
+// response if it can't
+func (m *Repository) adminRoomImage(w http.ResponseWriter, r *http.Request) (models.RoomImage, bool) {
+	roomID, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	id, err := strconv.Atoi(chi.URLParam(r, "imageID"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return models.RoomImage{}, false
+	}
+
+	img, err := m.DB.GetRoomImageByID(id)
+	if errors.Is(err, repository.ErrNotFound) || (err == nil && img.RoomID != roomID) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return img, false
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return img, false
+	}
+
+	return img, true
+}
+
+// deleteImageFiles removes an uploaded image's files from storage, logging any failure
+func (m *Repository) deleteImageFiles(img models.RoomImage) {
+	if img.StorageKey == "" {
+		return
+	}
+
+	for _, size := range []images.Size{images.Web, images.Thumbnail} {
+		err := m.App.Storage.Delete(imageKey(img, size))
+		if err != nil {
+			m.App.ErrorLog.Println(err)
+		}
+	}
+}
+
+// imageKey returns the storage key of an uploaded image's variant
+func imageKey(img models.RoomImage, size images.Size) string {
+	return img.StorageKey + "-" + size.Name + ".jpg"
+}
+
+// randomToken returns a random hex string suitable for unguessable file names
+func randomToken() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// maxStayRuleNights is the most nights a minimum or maximum stay rule can be set to
+const maxStayRuleNights = 365
+
+// AdminRoomRules lists the stay rules of a room, with a form to add one
+func (m *Repository) AdminRoomRules(w http.ResponseWriter, r *http.Request) {
+	room, ok := m.adminRoom(w, r)
+	if !ok {
+		return
+	}
+
+	m.renderRoomRules(w, r, room, forms.New(nil))
+}
+
+// AdminPostRoomRule adds a stay rule to a room
+func (m *Repository) AdminPostRoomRule(w http.ResponseWriter, r *http.Request) {
+	room, ok := m.adminRoom(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("type")
+
+	rule := models.StayRule{RoomID: room.ID, Type: form.Get("type")}
+
+	if form.Has("type") && !hasString(models.StayRuleTypes, rule.Type) {
+		form.Errors.Add("type", "Unknown rule "+rule.Type)
+	}
+
+	if rule.Type == models.StayRuleMinNights || rule.Type == models.StayRuleMaxNights {
+		if form.IntRange("nights", 1, maxStayRuleNights) {
+			rule.Nights, _ = strconv.Atoi(strings.TrimSpace(form.Get("nights")))
+		}
+	}
+
+	for _, v := range r.PostForm["weekdays"] {
+		day, err := strconv.Atoi(v)
+		if err != nil || day < int(time.Sunday) || day > int(time.Saturday) {
+			form.Errors.Add("weekdays", "Unknown day "+v)
+			continue
+		}
+		rule.Weekdays = append(rule.Weekdays, time.Weekday(day))
+	}
+	if rule.Type == models.StayRuleArrivalDays && len(rule.Weekdays) == 0 {
+		form.Errors.Add("weekdays", "Choose the days arrivals are allowed on")
+	}
+
+	for _, field := range []string{"start_date", "end_date"} {
+		if !form.Has(field) {
+			continue
+		}
+		d, err := dates.Parse(strings.TrimSpace(form.Get(field)))
+		if err != nil {
+			form.Errors.Add(field, "Enter a date as YYYY-MM-DD")
+			continue
+		}
+		if field == "start_date" {
+			rule.StartDate = d
+		} else {
+			rule.EndDate = d
+		}
+	}
+	if !rule.StartDate.IsZero() && !rule.EndDate.IsZero() && rule.EndDate.Before(rule.StartDate) {
+		form.Errors.Add("end_date", "The last arrival date can't be before the first")
+	}
+
+	if !form.Valid() {
+		m.renderRoomRules(w, r, room, form)
+		return
+	}
+
+	_, err = m.DB.InsertStayRule(rule)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Stay rule added")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/rules", room.ID), http.StatusSeeOther)
+}
+
+// AdminDeleteRoomRule removes a stay rule from a room
+func (m *Repository) AdminDeleteRoomRule(w http.ResponseWriter, r *http.Request) {
+	room, ok := m.adminRoom(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "ruleID"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	rules, err := m.DB.StayRulesByRoomID(room.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	found := false
+	for _, rule := range rules {
+		if rule.ID == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	err = m.DB.DeleteStayRule(id)
+	if errors.Is(err, repository.ErrNotFound) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Stay rule deleted")
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/rules", room.ID), http.StatusSeeOther)
+}
+
+// renderRoomRules renders the stay rules page of a room with the given form
+func (m *Repository) renderRoomRules(w http.ResponseWriter, r *http.Request, room models.Room, form *forms.Form) {
+	rules, err := m.DB.StayRulesByRoomID(room.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	weekdays := make([]time.Weekday, 0, 7)
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		weekdays = append(weekdays, d)
+	}
+
+	data := make(map[string]interface{})
+	data["room"] = room
+	data["rules"] = rules
+	data["rule_types"] = models.StayRuleTypes
+	data["weekdays"] = weekdays
+
+	render.Template(w, r, "admin-room-rules.page.tmpl", &models.TemplateData{
+		Form: form,
+		Data: data,
+	})
+}
+
+// AdminPostRoomBlock blocks nights of a room for the owner, so that they can't be booked
+func (m *Repository) AdminPostRoomBlock(w http.ResponseWriter, r *http.Request) {
+	room, ok := m.adminRoom(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("block_start", "block_end")
+	start, end := form.Stay("block_start", "block_end", m.today())
+
+	if form.Valid() {
+		free, err := m.DB.SearchAvailabilityByDatesByRoomID(start, end, room.ID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		if !free {
+			form.Errors.Add("block_start", "The room is already booked or blocked on some of these nights")
+		}
+	}
+
+	if !form.Valid() {
+		m.renderRoomRules(w, r, room, form)
+		return
+	}
+
+	err = m.DB.InsertRoomRestriction(models.RoomRestriction{
+		RoomID:        room.ID,
+		RestrictionID: models.RestrictionOwnerBlock,
+		StartDate:     start,
+		EndDate:       end,
+	})
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Blocked %s to %s", start, end))
+	http.Redirect(w, r, fmt.Sprintf("/admin/rooms/%d/rules", room.ID), http.StatusSeeOther)
+}
+
+// AdminReservations finds a reservation by the code given in the query
+func (m *Repository) AdminReservations(w http.ResponseWriter, r *http.Request) {
+	code := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("code")))
+	if code != "" {
+		http.Redirect(w, r, "/admin/reservations/"+url.PathEscape(code), http.StatusSeeOther)
+		return
+	}
+
+	render.Template(w, r, "admin-reservations.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// AdminReservation shows a reservation, with forms to change the guest's details or cancel it
+func (m *Repository) AdminReservation(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.adminReservation(w, r)
+	if !ok {
+		return
+	}
+
+	m.renderAdminReservation(w, r, res, forms.New(url.Values{
+		"first_name": {res.FirstName},
+		"last_name":  {res.LastName},
+		"email":      {res.Email},
+		"phone":      {res.Phone},
+	}))
+}
+
+// AdminPostReservation changes the guest's details of a reservation
+func (m *Repository) AdminPostReservation(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.adminReservation(w, r)
+	if !ok {
+		return
+	}
+
+	redirect := "/admin/reservations/" + url.PathEscape(res.Code)
+
+	if res.Cancelled() {
+		m.App.Session.Put(r.Context(), "error", "A cancelled reservation can't be changed")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// the same checks as the reservation form
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "email")
+	form.MinLength("first_name", 3)
+	form.IsEmail("email")
+
+	if !form.Valid() {
+		m.renderAdminReservation(w, r, res, form)
+		return
+	}
+
+	res.FirstName = strings.TrimSpace(form.Get("first_name"))
+	res.LastName = strings.TrimSpace(form.Get("last_name"))
+	res.Email = strings.TrimSpace(form.Get("email"))
+	res.Phone = strings.TrimSpace(form.Get("phone"))
+
+	err = m.DB.UpdateReservation(res)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Reservation updated")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// AdminCancelReservation cancels a reservation, freeing its nights to be booked again
+func (m *Repository) AdminCancelReservation(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.adminReservation(w, r)
+	if !ok {
+		return
+	}
+
+	err := m.DB.CancelReservation(res.Code)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Reservation cancelled")
+	http.Redirect(w, r, "/admin/reservations/"+url.PathEscape(res.Code), http.StatusSeeOther)
+}
+
+// adminReservation loads the reservation named by the code URL parameter, writing a 404 when there is none
+func (m *Repository) adminReservation(w http.ResponseWriter, r *http.Request) (models.Reservation, bool) {
+	res, err := m.DB.GetReservationByCode(chi.URLParam(r, "code"))
+	if errors.Is(err, repository.ErrNotFound) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return res, false
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return res, false
+	}
+
+	return res, true
+}
+
+func (m *Repository) renderAdminReservation(w http.ResponseWriter, r *http.Request, res models.Reservation, form *forms.Form) {
+	data := make(map[string]interface{})
+	data["reservation"] = res
+
+	render.Template(w, r, "admin-reservation.page.tmpl", &models.TemplateData{
+		Form: form,
+		Data: data,
+	})
+}
+
+// AdminAPIKeys lists partners and their API keys. A key that was just issued is shown once
+func (m *Repository) AdminAPIKeys(w http.ResponseWriter, r *http.Request) {
+	m.renderAPIKeys(w, r, forms.New(nil))
+}
+
+// AdminPostPartner adds a partner that API keys can be issued to
+func (m *Repository) AdminPostPartner(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("partner_name", "partner_email")
+	form.IsEmail("partner_email")
+
+	if !form.Valid() {
+		m.renderAPIKeys(w, r, form)
+		return
+	}
+
+	_, err = m.DB.InsertPartner(models.Partner{
+		Name:  strings.TrimSpace(form.Get("partner_name")),
+		Email: form.Get("partner_email"),
+	})
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Partner added")
+	http.Redirect(w, r, "/admin/api-keys", http.StatusSeeOther)
+}
+
+// AdminPostAPIKey issues an API key to a partner
+func (m *Repository) AdminPostAPIKey(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("partner_id", "name")
+
+	partnerID, _ := strconv.Atoi(form.Get("partner_id"))
+
+	scopes := r.PostForm["scopes"]
+	if len(scopes) == 0 {
+		form.Errors.Add("scopes", "Choose at least one scope")
+	}
+	for _, scope := range scopes {
+		if !apikeys.IsScope(scope) {
+			form.Errors.Add("scopes", "Unknown scope "+scope)
+		}
+	}
+
+	if !form.Valid() {
+		m.renderAPIKeys(w, r, form)
+		return
+	}
+
+	key, prefix, hash, err := apikeys.Generate()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	_, err = m.DB.InsertAPIKey(models.APIKey{
+		PartnerID: partnerID,
+		Name:      strings.TrimSpace(form.Get("name")),
+		Prefix:    prefix,
+		Hash:      hash,
+		Scopes:    scopes,
+	})
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// the key can't be recovered from its hash, so this is the only time it is shown
+	m.App.Session.Put(r.Context(), "api_key", key)
+	http.Redirect(w, r, "/admin/api-keys", http.StatusSeeOther)
+}
+
+// AdminRevokeAPIKey revokes an API key so that it is no longer accepted
+func (m *Repository) AdminRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	err = m.DB.RevokeAPIKey(id)
+	if errors.Is(err, repository.ErrNotFound) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "API key revoked")
+	http.Redirect(w, r, "/admin/api-keys", http.StatusSeeOther)
+}
+
+// renderAPIKeys renders the API keys page with the given form
+func (m *Repository) renderAPIKeys(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	keys, err := m.DB.AllAPIKeys()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	partners, err := m.DB.AllPartners()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["keys"] = keys
+	data["partners"] = partners
+	data["scopes"] = apikeys.Scopes
+
+	stringMap := make(map[string]string)
+	stringMap["new_key"] = m.App.Session.PopString(r.Context(), "api_key")
+
+	render.Template(w, r, "admin-api-keys.page.tmpl", &models.TemplateData{
+		Form:      form,
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// AdminWebhooks lists the webhook subscriptions
+func (m *Repository) AdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	m.renderWebhooks(w, r, forms.New(nil))
+}
+
+// AdminPostWebhook adds a webhook subscription. Its signing secret is generated and shown on the subscription's page
+func (m *Repository) AdminPostWebhook(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("url")
+
+	if form.Has("url") {
+		u, err := url.Parse(form.Get("url"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			form.Errors.Add("url", "Enter an http or https URL")
+		}
+	}
+
+	events := r.PostForm["events"]
+	if len(events) == 0 {
+		form.Errors.Add("events", "Choose at least one event")
+	}
+	for _, event := range events {
+		if !webhooks.IsEventType(event) {
+			form.Errors.Add("events", "Unknown event "+event)
+		}
+	}
+
+	if !form.Valid() {
+		m.renderWebhooks(w, r, form)
+		return
+	}
+
+	id, err := m.DB.InsertWebhookSubscription(models.WebhookSubscription{
+		URL:    form.Get("url"),
+		Secret: webhooks.NewSecret(),
+		Events: events,
+		Active: true,
+	})
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Webhook added")
+	http.Redirect(w, r, fmt.Sprintf("/admin/webhooks/%d", id), http.StatusSeeOther)
+}
+
+// AdminWebhook shows a webhook subscription and its recent deliveries
+func (m *Repository) AdminWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	subscription, err := m.DB.GetWebhookSubscriptionByID(id)
+	if errors.Is(err, repository.ErrNotFound) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	deliveries, err := m.DB.WebhookDeliveries(id, 50)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["subscription"] = subscription
+	data["deliveries"] = deliveries
+
+	render.Template(w, r, "admin-webhook.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminDeleteWebhook deletes a webhook subscription, along with its deliveries
+func (m *Repository) AdminDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	err = m.DB.DeleteWebhookSubscription(id)
+	if errors.Is(err, repository.ErrNotFound) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Webhook deleted")
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
+
+// renderWebhooks renders the webhooks page with the given form
+func (m *Repository) renderWebhooks(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	subscriptions, err := m.DB.AllWebhookSubscriptions()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["subscriptions"] = subscriptions
+	data["events"] = webhooks.EventTypes
+
+	render.Template(w, r, "admin-webhooks.page.tmpl", &models.TemplateData{
+		Form: form,
+		Data: data,
+	})
+}
+
+// AdminCacheStats reports the repository cache's hits, misses and invalidations as JSON. It is not found when the
+// cache isn't enabled
+func (m *Repository) AdminCacheStats(w http.ResponseWriter, r *http.Request) {
+	c, ok := m.DB.(*cache.Repo)
+	if !ok {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	js, err := json.Marshal(c.Stats())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
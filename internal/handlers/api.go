@@ -0,0 +1,617 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/apikeys"
+	"github.com/ashrielbrian/go_bookings/internal/forms"
+	"github.com/ashrielbrian/go_bookings/internal/helpers"
+	"github.com/ashrielbrian/go_bookings/internal/models"
+	"github.com/ashrielbrian/go_bookings/internal/repository"
+	"github.com/ashrielbrian/go_bookings/internal/stayrules"
+	"github.com/go-chi/chi/v5"
+)
+
+// apiDateLayout is the format of every date sent to or returned by the API
+const apiDateLayout = "2006-01-02"
+
+// maxAPIBodySize limits the size of JSON request bodies
+const maxAPIBodySize = 1 << 20
+
+// API error codes, returned in the error envelope so clients don't have to match on messages
+const (
+	apiErrBadRequest   = "bad_request"
+	apiErrUnauthorized = "unauthorized"
+	apiErrForbidden    = "forbidden"
+	apiErrValidation   = "validation_failed"
+	apiErrNotFound     = "not_found"
+	apiErrUnavailable  = "room_unavailable"
+	apiErrInternal     = "internal_error"
+)
+
+type contextKey string
+
+// apiKeyContextKey holds the authenticated API key in a request's context
+const apiKeyContextKey contextKey = "api_key"
+
+// apiEnvelope wraps every successful API response
+type apiEnvelope struct {
+	Data interface{} `json:"data"`
+}
+
+// apiError is the body of every failed API response
+type apiError struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Code    string              `json:"code" doc:"Machine readable error code"`
+	Message string              `json:"message" doc:"Human readable description of the error"`
+	Fields  map[string][]string `json:"fields,omitempty" doc:"Validation errors keyed by request field"`
+}
+
+type apiPrice struct {
+	Amount   int    `json:"amount" doc:"Amount in minor units of the currency, e.g. cents"`
+	Currency string `json:"currency" doc:"ISO 4217 currency code"`
+}
+
+type apiRoomImage struct {
+	URL          string `json:"url" doc:"URL of the full size image"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty" doc:"URL of a smaller version of the image"`
+	Caption      string `json:"caption,omitempty"`
+}
+
+type apiRoom struct {
+	ID           int            `json:"id"`
+	Name         string         `json:"name"`
+	Slug         string         `json:"slug" doc:"URL-friendly name, used by the room's page on the website"`
+	Description  string         `json:"description"`
+	MaxOccupancy int            `json:"max_occupancy" doc:"Most guests, adults and children, the room sleeps"`
+	BedTypes     string         `json:"bed_types" doc:"Beds in the room, e.g. \"1 King, 1 Sofa bed\""`
+	SizeSqm      int            `json:"size_sqm" doc:"Floor area in square metres; 0 when unknown"`
+	Price        apiPrice       `json:"price_per_night"`
+	CheckInTime  string         `json:"check_in_time" doc:"Local time at the property guests can arrive from, e.g. \"15:00\""`
+	CheckOutTime string         `json:"check_out_time" doc:"Local time at the property guests must leave by, e.g. \"11:00\""`
+	EarlyCheckIn *apiPrice      `json:"early_check_in,omitempty" doc:"Price of arriving at the check-out time instead, when the room offers it"`
+	LateCheckOut *apiPrice      `json:"late_check_out,omitempty" doc:"Price of leaving at the check-in time instead, when the room offers it"`
+	Amenities    []string       `json:"amenities"`
+	Images       []apiRoomImage `json:"images"`
+}
+
+type apiAvailability struct {
+	StartDate string    `json:"start_date" format:"date" doc:"Arrival date"`
+	EndDate   string    `json:"end_date" format:"date" doc:"Departure date"`
+	Adults    int       `json:"adults"`
+	Children  int       `json:"children"`
+	RoomID    int       `json:"room_id,omitempty" doc:"The room that was checked, when room_id was given"`
+	Available *bool     `json:"available,omitempty" doc:"Whether the room is free, sleeps the party and allows the stay, when room_id was given"`
+	StayRules []string  `json:"stay_rules,omitempty" doc:"The room's stay rules that the dates break, when room_id was given"`
+	Rooms     []apiRoom `json:"rooms,omitempty" doc:"Rooms that are free and sleep the party, when room_id was not given"`
+}
+
+type apiReservationRequest struct {
+	RoomID    int    `json:"room_id"`
+	StartDate string `json:"start_date" format:"date" doc:"Arrival date"`
+	EndDate   string `json:"end_date" format:"date" doc:"Departure date, after the arrival date"`
+	Adults    int    `json:"adults,omitempty" doc:"Defaults to 1"`
+	Children  int    `json:"children,omitempty" doc:"Defaults to 0"`
+	FirstName string `json:"first_name" doc:"At least 3 characters"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email" format:"email"`
+	Phone     string `json:"phone,omitempty"`
+	// the add-ons are only accepted in rooms that offer them
+	EarlyCheckIn bool `json:"early_check_in,omitempty" doc:"Arrive at the room's check-out time rather than its check-in time"`
+	LateCheckOut bool `json:"late_check_out,omitempty" doc:"Leave at the room's check-in time rather than its check-out time"`
+}
+
+// Reservation statuses
+const (
+	apiStatusConfirmed = "confirmed"
+	apiStatusCancelled = "cancelled"
+)
+
+type apiReservation struct {
+	Code      string   `json:"code" doc:"Confirmation code, used to look the reservation up"`
+	Status    string   `json:"status" doc:"confirmed, or cancelled once the reservation is cancelled"`
+	RoomID    int      `json:"room_id"`
+	RoomName  string   `json:"room_name"`
+	StartDate string   `json:"start_date" format:"date" doc:"Arrival date"`
+	EndDate   string   `json:"end_date" format:"date" doc:"Departure date"`
+	Nights    int      `json:"nights"`
+	Adults    int      `json:"adults"`
+	Children  int      `json:"children"`
+	FirstName string   `json:"first_name"`
+	LastName  string   `json:"last_name"`
+	Email     string   `json:"email" format:"email"`
+	Phone     string   `json:"phone,omitempty"`
+	CheckIn   string   `json:"check_in" format:"date-time" doc:"When the guests can arrive, in the property's time zone"`
+	CheckOut  string   `json:"check_out" format:"date-time" doc:"When the guests must leave, in the property's time zone"`
+	Total     apiPrice `json:"total" doc:"Price of the nights and add-ons"`
+}
+
+// APIKeyAuth authenticates API requests by the key in their "Authorization: Bearer" header and counts the request
+// against the key
+func (m *Repository) APIKeyAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			writeUnauthorized(w, "Missing API key.")
+			return
+		}
+
+		key := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+
+		prefix, err := apikeys.Prefix(key)
+		if err != nil {
+			writeUnauthorized(w, "Invalid API key.")
+			return
+		}
+
+		apiKey, err := m.DB.GetAPIKeyByPrefix(prefix)
+		if errors.Is(err, repository.ErrNotFound) || (err == nil && (!apikeys.Verify(key, apiKey.Hash) || apiKey.Revoked())) {
+			writeUnauthorized(w, "Invalid API key.")
+			return
+		}
+		if err != nil {
+			m.apiServerError(w, err)
+			return
+		}
+
+		// usage is informational, so a failure to record it shouldn't fail the request
+		err = m.DB.RecordAPIKeyUsage(apiKey.ID)
+		if err != nil {
+			m.App.ErrorLog.Println(err)
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey, apiKey)))
+	})
+}
+
+// RequireScope rejects API requests whose key hasn't been granted scope. It must be used after APIKeyAuth
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apiKey, ok := APIKeyFromContext(r.Context())
+			if !ok {
+				writeUnauthorized(w, "Missing API key.")
+				return
+			}
+
+			if !apiKey.HasScope(scope) {
+				writeAPIError(w, http.StatusForbidden, apiErrForbidden, fmt.Sprintf("This API key does not have the %s scope.", scope), nil)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// APIKeyFromContext returns the API key a request was authenticated with by APIKeyAuth
+func APIKeyFromContext(ctx context.Context) (models.APIKey, bool) {
+	apiKey, ok := ctx.Value(apiKeyContextKey).(models.APIKey)
+	return apiKey, ok
+}
+
+// WriteAPIError writes the API's error envelope, for middleware outside this package
+func WriteAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeAPIError(w, status, code, message, nil)
+}
+
+// APIRooms lists the rooms that can be booked
+func (m *Repository) APIRooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms(false)
+	if err != nil {
+		m.apiServerError(w, err)
+		return
+	}
+
+	out := make([]apiRoom, 0, len(rooms))
+	for _, room := range rooms {
+		out = append(out, m.apiRoomFrom(room))
+	}
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+// APIRoom shows a single bookable room
+func (m *Repository) APIRoom(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, apiErrNotFound, "Room not found.", nil)
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(id)
+	if errors.Is(err, repository.ErrNotFound) || (err == nil && room.Retired) {
+		writeAPIError(w, http.StatusNotFound, apiErrNotFound, "Room not found.", nil)
+		return
+	}
+	if err != nil {
+		m.apiServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, m.apiRoomFrom(room))
+}
+
+// APIAvailability checks whether a room is free for the given dates, or lists every free room
+// when no room_id is given
+func (m *Repository) APIAvailability(w http.ResponseWriter, r *http.Request) {
+	form := forms.New(r.URL.Query())
+	form.Required("start", "end")
+	adults, children := guestCounts(form)
+	start, end := form.Stay("start", "end", m.today())
+
+	if !form.Valid() {
+		writeAPIValidationError(w, form)
+		return
+	}
+
+	out := apiAvailability{
+		StartDate: start.Format(apiDateLayout),
+		EndDate:   end.Format(apiDateLayout),
+		Adults:    adults,
+		Children:  children,
+	}
+
+	if !form.Has("room_id") {
+		rooms, err := m.DB.SearchAvailabiltyForAllRooms(start, end, models.RoomFilter{Guests: adults + children})
+		if err != nil {
+			m.apiServerError(w, err)
+			return
+		}
+
+		rules, err := m.stayRulesByRoom()
+		if err != nil {
+			m.apiServerError(w, err)
+			return
+		}
+
+		out.Rooms = make([]apiRoom, 0, len(rooms))
+		for _, room := range rooms {
+			if len(stayrules.Check(rules[room.ID], start, end)) == 0 {
+				out.Rooms = append(out.Rooms, m.apiRoomFrom(room))
+			}
+		}
+
+		writeJSON(w, http.StatusOK, out)
+		return
+	}
+
+	roomID, err := strconv.Atoi(form.Get("room_id"))
+	if err != nil {
+		form.Errors.Add("room_id", "Must be a whole number")
+		writeAPIValidationError(w, form)
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(roomID)
+	if errors.Is(err, repository.ErrNotFound) || (err == nil && room.Retired) {
+		writeAPIError(w, http.StatusNotFound, apiErrNotFound, "Room not found.", nil)
+		return
+	}
+	if err != nil {
+		m.apiServerError(w, err)
+		return
+	}
+
+	available := false
+	if adults+children <= room.MaxOccupancy {
+		available, err = m.DB.SearchAvailabilityByDatesByRoomID(start, end, roomID)
+		if err != nil {
+			m.apiServerError(w, err)
+			return
+		}
+	}
+
+	out.StayRules, err = m.brokenStayRules(roomID, start, end)
+	if err != nil {
+		m.apiServerError(w, err)
+		return
+	}
+	if len(out.StayRules) > 0 {
+		available = false
+	}
+
+	out.RoomID = roomID
+	out.Available = &available
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+// APICreateReservation books a room. The response carries the reservation's code, which is needed to look it up later
+func (m *Repository) APICreateReservation(w http.ResponseWriter, r *http.Request) {
+	var req apiReservationRequest
+
+	err := decodeJSON(w, r, &req)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, apiErrBadRequest, err.Error(), nil)
+		return
+	}
+
+	// run the request through the same validation as the reservation form
+	form := forms.New(url.Values{
+		"start_date": {req.StartDate},
+		"end_date":   {req.EndDate},
+		"first_name": {req.FirstName},
+		"last_name":  {req.LastName},
+		"email":      {req.Email},
+		"phone":      {req.Phone},
+	})
+	if req.Adults != 0 || req.Children != 0 {
+		form.Set("adults", strconv.Itoa(req.Adults))
+		form.Set("children", strconv.Itoa(req.Children))
+	}
+
+	form.Required("start_date", "end_date", "first_name", "last_name", "email")
+	form.MinLength("first_name", 3)
+	form.IsEmail("email")
+	adults, children := guestCounts(form)
+	start, end := form.Stay("start_date", "end_date", m.today())
+
+	if req.RoomID == 0 {
+		form.Errors.Add("room_id", "This field cannot be blank!")
+	}
+
+	if !form.Valid() {
+		writeAPIValidationError(w, form)
+		return
+	}
+
+	room, err := m.DB.GetRoomByID(req.RoomID)
+	if errors.Is(err, repository.ErrNotFound) || (err == nil && room.Retired) {
+		form.Errors.Add("room_id", "No such room")
+		writeAPIValidationError(w, form)
+		return
+	}
+	if err != nil {
+		m.apiServerError(w, err)
+		return
+	}
+
+	if adults+children > room.MaxOccupancy {
+		form.Errors.Add("adults", fmt.Sprintf("This room sleeps at most %d guests", room.MaxOccupancy))
+		writeAPIValidationError(w, form)
+		return
+	}
+	if req.EarlyCheckIn && room.EarlyCheckInPrice == 0 {
+		form.Errors.Add("early_check_in", "This room doesn't offer early check-in")
+	}
+	if req.LateCheckOut && room.LateCheckOutPrice == 0 {
+		form.Errors.Add("late_check_out", "This room doesn't offer late check-out")
+	}
+	if !form.Valid() {
+		writeAPIValidationError(w, form)
+		return
+	}
+
+	broken, err := m.brokenStayRules(room.ID, start, end)
+	if err != nil {
+		m.apiServerError(w, err)
+		return
+	}
+	if len(broken) > 0 {
+		for _, msg := range broken {
+			form.Errors.Add("start_date", msg)
+		}
+		writeAPIValidationError(w, form)
+		return
+	}
+
+	apiKey, _ := APIKeyFromContext(r.Context())
+
+	reservation := models.Reservation{
+		Code:         helpers.NewReservationCode(),
+		FirstName:    req.FirstName,
+		LastName:     req.LastName,
+		Email:        req.Email,
+		Phone:        req.Phone,
+		StartDate:    start,
+		EndDate:      end,
+		RoomID:       room.ID,
+		Room:         room,
+		Adults:       adults,
+		Children:     children,
+		EarlyCheckIn: req.EarlyCheckIn,
+		LateCheckOut: req.LateCheckOut,
+		PartnerID:    apiKey.PartnerID,
+	}
+
+	// the room must be free for the nights the add-ons keep empty as well as the stay's own
+	heldStart, heldEnd := reservation.Held()
+	available, err := m.DB.SearchAvailabilityByDatesByRoomID(heldStart, heldEnd, room.ID)
+	if err != nil {
+		m.apiServerError(w, err)
+		return
+	}
+	if !available {
+		writeAPIError(w, http.StatusConflict, apiErrUnavailable, "The room is not available for those dates.", nil)
+		return
+	}
+
+	// API clients don't have a display currency, so they are charged in the base currency
+	total := reservation.Total()
+	_, err = m.DB.CreateBooking(reservation, models.Payment{
+		Amount:       total,
+		Currency:     m.App.BaseCurrency,
+		BaseAmount:   total,
+		BaseCurrency: m.App.BaseCurrency,
+		ExchangeRate: 1,
+	})
+	if errors.Is(err, repository.ErrUnavailable) {
+		// another booking took the room since it was checked
+		writeAPIError(w, http.StatusConflict, apiErrUnavailable, "The room is not available for those dates.", nil)
+		return
+	}
+	if err != nil {
+		m.apiServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/v1/reservations/"+reservation.Code)
+	writeJSON(w, http.StatusCreated, m.apiReservationFrom(reservation))
+}
+
+// APIReservation looks up a reservation by its code. Partners only see the reservations made with their own keys;
+// any other is reported as not found, so that one partner can't read another's guests by guessing codes
+func (m *Repository) APIReservation(w http.ResponseWriter, r *http.Request) {
+	apiKey, _ := APIKeyFromContext(r.Context())
+
+	reservation, err := m.DB.GetReservationByCode(chi.URLParam(r, "code"))
+	if errors.Is(err, repository.ErrNotFound) ||
+		(err == nil && (apiKey.PartnerID == 0 || reservation.PartnerID != apiKey.PartnerID)) {
+		writeAPIError(w, http.StatusNotFound, apiErrNotFound, "Reservation not found.", nil)
+		return
+	}
+	if err != nil {
+		m.apiServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, m.apiReservationFrom(reservation))
+}
+
+// APINotFound answers unknown API routes with the API's error envelope instead of an HTML page
+func (m *Repository) APINotFound(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusNotFound, apiErrNotFound, "No such endpoint.", nil)
+}
+
+// APIMethodNotAllowed answers API requests using the wrong method with the API's error envelope
+func (m *Repository) APIMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusMethodNotAllowed, apiErrBadRequest, "Method not allowed.", nil)
+}
+
+func (m *Repository) apiRoomFrom(room models.Room) apiRoom {
+	out := apiRoom{
+		ID:           room.ID,
+		Name:         room.RoomName,
+		Slug:         room.Slug,
+		Description:  room.Description,
+		MaxOccupancy: room.MaxOccupancy,
+		BedTypes:     room.BedTypes,
+		SizeSqm:      room.SizeSqm,
+		Price:        apiPrice{Amount: room.Price, Currency: m.App.BaseCurrency},
+		CheckInTime:  room.CheckInTime,
+		CheckOutTime: room.CheckOutTime,
+		Amenities:    make([]string, 0, len(room.Amenities)),
+		Images:       make([]apiRoomImage, 0, len(room.Images)),
+	}
+
+	if room.EarlyCheckInPrice > 0 {
+		out.EarlyCheckIn = &apiPrice{Amount: room.EarlyCheckInPrice, Currency: m.App.BaseCurrency}
+	}
+	if room.LateCheckOutPrice > 0 {
+		out.LateCheckOut = &apiPrice{Amount: room.LateCheckOutPrice, Currency: m.App.BaseCurrency}
+	}
+
+	for _, a := range room.Amenities {
+		out.Amenities = append(out.Amenities, a.Name)
+	}
+	for _, img := range room.Images {
+		out.Images = append(out.Images, apiRoomImage{URL: img.URL, ThumbnailURL: img.ThumbnailURL, Caption: img.Caption})
+	}
+
+	return out
+}
+
+func (m *Repository) apiReservationFrom(res models.Reservation) apiReservation {
+	out := apiReservation{
+		Code:      res.Code,
+		Status:    apiStatusConfirmed,
+		RoomID:    res.RoomID,
+		RoomName:  res.Room.RoomName,
+		StartDate: res.StartDate.Format(apiDateLayout),
+		EndDate:   res.EndDate.Format(apiDateLayout),
+		Nights:    res.Nights(),
+		Adults:    res.Adults,
+		Children:  res.Children,
+		FirstName: res.FirstName,
+		LastName:  res.LastName,
+		Email:     res.Email,
+		Phone:     res.Phone,
+		CheckIn:   res.CheckIn(m.App.Location).Format(time.RFC3339),
+		CheckOut:  res.CheckOut(m.App.Location).Format(time.RFC3339),
+		Total:     apiPrice{Amount: res.Total(), Currency: m.App.BaseCurrency},
+	}
+	if res.Cancelled() {
+		out.Status = apiStatusCancelled
+	}
+
+	return out
+}
+
+// apiServerError logs an unexpected error and reports it to the client without any details
+func (m *Repository) apiServerError(w http.ResponseWriter, err error) {
+	m.App.ErrorLog.Println(err)
+	writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Something went wrong.", nil)
+}
+
+// decodeJSON decodes a single JSON object from the request body, rejecting unknown fields
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIBodySize)
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if errors.Is(err, io.EOF) {
+		return errors.New("Request body must not be empty.")
+	}
+	if err != nil {
+		return fmt.Errorf("Request body is not valid JSON: %v", err)
+	}
+
+	if dec.More() {
+		return errors.New("Request body must contain a single JSON object.")
+	}
+
+	return nil
+}
+
+// writeJSON writes data wrapped in the API's success envelope
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	out, err := json.Marshal(apiEnvelope{Data: data})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, apiErrInternal, "Something went wrong.", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+// writeAPIError writes the API's error envelope
+func writeAPIError(w http.ResponseWriter, status int, code, message string, fields map[string][]string) {
+	out, _ := json.Marshal(apiError{Error: apiErrorDetail{Code: code, Message: message, Fields: fields}})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+// writeUnauthorized tells the client to authenticate with an API key
+func writeUnauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	writeAPIError(w, http.StatusUnauthorized, apiErrUnauthorized, message, nil)
+}
+
+// writeAPIValidationError reports the errors collected on a form
+func writeAPIValidationError(w http.ResponseWriter, form *forms.Form) {
+	fields := make(map[string][]string, len(form.Errors))
+	for field, messages := range form.Errors {
+		fields[field] = messages
+	}
+
+	writeAPIError(w, http.StatusUnprocessableEntity, apiErrValidation, "The request has invalid fields.", fields)
+}
@@ -6,10 +6,15 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
-	"time"
+	"strings"
 
+	"github.com/ashrielbrian/go_bookings/internal/alternatives"
+	"github.com/ashrielbrian/go_bookings/internal/calendar"
 	"github.com/ashrielbrian/go_bookings/internal/config"
+	"github.com/ashrielbrian/go_bookings/internal/currency"
+	"github.com/ashrielbrian/go_bookings/internal/dates"
 	"github.com/ashrielbrian/go_bookings/internal/driver"
 	"github.com/ashrielbrian/go_bookings/internal/forms"
 	"github.com/ashrielbrian/go_bookings/internal/helpers"
@@ -17,6 +22,7 @@ import (
 	"github.com/ashrielbrian/go_bookings/internal/render"
 	"github.com/ashrielbrian/go_bookings/internal/repository"
 	"github.com/ashrielbrian/go_bookings/internal/repository/dbrepo"
+	"github.com/ashrielbrian/go_bookings/internal/stayrules"
 	"github.com/go-chi/chi/v5"
 )
 
@@ -30,17 +36,22 @@ type Repository struct {
 
 // NewRepository creates a new repository
 func NewRepository(a *config.AppConfig, db *driver.DB) *Repository {
+	repo := dbrepo.NewPostgresRepo(db.SQL, a)
+	if db.Dialect == driver.SQLite {
+		repo = dbrepo.NewSQLiteRepo(db.SQL, a)
+	}
+
 	return &Repository{
 		App: a,
-		DB:  dbrepo.NewPostgresRepo(db.SQL, a),
+		DB:  repo,
 	}
 }
 
-// NewTestRepository creates a new repository
+// NewTestRepository creates a new repository backed by an empty in-memory database
 func NewTestRepository(a *config.AppConfig) *Repository {
 	return &Repository{
 		App: a,
-		DB:  dbrepo.NewTestingRepo(a),
+		DB:  dbrepo.NewMemoryRepo(a),
 	}
 }
 
@@ -59,7 +70,30 @@ func (m *Repository) Contact(w http.ResponseWriter, r *http.Request) {
 	render.Template(w, r, "contact.page.tmpl", &models.TemplateData{})
 }
 func (m *Repository) Availability(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "search-availability.page.tmpl", &models.TemplateData{})
+	render.Template(w, r, "search-availability.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// maxPartySize is the largest number of adults or children that can be searched for
+const maxPartySize = 20
+
+// guestCounts returns the adults and children in a form, defaulting to one adult when the fields are absent
+func guestCounts(form *forms.Form) (int, int) {
+	if !form.Has("adults") {
+		form.Set("adults", "1")
+	}
+	if !form.Has("children") {
+		form.Set("children", "0")
+	}
+
+	form.IntRange("adults", 1, maxPartySize)
+	form.IntRange("children", 0, maxPartySize)
+
+	adults, _ := strconv.Atoi(form.Get("adults"))
+	children, _ := strconv.Atoi(form.Get("children"))
+
+	return adults, children
 }
 
 type jsonResponse struct {
@@ -68,6 +102,10 @@ type jsonResponse struct {
 	RoomID    string `json:"room_id"`
 	StartDate string `json:"start_date"`
 	EndDate   string `json:"end_date"`
+	Adults    int    `json:"adults"`
+	Children  int    `json:"children"`
+	// Errors are the stay rules the dates break
+	Errors []string `json:"errors,omitempty"`
 }
 
 func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
@@ -90,9 +128,7 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 	ed := r.Form.Get("end")
 	log.Println("--->", sd, ed)
 
-	layout := "2006-01-02"
-
-	startDate, err := time.Parse(layout, sd)
+	startDate, err := dates.Parse(sd)
 
 	if err != nil {
 		resp := jsonResponse{
@@ -106,7 +142,7 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	endDate, err := time.Parse(layout, ed)
+	endDate, err := dates.Parse(ed)
 	if err != nil {
 		log.Println(ed)
 		resp := jsonResponse{
@@ -120,16 +156,98 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !endDate.After(startDate) || startDate.Before(m.today()) {
+		resp := jsonResponse{
+			OK:      false,
+			Message: "Choose an arrival date from today and a departure date after it.",
+		}
+
+		js, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+		return
+	}
+
+	form := forms.New(r.Form)
+	adults, children := guestCounts(form)
+	if !form.Valid() {
+		resp := jsonResponse{
+			OK:      false,
+			Message: "Invalid number of guests.",
+		}
+
+		js, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+		return
+	}
+
 	roomID, _ := strconv.Atoi(r.Form.Get("room_id"))
 
-	available, _ := m.DB.SearchAvailabilityByDatesByRoomID(startDate, endDate, roomID)
+	room, err := m.bookableRoom(roomID)
+	if err != nil {
+		resp := jsonResponse{
+			OK:      false,
+			Message: "Unknown room.",
+		}
+
+		js, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(js)
+		return
+	}
+
+	message := "!"
+	available := false
+	var broken []string
+
+	if adults+children > room.MaxOccupancy {
+		message = fmt.Sprintf("This room sleeps at most %d guests.", room.MaxOccupancy)
+	} else {
+		available, err = m.DB.SearchAvailabilityByDatesByRoomID(startDate, endDate, roomID)
+		if err != nil {
+			m.App.ErrorLog.Println(err)
+			resp := jsonResponse{
+				OK:      false,
+				Message: "Error querying database.",
+			}
+
+			js, _ := json.Marshal(resp)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(js)
+			return
+		}
+	}
+
+	if available {
+		broken, err = m.brokenStayRules(roomID, startDate, endDate)
+		if err != nil {
+			m.App.ErrorLog.Println(err)
+			resp := jsonResponse{
+				OK:      false,
+				Message: "Error checking the room's stay rules.",
+			}
+
+			js, _ := json.Marshal(resp)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(js)
+			return
+		}
+		if len(broken) > 0 {
+			available = false
+			message = strings.Join(broken, ". ") + "."
+		}
+	}
 
 	resp := jsonResponse{
 		OK:        available,
-		Message:   "!",
+		Message:   message,
 		StartDate: sd,
 		EndDate:   ed,
 		RoomID:    strconv.Itoa(roomID),
+		Adults:    adults,
+		Children:  children,
+		Errors:    broken,
 	}
 
 	out, _ := json.MarshalIndent(resp, "", "     ")
@@ -138,62 +256,409 @@ func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
 	w.Write(out)
 
 }
-func (m *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
-	start := r.Form.Get("start")
-	end := r.Form.Get("end")
 
-	// // https://www.pauladamsmith.com/blog/2011/05/go_time.html
-	// // 01/02 03:04:05PM '06 -0700
-	layout := "2006-01-02"
-	startDate, err := time.Parse(layout, start)
+// PostAvailability validates the search form and redirects to the search results, which take their
+// parameters from the query string so that filters can be changed and shared
+func (m *Repository) PostAvailability(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
 	if err != nil {
 		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("start", "end")
+	form.Stay("start", "end", m.today())
+	guestCounts(form)
+
+	if !form.Valid() {
+		render.Template(w, r, "search-availability.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	q := url.Values{}
+	for _, key := range []string{"start", "end", "adults", "children"} {
+		q.Set(key, form.Get(key))
+	}
+
+	http.Redirect(w, r, "/search-availability/results?"+q.Encode(), http.StatusSeeOther)
+}
+
+// AvailabilityResults lists the rooms available for the dates and party in the query string, narrowed
+// down and sorted by the filters in the query string
+func (m *Repository) AvailabilityResults(w http.ResponseWriter, r *http.Request) {
+	form := forms.New(r.URL.Query())
+	form.Required("start", "end")
+	adults, children := guestCounts(form)
+	startDate, endDate := form.Stay("start", "end", m.today())
+
+	if !form.Valid() {
+		m.App.Session.Put(r.Context(), "error", "Invalid search, please try again")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
 	}
-	endDate, err := time.Parse(layout, end)
+
+	filter := m.roomFilter(r, form)
+	filter.Guests = adults + children
+
+	rooms, err := m.DB.SearchAvailabiltyForAllRooms(startDate, endDate, filter)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	rooms, err := m.DB.SearchAvailabiltyForAllRooms(startDate, endDate)
+	rules, err := m.stayRulesByRoom()
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	for _, i := range rooms {
-		m.App.InfoLog.Println("ROOM:", i.ID, i.RoomName)
+	// rooms whose rules the dates break aren't offered, and guests are told why
+	var allowed []models.Room
+	for _, room := range rooms {
+		broken := stayrules.Check(rules[room.ID], startDate, endDate)
+		for _, msg := range broken {
+			if !hasString(form.Errors["dates"], msg) {
+				form.Errors.Add("dates", msg)
+			}
+		}
+		if len(broken) == 0 {
+			allowed = append(allowed, room)
+		}
 	}
+	rooms = allowed
 
-	if len(rooms) == 0 {
-		// no availability
-		m.App.Session.Put(r.Context(), "error", "No availability")
-		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+	if len(rooms) == 0 && !filter.Narrowed() {
+		found, err := m.findAlternatives(startDate, endDate, filter.Guests, rules)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		if len(found) == 0 && form.Valid() {
+			// no availability
+			m.App.Session.Put(r.Context(), "error", "No availability")
+			http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+			return
+		}
+
+		data := make(map[string]interface{})
+		data["alternatives"] = found
+
+		render.Template(w, r, "search-availability.page.tmpl", &models.TemplateData{
+			Form: form,
+			Data: data,
+		})
 		return
 	}
 
+	amenities, err := m.DB.AllAmenities()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	selected := make(map[int]bool)
+	for _, id := range filter.AmenityIDs {
+		selected[id] = true
+	}
+
 	data := make(map[string]interface{})
 	data["rooms"] = rooms
+	data["amenities"] = amenities
+	data["selected_amenities"] = selected
+	data["bed_types"] = models.BedTypes
 
 	res := models.Reservation{
 		StartDate: startDate,
 		EndDate:   endDate,
+		Adults:    adults,
+		Children:  children,
 	}
 
 	m.App.Session.Put(r.Context(), "reservation", res)
 
 	render.Template(w, r, "choose-room.page.tmpl", &models.TemplateData{
+		Form: form,
 		Data: data,
 	})
+}
+
+// alternativeOptions sets how far from the dates searched for other stays are suggested when no room is free
+var alternativeOptions = alternatives.Options{Days: 3, Max: 6}
 
-	w.Write([]byte(fmt.Sprintf("Posted to search availability %s to %s", start, end)))
+// findAlternatives suggests other stays for a party of guests when no room is free from start to end, keeping to
+// the rooms' stay rules
+func (m *Repository) findAlternatives(start, end dates.Date, guests int,
+	rules map[int][]models.StayRule) ([]alternatives.Alternative, error) {
+	all, err := m.DB.AllRooms(false)
+	if err != nil {
+		return nil, err
+	}
+
+	from, to := alternatives.Window(start, end, alternativeOptions)
+
+	var rooms []models.Room
+	days := make(map[int][]models.DayAvailability)
+	for _, room := range all {
+		if room.Retired || room.MaxOccupancy < guests {
+			continue
+		}
+
+		days[room.ID], err = m.DB.RoomAvailabilityByDay(room.ID, from, to)
+		if err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+
+	opts := alternativeOptions
+	opts.Allowed = func(room models.Room, s, e dates.Date) bool {
+		return len(stayrules.Check(rules[room.ID], s, e)) == 0
+	}
+
+	return alternatives.Find(start, end, rooms, days, m.today(), opts), nil
+}
+
+// today returns the date it is now at the property, the first date a stay can start on
+func (m *Repository) today() dates.Date {
+	return dates.Today(m.App.Now(), m.App.Location)
+}
+
+// stayRulesByRoom returns every room's stay rules, by room ID
+func (m *Repository) stayRulesByRoom() (map[int][]models.StayRule, error) {
+	all, err := m.DB.AllStayRules()
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make(map[int][]models.StayRule)
+	for _, rule := range all {
+		rules[rule.RoomID] = append(rules[rule.RoomID], rule)
+	}
+
+	return rules, nil
+}
+
+// brokenStayRules returns the messages of the stay rules of a room that a stay from start to end breaks
+func (m *Repository) brokenStayRules(roomID int, start, end dates.Date) ([]string, error) {
+	rules, err := m.DB.StayRulesByRoomID(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	return stayrules.Check(rules, start, end), nil
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// roomFilter builds a room filter from the filter fields of a search form. Prices are entered in the
+// guest's display currency and converted to the base currency.
+func (m *Repository) roomFilter(r *http.Request, form *forms.Form) models.RoomFilter {
+	var filter models.RoomFilter
+
+	for _, v := range form.Values["amenity"] {
+		id, err := strconv.Atoi(v)
+		if err == nil {
+			filter.AmenityIDs = append(filter.AmenityIDs, id)
+		}
+	}
+
+	for _, bedType := range models.BedTypes {
+		if strings.EqualFold(form.Get("bed_type"), bedType) {
+			filter.BedType = bedType
+		}
+	}
+
+	switch form.Get("sort") {
+	case models.RoomSortPriceAsc, models.RoomSortPriceDesc, models.RoomSortSizeAsc, models.RoomSortSizeDesc:
+		filter.Sort = form.Get("sort")
+	}
+
+	code := m.App.Session.GetString(r.Context(), "currency")
+	rate := m.App.Session.GetFloat(r.Context(), "exchange_rate")
+	if code == "" || rate <= 0 {
+		code = m.App.BaseCurrency
+		rate = 1
+	}
+
+	toBase := func(field string) int {
+		amount, err := currency.ParseAmount(form.Get(field), code)
+		if !form.Has(field) || err != nil || amount <= 0 {
+			return 0
+		}
+		return currency.Convert(amount, 1/rate, code, m.App.BaseCurrency)
+	}
+
+	filter.MinPrice = toBase("min_price")
+	filter.MaxPrice = toBase("max_price")
+
+	return filter
+}
+
+// Rooms lists every room that is available to book
+func (m *Repository) Rooms(w http.ResponseWriter, r *http.Request) {
+	rooms, err := m.DB.AllRooms(false)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["rooms"] = rooms
+
+	render.Template(w, r, "rooms.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
 }
 
-func (m *Repository) Generals(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "generals.page.tmpl", &models.TemplateData{})
+// Room renders the page of the room identified by the slug in the URL
+func (m *Repository) Room(w http.ResponseWriter, r *http.Request) {
+	room, err := m.DB.GetRoomBySlug(chi.URLParam(r, "slug"))
+	if errors.Is(err, repository.ErrNotFound) || (err == nil && room.Retired) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	today := m.today()
+
+	// the calendar shows the month in the query string, for browsers without JavaScript, or the current month
+	first, err := calendar.ParseMonth(r.URL.Query().Get("month"))
+	if err != nil || first.Before(calendar.FirstOfMonth(today)) {
+		first = calendar.FirstOfMonth(today)
+	}
+
+	start, end := calendar.Range(first)
+	days, err := m.DB.RoomAvailabilityByDay(room.ID, start, end)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["room"] = room
+	data["calendar"] = calendar.New(first, days, today)
+
+	render.Template(w, r, "room.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
 }
-func (m *Repository) Majors(w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "majors.page.tmpl", &models.TemplateData{})
+
+// maxCalendarDays is the longest range of dates RoomAvailability returns
+const maxCalendarDays = 366
+
+type calendarDay struct {
+	Date      string `json:"date"`
+	Available bool   `json:"available"`
+}
+
+type calendarResponse struct {
+	OK        bool          `json:"ok"`
+	Message   string        `json:"message,omitempty"`
+	RoomID    int           `json:"room_id,omitempty"`
+	StartDate string        `json:"start_date,omitempty"`
+	EndDate   string        `json:"end_date,omitempty"`
+	Days      []calendarDay `json:"days,omitempty"`
+}
+
+// RoomAvailability returns whether the room identified by the slug in the URL is free on each night of a month,
+// given as month=2006-01, or from start up to, but not including, end. It defaults to the current month. Past
+// nights are never free. The date pickers use it to disable the dates that can't be booked
+func (m *Repository) RoomAvailability(w http.ResponseWriter, r *http.Request) {
+	room, err := m.DB.GetRoomBySlug(chi.URLParam(r, "slug"))
+	if errors.Is(err, repository.ErrNotFound) || (err == nil && room.Retired) {
+		writeCalendarJSON(w, http.StatusNotFound, calendarResponse{Message: "Unknown room."})
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	today := m.today()
+
+	start, end, err := calendarDates(r.URL.Query(), today)
+	if err != nil {
+		writeCalendarJSON(w, http.StatusBadRequest, calendarResponse{Message: err.Error()})
+		return
+	}
+
+	days, err := m.DB.RoomAvailabilityByDay(room.ID, start, end)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	resp := calendarResponse{
+		OK:        true,
+		RoomID:    room.ID,
+		StartDate: start.String(),
+		EndDate:   end.String(),
+		Days:      make([]calendarDay, 0, len(days)),
+	}
+	for _, d := range days {
+		resp.Days = append(resp.Days, calendarDay{
+			Date:      d.Date.String(),
+			Available: d.Available && !d.Date.Before(today),
+		})
+	}
+
+	writeCalendarJSON(w, http.StatusOK, resp)
+}
+
+// calendarDates reads the range of dates asked of RoomAvailability from its query string
+func calendarDates(q url.Values, today dates.Date) (dates.Date, dates.Date, error) {
+	switch {
+	case q.Get("month") != "":
+		first, err := calendar.ParseMonth(q.Get("month"))
+		if err != nil {
+			return first, first, errors.New("Invalid month, expected YYYY-MM.")
+		}
+		return first, first.AddDate(0, 1, 0), nil
+
+	case q.Get("start") != "" || q.Get("end") != "":
+		start, err := dates.Parse(q.Get("start"))
+		if err != nil {
+			return start, start, errors.New("Invalid start date, expected YYYY-MM-DD.")
+		}
+		end, err := dates.Parse(q.Get("end"))
+		if err != nil {
+			return start, end, errors.New("Invalid end date, expected YYYY-MM-DD.")
+		}
+		if !end.After(start) {
+			return start, end, errors.New("The end date must be after the start date.")
+		}
+		if end.Sub(start) > maxCalendarDays {
+			return start, end, fmt.Errorf("At most %d days can be asked for at once.", maxCalendarDays)
+		}
+		return start, end, nil
+	}
+
+	first := calendar.FirstOfMonth(today)
+
+	return first, first.AddDate(0, 1, 0), nil
+}
+
+// writeCalendarJSON writes a RoomAvailability response
+func writeCalendarJSON(w http.ResponseWriter, status int, resp calendarResponse) {
+	js, _ := json.Marshal(resp)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
 }
 
 // Reservation gets the roomID, startDate, endDate from the session and renders the make-reservation page
@@ -205,23 +670,29 @@ func (m *Repository) Reservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	room, err := m.DB.GetRoomByID(res.RoomID)
+	room, err := m.bookableRoom(res.RoomID)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "No such room ID!")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 		return
 	}
 
-	res.Room.RoomName = room.RoomName
+	res.Room = bookedRoom(room)
 
 	m.App.Session.Put(r.Context(), "reservation", res)
 
-	sd := res.StartDate.Format("2006-01-02")
-	ed := res.EndDate.Format("2006-01-02")
+	sd := res.StartDate.String()
+	ed := res.EndDate.String()
 
 	stringMap := make(map[string]string)
 	stringMap["start_date"] = sd
 	stringMap["end_date"] = ed
+	// submitting the form more than once with this token makes a single reservation
+	stringMap["idempotency_key"] = randomToken()
+	m.addStayTimes(stringMap, res)
+
+	intMap := make(map[string]int)
+	intMap["total"] = res.Total()
 
 	data := make(map[string]interface{})
 	data["reservation"] = res
@@ -230,6 +701,7 @@ func (m *Repository) Reservation(w http.ResponseWriter, r *http.Request) {
 		Form:      forms.New(nil),
 		Data:      data,
 		StringMap: stringMap,
+		IntMap:    intMap,
 	})
 }
 func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
@@ -252,61 +724,209 @@ func (m *Repository) PostReservation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the reservation may have been left in the session since an earlier day, so its dates are checked as a search's are
+	stay := forms.New(url.Values{"start": {reservation.StartDate.String()}, "end": {reservation.EndDate.String()}})
+	stay.Stay("start", "end", m.today())
+	if !stay.Valid() {
+		m.App.Session.Put(r.Context(), "error", "Invalid dates, please search again")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
+	room, err := m.bookableRoom(reservation.RoomID)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "No such room ID!")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
 	reservation.FirstName = r.Form.Get("first_name")
 	reservation.LastName = r.Form.Get("last_name")
 	reservation.Phone = r.Form.Get("phone")
 	reservation.Email = r.Form.Get("email")
+	reservation.Room = bookedRoom(room)
 
 	// form contains the error msgs for each field (if exists)
 	form := forms.New(r.PostForm)
 
+	// guests chosen when searching are kept unless the form changes them
+	if !form.Has("adults") && reservation.Adults > 0 {
+		form.Set("adults", strconv.Itoa(reservation.Adults))
+		form.Set("children", strconv.Itoa(reservation.Children))
+	}
+
 	form.Required("first_name", "last_name", "email")
 	form.MinLength("first_name", 3)
 	form.IsEmail("email")
+	reservation.Adults, reservation.Children = guestCounts(form)
+
+	if form.Valid() && reservation.Guests() > room.MaxOccupancy {
+		form.Errors.Add("adults", fmt.Sprintf("This room sleeps at most %d guests", room.MaxOccupancy))
+	}
+
+	broken, err := m.brokenStayRules(room.ID, reservation.StartDate, reservation.EndDate)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	for _, msg := range broken {
+		form.Errors.Add("dates", msg)
+	}
+
+	// add-ons are only taken in rooms that offer them
+	reservation.EarlyCheckIn = room.EarlyCheckInPrice > 0 && form.Has("early_check_in")
+	reservation.LateCheckOut = room.LateCheckOutPrice > 0 && form.Has("late_check_out")
 
 	if !form.Valid() {
+		m.renderReservationForm(w, r, form, reservation)
+		return
+	}
 
-		data := make(map[string]interface{})
-		data["reservation"] = reservation
-		render.Template(w, r, "make-reservation.page.tmpl", &models.TemplateData{
-			Form: form,
-			Data: data,
-		})
+	// tokens are kept to the guest's session, so without one the form isn't protected from being sent twice
+	token := form.Get("idempotency_key")
+	if len(token) > maxIdempotencyKeyLength || m.webIdempotencyScope(r) == "" {
+		token = ""
+	}
+	if token != "" && !m.claimBookingToken(w, r, token, bookingRequestHash(r, reservation)) {
 		return
 	}
 
-	newReservationID, err := m.DB.InsertReservation(reservation)
+	// the token is released on every way out but a booking, including a panic, so that the guest can send the
+	// form again
+	booked := false
+	defer func() { m.completeBookingToken(r, token, reservation, booked) }()
+
+	// the nights are checked once the token is claimed, so that a repeated submission is answered with the
+	// booking it made rather than told the room is taken
+	err = m.checkNights(form, reservation)
 	if err != nil {
-		log.Println("ca't insert res")
+		helpers.ServerError(w, err)
+		return
+	}
+	if !form.Valid() {
+		m.renderReservationForm(w, r, form, reservation)
+		return
+	}
 
+	reservation.Code = helpers.NewReservationCode()
+
+	payment := m.paymentFor(r, reservation.Total())
+
+	_, err = m.DB.CreateBooking(reservation, payment)
+	if errors.Is(err, repository.ErrUnavailable) {
+		// another guest booked the room since its nights were checked
+		m.App.Session.Put(r.Context(), "error", "This room is no longer available on these dates, please search again")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		m.App.ErrorLog.Println(err)
 		m.App.Session.Put(r.Context(), "error", "Error inserting reservation!")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 		return
 	}
 
+	booked = true
+
+	// requires gob.Register(models.Reservation) - see main.go
 	m.App.Session.Put(r.Context(), "reservation", reservation)
 
-	restriction := models.RoomRestriction{
-		StartDate:     reservation.StartDate,
-		EndDate:       reservation.EndDate,
-		RoomID:        reservation.RoomID,
-		ReservationID: newReservationID,
-		RestrictionID: 1,
+	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+}
+
+// bookableRoom returns the room with id when guests can book it, or repository.ErrNotFound when it doesn't exist
+// or has been retired
+func (m *Repository) bookableRoom(id int) (models.Room, error) {
+	room, err := m.DB.GetRoomByID(id)
+	if err != nil {
+		return room, err
+	}
+	if room.Retired {
+		return models.Room{}, repository.ErrNotFound
+	}
+	return room, nil
+}
+
+// stayTimeLayout is how check-in and check-out times are shown to guests
+const stayTimeLayout = "Mon 2 Jan 2006, 15:04"
+
+// bookedRoom returns the details of a room kept with a reservation in the session: what its nights and add-ons
+// cost and when guests arrive and leave
+func bookedRoom(room models.Room) models.Room {
+	return models.Room{
+		ID:                room.ID,
+		RoomName:          room.RoomName,
+		Price:             room.Price,
+		MaxOccupancy:      room.MaxOccupancy,
+		CheckInTime:       room.CheckInTime,
+		CheckOutTime:      room.CheckOutTime,
+		EarlyCheckInPrice: room.EarlyCheckInPrice,
+		LateCheckOutPrice: room.LateCheckOutPrice,
+		TurnoverDays:      room.TurnoverDays,
 	}
+}
+
+// addStayTimes adds when the guests of res can check in and must check out, at the property, to stringMap
+func (m *Repository) addStayTimes(stringMap map[string]string, res models.Reservation) {
+	stringMap["check_in"] = res.CheckIn(m.App.Location).Format(stayTimeLayout)
+	stringMap["check_out"] = res.CheckOut(m.App.Location).Format(stayTimeLayout)
+}
 
-	err = m.DB.InsertRoomRestriction(restriction)
+// checkNights adds errors to form for the nights res needs that the room isn't free for. The session can outlive
+// the search that found the room free, so the stay's own nights are checked again, as well as the night before it
+// for early check-in and the night it ends for late check-out
+func (m *Repository) checkNights(form *forms.Form, res models.Reservation) error {
+	free, err := m.DB.SearchAvailabilityByDatesByRoomID(res.StartDate, res.EndDate, res.RoomID)
 	if err != nil {
-		log.Println("can't insert restriction")
+		return err
+	}
+	if !free {
+		form.Errors.Add("dates", "This room is no longer available on these dates")
+	}
 
-		m.App.Session.Put(r.Context(), "error", "Error inserting room restriction!")
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-		return
+	if res.EarlyCheckIn {
+		free, err := m.DB.SearchAvailabilityByDatesByRoomID(res.StartDate.AddDate(0, 0, -1), res.StartDate, res.RoomID)
+		if err != nil {
+			return err
+		}
+		if !free {
+			form.Errors.Add("early_check_in", "Early check-in isn't available on these dates")
+		}
 	}
 
-	// requires gob.Register(models.Reservation) - see main.go
-	m.App.Session.Put(r.Context(), "reservation", reservation)
+	if res.LateCheckOut {
+		free, err := m.DB.SearchAvailabilityByDatesByRoomID(res.EndDate, res.EndDate.AddDate(0, 0, 1), res.RoomID)
+		if err != nil {
+			return err
+		}
+		if !free {
+			form.Errors.Add("late_check_out", "Late check-out isn't available on these dates")
+		}
+	}
 
-	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+	return nil
+}
+
+// renderReservationForm shows the make-reservation page again for res, with the errors in form
+func (m *Repository) renderReservationForm(w http.ResponseWriter, r *http.Request, form *forms.Form, res models.Reservation) {
+	data := make(map[string]interface{})
+	data["reservation"] = res
+
+	stringMap := make(map[string]string)
+	stringMap["start_date"] = res.StartDate.String()
+	stringMap["end_date"] = res.EndDate.String()
+	stringMap["idempotency_key"] = form.Get("idempotency_key")
+	m.addStayTimes(stringMap, res)
+
+	intMap := make(map[string]int)
+	intMap["total"] = res.Total()
+
+	render.Template(w, r, "make-reservation.page.tmpl", &models.TemplateData{
+		Form:      form,
+		Data:      data,
+		StringMap: stringMap,
+		IntMap:    intMap,
+	})
 }
 
 // ReservationSummary displays the user's reservation as a confirmation after booking
@@ -325,16 +945,21 @@ func (m *Repository) ReservationSummary(w http.ResponseWriter, r *http.Request)
 	data := make(map[string]interface{})
 	data["reservation"] = reservation
 
-	sd := reservation.StartDate.Format("2006-01-02")
-	ed := reservation.EndDate.Format("2006-01-02")
+	sd := reservation.StartDate.String()
+	ed := reservation.EndDate.String()
 
 	stringMap := make(map[string]string)
 	stringMap["start_date"] = sd
 	stringMap["end_date"] = ed
+	m.addStayTimes(stringMap, reservation)
+
+	intMap := make(map[string]int)
+	intMap["total"] = reservation.Total()
 
 	render.Template(w, r, "reservation-summary.page.tmpl", &models.TemplateData{
 		Data:      data,
 		StringMap: stringMap,
+		IntMap:    intMap,
 	})
 }
 
@@ -353,6 +978,17 @@ func (m *Repository) ChooseRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	_, err = m.bookableRoom(roomID)
+	if errors.Is(err, repository.ErrNotFound) {
+		m.App.Session.Put(r.Context(), "error", "That room can't be booked, please search again")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
 	res.RoomID = roomID
 
 	m.App.Session.Put(r.Context(), "reservation", res)
@@ -363,14 +999,30 @@ func (m *Repository) ChooseRoom(w http.ResponseWriter, r *http.Request) {
 // BookRoom takes URL params, builds a sessional vairable, and takes user to make reservation screen
 func (m *Repository) BookRoom(w http.ResponseWriter, r *http.Request) {
 	roomID, _ := strconv.Atoi(r.URL.Query().Get("id"))
-	sd := r.URL.Query().Get("s")
-	ed := r.URL.Query().Get("e")
+	form := forms.New(url.Values{"s": {r.URL.Query().Get("s")}, "e": {r.URL.Query().Get("e")}})
+	form.Required("s", "e")
+	startDate, endDate := form.Stay("s", "e", m.today())
+	if !form.Valid() {
+		m.App.Session.Put(r.Context(), "error", "Invalid dates, please search again")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
 
-	layout := "2006-01-02"
-	startDate, _ := time.Parse(layout, sd)
-	endDate, _ := time.Parse(layout, ed)
+	adults, _ := strconv.Atoi(r.URL.Query().Get("a"))
+	children, _ := strconv.Atoi(r.URL.Query().Get("c"))
+	if adults < 1 {
+		adults = 1
+	}
+	if children < 0 {
+		children = 0
+	}
 
-	room, err := m.DB.GetRoomByID(roomID)
+	room, err := m.bookableRoom(roomID)
+	if errors.Is(err, repository.ErrNotFound) {
+		m.App.Session.Put(r.Context(), "error", "That room can't be booked, please search again")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
@@ -379,11 +1031,152 @@ func (m *Repository) BookRoom(w http.ResponseWriter, r *http.Request) {
 	var res models.Reservation
 
 	res.Room.RoomName = room.RoomName
+	res.Room.Price = room.Price
 	res.RoomID = roomID
 	res.StartDate = startDate
 	res.EndDate = endDate
+	res.Adults = adults
+	res.Children = children
 
 	m.App.Session.Put(r.Context(), "reservation", res)
 
 	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
 }
+
+// paymentFor builds the payment for a reservation total given in the base currency, charging it in the
+// guest's selected currency at the currently stored exchange rate
+func (m *Repository) paymentFor(r *http.Request, baseAmount int) models.Payment {
+	payment := models.Payment{
+		Amount:       baseAmount,
+		Currency:     m.App.BaseCurrency,
+		BaseAmount:   baseAmount,
+		BaseCurrency: m.App.BaseCurrency,
+		ExchangeRate: 1,
+	}
+
+	code := m.App.Session.GetString(r.Context(), "currency")
+	if code == "" || code == m.App.BaseCurrency {
+		return payment
+	}
+
+	rate, err := m.DB.GetExchangeRate(code)
+	if err != nil {
+		// the rate has been removed since the guest selected it, so charge in the base currency
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Remove(r.Context(), "currency")
+		m.App.Session.Remove(r.Context(), "exchange_rate")
+		return payment
+	}
+
+	// keep the displayed price in line with what was charged
+	m.App.Session.Put(r.Context(), "exchange_rate", rate.Rate)
+
+	payment.Currency = rate.Currency
+	payment.ExchangeRate = rate.Rate
+	payment.Amount = currency.Convert(baseAmount, rate.Rate, m.App.BaseCurrency, rate.Currency)
+
+	return payment
+}
+
+// SetCurrency stores the guest's display currency in the session and redirects back
+func (m *Repository) SetCurrency(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	redirect := refererPath(r)
+
+	code := strings.ToUpper(r.Form.Get("currency"))
+
+	if code == "" || code == m.App.BaseCurrency {
+		m.App.Session.Remove(r.Context(), "currency")
+		m.App.Session.Remove(r.Context(), "exchange_rate")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	rate, err := m.DB.GetExchangeRate(code)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Prices are not available in "+code)
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "currency", rate.Currency)
+	m.App.Session.Put(r.Context(), "exchange_rate", rate.Rate)
+
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// refererPath returns the path of the page the request came from, or "/" when the Referer is missing or another site,
+// so that redirecting back to it can't send the guest off the site
+func refererPath(r *http.Request) string {
+	u, err := url.Parse(r.Referer())
+	if err != nil || (u.Host != "" && u.Host != r.Host) || (u.Scheme != "" && u.Host == "") {
+		return "/"
+	}
+
+	// a path starting with // or /\ is read by browsers as another host
+	if !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(u.Path, "//") || strings.HasPrefix(u.Path, "/\\") {
+		return "/"
+	}
+
+	if u.RawQuery != "" {
+		return u.EscapedPath() + "?" + u.RawQuery
+	}
+	return u.EscapedPath()
+}
+
+// ShowLogin renders the login page
+func (m *Repository) ShowLogin(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "login.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostShowLogin logs the user in
+func (m *Repository) PostShowLogin(w http.ResponseWriter, r *http.Request) {
+	// prevents session fixation attacks
+	_ = m.App.Session.RenewToken(r.Context())
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	email := r.Form.Get("email")
+	password := r.Form.Get("password")
+
+	form := forms.New(r.PostForm)
+	form.Required("email", "password")
+	form.IsEmail("email")
+
+	if !form.Valid() {
+		render.Template(w, r, "login.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	id, _, err := m.DB.Authenticate(email, password)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid login credentials")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "user_id", id)
+	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Logout logs the user out
+func (m *Repository) Logout(w http.ResponseWriter, r *http.Request) {
+	_ = m.App.Session.Destroy(r.Context())
+	_ = m.App.Session.RenewToken(r.Context())
+
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
@@ -1,17 +1,40 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"image"
+	"image/png"
+	"io"
+	"io/fs"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
+	_ "time/tzdata"
 
+	"github.com/ashrielbrian/go_bookings/internal/apikeys"
+	"github.com/ashrielbrian/go_bookings/internal/clock"
+	"github.com/ashrielbrian/go_bookings/internal/dates"
+	"github.com/ashrielbrian/go_bookings/internal/events"
 	"github.com/ashrielbrian/go_bookings/internal/models"
+	"github.com/ashrielbrian/go_bookings/internal/repository"
+	"github.com/ashrielbrian/go_bookings/internal/repository/cache"
+	"github.com/ashrielbrian/go_bookings/internal/repository/dbrepo"
+	"github.com/ashrielbrian/go_bookings/internal/storage"
+	"github.com/ashrielbrian/go_bookings/internal/webhooks"
+	"github.com/go-chi/chi/v5"
 )
 
 type postData struct {
@@ -27,13 +50,32 @@ var theTests = []struct {
 }{
 	{"home", "/", "GET", http.StatusOK},
 	{"about", "/about", "GET", http.StatusOK},
-	{"gq", "/generals-quarters", "GET", http.StatusOK},
-	{"ms", "/majors-suite", "GET", http.StatusOK},
+	{"rooms", "/rooms", "GET", http.StatusOK},
+	{"gq", "/rooms/generals-quarters", "GET", http.StatusOK},
+	{"ms", "/rooms/majors-suite", "GET", http.StatusOK},
+	{"unknown room", "/rooms/no-such-room", "GET", http.StatusNotFound},
+	{"gq in a later month", "/rooms/generals-quarters?month=2099-01", "GET", http.StatusOK},
+	{"gq in an invalid month", "/rooms/generals-quarters?month=soon", "GET", http.StatusOK},
+	{"gq availability", "/rooms/generals-quarters/availability", "GET", http.StatusOK},
+	{"unknown room availability", "/rooms/no-such-room/availability", "GET", http.StatusNotFound},
 	{"sa", "/search-availability", "GET", http.StatusOK},
 	{"contact", "/contact", "GET", http.StatusOK},
+	{"login", "/user/login", "GET", http.StatusOK},
+	{"logout", "/user/logout", "GET", http.StatusOK},
+	{"exchange rates", "/admin/exchange-rates", "GET", http.StatusOK},
+	{"admin rooms", "/admin/rooms", "GET", http.StatusOK},
+	{"admin new room", "/admin/rooms/new", "GET", http.StatusOK},
+	{"admin room", "/admin/rooms/1", "GET", http.StatusOK},
+	{"admin unknown room", "/admin/rooms/100", "GET", http.StatusNotFound},
+	{"admin api keys", "/admin/api-keys", "GET", http.StatusOK},
+	{"admin webhooks", "/admin/webhooks", "GET", http.StatusOK},
+	{"admin cache disabled", "/admin/cache", "GET", http.StatusNotFound},
+	{"openapi", "/api/openapi.json", "GET", http.StatusOK},
 }
 
 func TestHandlers(t *testing.T) {
+	newTestDB(t)
+
 	routes := getRoutes()
 	ts := httptest.NewTLSServer(routes)
 	defer ts.Close()
@@ -52,10 +94,10 @@ func TestHandlers(t *testing.T) {
 }
 
 func TestRepository_Reservation(t *testing.T) {
-	layout := "2006-01-02"
+	newTestDB(t)
 
-	sd, _ := time.Parse(layout, "2022-01-01")
-	ed, _ := time.Parse(layout, "2022-01-05")
+	sd, _ := dates.Parse("2050-01-01")
+	ed, _ := dates.Parse("2050-01-05")
 	var res = models.Reservation{
 		RoomID: 1,
 		Room: models.Room{
@@ -111,10 +153,10 @@ func TestRepository_Reservation(t *testing.T) {
 }
 
 func TestRepository_PostReservation(t *testing.T) {
-	layout := "2006-01-02"
+	db := newTestDB(t)
 
-	sd, _ := time.Parse(layout, "2022-01-01")
-	ed, _ := time.Parse(layout, "2022-01-05")
+	sd, _ := dates.Parse("2050-01-01")
+	ed, _ := dates.Parse("2050-01-05")
 
 	var res = models.Reservation{
 
@@ -183,7 +225,7 @@ func TestRepository_PostReservation(t *testing.T) {
 		t.Errorf("PostReservation expected status code %d due to invalid form, got %d", http.StatusOK, rr.Code)
 	}
 
-	// test case with failed reservation by setting a large roomID
+	// test case with an unknown room
 	postedData.Add("first_name", "John")
 	res.RoomID = 1000
 	rr = httptest.NewRecorder()
@@ -199,9 +241,11 @@ func TestRepository_PostReservation(t *testing.T) {
 		t.Errorf("PostReservation expected status code %d due to failed reservation, got %d", http.StatusTemporaryRedirect, rr.Code)
 	}
 
-	// test case with a failed room restriction insertion by setting the StartDate to be an incorrect value
+	// test case with the booking failing to be saved, on nights that are still free
+	db.Fail("CreateBooking", errors.New("connection reset"))
 	res.RoomID = 1
-	res.StartDate, _ = time.Parse("2006-01-02", "1970-01-01")
+	res.StartDate, _ = dates.Parse("2050-02-01")
+	res.EndDate, _ = dates.Parse("2050-02-05")
 
 	rr = httptest.NewRecorder()
 	req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
@@ -213,16 +257,18 @@ func TestRepository_PostReservation(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 	if rr.Code != http.StatusTemporaryRedirect {
-		t.Errorf("PostReservation expected status code %d due to failed restriction, got %d", http.StatusTemporaryRedirect, rr.Code)
+		t.Errorf("PostReservation expected status code %d due to failed booking, got %d", http.StatusTemporaryRedirect, rr.Code)
 	}
 
 }
 
 func TestRepository_AvailabilityJSON(t *testing.T) {
+	newTestDB(t)
+
 	postedData := url.Values{}
 
-	postedData.Add("start", "2022-01-01")
-	postedData.Add("end", "2022-01-09")
+	postedData.Add("start", "2050-01-01")
+	postedData.Add("end", "2050-01-09")
 	postedData.Add("room_id", "1")
 
 	rr := httptest.NewRecorder()
@@ -257,7 +303,7 @@ func TestRepository_AvailabilityJSON(t *testing.T) {
 	}
 
 	// test invalid end date
-	postedData.Set("start", "2022-01-01")
+	postedData.Set("start", "2050-01-01")
 	postedData.Set("end", "invalid")
 	rr = httptest.NewRecorder()
 	req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
@@ -289,12 +335,2089 @@ func TestRepository_AvailabilityJSON(t *testing.T) {
 
 }
 
-func getCtx(r *http.Request) context.Context {
-	ctx, err := session.Load(r.Context(), r.Header.Get("X-Session"))
+func TestRepository_PostAvailability(t *testing.T) {
+	newTestDB(t)
+
+	var tests = []struct {
+		name             string
+		adults           string
+		children         string
+		expectedCode     int
+		expectedLocation string
+	}{
+		{"valid search", "2", "1", http.StatusSeeOther,
+			"/search-availability/results?adults=2&children=1&end=2050-01-03&start=2050-01-01"},
+		{"no adults", "0", "1", http.StatusOK, ""},
+		{"invalid children", "2", "some", http.StatusOK, ""},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("start", "2050-01-01")
+		postedData.Add("end", "2050-01-03")
+		postedData.Add("adults", e.adults)
+		postedData.Add("children", e.children)
+
+		req, _ := http.NewRequest("POST", "/search-availability", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.PostAvailability)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d, got %d", e.name, e.expectedCode, rr.Code)
+		}
+
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %s, got %s", e.name, e.expectedLocation, loc)
+		}
+	}
+}
+
+func TestRepository_PastDates(t *testing.T) {
+	newTestDB(t)
+
+	// at 20:00 UTC on 31 December 2049 it is already 1 January 2050 at a property on Kiritimati, so a stay
+	// starting on the UTC date is in the past there
+	loc, err := time.LoadLocation("Pacific/Kiritimati")
 	if err != nil {
-		log.Println(err)
-		return nil
+		t.Fatal(err)
+	}
+	defer func(saved *time.Location, c clock.Clock) { app.Location, app.Clock = saved, c }(app.Location, app.Clock)
+	app.Location = loc
+	app.Clock = clock.NewFake(time.Date(2049, 12, 31, 20, 0, 0, 0, time.UTC))
+
+	today := dates.New(2050, 1, 1)
+
+	var tests = []struct {
+		name  string
+		start dates.Date
+		valid bool
+	}{
+		{"today at the property", today, true},
+		{"yesterday at the property", today.AddDate(0, 0, -1), false},
 	}
 
-	return ctx
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("start", e.start.String())
+		postedData.Add("end", e.start.AddDate(0, 0, 2).String())
+		postedData.Add("adults", "1")
+
+		req, _ := http.NewRequest("POST", "/search-availability", strings.NewReader(postedData.Encode()))
+		req = req.WithContext(getCtx(req))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.PostAvailability).ServeHTTP(rr, req)
+
+		if valid := rr.Code == http.StatusSeeOther; valid != e.valid {
+			t.Errorf("%s: expected the search to be valid %v, got status code %d", e.name, e.valid, rr.Code)
+		}
+
+		req, _ = http.NewRequest("GET", "/search-availability/results?"+postedData.Encode(), nil)
+		req = req.WithContext(getCtx(req))
+		rr = httptest.NewRecorder()
+		http.HandlerFunc(Repo.AvailabilityResults).ServeHTTP(rr, req)
+
+		if loc := rr.Header().Get("Location"); (loc == "/search-availability") == e.valid {
+			t.Errorf("%s: expected the results to be shown %v, got status code %d", e.name, e.valid, rr.Code)
+		}
+
+		postedData.Add("room_id", "1")
+		req, _ = http.NewRequest("POST", "/search-availability-json", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr = httptest.NewRecorder()
+		http.HandlerFunc(Repo.AvailabilityJSON).ServeHTTP(rr, req)
+
+		var body jsonResponse
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		if body.OK != e.valid {
+			t.Errorf("%s: expected availability %v, got %q", e.name, e.valid, body.Message)
+		}
+
+		// a reservation left in the session can't be booked once its arrival has passed
+		bookingData := url.Values{}
+		bookingData.Add("first_name", "John")
+		bookingData.Add("last_name", "Smith")
+		bookingData.Add("email", "j@smith.com")
+
+		req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(bookingData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		session.Put(ctx, "reservation", models.Reservation{RoomID: 1, StartDate: e.start, EndDate: e.start.AddDate(0, 0, 2)})
+		rr = httptest.NewRecorder()
+		http.HandlerFunc(Repo.PostReservation).ServeHTTP(rr, req)
+
+		if loc := rr.Header().Get("Location"); (loc == "/reservation-summary") != e.valid {
+			t.Errorf("%s: expected the reservation to be made %v, got status code %d to %q", e.name, e.valid, rr.Code, loc)
+		}
+	}
+}
+
+func TestRepository_AvailabilityResults(t *testing.T) {
+	newTestDB(t)
+
+	var tests = []struct {
+		name          string
+		query         string
+		expectedCode  int
+		expectedRooms []string
+	}{
+		{"rooms for party", "adults=2&children=0", http.StatusOK, []string{"General's Quarters", "Major's Suite"}},
+		{"large party", "adults=3&children=1", http.StatusOK, []string{"Major's Suite"}},
+		{"no room large enough", "adults=4&children=2", http.StatusSeeOther, nil},
+		{"amenity", "adults=1&amenity=1", http.StatusOK, []string{"General's Quarters"}},
+		{"no room matches filters", "adults=1&amenity=1&amenity=2", http.StatusOK, nil},
+		{"bed type", "adults=1&bed_type=king", http.StatusOK, []string{"Major's Suite"}},
+		{"max price", "adults=1&max_price=120", http.StatusOK, []string{"General's Quarters"}},
+		{"min price", "adults=1&min_price=120", http.StatusOK, []string{"Major's Suite"}},
+		{"sort by size", "adults=1&sort=size_desc", http.StatusOK, []string{"Major's Suite", "General's Quarters"}},
+		{"invalid guests", "adults=0", http.StatusSeeOther, nil},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/search-availability/results?start=2050-01-01&end=2050-01-03&"+e.query, nil)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.AvailabilityResults)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d, got %d", e.name, e.expectedCode, rr.Code)
+		}
+
+		if rr.Code != http.StatusOK {
+			continue
+		}
+
+		body := rr.Body.String()
+		last := -1
+		for _, name := range e.expectedRooms {
+			i := strings.Index(body, template.HTMLEscapeString(name))
+			if i < 0 {
+				t.Errorf("%s: expected %s in results", e.name, name)
+			} else if i < last {
+				t.Errorf("%s: expected %s to come later in results", e.name, name)
+			}
+			last = i
+		}
+
+		if len(e.expectedRooms) == 0 && !strings.Contains(body, "No rooms match your filters") {
+			t.Errorf("%s: expected no rooms to match", e.name)
+		}
+	}
+}
+
+func TestRepository_PostReservationGuests(t *testing.T) {
+	newTestDB(t)
+
+	sd, _ := dates.Parse("2050-01-01")
+	ed, _ := dates.Parse("2050-01-03")
+
+	var tests = []struct {
+		name         string
+		adults       string
+		children     string
+		expectedCode int
+	}{
+		{"party fits", "1", "1", http.StatusSeeOther},
+		{"party too large", "2", "1", http.StatusOK},
+		{"no adults", "0", "0", http.StatusOK},
+	}
+
+	for _, e := range tests {
+		res := models.Reservation{RoomID: 1, StartDate: sd, EndDate: ed}
+
+		postedData := url.Values{}
+		postedData.Add("first_name", "John")
+		postedData.Add("last_name", "Smith")
+		postedData.Add("email", "j@smith.com")
+		postedData.Add("adults", e.adults)
+		postedData.Add("children", e.children)
+
+		req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		session.Put(ctx, "reservation", res)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.PostReservation)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d, got %d", e.name, e.expectedCode, rr.Code)
+		}
+	}
+}
+
+func TestRepository_AvailabilityJSONDatabaseError(t *testing.T) {
+	mem := dbrepo.NewMemoryRepo(&app)
+
+	roomID, err := mem.InsertRoom(models.Room{RoomName: "General's Quarters", Slug: "generals-quarters", MaxOccupancy: 2, Price: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := Repo
+	NewHandlers(&Repository{App: &app, DB: mem})
+	defer NewHandlers(saved)
+
+	mem.Fail("SearchAvailabilityByDatesByRoomID", errors.New("connection reset"))
+
+	postedData := url.Values{}
+	postedData.Add("start", "2050-01-01")
+	postedData.Add("end", "2050-01-03")
+	postedData.Add("room_id", strconv.Itoa(roomID))
+
+	req, _ := http.NewRequest("POST", "/search-availability-json", strings.NewReader(postedData.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.AvailabilityJSON).ServeHTTP(rr, req)
+
+	var body jsonResponse
+	json.Unmarshal(rr.Body.Bytes(), &body)
+
+	expected := "Error querying database."
+	if body.OK || body.Message != expected {
+		t.Errorf("expected an error with %q, got %+v", expected, body)
+	}
+}
+
+func TestRepository_AvailabilityJSONGuests(t *testing.T) {
+	newTestDB(t)
+
+	postedData := url.Values{}
+	postedData.Add("start", "2050-01-01")
+	postedData.Add("end", "2050-01-03")
+	postedData.Add("room_id", "1")
+	postedData.Add("adults", "3")
+
+	req, _ := http.NewRequest("POST", "/search-availability-json", strings.NewReader(postedData.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(Repo.AvailabilityJSON)
+	handler.ServeHTTP(rr, req)
+
+	var body jsonResponse
+	json.Unmarshal(rr.Body.Bytes(), &body)
+
+	expected := "This room sleeps at most 2 guests."
+	if body.OK || body.Message != expected {
+		t.Errorf("expected unavailable with message `%s`, got ok=%v `%s`", expected, body.OK, body.Message)
+	}
+}
+
+func TestRepository_SetCurrencyRedirect(t *testing.T) {
+	newTestDB(t)
+
+	var tests = []struct {
+		name     string
+		referer  string
+		expected string
+	}{
+		{"no referer", "", "/"},
+		{"path", "/rooms?adults=2", "/rooms?adults=2"},
+		{"same host", "http://example.com/about", "/about"},
+		{"other host", "https://evil.example/about", "/"},
+		{"protocol relative", "//evil.example/about", "/"},
+		{"backslash", "/\\evil.example/about", "/"},
+		{"javascript", "javascript:alert(1)", "/"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "http://example.com/set-currency", strings.NewReader("currency=USD"))
+		req = req.WithContext(getCtx(req))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Referer", e.referer)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.SetCurrency).ServeHTTP(rr, req)
+
+		if loc := rr.Header().Get("Location"); loc != e.expected {
+			t.Errorf("%s: expected redirect to %s, got %s", e.name, e.expected, loc)
+		}
+	}
+}
+
+func TestRepository_SetCurrency(t *testing.T) {
+	newTestDB(t)
+
+	var tests = []struct {
+		name             string
+		currency         string
+		expectedCurrency string
+	}{
+		{"known currency", "eur", "EUR"},
+		{"base currency", "USD", ""},
+		{"no exchange rate", "JPY", ""},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("currency", e.currency)
+
+		req, _ := http.NewRequest("POST", "/set-currency", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Referer", "/about")
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.SetCurrency)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status code %d, got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+
+		if loc := rr.Header().Get("Location"); loc != "/about" {
+			t.Errorf("%s: expected redirect to /about, got %s", e.name, loc)
+		}
+
+		if got := session.GetString(ctx, "currency"); got != e.expectedCurrency {
+			t.Errorf("%s: expected session currency %q, got %q", e.name, e.expectedCurrency, got)
+		}
+	}
+}
+
+func TestRepository_PaymentFor(t *testing.T) {
+	newTestDB(t)
+
+	req, _ := http.NewRequest("POST", "/make-reservation", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+
+	payment := Repo.paymentFor(req, 20000)
+	if payment.Currency != "USD" || payment.Amount != 20000 || payment.ExchangeRate != 1 {
+		t.Errorf("expected base currency payment, got %+v", payment)
+	}
+
+	session.Put(ctx, "currency", "EUR")
+	session.Put(ctx, "exchange_rate", 0.5)
+
+	payment = Repo.paymentFor(req, 20000)
+	if payment.Currency != "EUR" || payment.Amount != 18000 || payment.BaseAmount != 20000 {
+		t.Errorf("expected EUR payment at the stored rate, got %+v", payment)
+	}
+
+	if rate := session.GetFloat(ctx, "exchange_rate"); rate != 0.9 {
+		t.Errorf("expected session exchange rate to be refreshed to 0.9, got %f", rate)
+	}
+}
+
+func TestRepository_PostShowLogin(t *testing.T) {
+	db := newTestDB(t)
+
+	_, err := db.AddUser(models.User{FirstName: "Admin", LastName: "User", Email: "admin@example.com"}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name             string
+		email            string
+		password         string
+		expectedCode     int
+		expectedLocation string
+	}{
+		{"valid credentials", "admin@example.com", "password", http.StatusSeeOther, "/"},
+		{"invalid credentials", "admin@example.com", "wrong", http.StatusSeeOther, "/user/login"},
+		{"invalid form", "not-an-email", "password", http.StatusOK, ""},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("email", e.email)
+		postedData.Add("password", e.password)
+
+		req, _ := http.NewRequest("POST", "/user/login", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.PostShowLogin)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d, got %d", e.name, e.expectedCode, rr.Code)
+		}
+
+		if loc := rr.Header().Get("Location"); e.expectedLocation != "" && loc != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %s, got %s", e.name, e.expectedLocation, loc)
+		}
+	}
+}
+
+func TestRepository_AdminPostExchangeRate(t *testing.T) {
+	newTestDB(t)
+
+	var tests = []struct {
+		name         string
+		currency     string
+		rate         string
+		expectedCode int
+	}{
+		{"valid rate", "EUR", "0.91", http.StatusSeeOther},
+		{"negative rate", "EUR", "-1", http.StatusOK},
+		{"unsupported currency", "XYZ", "1.5", http.StatusOK},
+		{"base currency", "USD", "1", http.StatusOK},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("currency", e.currency)
+		postedData.Add("rate", e.rate)
+
+		req, _ := http.NewRequest("POST", "/admin/exchange-rates", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.AdminPostExchangeRate)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d, got %d", e.name, e.expectedCode, rr.Code)
+		}
+	}
+}
+
+func TestRepository_AdminPostNewRoom(t *testing.T) {
+	newTestDB(t)
+
+	var tests = []struct {
+		name         string
+		roomName     string
+		price        string
+		occupancy    string
+		expectedCode int
+	}{
+		{"valid room", "Colonel's Cabin", "120.50", "2", http.StatusSeeOther},
+		{"missing name", "", "120.50", "2", http.StatusOK},
+		{"invalid price", "Colonel's Cabin", "free", "2", http.StatusOK},
+		{"invalid occupancy", "Colonel's Cabin", "120.50", "0", http.StatusOK},
+		{"no slug", "!!!", "120.50", "2", http.StatusOK},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("room_name", e.roomName)
+		postedData.Add("price", e.price)
+		postedData.Add("max_occupancy", e.occupancy)
+		postedData.Add("amenities", "1")
+
+		req, _ := http.NewRequest("POST", "/admin/rooms/new", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(Repo.AdminPostNewRoom)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d, got %d", e.name, e.expectedCode, rr.Code)
+		}
+	}
+}
+
+func TestRepository_AdminPostShowRoom(t *testing.T) {
+	newTestDB(t)
+
+	var tests = []struct {
+		name         string
+		id           string
+		roomName     string
+		expectedCode int
+	}{
+		{"valid update", "1", "General's Quarters", http.StatusSeeOther},
+		{"invalid form", "1", "", http.StatusOK},
+		{"unknown room", "100", "General's Quarters", http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("room_name", e.roomName)
+		postedData.Add("price", "100")
+		postedData.Add("max_occupancy", "2")
+
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/admin/rooms/"+e.id, strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		getAdminRoutes().ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d, got %d", e.name, e.expectedCode, rr.Code)
+		}
+	}
+}
+
+func TestRepository_AdminRetireRoom(t *testing.T) {
+	newTestDB(t)
+
+	for _, retired := range []string{"1", "0"} {
+		postedData := url.Values{}
+		postedData.Add("retired", retired)
+
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/admin/rooms/1/retire", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		getAdminRoutes().ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("retired=%s: expected status code %d, got %d", retired, http.StatusSeeOther, rr.Code)
+		}
+	}
+}
+
+func TestRepository_AdminPostRoomImages(t *testing.T) {
+	newTestDB(t)
+
+	img := image.NewRGBA(image.Rect(0, 0, 2000, 1000))
+	var pngData bytes.Buffer
+	_ = png.Encode(&pngData, img)
+
+	var tests = []struct {
+		name         string
+		roomID       string
+		content      []byte
+		expectedCode int
+	}{
+		{"valid image", "1", pngData.Bytes(), http.StatusSeeOther},
+		{"not an image", "1", []byte("<html></html>"), http.StatusSeeOther},
+		{"unknown room", "100", pngData.Bytes(), http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("images", "room.png")
+		fw.Write(e.content)
+		mw.WriteField("caption", "View from the window")
+		mw.Close()
+
+		req, _ := http.NewRequest("POST", "/admin/rooms/"+e.roomID+"/images", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+
+		getAdminRoutes().ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d, got %d", e.name, e.expectedCode, rr.Code)
+		}
+	}
+}
+
+func TestRepository_AdminPostRoomImagesBatch(t *testing.T) {
+	mem := dbrepo.NewMemoryRepo(&app)
+
+	roomID, err := mem.InsertRoom(models.Room{RoomName: "General's Quarters", Slug: "generals-quarters", MaxOccupancy: 2, Price: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := Repo
+	NewHandlers(&Repository{App: &app, DB: mem})
+	defer NewHandlers(saved)
+
+	uploads := t.TempDir()
+	savedStorage := app.Storage
+	app.Storage = storage.NewLocal(uploads, "/uploads")
+	defer func() { app.Storage = savedStorage }()
+
+	var pngData bytes.Buffer
+	_ = png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 200, 100)))
+
+	// the second file is not an image, so the first must not be saved either
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("images", "room.png")
+	fw.Write(pngData.Bytes())
+	fw, _ = mw.CreateFormFile("images", "room.html")
+	fw.Write([]byte("<html></html>"))
+	mw.Close()
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/admin/rooms/%d/images", roomID), &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rr := httptest.NewRecorder()
+
+	getAdminRoutes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("expected status code %d, got %d", http.StatusSeeOther, rr.Code)
+	}
+
+	room, err := mem.GetRoomByID(roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(room.Images) != 0 {
+		t.Errorf("expected no images to be recorded, got %d", len(room.Images))
+	}
+
+	var files []string
+	filepath.WalkDir(uploads, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	})
+	if len(files) != 0 {
+		t.Errorf("expected no files to be saved, got %v", files)
+	}
+}
+
+// failingStorage saves as many files as saves, then fails
+type failingStorage struct {
+	storage.Storage
+	saves int
+}
+
+func (f *failingStorage) Save(key string, r io.Reader) (string, error) {
+	if f.saves == 0 {
+		return "", errors.New("disk full")
+	}
+	f.saves--
+
+	return f.Storage.Save(key, r)
+}
+
+func TestRepository_AdminPostRoomImagesRollback(t *testing.T) {
+	db := newTestDB(t)
+
+	var pngData bytes.Buffer
+	_ = png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 200, 100)))
+
+	for saves := 1; saves <= 3; saves++ {
+		uploads := t.TempDir()
+		savedStorage := app.Storage
+		app.Storage = &failingStorage{Storage: storage.NewLocal(uploads, "/uploads"), saves: saves}
+
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for _, name := range []string{"room.png", "bathroom.png"} {
+			fw, _ := mw.CreateFormFile("images", name)
+			fw.Write(pngData.Bytes())
+		}
+		mw.Close()
+
+		req, _ := http.NewRequest("POST", "/admin/rooms/1/images", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+
+		getAdminRoutes().ServeHTTP(rr, req)
+		app.Storage = savedStorage
+
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("failing after %d saves: expected status code %d, got %d", saves, http.StatusInternalServerError, rr.Code)
+		}
+
+		// only the seeded image is left
+		room, err := db.GetRoomByID(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(room.Images) != 1 {
+			t.Errorf("failing after %d saves: expected the batch not to be recorded, got %d images", saves, len(room.Images))
+		}
+
+		var files []string
+		filepath.WalkDir(uploads, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				files = append(files, path)
+			}
+			return err
+		})
+		if len(files) != 0 {
+			t.Errorf("failing after %d saves: expected the saved files to be removed, got %v", saves, files)
+		}
+	}
+
+	// a failure to record the image removes its files as well
+	uploads := t.TempDir()
+	savedStorage := app.Storage
+	app.Storage = storage.NewLocal(uploads, "/uploads")
+	defer func() { app.Storage = savedStorage }()
+
+	db.Fail("InsertRoomImage", errors.New("connection reset"))
+	defer db.Fail("InsertRoomImage", nil)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("images", "room.png")
+	fw.Write(pngData.Bytes())
+	mw.Close()
+
+	req, _ := http.NewRequest("POST", "/admin/rooms/1/images", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rr := httptest.NewRecorder()
+
+	getAdminRoutes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected status code %d, got %d", http.StatusInternalServerError, rr.Code)
+	}
+
+	var files []string
+	filepath.WalkDir(uploads, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	})
+	if len(files) != 0 {
+		t.Errorf("expected the saved files to be removed, got %v", files)
+	}
+}
+
+func TestRepository_AdminRoomImage(t *testing.T) {
+	newTestDB(t)
+
+	var tests = []struct {
+		name         string
+		url          string
+		expectedCode int
+	}{
+		{"update image", "/admin/rooms/1/images/1", http.StatusSeeOther},
+		{"update image of other room", "/admin/rooms/2/images/1", http.StatusNotFound},
+		{"update unknown image", "/admin/rooms/1/images/100", http.StatusNotFound},
+		{"delete image", "/admin/rooms/1/images/1/delete", http.StatusSeeOther},
+		{"delete unknown image", "/admin/rooms/1/images/100/delete", http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("caption", "Sunset")
+		postedData.Add("sort_order", "2")
+
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		getAdminRoutes().ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d, got %d", e.name, e.expectedCode, rr.Code)
+		}
+	}
+}
+
+func TestRepository_API(t *testing.T) {
+	newTestDB(t)
+
+	var tests = []struct {
+		name         string
+		method       string
+		url          string
+		body         string
+		expectedCode int
+		errorCode    string
+	}{
+		{"rooms", "GET", "/api/v1/rooms", "", http.StatusOK, ""},
+		{"room", "GET", "/api/v1/rooms/1", "", http.StatusOK, ""},
+		{"unknown room", "GET", "/api/v1/rooms/100", "", http.StatusNotFound, "not_found"},
+		{"invalid room id", "GET", "/api/v1/rooms/abc", "", http.StatusNotFound, "not_found"},
+		{"all availability", "GET", "/api/v1/availability?start=2050-01-01&end=2050-01-02", "", http.StatusOK, ""},
+		{"room available", "GET", "/api/v1/availability?start=2050-01-01&end=2050-01-02&room_id=1", "", http.StatusOK, ""},
+		{"availability unknown room", "GET", "/api/v1/availability?start=2050-01-01&end=2050-01-02&room_id=100", "", http.StatusNotFound, "not_found"},
+		{"availability missing dates", "GET", "/api/v1/availability", "", http.StatusUnprocessableEntity, "validation_failed"},
+		{"availability reversed dates", "GET", "/api/v1/availability?start=2050-01-02&end=2050-01-01", "", http.StatusUnprocessableEntity, "validation_failed"},
+		{"availability in the past", "GET", "/api/v1/availability?start=2020-01-01&end=2020-01-02", "", http.StatusUnprocessableEntity, "validation_failed"},
+		{"reservation", "GET", "/api/v1/reservations/PARTNER1", "", http.StatusOK, ""},
+		{"reservation made on the website", "GET", "/api/v1/reservations/TESTCODE", "", http.StatusNotFound, "not_found"},
+		{"unknown reservation", "GET", "/api/v1/reservations/NOPE", "", http.StatusNotFound, "not_found"},
+		{"unknown endpoint", "GET", "/api/v1/nope", "", http.StatusNotFound, "not_found"},
+		{"wrong method", "DELETE", "/api/v1/rooms", "", http.StatusMethodNotAllowed, "bad_request"},
+		{
+			"create reservation", "POST", "/api/v1/reservations",
+			`{"room_id":1,"start_date":"2050-01-01","end_date":"2050-01-03","adults":2,"first_name":"John","last_name":"Smith","email":"j@smith.com"}`,
+			http.StatusCreated, "",
+		},
+		{
+			"create reservation for booked room", "POST", "/api/v1/reservations",
+			`{"room_id":2,"start_date":"2050-03-01","end_date":"2050-03-03","first_name":"John","last_name":"Smith","email":"j@smith.com"}`,
+			http.StatusConflict, "room_unavailable",
+		},
+		{
+			"create reservation for unknown room", "POST", "/api/v1/reservations",
+			`{"room_id":100,"start_date":"2050-01-01","end_date":"2050-01-03","first_name":"John","last_name":"Smith","email":"j@smith.com"}`,
+			http.StatusUnprocessableEntity, "validation_failed",
+		},
+		{
+			"create reservation with too many guests", "POST", "/api/v1/reservations",
+			`{"room_id":1,"start_date":"2050-01-01","end_date":"2050-01-03","adults":3,"first_name":"John","last_name":"Smith","email":"j@smith.com"}`,
+			http.StatusUnprocessableEntity, "validation_failed",
+		},
+		{
+			"create reservation with invalid fields", "POST", "/api/v1/reservations",
+			`{"room_id":1,"start_date":"tomorrow","first_name":"J","email":"nope"}`,
+			http.StatusUnprocessableEntity, "validation_failed",
+		},
+		{
+			"create reservation breaking stay rules", "POST", "/api/v1/reservations",
+			`{"room_id":2,"start_date":"2050-01-01","end_date":"2050-01-02","first_name":"John","last_name":"Smith","email":"j@smith.com"}`,
+			http.StatusUnprocessableEntity, "validation_failed",
+		},
+		{
+			"create reservation in the past", "POST", "/api/v1/reservations",
+			`{"room_id":1,"start_date":"2020-01-01","end_date":"2020-01-03","first_name":"John","last_name":"Smith","email":"j@smith.com"}`,
+			http.StatusUnprocessableEntity, "validation_failed",
+		},
+		{
+			"create reservation with an add-on the room lacks", "POST", "/api/v1/reservations",
+			`{"room_id":2,"start_date":"2050-01-01","end_date":"2050-01-05","late_check_out":true,"first_name":"John","last_name":"Smith","email":"j@smith.com"}`,
+			http.StatusUnprocessableEntity, "validation_failed",
+		},
+		{"create reservation with unknown field", "POST", "/api/v1/reservations", `{"room":1}`, http.StatusBadRequest, "bad_request"},
+		{"create reservation with invalid json", "POST", "/api/v1/reservations", `{`, http.StatusBadRequest, "bad_request"},
+		{"create reservation without body", "POST", "/api/v1/reservations", "", http.StatusBadRequest, "bad_request"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
+		rr := httptest.NewRecorder()
+
+		getAPIRoutes().ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d, got %d", e.name, e.expectedCode, rr.Code)
+		}
+
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: expected JSON response, got %q", e.name, ct)
+		}
+
+		var body struct {
+			Data  json.RawMessage `json:"data"`
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+
+		err := json.Unmarshal(rr.Body.Bytes(), &body)
+		if err != nil {
+			t.Errorf("%s: failed to parse response: %v", e.name, err)
+			continue
+		}
+
+		if body.Error.Code != e.errorCode {
+			t.Errorf("%s: expected error code %q, got %q", e.name, e.errorCode, body.Error.Code)
+		}
+
+		if e.errorCode == "" && len(body.Data) == 0 {
+			t.Errorf("%s: expected data in response", e.name)
+		}
+	}
+}
+
+func TestRepository_APICreateReservation(t *testing.T) {
+	newTestDB(t)
+
+	body := `{"room_id":1,"start_date":"2050-01-01","end_date":"2050-01-03","adults":2,"children":0,"first_name":"John","last_name":"Smith","email":"j@smith.com"}`
+
+	req, _ := http.NewRequest("POST", "/api/v1/reservations", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	rr := httptest.NewRecorder()
+
+	getAPIRoutes().ServeHTTP(rr, req)
+
+	var resp struct {
+		Data apiReservation `json:"data"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+
+	if len(resp.Data.Code) != 8 {
+		t.Errorf("expected an 8 character reservation code, got %q", resp.Data.Code)
+	}
+
+	if loc := rr.Header().Get("Location"); loc != "/api/v1/reservations/"+resp.Data.Code {
+		t.Errorf("expected location of the new reservation, got %q", loc)
+	}
+
+	if resp.Data.Nights != 2 || resp.Data.Total.Amount != 20000 || resp.Data.Total.Currency != "USD" {
+		t.Errorf("unexpected total: %d nights, %d %s", resp.Data.Nights, resp.Data.Total.Amount, resp.Data.Total.Currency)
+	}
+}
+
+func TestRepository_APIKeyAuth(t *testing.T) {
+	newTestDB(t)
+
+	var tests = []struct {
+		name         string
+		method       string
+		url          string
+		auth         string
+		expectedCode int
+	}{
+		{"no key", "GET", "/api/v1/rooms", "", http.StatusUnauthorized},
+		{"not bearer", "GET", "/api/v1/rooms", "Basic " + testAPIKey, http.StatusUnauthorized},
+		{"malformed key", "GET", "/api/v1/rooms", "Bearer nope", http.StatusUnauthorized},
+		{"unknown key", "GET", "/api/v1/rooms", "Bearer gb_unknown0_secret", http.StatusUnauthorized},
+		{"wrong secret", "GET", "/api/v1/rooms", "Bearer gb_testall0_wrong", http.StatusUnauthorized},
+		{"revoked key", "GET", "/api/v1/rooms", "Bearer " + testRevokedAPIKey, http.StatusUnauthorized},
+		{"read only key reads", "GET", "/api/v1/availability?start=2050-01-01&end=2050-01-02", "Bearer " + testReadOnlyAPIKey, http.StatusOK},
+		{"read only key books", "POST", "/api/v1/reservations", "Bearer " + testReadOnlyAPIKey, http.StatusForbidden},
+		{"read only key reads reservation", "GET", "/api/v1/reservations/PARTNER1", "Bearer " + testReadOnlyAPIKey, http.StatusForbidden},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, e.url, nil)
+		if e.auth != "" {
+			req.Header.Set("Authorization", e.auth)
+		}
+		rr := httptest.NewRecorder()
+
+		getAPIRoutes().ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d, got %d", e.name, e.expectedCode, rr.Code)
+		}
+
+		if e.expectedCode == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected WWW-Authenticate header", e.name)
+		}
+	}
+}
+
+func TestRepository_AdminAPIKeys(t *testing.T) {
+	db := newTestDB(t)
+
+	var tests = []struct {
+		name         string
+		url          string
+		postedData   url.Values
+		expectedCode int
+		failing      string
+	}{
+		{"issue key", "/admin/api-keys", url.Values{"partner_id": {"1"}, "name": {"Bookings"}, "scopes": {"rooms:read", "reservations:write"}}, http.StatusSeeOther, ""},
+		{"issue key without scopes", "/admin/api-keys", url.Values{"partner_id": {"1"}, "name": {"Bookings"}}, http.StatusOK, ""},
+		{"issue key with unknown scope", "/admin/api-keys", url.Values{"partner_id": {"1"}, "name": {"Bookings"}, "scopes": {"admin"}}, http.StatusOK, ""},
+		{"issue key without name", "/admin/api-keys", url.Values{"partner_id": {"1"}, "scopes": {"rooms:read"}}, http.StatusOK, ""},
+		{"issue key failure", "/admin/api-keys", url.Values{"partner_id": {"1"}, "name": {"Bookings"}, "scopes": {"rooms:read"}}, http.StatusInternalServerError, "InsertAPIKey"},
+		{"revoke key", "/admin/api-keys/1/revoke", url.Values{}, http.StatusSeeOther, ""},
+		{"revoke unknown key", "/admin/api-keys/100/revoke", url.Values{}, http.StatusNotFound, ""},
+		{"add partner", "/admin/partners", url.Values{"partner_name": {"Acme Travel"}, "partner_email": {"api@acme.com"}}, http.StatusSeeOther, ""},
+		{"add invalid partner", "/admin/partners", url.Values{"partner_name": {"Acme Travel"}, "partner_email": {"nope"}}, http.StatusOK, ""},
+	}
+
+	for _, e := range tests {
+		if e.failing != "" {
+			db.Fail(e.failing, errors.New("connection reset"))
+		}
+
+		req, _ := http.NewRequest("POST", e.url, strings.NewReader(e.postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		getAdminRoutes().ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d, got %d", e.name, e.expectedCode, rr.Code)
+		}
+
+		if e.failing != "" {
+			db.Fail(e.failing, nil)
+		}
+	}
+
+	// the new key is put in the session to be shown once
+	postedData := url.Values{"partner_id": {"1"}, "name": {"Bookings"}, "scopes": {"rooms:read"}}
+	req, _ := http.NewRequest("POST", "/admin/api-keys", strings.NewReader(postedData.Encode()))
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	http.HandlerFunc(Repo.AdminPostAPIKey).ServeHTTP(rr, req)
+
+	if key := session.GetString(ctx, "api_key"); !strings.HasPrefix(key, "gb_") {
+		t.Errorf("expected the new key in the session, got %q", key)
+	}
+}
+
+func TestRepository_AdminWebhooks(t *testing.T) {
+	db := newTestDB(t)
+
+	var tests = []struct {
+		name         string
+		method       string
+		url          string
+		postedData   url.Values
+		expectedCode int
+		failing      string
+	}{
+		{"add webhook", "POST", "/admin/webhooks", url.Values{"url": {"https://example.com/hooks"}, "events": {"reservation.created", "block.created"}}, http.StatusSeeOther, ""},
+		{"add webhook without events", "POST", "/admin/webhooks", url.Values{"url": {"https://example.com/hooks"}}, http.StatusOK, ""},
+		{"add webhook with unknown event", "POST", "/admin/webhooks", url.Values{"url": {"https://example.com/hooks"}, "events": {"room.created"}}, http.StatusOK, ""},
+		{"add webhook without url", "POST", "/admin/webhooks", url.Values{"events": {"reservation.created"}}, http.StatusOK, ""},
+		{"add webhook with bad url", "POST", "/admin/webhooks", url.Values{"url": {"ftp://example.com"}, "events": {"reservation.created"}}, http.StatusOK, ""},
+		{"add webhook failure", "POST", "/admin/webhooks", url.Values{"url": {"https://example.com/hooks"}, "events": {"reservation.created"}}, http.StatusInternalServerError, "InsertWebhookSubscription"},
+		{"show webhook", "GET", "/admin/webhooks/1", nil, http.StatusOK, ""},
+		{"show unknown webhook", "GET", "/admin/webhooks/100", nil, http.StatusNotFound, ""},
+		{"delete webhook", "POST", "/admin/webhooks/1/delete", url.Values{}, http.StatusSeeOther, ""},
+		{"delete unknown webhook", "POST", "/admin/webhooks/100/delete", url.Values{}, http.StatusNotFound, ""},
+	}
+
+	for _, e := range tests {
+		if e.failing != "" {
+			db.Fail(e.failing, errors.New("connection reset"))
+		}
+
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		getAdminRoutes().ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d, got %d", e.name, e.expectedCode, rr.Code)
+		}
+
+		if e.failing != "" {
+			db.Fail(e.failing, nil)
+		}
+	}
+}
+
+func TestRepository_PostReservationIdempotency(t *testing.T) {
+	db := newTestDB(t)
+
+	sd, _ := dates.Parse("2050-01-01")
+	ed, _ := dates.Parse("2050-01-03")
+
+	res := models.Reservation{RoomID: 1, StartDate: sd, EndDate: ed}
+
+	defer func(wait time.Duration) { idempotencyWait = wait }(idempotencyWait)
+	idempotencyWait = 0
+
+	// claim stores a token as claimed by an earlier submission of the form, in progress until it is completed
+	claim := func(scope, hash string, completed bool) {
+		k := models.IdempotencyKey{Scope: scope, Key: "form-token", RequestHash: hash, ExpiresAt: time.Now().Add(time.Hour)}
+		if _, _, err := db.ClaimIdempotencyKey(k); err != nil {
+			t.Fatal(err)
+		}
+		if completed {
+			k.StatusCode, k.Location, k.Body = http.StatusSeeOther, "/reservation-summary", "TESTCODE"
+			if err := db.CompleteIdempotencyKey(k); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var tests = []struct {
+		name             string
+		setup            func(scope, hash string)
+		expectedCode     int
+		expectedLocation string
+		expectedReplay   string
+	}{
+		{"new token", func(scope, hash string) {}, http.StatusSeeOther, "/reservation-summary", ""},
+		{"repeated token", func(scope, hash string) { claim(scope, hash, true) }, http.StatusSeeOther, "/reservation-summary", "TESTCODE"},
+		{"token used for another booking", func(scope, hash string) { claim(scope, "different", true) }, http.StatusSeeOther, "/make-reservation", ""},
+		{"token in progress", func(scope, hash string) { claim(scope, hash, false) }, http.StatusSeeOther, "/", ""},
+		{"claim failure", func(scope, hash string) { db.Fail("ClaimIdempotencyKey", errors.New("connection reset")) }, http.StatusTemporaryRedirect, "/", ""},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("first_name", "John")
+		postedData.Add("last_name", "Smith")
+		postedData.Add("email", "j@smith.com")
+		postedData.Add("adults", "1")
+		postedData.Add("children", "0")
+		postedData.Add("idempotency_key", "form-token")
+
+		req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+		req.Header.Set("X-Session", newSessionToken(t))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		session.Put(ctx, "reservation", res)
+
+		req.ParseForm()
+		e.setup(Repo.webIdempotencyScope(req), bookingRequestHash(req, res))
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.PostReservation).ServeHTTP(rr, req)
+		db.Fail("ClaimIdempotencyKey", nil)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d, got %d", e.name, e.expectedCode, rr.Code)
+		}
+
+		if loc := rr.Header().Get("Location"); loc != e.expectedLocation {
+			t.Errorf("%s: expected redirect to %s, got %s", e.name, e.expectedLocation, loc)
+		}
+
+		if e.expectedReplay != "" {
+			replayed, _ := session.Get(ctx, "reservation").(models.Reservation)
+			if replayed.Code != e.expectedReplay {
+				t.Errorf("%s: expected the original reservation in the session, got %q", e.name, replayed.Code)
+			}
+		}
+	}
+}
+
+func TestRepository_PostReservationIdempotencySessions(t *testing.T) {
+	mem := newTestDB(t)
+	roomID := 1
+
+	sd, _ := dates.Parse("2050-01-01")
+	ed, _ := dates.Parse("2050-01-03")
+
+	post := func(sessionToken, firstName string, start dates.Date) (*httptest.ResponseRecorder, models.Reservation) {
+		postedData := url.Values{}
+		postedData.Add("first_name", firstName)
+		postedData.Add("last_name", "Smith")
+		postedData.Add("email", "j@smith.com")
+		postedData.Add("idempotency_key", "form-token")
+
+		req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+		req.Header.Set("X-Session", sessionToken)
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		session.Put(ctx, "reservation", models.Reservation{RoomID: roomID, StartDate: start, EndDate: start.AddDate(0, 0, 2)})
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.PostReservation).ServeHTTP(rr, req)
+
+		res, _ := session.Get(ctx, "reservation").(models.Reservation)
+		return rr, res
+	}
+
+	first := newSessionToken(t)
+	rr, booked := post(first, "John", sd)
+	if rr.Code != http.StatusSeeOther || booked.Code == "" {
+		t.Fatalf("expected the first submission to book, got %d", rr.Code)
+	}
+
+	// the guest submitting again gets their booking back
+	rr, replayed := post(first, "John", sd)
+	if rr.Code != http.StatusSeeOther || replayed.Code != booked.Code {
+		t.Errorf("expected the repeat to replay %s, got %d with %q", booked.Code, rr.Code, replayed.Code)
+	}
+
+	// but changing the form doesn't
+	if rr, _ = post(first, "Jonathan", sd); rr.Header().Get("Location") != "/make-reservation" {
+		t.Errorf("expected a changed form to be sent back, got %d to %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	// and someone else sending the same token makes their own booking rather than seeing the guest's
+	rr, other := post(newSessionToken(t), "John", ed.AddDate(0, 0, 1))
+	if rr.Code != http.StatusSeeOther || other.Code == "" || other.Code == booked.Code {
+		t.Errorf("expected a new booking in another session, got %d with %q", rr.Code, other.Code)
+	}
+	if available, _ := mem.SearchAvailabilityByDatesByRoomID(ed.AddDate(0, 0, 1), ed.AddDate(0, 0, 3), roomID); available {
+		t.Error("expected the booking in the other session to be made")
+	}
+}
+
+func TestRepository_APIIdempotency(t *testing.T) {
+	db := newTestDB(t)
+
+	// booking returns the body of a request to book room 1 for the first two nights of a month in 2050
+	booking := func(month string) string {
+		return `{"room_id":1,"start_date":"2050-` + month + `-01","end_date":"2050-` + month + `-03","first_name":"John","last_name":"Smith","email":"j@smith.com"}`
+	}
+
+	// a request with this key is still being handled
+	pending, _ := http.NewRequest("POST", "/api/v1/reservations", nil)
+	if _, _, err := db.ClaimIdempotencyKey(models.IdempotencyKey{
+		Scope:       "api:testall0",
+		Key:         "pending",
+		RequestHash: requestHash(pending, []byte(booking("05"))),
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name         string
+		key          string
+		body         string
+		failing      string
+		expectedCode int
+		replayed     bool
+	}{
+		{"no key", "", booking("01"), "", http.StatusCreated, false},
+		{"new key", "new", booking("02"), "", http.StatusCreated, false},
+		{"repeated key", "new", booking("02"), "", http.StatusCreated, true},
+		{"key used for another request", "new", booking("03"), "", http.StatusUnprocessableEntity, false},
+		{"key in progress", "pending", booking("05"), "", http.StatusConflict, false},
+		{"key too long", strings.Repeat("k", 256), booking("06"), "", http.StatusBadRequest, false},
+		{"claim failure", "failing", booking("07"), "ClaimIdempotencyKey", http.StatusInternalServerError, false},
+	}
+
+	var location string
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/api/v1/reservations", strings.NewReader(e.body))
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
+		if e.key != "" {
+			req.Header.Set("Idempotency-Key", e.key)
+		}
+		rr := httptest.NewRecorder()
+
+		if e.failing != "" {
+			db.Fail(e.failing, errors.New("connection reset"))
+		}
+		getAPIRoutes().ServeHTTP(rr, req)
+		if e.failing != "" {
+			db.Fail(e.failing, nil)
+		}
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d, got %d", e.name, e.expectedCode, rr.Code)
+		}
+
+		if replayed := rr.Header().Get("Idempotent-Replayed") == "true"; replayed != e.replayed {
+			t.Errorf("%s: expected replayed to be %v", e.name, e.replayed)
+		}
+
+		if e.replayed && rr.Header().Get("Location") != location {
+			t.Errorf("%s: expected the original location %q, got %q", e.name, location, rr.Header().Get("Location"))
+		}
+		location = rr.Header().Get("Location")
+	}
+}
+
+func TestRepository_APIIdempotencyPanic(t *testing.T) {
+	mem := dbrepo.NewMemoryRepo(&app)
+	m := &Repository{App: &app, DB: mem}
+
+	h := m.APIIdempotency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("handler failed")
+	}))
+
+	req, _ := http.NewRequest("POST", "/api/v1/reservations", strings.NewReader(`{}`))
+	req.Header.Set("Idempotency-Key", "crash")
+	req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey, models.APIKey{Prefix: "testkey"}))
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected the panic to reach the caller")
+			}
+		}()
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	// the client can retry rather than being told the request is in progress
+	if _, err := mem.GetIdempotencyKey("api:testkey", "crash"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected the key to be released, got %v", err)
+	}
+}
+
+func TestRepository_ClaimBookingTokenWait(t *testing.T) {
+	defer func(c clock.Clock) { app.Clock = c }(app.Clock)
+	clk := clock.NewFake(time.Date(2049, 12, 31, 20, 0, 0, 0, time.UTC))
+	app.Clock = clk
+
+	defer func(wait time.Duration) { idempotencyWait = wait }(idempotencyWait)
+	idempotencyWait = time.Hour
+
+	mem := dbrepo.NewMemoryRepo(&app)
+	m := &Repository{App: &app, DB: mem}
+
+	req, _ := http.NewRequest("POST", "/make-reservation", nil)
+	req.Header.Set("X-Session", newSessionToken(t))
+	req = req.WithContext(getCtx(req))
+
+	// the first submission is still being saved
+	_, claimed, err := mem.ClaimIdempotencyKey(models.IdempotencyKey{
+		Scope:       m.webIdempotencyScope(req),
+		Key:         "pending",
+		RequestHash: "hash",
+		ExpiresAt:   clk.Now().Add(idempotencyTTL),
+	})
+	if err != nil || !claimed {
+		t.Fatalf("expected the token to be claimed, got %v", err)
+	}
+
+	// the wait is timed by the app's clock, so moving it on ends the wait
+	go func() {
+		time.Sleep(3 * idempotencyPoll)
+		clk.Advance(2 * time.Hour)
+	}()
+
+	done := make(chan bool)
+	rr := httptest.NewRecorder()
+	go func() { done <- m.claimBookingToken(rr, req, "pending", "hash") }()
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("expected the token not to be claimed again")
+		}
+		if loc := rr.Header().Get("Location"); loc != "/" {
+			t.Errorf("expected the guest to be told the booking is in progress, got a redirect to %q", loc)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the wait to end when the clock passed its deadline")
+	}
+}
+
+// newSessionToken returns the token of a new, stored session, for requests made in a session the guest already has
+func newSessionToken(t *testing.T) string {
+	t.Helper()
+
+	ctx, err := session.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Put(ctx, "started", true)
+
+	token, _, err := session.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func getCtx(r *http.Request) context.Context {
+	ctx, err := session.Load(r.Context(), r.Header.Get("X-Session"))
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	return ctx
+}
+
+func TestRepository_Subscribe(t *testing.T) {
+	newTestDB(t)
+
+	bus := events.NewBus()
+	Repo.Subscribe(bus)
+
+	tests := []struct {
+		name      string
+		eventType string
+		payload   string
+		expectErr bool
+	}{
+		{"reservation created", events.ReservationCreated, `{"reservation_id":1,"code":"TESTCODE"}`, false},
+		{"reservation gone", events.ReservationCreated, `{"reservation_id":2,"code":"MISSING"}`, false},
+		{"invalid payload", events.ReservationCreated, `nope`, true},
+		{"reservation updated", events.ReservationUpdated, `{"reservation_id":1,"code":"TESTCODE"}`, false},
+		{"reservation cancelled", events.ReservationCancelled, `{"reservation_id":1,"code":"TESTCODE"}`, false},
+		{"invalid cancellation payload", events.ReservationCancelled, `nope`, true},
+		{"block created", events.BlockCreated, `{"room_restriction_id":1,"room_id":1,"start_date":"2050-01-01","end_date":"2050-01-03"}`, false},
+		{"block of unknown room", events.BlockCreated, `{"room_restriction_id":1,"room_id":100,"start_date":"2050-01-01","end_date":"2050-01-03"}`, false},
+		{"invalid block payload", events.BlockCreated, `nope`, true},
+	}
+
+	for _, e := range tests {
+		err := bus.Publish(models.OutboxEvent{ID: 1, Type: e.eventType, Payload: e.payload})
+		if (err != nil) != e.expectErr {
+			t.Errorf("%s: expected error %v, got %v", e.name, e.expectErr, err)
+		}
+	}
+}
+
+func TestRepository_APIBooking(t *testing.T) {
+	mem := newTestDB(t)
+	roomID := 1
+
+	routes := getAPIRoutes()
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		return rr
+	}
+
+	book := func(start, end string) *httptest.ResponseRecorder {
+		return do("POST", "/api/v1/reservations", fmt.Sprintf(`{"room_id":%d,"start_date":%q,"end_date":%q,"adults":2,`+
+			`"first_name":"John","last_name":"Smith","email":"j@smith.com"}`, roomID, start, end))
+	}
+
+	rr := book("2050-01-01", "2050-01-05")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected the booking to be created, got %d: %s", rr.Code, rr.Body)
+	}
+
+	var created struct {
+		Data apiReservation `json:"data"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &created)
+
+	if rr = do("GET", "/api/v1/reservations/"+created.Data.Code, ""); rr.Code != http.StatusOK {
+		t.Errorf("expected the booking to be found by its code, got %d", rr.Code)
+	}
+	if got, _ := mem.GetReservationByCode(created.Data.Code); got.PartnerID != 1 {
+		t.Errorf("expected the booking to be saved as made by partner 1, got %d", got.PartnerID)
+	}
+
+	// other partners can't read it
+	req, _ := http.NewRequest("GET", "/api/v1/reservations/"+created.Data.Code, nil)
+	req.Header.Set("Authorization", "Bearer "+testOtherAPIKey)
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected another partner's booking not to be found, got %d", rr.Code)
+	}
+
+	if rr = book("2050-01-04", "2050-01-08"); rr.Code != http.StatusConflict {
+		t.Errorf("expected overlapping dates to be refused, got %d", rr.Code)
+	}
+
+	if rr = book("2050-01-05", "2050-01-08"); rr.Code != http.StatusCreated {
+		t.Errorf("expected a stay starting on the day the last one ends to be booked, got %d", rr.Code)
+	}
+
+	var availability struct {
+		Data apiAvailability `json:"data"`
+	}
+	rr = do("GET", "/api/v1/availability?start=2050-01-07&end=2050-01-09", "")
+	json.Unmarshal(rr.Body.Bytes(), &availability)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected the availability to be found, got %d: %s", rr.Code, rr.Body)
+	}
+	for _, room := range availability.Data.Rooms {
+		if room.ID == roomID {
+			t.Errorf("expected the booked room not to be free, got %s", rr.Body)
+		}
+	}
+
+	mem.Fail("CreateBooking", errors.New("connection reset"))
+	if rr = book("2050-02-01", "2050-02-03"); rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected a database failure to be a server error, got %d", rr.Code)
+	}
+
+	mem.Fail("CreateBooking", repository.ErrUnavailable)
+	if rr = book("2050-02-01", "2050-02-03"); rr.Code != http.StatusConflict {
+		t.Errorf("expected a booking taken since the room was checked to be a conflict, got %d", rr.Code)
+	}
+
+	mem.Fail("CreateBooking", nil)
+	if rr = book("2050-02-01", "2050-02-03"); rr.Code != http.StatusCreated {
+		t.Errorf("expected the booking to work once the database is back, got %d", rr.Code)
+	}
+
+	// a cancelled booking is reported as cancelled
+	if err := mem.CancelReservation(created.Data.Code); err != nil {
+		t.Fatal(err)
+	}
+	var found struct {
+		Data apiReservation `json:"data"`
+	}
+	rr = do("GET", "/api/v1/reservations/"+created.Data.Code, "")
+	json.Unmarshal(rr.Body.Bytes(), &found)
+	if created.Data.Status != "confirmed" || found.Data.Status != "cancelled" {
+		t.Errorf("expected the booking to be confirmed, then cancelled, got %q and %q", created.Data.Status, found.Data.Status)
+	}
+}
+
+func TestRepository_CheckInTimesAndTurnover(t *testing.T) {
+	mem := dbrepo.NewMemoryRepo(&app)
+
+	roomID, err := mem.InsertRoom(models.Room{RoomName: "General's Quarters", Slug: "generals-quarters", MaxOccupancy: 2,
+		Price: 10000, EarlyCheckInPrice: 2500, TurnoverDays: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	partnerID, err := mem.InsertPartner(models.Partner{Name: "Test Travel", Email: "api@testtravel.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mem.InsertAPIKey(models.APIKey{PartnerID: partnerID, Name: "Bookings", Prefix: "testall0",
+		Hash: apikeys.Hash(testAPIKey), Scopes: apikeys.Scopes})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := Repo
+	NewHandlers(&Repository{App: &app, DB: mem})
+	defer NewHandlers(saved)
+
+	routes := getAPIRoutes()
+
+	book := func(start, end, addOns string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"room_id":%d,"start_date":%q,"end_date":%q,"adults":2,%s`+
+			`"first_name":"John","last_name":"Smith","email":"j@smith.com"}`, roomID, start, end, addOns)
+		req, _ := http.NewRequest("POST", "/api/v1/reservations", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := book("2050-01-01", "2050-01-05", `"early_check_in":true,`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected the booking to be created, got %d: %s", rr.Code, rr.Body)
+	}
+
+	var created struct {
+		Data apiReservation `json:"data"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	if created.Data.Total.Amount != 4*10000+2500 {
+		t.Errorf("expected the early check-in to be charged, got a total of %d", created.Data.Total.Amount)
+	}
+	if created.Data.CheckIn != "2050-01-01T11:00:00Z" || created.Data.CheckOut != "2050-01-05T11:00:00Z" {
+		t.Errorf("expected to arrive and leave at the check-out time, got %s and %s", created.Data.CheckIn, created.Data.CheckOut)
+	}
+
+	if rr = book("2050-01-05", "2050-01-07", ""); rr.Code != http.StatusConflict {
+		t.Errorf("expected a stay starting without a turnover day to be refused, got %d", rr.Code)
+	}
+	if rr = book("2050-01-06", "2050-01-08", ""); rr.Code != http.StatusCreated {
+		t.Errorf("expected a stay starting after the turnover day to be booked, got %d", rr.Code)
+	}
+	if rr = book("2050-02-01", "2050-02-03", `"late_check_out":true,`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected an add-on the room doesn't offer to be refused, got %d", rr.Code)
+	}
+
+	// the reservation form only offers early check-in when the night before is free
+	post := func(start, end string) *httptest.ResponseRecorder {
+		sd, _ := dates.Parse(start)
+		ed, _ := dates.Parse(end)
+
+		postedData := url.Values{}
+		postedData.Add("first_name", "John")
+		postedData.Add("last_name", "Smith")
+		postedData.Add("email", "j@smith.com")
+		postedData.Add("early_check_in", "1")
+
+		req, _ := http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+		ctx := getCtx(req)
+		req = req.WithContext(ctx)
+		session.Put(ctx, "reservation", models.Reservation{RoomID: roomID, StartDate: sd, EndDate: ed})
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(Repo.PostReservation).ServeHTTP(rr, req)
+		return rr
+	}
+
+	expected := "This room is no longer available on these dates"
+	if rr = post("2050-01-04", "2050-01-06"); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), expected) {
+		t.Errorf("expected the reservation form with %q for nights already booked, got %d", expected, rr.Code)
+	}
+
+	expected = "Early check-in isn&#39;t available on these dates"
+	if rr = post("2050-01-09", "2050-01-11"); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), expected) {
+		t.Errorf("expected the reservation form with %q, got %d", expected, rr.Code)
+	}
+	if rr = post("2050-01-10", "2050-01-12"); rr.Code != http.StatusSeeOther {
+		t.Errorf("expected early check-in to be booked when the night before is free, got %d", rr.Code)
+	}
+}
+
+func TestRepository_AdminCacheStats(t *testing.T) {
+	mem := dbrepo.NewMemoryRepo(&app)
+	c := cache.New(mem, cache.DefaultOptions())
+
+	_, err := c.SearchAvailabilityByDatesByRoomID(dates.New(2050, 1, 1), dates.New(2050, 1, 2), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := Repo
+	NewHandlers(&Repository{App: &app, DB: c})
+	defer NewHandlers(saved)
+
+	req, _ := http.NewRequest("GET", "/admin/cache", nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(Repo.AdminCacheStats)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	var stats cache.Stats
+	err = json.Unmarshal(rr.Body.Bytes(), &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestRepository_RoomAvailability(t *testing.T) {
+	mem := dbrepo.NewMemoryRepo(&app)
+
+	roomID, err := mem.InsertRoom(models.Room{RoomName: "General's Quarters", Slug: "generals-quarters", MaxOccupancy: 2, Price: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, _ := dates.Parse("2099-01-10")
+	ed, _ := dates.Parse("2099-01-12")
+	err = mem.InsertRoomRestriction(models.RoomRestriction{RoomID: roomID, RestrictionID: 2, StartDate: sd, EndDate: ed})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := Repo
+	NewHandlers(&Repository{App: &app, DB: mem})
+	defer NewHandlers(saved)
+
+	routes := getRoutes()
+
+	tests := []struct {
+		name               string
+		query              string
+		expectedStatusCode int
+		expectedDays       int
+	}{
+		{"month", "?month=2099-01", http.StatusOK, 31},
+		{"range", "?start=2099-01-09&end=2099-01-13", http.StatusOK, 4},
+		{"current month", "", http.StatusOK, -1},
+		{"invalid month", "?month=2099-13", http.StatusBadRequest, 0},
+		{"invalid start", "?start=tomorrow&end=2099-01-13", http.StatusBadRequest, 0},
+		{"missing end", "?start=2099-01-09", http.StatusBadRequest, 0},
+		{"end before start", "?start=2099-01-13&end=2099-01-09", http.StatusBadRequest, 0},
+		{"too long", "?start=2099-01-01&end=2100-01-03", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/rooms/generals-quarters/availability"+tt.query, nil)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatusCode {
+			t.Errorf("%s: expected %d, got %d: %s", tt.name, tt.expectedStatusCode, rr.Code, rr.Body)
+			continue
+		}
+
+		var resp calendarResponse
+		err = json.Unmarshal(rr.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if resp.OK != (tt.expectedStatusCode == http.StatusOK) {
+			t.Errorf("%s: unexpected ok %v: %s", tt.name, resp.OK, resp.Message)
+		}
+		if tt.expectedDays >= 0 && len(resp.Days) != tt.expectedDays {
+			t.Errorf("%s: expected %d days, got %d", tt.name, tt.expectedDays, len(resp.Days))
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/rooms/generals-quarters/availability?start=2099-01-09&end=2099-01-13", nil)
+	rr := httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+
+	var resp calendarResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+
+	expected := []calendarDay{{"2099-01-09", true}, {"2099-01-10", false}, {"2099-01-11", false}, {"2099-01-12", true}}
+	for i, day := range resp.Days {
+		if day != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], day)
+		}
+	}
+
+	// past nights are never available
+	req, _ = http.NewRequest("GET", "/rooms/generals-quarters/availability?start=2020-01-01&end=2020-01-03", nil)
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+
+	resp = calendarResponse{}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if len(resp.Days) != 2 || resp.Days[0].Available || resp.Days[1].Available {
+		t.Errorf("expected past nights to be unavailable, got %+v", resp.Days)
+	}
+}
+
+func TestRepository_AvailabilityAlternatives(t *testing.T) {
+	mem := dbrepo.NewMemoryRepo(&app)
+
+	roomID, err := mem.InsertRoom(models.Room{RoomName: "General's Quarters", Slug: "generals-quarters", MaxOccupancy: 2, Price: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, _ := dates.Parse("2099-01-10")
+	ed, _ := dates.Parse("2099-01-12")
+	err = mem.InsertRoomRestriction(models.RoomRestriction{RoomID: roomID, RestrictionID: 2, StartDate: sd, EndDate: ed})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := Repo
+	NewHandlers(&Repository{App: &app, DB: mem})
+	defer NewHandlers(saved)
+
+	routes := getRoutes()
+
+	search := func(query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/search-availability/results?"+query, nil)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := search("start=2099-01-10&end=2099-01-12&adults=2")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected the search page with alternatives, got %d", rr.Code)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, `id="alternatives"`) || !strings.Contains(body, "start=2099-01-12&end=2099-01-14") {
+		t.Errorf("expected a stay two days later to be suggested, got %s", body)
+	}
+
+	// nobody fits, so there is nothing to suggest
+	if rr = search("start=2099-01-10&end=2099-01-12&adults=3"); rr.Code != http.StatusSeeOther {
+		t.Errorf("expected a redirect when there are no alternatives, got %d", rr.Code)
+	}
+}
+
+func TestRepository_RetiredRoom(t *testing.T) {
+	mem := dbrepo.NewMemoryRepo(&app)
+
+	roomID, err := mem.InsertRoom(models.Room{RoomName: "General's Quarters", Slug: "generals-quarters", MaxOccupancy: 2, Price: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mem.SetRoomRetired(roomID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := Repo
+	NewHandlers(&Repository{App: &app, DB: mem})
+	defer NewHandlers(saved)
+
+	sd, _ := dates.Parse("2050-01-01")
+	ed, _ := dates.Parse("2050-01-03")
+	res := models.Reservation{RoomID: roomID, StartDate: sd, EndDate: ed}
+
+	// a link to book the room is refused
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/book-room?id=%d&s=2050-01-01&e=2050-01-03", roomID), nil)
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(Repo.BookRoom).ServeHTTP(rr, req)
+	if loc := rr.Header().Get("Location"); rr.Code != http.StatusSeeOther || loc != "/search-availability" {
+		t.Errorf("expected BookRoom to send the guest back to the search, got %d to %q", rr.Code, loc)
+	}
+	if _, ok := session.Get(ctx, "reservation").(models.Reservation); ok {
+		t.Error("expected BookRoom not to put the reservation in the session")
+	}
+
+	// so is choosing it from the search results
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/choose-room/%d", roomID), nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", fmt.Sprint(roomID))
+	ctx = getCtx(req)
+	req = req.WithContext(context.WithValue(ctx, chi.RouteCtxKey, rctx))
+	session.Put(ctx, "reservation", models.Reservation{StartDate: sd, EndDate: ed})
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(Repo.ChooseRoom).ServeHTTP(rr, req)
+	if loc := rr.Header().Get("Location"); rr.Code != http.StatusSeeOther || loc != "/search-availability" {
+		t.Errorf("expected ChooseRoom to send the guest back to the search, got %d to %q", rr.Code, loc)
+	}
+
+	// its availability isn't reported
+	postedData := url.Values{}
+	postedData.Add("start", "2050-01-01")
+	postedData.Add("end", "2050-01-03")
+	postedData.Add("room_id", fmt.Sprint(roomID))
+	req, _ = http.NewRequest("POST", "/search-availability-json", strings.NewReader(postedData.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(Repo.AvailabilityJSON).ServeHTTP(rr, req)
+
+	var body jsonResponse
+	json.Unmarshal(rr.Body.Bytes(), &body)
+	if body.OK {
+		t.Errorf("expected the retired room to be unavailable, got %+v", body)
+	}
+
+	// and a reservation already in the session isn't made
+	postedData = url.Values{}
+	postedData.Add("first_name", "John")
+	postedData.Add("last_name", "Smith")
+	postedData.Add("email", "j@smith.com")
+	req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+	ctx = getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "reservation", res)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(Repo.PostReservation).ServeHTTP(rr, req)
+	if rr.Code != http.StatusTemporaryRedirect {
+		t.Errorf("expected PostReservation to refuse the retired room, got %d", rr.Code)
+	}
+	if available, _ := mem.SearchAvailabilityByDatesByRoomID(sd, ed, roomID); !available {
+		t.Error("expected no reservation to be made")
+	}
+}
+
+func TestRepository_StayRules(t *testing.T) {
+	mem := dbrepo.NewMemoryRepo(&app)
+
+	roomID, err := mem.InsertRoom(models.Room{RoomName: "General's Quarters", Slug: "generals-quarters", MaxOccupancy: 2, Price: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mem.InsertStayRule(models.StayRule{RoomID: roomID, Type: models.StayRuleMinNights, Nights: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Stays must be at least 3 nights"
+
+	saved := Repo
+	NewHandlers(&Repository{App: &app, DB: mem})
+	defer NewHandlers(saved)
+
+	routes := getRoutes()
+
+	// the search explains why the room isn't offered, and suggests nothing that breaks the rule either
+	req, _ := http.NewRequest("GET", "/search-availability/results?start=2099-01-10&end=2099-01-12&adults=2", nil)
+	rr := httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), expected) {
+		t.Errorf("expected the search page with %q, got %d", expected, rr.Code)
+	}
+	if strings.Contains(rr.Body.String(), `id="alternatives"`) {
+		t.Error("expected no alternatives, since every shorter or shifted stay breaks the rule")
+	}
+
+	req, _ = http.NewRequest("GET", "/search-availability/results?start=2099-01-10&end=2099-01-13&adults=2", nil)
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "General&#39;s Quarters") {
+		t.Errorf("expected the room to be offered for 3 nights, got %d", rr.Code)
+	}
+
+	postedData := url.Values{}
+	postedData.Add("start", "2099-01-10")
+	postedData.Add("end", "2099-01-12")
+	postedData.Add("room_id", fmt.Sprint(roomID))
+
+	req, _ = http.NewRequest("POST", "/search-availability-json", strings.NewReader(postedData.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(Repo.AvailabilityJSON).ServeHTTP(rr, req)
+
+	var body jsonResponse
+	json.Unmarshal(rr.Body.Bytes(), &body)
+	if body.OK || len(body.Errors) != 1 || body.Errors[0] != expected || body.Message != expected+"." {
+		t.Errorf("expected unavailable with %q, got %+v", expected, body)
+	}
+
+	// a room whose rules can't be read isn't reported available
+	mem.Fail("StayRulesByRoomID", errors.New("connection reset"))
+	postedData.Set("end", "2099-01-13")
+	req, _ = http.NewRequest("POST", "/search-availability-json", strings.NewReader(postedData.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(Repo.AvailabilityJSON).ServeHTTP(rr, req)
+
+	body = jsonResponse{}
+	json.Unmarshal(rr.Body.Bytes(), &body)
+	if body.OK || body.Message == "" {
+		t.Errorf("expected unavailable with an error message when the rules can't be read, got %+v", body)
+	}
+	mem.Fail("StayRulesByRoomID", nil)
+
+	// the reservation form refuses the stay too
+	sd, _ := dates.Parse("2099-01-10")
+	ed, _ := dates.Parse("2099-01-12")
+
+	postedData = url.Values{}
+	postedData.Add("first_name", "John")
+	postedData.Add("last_name", "Smith")
+	postedData.Add("email", "j@smith.com")
+
+	req, _ = http.NewRequest("POST", "/make-reservation", strings.NewReader(postedData.Encode()))
+	ctx := getCtx(req)
+	req = req.WithContext(ctx)
+	session.Put(ctx, "reservation", models.Reservation{RoomID: roomID, StartDate: sd, EndDate: ed})
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(Repo.PostReservation).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), expected) {
+		t.Errorf("expected the reservation form with %q, got %d", expected, rr.Code)
+	}
+	if available, _ := mem.SearchAvailabilityByDatesByRoomID(sd, ed, roomID); !available {
+		t.Error("expected no reservation to be made")
+	}
+}
+
+func TestRepository_APIAvailabilityStayRules(t *testing.T) {
+	newTestDB(t)
+
+	req, _ := http.NewRequest("GET", "/api/v1/availability?start=2050-01-01&end=2050-01-02&room_id=2", nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	rr := httptest.NewRecorder()
+
+	getAPIRoutes().ServeHTTP(rr, req)
+
+	var body struct {
+		Data apiAvailability `json:"data"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &body)
+
+	if rr.Code != http.StatusOK || len(body.Data.StayRules) != 1 || body.Data.Available == nil || *body.Data.Available {
+		t.Errorf("expected room 2 to be unavailable under its stay rules, got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRepository_AdminRoomRules(t *testing.T) {
+	newTestDB(t)
+
+	var tests = []struct {
+		name         string
+		method       string
+		url          string
+		data         url.Values
+		expectedCode int
+	}{
+		{"rules page", "GET", "/admin/rooms/2/rules", nil, http.StatusOK},
+		{"rules of unknown room", "GET", "/admin/rooms/100/rules", nil, http.StatusNotFound},
+		{"add rule", "POST", "/admin/rooms/1/rules",
+			url.Values{"type": {"min_nights"}, "nights": {"2"}, "weekdays": {"5", "6"}}, http.StatusSeeOther},
+		{"add seasonal rule", "POST", "/admin/rooms/1/rules",
+			url.Values{"type": {"arrival_days"}, "weekdays": {"6"}, "start_date": {"2050-07-01"}, "end_date": {"2050-07-31"}},
+			http.StatusSeeOther},
+		{"add rule without nights", "POST", "/admin/rooms/1/rules", url.Values{"type": {"max_nights"}}, http.StatusOK},
+		{"add rule of unknown type", "POST", "/admin/rooms/1/rules", url.Values{"type": {"nope"}}, http.StatusOK},
+		{"add arrival days without days", "POST", "/admin/rooms/1/rules", url.Values{"type": {"arrival_days"}}, http.StatusOK},
+		{"add rule with unknown day", "POST", "/admin/rooms/1/rules",
+			url.Values{"type": {"no_arrival"}, "weekdays": {"7"}}, http.StatusOK},
+		{"add rule with reversed dates", "POST", "/admin/rooms/1/rules",
+			url.Values{"type": {"no_arrival"}, "start_date": {"2050-07-31"}, "end_date": {"2050-07-01"}}, http.StatusOK},
+		{"delete rule", "POST", "/admin/rooms/2/rules/1/delete", nil, http.StatusSeeOther},
+		{"delete rule of another room", "POST", "/admin/rooms/1/rules/1/delete", nil, http.StatusNotFound},
+		{"delete unknown rule", "POST", "/admin/rooms/2/rules/100/delete", nil, http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.data.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		getAdminRoutes().ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d, got %d", e.name, e.expectedCode, rr.Code)
+		}
+	}
+}
+
+func TestRepository_AdminReservationChanges(t *testing.T) {
+	db := newTestDB(t)
+
+	subscriptionID, err := db.InsertWebhookSubscription(models.WebhookSubscription{URL: "https://example.com/all",
+		Secret: "secret", Events: webhooks.EventTypes, Active: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the seeded data's events have been sent already
+	seeded, err := db.PendingOutboxEvents(100, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range seeded {
+		db.MarkOutboxEventPublished(e.ID)
+	}
+
+	var tests = []struct {
+		name             string
+		method           string
+		url              string
+		data             url.Values
+		expectedCode     int
+		expectedLocation string
+	}{
+		{"lookup page", "GET", "/admin/reservations", nil, http.StatusOK, ""},
+		{"lookup", "GET", "/admin/reservations?code=testcode", nil, http.StatusSeeOther, "/admin/reservations/TESTCODE"},
+		{"reservation", "GET", "/admin/reservations/TESTCODE", nil, http.StatusOK, ""},
+		{"unknown reservation", "GET", "/admin/reservations/NOPE", nil, http.StatusNotFound, ""},
+		{"update with invalid email", "POST", "/admin/reservations/TESTCODE",
+			url.Values{"first_name": {"Jonathan"}, "last_name": {"Smith"}, "email": {"nope"}}, http.StatusOK, ""},
+		{"update", "POST", "/admin/reservations/TESTCODE",
+			url.Values{"first_name": {"Jonathan"}, "last_name": {"Smith"}, "email": {"jonathan@smith.com"}},
+			http.StatusSeeOther, "/admin/reservations/TESTCODE"},
+		{"cancel", "POST", "/admin/reservations/TESTCODE/cancel", nil, http.StatusSeeOther, "/admin/reservations/TESTCODE"},
+		{"cancelled reservation", "GET", "/admin/reservations/TESTCODE", nil, http.StatusOK, ""},
+		{"update cancelled reservation", "POST", "/admin/reservations/TESTCODE",
+			url.Values{"first_name": {"Johnny"}, "last_name": {"Smith"}, "email": {"johnny@smith.com"}},
+			http.StatusSeeOther, "/admin/reservations/TESTCODE"},
+		{"block the cancelled nights", "POST", "/admin/rooms/1/blocks",
+			url.Values{"block_start": {"2050-06-01"}, "block_end": {"2050-06-03"}}, http.StatusSeeOther, "/admin/rooms/1/rules"},
+		{"block blocked nights", "POST", "/admin/rooms/1/blocks",
+			url.Values{"block_start": {"2050-06-02"}, "block_end": {"2050-06-04"}}, http.StatusOK, ""},
+		{"block past nights", "POST", "/admin/rooms/1/blocks",
+			url.Values{"block_start": {"2020-01-01"}, "block_end": {"2020-01-03"}}, http.StatusOK, ""},
+		{"block without dates", "POST", "/admin/rooms/1/blocks", url.Values{}, http.StatusOK, ""},
+		{"block unknown room", "POST", "/admin/rooms/100/blocks",
+			url.Values{"block_start": {"2050-06-01"}, "block_end": {"2050-06-03"}}, http.StatusNotFound, ""},
+	}
+
+	for _, e := range tests {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.data.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		getAdminRoutes().ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected status code %d, got %d", e.name, e.expectedCode, rr.Code)
+		}
+		if e.expectedLocation != "" && rr.Header().Get("Location") != e.expectedLocation {
+			t.Errorf("%s: expected a redirect to %s, got %q", e.name, e.expectedLocation, rr.Header().Get("Location"))
+		}
+	}
+
+	res, err := db.GetReservationByCode("TESTCODE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.FirstName != "Jonathan" || res.Email != "jonathan@smith.com" || !res.Cancelled() {
+		t.Errorf("expected the updated guest and the cancellation, got %+v", res)
+	}
+
+	// each change is sent to the webhooks subscribed to it
+	bus := events.NewBus()
+	Repo.Subscribe(bus)
+
+	pending, err := db.PendingOutboxEvents(100, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range pending {
+		if err = bus.Publish(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliveries, err := db.WebhookDeliveries(subscriptionID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent []string
+	for _, d := range deliveries {
+		sent = append(sent, d.EventType)
+	}
+	sort.Strings(sent)
+	if strings.Join(sent, " ") != "block.created reservation.cancelled reservation.updated" {
+		t.Errorf("expected a webhook for the update, the cancellation and the block, got %v", sent)
+	}
 }
@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/models"
+	"github.com/ashrielbrian/go_bookings/internal/repository"
+)
+
+// idempotencyTTL is how long the outcome of a request made with an idempotency key is remembered
+const idempotencyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLength is the longest idempotency key accepted
+const maxIdempotencyKeyLength = 255
+
+// idempotencyWait is how long a repeated booking form submission waits for the first one to finish
+var idempotencyWait = 5 * time.Second
+
+// idempotencyPoll is how often a repeated booking form submission checks whether the first one has finished
+const idempotencyPoll = 100 * time.Millisecond
+
+// Idempotency API error codes
+const (
+	apiErrInProgress   = "request_in_progress"
+	apiErrKeyReused    = "idempotency_key_reused"
+	apiErrKeyMalformed = "idempotency_key_invalid"
+)
+
+// APIIdempotency makes requests carrying an Idempotency-Key header safe to retry. The first request with a key is
+// handled as usual and its response stored; repeats within 24 hours get the stored response back instead of being
+// handled again. Keys belong to the API key that used them. It must be used after APIKeyAuth
+func (m *Repository) APIIdempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			writeAPIError(w, http.StatusBadRequest, apiErrKeyMalformed, "Idempotency-Key is too long.", nil)
+			return
+		}
+
+		apiKey, ok := APIKeyFromContext(r.Context())
+		if !ok {
+			writeUnauthorized(w, "Missing API key.")
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAPIBodySize))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, apiErrBadRequest, "Request body is too large.", nil)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		claim := models.IdempotencyKey{
+			Scope:       "api:" + apiKey.Prefix,
+			Key:         key,
+			RequestHash: requestHash(r, body),
+			ExpiresAt:   m.App.Now().Add(idempotencyTTL),
+		}
+
+		existing, claimed, err := m.DB.ClaimIdempotencyKey(claim)
+		if err != nil {
+			m.apiServerError(w, err)
+			return
+		}
+
+		if !claimed {
+			switch {
+			case existing.RequestHash != claim.RequestHash:
+				writeAPIError(w, http.StatusUnprocessableEntity, apiErrKeyReused,
+					"This Idempotency-Key was used for a different request.", nil)
+			case !existing.Completed():
+				writeAPIError(w, http.StatusConflict, apiErrInProgress,
+					"A request with this Idempotency-Key is still being processed.", nil)
+			default:
+				replayAPIResponse(w, existing)
+			}
+			return
+		}
+
+		// a panicking handler leaves no response to store, so the key is released for the client to retry rather
+		// than left in progress until it expires
+		handled := false
+		defer func() {
+			if handled {
+				return
+			}
+			if err := m.DB.ReleaseIdempotencyKey(claim.Scope, claim.Key); err != nil {
+				m.App.ErrorLog.Println(err)
+			}
+		}()
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		handled = true
+
+		// server errors may not happen again, so let the client retry rather than replaying them
+		if rec.status >= http.StatusInternalServerError {
+			err = m.DB.ReleaseIdempotencyKey(claim.Scope, claim.Key)
+		} else {
+			claim.StatusCode = rec.status
+			claim.Location = rec.Header().Get("Location")
+			claim.Body = rec.body.String()
+			err = m.DB.CompleteIdempotencyKey(claim)
+		}
+
+		if err != nil {
+			m.App.ErrorLog.Println(err)
+		}
+	})
+}
+
+// replayAPIResponse writes the response stored with an idempotency key
+func replayAPIResponse(w http.ResponseWriter, k models.IdempotencyKey) {
+	if k.Location != "" {
+		w.Header().Set("Location", k.Location)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(k.StatusCode)
+	w.Write([]byte(k.Body))
+}
+
+// requestHash identifies a request, so that an idempotency key can't be reused for a different one
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder passes a response through while keeping a copy of its status and body
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// webIdempotencyScope returns the scope of the booking form's idempotency keys in the guest's session. The keys come
+// from the form, so a key is only honoured in the session that was given it, and a guest sending someone else's
+// key can't get their booking back. The scope holds a hash of the session token rather than the token itself. It
+// returns "" when the request has no session yet
+func (m *Repository) webIdempotencyScope(r *http.Request) string {
+	token := m.App.Session.Token(r.Context())
+	if token == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(token))
+
+	return "web:" + hex.EncodeToString(sum[:])
+}
+
+// bookingRequestHash identifies a booking form submission by its fields and the stay it books, so that an
+// idempotency token can't be reused for a different booking
+func bookingRequestHash(r *http.Request, res models.Reservation) string {
+	stay := fmt.Sprintf("\n%d %s %s", res.RoomID, res.StartDate, res.EndDate)
+
+	return requestHash(r, []byte(r.PostForm.Encode()+stay))
+}
+
+// claimBookingToken claims the idempotency token of a booking form submission, identified by hash. When the token
+// has already been used it sends the guest to the outcome of the first submission and returns false
+func (m *Repository) claimBookingToken(w http.ResponseWriter, r *http.Request, token, hash string) bool {
+	scope := m.webIdempotencyScope(r)
+
+	existing, claimed, err := m.DB.ClaimIdempotencyKey(models.IdempotencyKey{
+		Scope:       scope,
+		Key:         token,
+		RequestHash: hash,
+		ExpiresAt:   m.App.Now().Add(idempotencyTTL),
+	})
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Error inserting reservation!")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return false
+	}
+
+	if claimed {
+		return true
+	}
+
+	if existing.RequestHash != hash {
+		// the form was changed after it was submitted; a fresh one has a new token
+		m.App.Session.Put(r.Context(), "error", "This form has already been submitted. Please check your details and submit it again.")
+		http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+		return false
+	}
+
+	// a double click sends the second submission while the first is still being saved. The polls are counted as
+	// well as timed, so that a clock that has been stopped can't keep the guest waiting
+	deadline := m.App.Now().Add(idempotencyWait)
+	for polls := idempotencyWait / idempotencyPoll; polls > 0 && !existing.Completed() && m.App.Now().Before(deadline); polls-- {
+		time.Sleep(idempotencyPoll)
+
+		existing, err = m.DB.GetIdempotencyKey(scope, token)
+		if errors.Is(err, repository.ErrNotFound) {
+			// the first submission failed, and the guest was told so
+			break
+		}
+		if err != nil {
+			m.App.ErrorLog.Println(err)
+			break
+		}
+	}
+
+	if !existing.Completed() {
+		m.App.Session.Put(r.Context(), "error", "Your reservation is still being processed. Please wait a moment before checking again.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return false
+	}
+
+	reservation, err := m.DB.GetReservationByCode(existing.Body)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Can't find your reservation")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return false
+	}
+
+	m.App.Session.Put(r.Context(), "reservation", reservation)
+	http.Redirect(w, r, existing.Location, existing.StatusCode)
+
+	return false
+}
+
+// completeBookingToken records the outcome of a booking form submission. A failed booking releases the token so
+// that the guest can submit the form again
+func (m *Repository) completeBookingToken(r *http.Request, token string, reservation models.Reservation, ok bool) {
+	if token == "" {
+		return
+	}
+
+	scope := m.webIdempotencyScope(r)
+
+	var err error
+	if ok {
+		err = m.DB.CompleteIdempotencyKey(models.IdempotencyKey{
+			Scope:      scope,
+			Key:        token,
+			StatusCode: http.StatusSeeOther,
+			Location:   "/reservation-summary",
+			Body:       reservation.Code,
+		})
+	} else {
+		err = m.DB.ReleaseIdempotencyKey(scope, token)
+	}
+
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+	}
+}
+
+// PurgeIdempotencyKeys deletes expired idempotency keys every interval until done is closed
+func (m *Repository) PurgeIdempotencyKeys(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			n, err := m.DB.DeleteExpiredIdempotencyKeys()
+			if err != nil {
+				m.App.ErrorLog.Println(err)
+				continue
+			}
+			if n > 0 {
+				m.App.InfoLog.Println("Deleted " + strconv.Itoa(n) + " expired idempotency keys")
+			}
+		}
+	}
+}
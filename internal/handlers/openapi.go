@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/ashrielbrian/go_bookings/internal/apikeys"
+	"github.com/ashrielbrian/go_bookings/internal/openapi"
+)
+
+// apiSpec is built once, the first time it is requested
+var (
+	apiSpecOnce sync.Once
+	apiSpecJSON []byte
+)
+
+// APIOpenAPI serves the OpenAPI document describing the API
+func (m *Repository) APIOpenAPI(w http.ResponseWriter, r *http.Request) {
+	apiSpecOnce.Do(func() {
+		apiSpecJSON, _ = json.MarshalIndent(APISpec(), "", "  ")
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(apiSpecJSON)
+}
+
+// APISpec returns the OpenAPI document describing every API route. Schemas are generated from the
+// types the handlers encode and decode, so only the routes themselves need to be kept up to date here
+func APISpec() *openapi.Document {
+	doc := openapi.New(openapi.Info{
+		Title:   "Bookings API",
+		Version: "1",
+		Description: "Every response is JSON. Successful responses wrap their result in a data member and failed " +
+			"responses carry an error member instead. Prices are in minor units of the property's base currency.",
+	})
+
+	doc.Components.SecuritySchemes["apiKey"] = openapi.SecurityScheme{
+		Type:         "http",
+		Scheme:       "bearer",
+		BearerFormat: "gb_<prefix>_<secret>",
+		Description:  "An API key issued by the property. Each operation lists the scope the key needs.",
+	}
+	doc.Security = []map[string][]string{{"apiKey": {}}}
+
+	doc.Define("Price", apiPrice{})
+	doc.Define("RoomImage", apiRoomImage{})
+	room := doc.Define("Room", apiRoom{})
+	availability := doc.Define("Availability", apiAvailability{})
+	reservationRequest := doc.Define("ReservationRequest", apiReservationRequest{})
+	reservation := doc.Define("Reservation", apiReservation{})
+	doc.Define("Error", apiError{})
+
+	doc.Add("GET", "/api/v1/rooms", &openapi.Operation{
+		OperationID: "listRooms",
+		Summary:     "List rooms",
+		Description: requiresScope(apikeys.ScopeRoomsRead),
+		Tags:        []string{"Rooms"},
+		Responses: apiResponses(map[string]openapi.Response{
+			"200": dataResponse("The rooms that can be booked", &openapi.Schema{Type: "array", Items: room}),
+		}, "401", "403"),
+	})
+
+	doc.Add("GET", "/api/v1/rooms/{id}", &openapi.Operation{
+		OperationID: "getRoom",
+		Summary:     "Get a room",
+		Description: requiresScope(apikeys.ScopeRoomsRead),
+		Tags:        []string{"Rooms"},
+		Parameters: []openapi.Parameter{
+			{Name: "id", In: "path", Required: true, Schema: &openapi.Schema{Type: "integer"}},
+		},
+		Responses: apiResponses(map[string]openapi.Response{
+			"200": dataResponse("The room", room),
+		}, "401", "403", "404"),
+	})
+
+	doc.Add("GET", "/api/v1/availability", &openapi.Operation{
+		OperationID: "getAvailability",
+		Summary:     "Check availability",
+		Description: "Checks whether a room is free for the given dates, or lists every free room when no room_id is given. " +
+			"Rooms whose stay rules, such as a minimum number of nights, the dates break are not free. " +
+			requiresScope(apikeys.ScopeAvailabilityRead),
+		Tags: []string{"Availability"},
+		Parameters: []openapi.Parameter{
+			{Name: "start", In: "query", Required: true, Description: "Arrival date", Schema: &openapi.Schema{Type: "string", Format: "date"}},
+			{Name: "end", In: "query", Required: true, Description: "Departure date", Schema: &openapi.Schema{Type: "string", Format: "date"}},
+			{Name: "room_id", In: "query", Description: "Only check this room", Schema: &openapi.Schema{Type: "integer"}},
+			{Name: "adults", In: "query", Description: "Defaults to 1", Schema: &openapi.Schema{Type: "integer"}},
+			{Name: "children", In: "query", Description: "Defaults to 0", Schema: &openapi.Schema{Type: "integer"}},
+		},
+		Responses: apiResponses(map[string]openapi.Response{
+			"200": dataResponse("The availability", availability),
+		}, "401", "403", "404", "422"),
+	})
+
+	doc.Add("POST", "/api/v1/reservations", &openapi.Operation{
+		OperationID: "createReservation",
+		Summary:     "Book a room",
+		Description: "Send an Idempotency-Key header to make the request safe to retry: repeating it with the same key " +
+			"within 24 hours returns the original response, marked with an Idempotent-Replayed header, instead of " +
+			"booking again. " + requiresScope(apikeys.ScopeReservationsWrite),
+		Tags: []string{"Reservations"},
+		Parameters: []openapi.Parameter{
+			{Name: "Idempotency-Key", In: "header", Description: "A unique value, such as a UUID, of up to 255 characters", Schema: &openapi.Schema{Type: "string"}},
+		},
+		RequestBody: &openapi.RequestBody{
+			Required: true,
+			Content:  map[string]openapi.MediaType{"application/json": {Schema: reservationRequest}},
+		},
+		Responses: apiResponses(map[string]openapi.Response{
+			"201": withLocation(dataResponse("The reservation was made", reservation)),
+			"409": errorResponse("The room is not available for those dates, or a request with the same Idempotency-Key is still in progress"),
+			"422": errorResponse("The request has invalid fields, the dates break the room's stay rules, or its Idempotency-Key was used for a different request"),
+		}, "400", "401", "403"),
+	})
+
+	doc.Add("GET", "/api/v1/reservations/{code}", &openapi.Operation{
+		OperationID: "getReservation",
+		Summary:     "Get a reservation",
+		Description: "Only reservations made with the partner's own API keys can be read. " + requiresScope(apikeys.ScopeReservationsRead),
+		Tags:        []string{"Reservations"},
+		Parameters: []openapi.Parameter{
+			{Name: "code", In: "path", Required: true, Description: "The reservation's confirmation code", Schema: &openapi.Schema{Type: "string"}},
+		},
+		Responses: apiResponses(map[string]openapi.Response{
+			"200": dataResponse("The reservation", reservation),
+			"404": errorResponse("No reservation has the code, or it was made by another partner"),
+		}, "401", "403"),
+	})
+
+	return doc
+}
+
+// commonErrors describes the errors shared by many operations
+var commonErrors = map[string]string{
+	"400": "The request body is not valid JSON",
+	"401": "The API key is missing, invalid or revoked",
+	"403": "The API key does not have the scope needed",
+	"404": "Not found",
+	"422": "The request has invalid fields",
+}
+
+// apiResponses adds the given common errors, along with the rate limit and catch-all server errors, to an operation's responses
+func apiResponses(responses map[string]openapi.Response, errors ...string) map[string]openapi.Response {
+	for _, status := range errors {
+		responses[status] = errorResponse(commonErrors[status])
+	}
+	responses["429"] = withRetryAfter(errorResponse("The API key has made too many requests"))
+	responses["500"] = errorResponse("Something went wrong")
+
+	return responses
+}
+
+func dataResponse(description string, schema *openapi.Schema) openapi.Response {
+	return openapi.Response{
+		Description: description,
+		Content: map[string]openapi.MediaType{"application/json": {Schema: &openapi.Schema{
+			Type:       "object",
+			Properties: map[string]*openapi.Schema{"data": schema},
+			Required:   []string{"data"},
+		}}},
+	}
+}
+
+func errorResponse(description string) openapi.Response {
+	return openapi.Response{
+		Description: description,
+		Content:     map[string]openapi.MediaType{"application/json": {Schema: openapi.Ref("Error")}},
+	}
+}
+
+func withLocation(r openapi.Response) openapi.Response {
+	r.Headers = map[string]openapi.Header{
+		"Location": {Description: "URL of the new reservation", Schema: &openapi.Schema{Type: "string"}},
+	}
+	return r
+}
+
+func withRetryAfter(r openapi.Response) openapi.Response {
+	r.Headers = map[string]openapi.Header{
+		"Retry-After": {Description: "Seconds until the request can be retried", Schema: &openapi.Schema{Type: "integer"}},
+	}
+	return r
+}
+
+func requiresScope(scope string) string {
+	return "Requires the " + scope + " scope."
+}
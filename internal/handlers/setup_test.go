@@ -12,9 +12,16 @@ import (
 	"time"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/ashrielbrian/go_bookings/internal/apikeys"
 	"github.com/ashrielbrian/go_bookings/internal/config"
+	"github.com/ashrielbrian/go_bookings/internal/currency"
+	"github.com/ashrielbrian/go_bookings/internal/dates"
+	"github.com/ashrielbrian/go_bookings/internal/helpers"
 	"github.com/ashrielbrian/go_bookings/internal/models"
 	"github.com/ashrielbrian/go_bookings/internal/render"
+	"github.com/ashrielbrian/go_bookings/internal/repository/dbrepo"
+	"github.com/ashrielbrian/go_bookings/internal/stayrules"
+	"github.com/ashrielbrian/go_bookings/internal/storage"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/justinas/nosurf"
@@ -23,13 +30,19 @@ import (
 var app config.AppConfig
 var session *scs.SessionManager
 var pathToTemplates = "./../../templates"
-var functions = template.FuncMap{}
+var functions = template.FuncMap{
+	"formatCurrency": currency.Format,
+	"displayPrice":   render.DisplayPrice,
+	"currencies":     currency.Supported,
+	"stayRule":       stayrules.Message,
+}
 
 func TestMain(m *testing.M) {
 	gob.Register(models.Reservation{})
 
 	// change this to true when deploying to production
 	app.InProduction = false
+	app.BaseCurrency = "USD"
 
 	session = scs.New()
 	session.Lifetime = 24 * time.Hour
@@ -51,11 +64,185 @@ func TestMain(m *testing.M) {
 
 	app.TemplateCache = tc
 
+	uploads, err := os.MkdirTemp("", "uploads")
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.Storage = storage.NewLocal(uploads, "/uploads")
+
 	render.NewRenderer(&app)
+	helpers.NewHelpers(&app)
 	repo := NewTestRepository(&app)
+	if err := seedTestDB(repo.DB.(*dbrepo.MemoryRepo)); err != nil {
+		log.Fatal(err)
+	}
 	NewHandlers(repo)
 
-	os.Exit(m.Run())
+	code := m.Run()
+	os.RemoveAll(uploads)
+	os.Exit(code)
+}
+
+// API keys of the seeded partners
+const (
+	testAPIKey         = "gb_testall0_secret"
+	testReadOnlyAPIKey = "gb_testread_secret"
+	testRevokedAPIKey  = "gb_testrevk_secret"
+	testOtherAPIKey    = "gb_testothr_secret"
+)
+
+// newTestDB points the handlers at a database of the test's own, seeded by seedTestDB, until the test ends
+func newTestDB(t *testing.T) *dbrepo.MemoryRepo {
+	t.Helper()
+
+	repo := NewTestRepository(&app)
+	db := repo.DB.(*dbrepo.MemoryRepo)
+
+	err := seedTestDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := Repo
+	NewHandlers(repo)
+	t.Cleanup(func() { NewHandlers(saved) })
+
+	return db
+}
+
+// seedTestDB stores the data the handler tests rely on:
+//
+//   - room 1, General's Quarters, sleeps 2 and sells early check-in and late check-out. It has the Sea view amenity
+//     and image 1, and reservation TESTCODE from 1 to 3 June 2050
+//   - room 2, Major's Suite, sleeps 4, has the Kitchen, a turnover day, stay rule 1 of at least 2 nights and an owner
+//     block from 1 to 8 March 2050
+//   - EUR and GBP exchange rates
+//   - partner 1, Test Travel, with testAPIKey, testReadOnlyAPIKey and the revoked testRevokedAPIKey, and its
+//     reservation PARTNER1 of room 1 from 1 to 3 July 2050
+//   - partner 2, Other Travel, with testOtherAPIKey
+//   - webhook subscription 1 to reservation.created
+func seedTestDB(db *dbrepo.MemoryRepo) error {
+	rooms := []models.Room{
+		{
+			RoomName:          "General's Quarters",
+			Slug:              "generals-quarters",
+			MaxOccupancy:      2,
+			BedTypes:          "1 Queen",
+			Price:             10000,
+			SizeSqm:           30,
+			CheckInTime:       "15:00",
+			CheckOutTime:      "11:00",
+			EarlyCheckInPrice: 2500,
+			LateCheckOutPrice: 2000,
+		},
+		{
+			RoomName:     "Major's Suite",
+			Slug:         "majors-suite",
+			MaxOccupancy: 4,
+			BedTypes:     "1 King, 1 Sofa bed",
+			Price:        15000,
+			SizeSqm:      45,
+			CheckInTime:  "14:00",
+			CheckOutTime: "10:00",
+			TurnoverDays: 1,
+		},
+	}
+	for i, room := range rooms {
+		id, err := db.InsertRoom(room)
+		if err != nil {
+			return err
+		}
+		if err = db.SetRoomAmenities(id, []int{i + 1}); err != nil {
+			return err
+		}
+	}
+
+	_, err := db.InsertRoomImage(models.RoomImage{RoomID: 1, URL: "/static/images/generals-quarters.png"})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.InsertStayRule(models.StayRule{RoomID: 2, Type: models.StayRuleMinNights, Nights: 2})
+	if err != nil {
+		return err
+	}
+
+	err = db.InsertRoomRestriction(models.RoomRestriction{RoomID: 2, RestrictionID: 2, StartDate: dates.New(2050, 3, 1),
+		EndDate: dates.New(2050, 3, 8)})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.CreateBooking(models.Reservation{
+		Code:      "TESTCODE",
+		FirstName: "John",
+		LastName:  "Smith",
+		Email:     "j@smith.com",
+		RoomID:    1,
+		StartDate: dates.New(2050, 6, 1),
+		EndDate:   dates.New(2050, 6, 3),
+		Adults:    2,
+	}, models.Payment{Amount: 20000, BaseAmount: 20000, Currency: "USD", ExchangeRate: 1})
+	if err != nil {
+		return err
+	}
+
+	for currency, rate := range map[string]float64{"EUR": 0.9, "GBP": 0.8} {
+		if err = db.UpsertExchangeRate(currency, rate); err != nil {
+			return err
+		}
+	}
+
+	partnerID, err := db.InsertPartner(models.Partner{Name: "Test Travel", Email: "api@testtravel.com"})
+	if err != nil {
+		return err
+	}
+
+	keys := []models.APIKey{
+		{Name: "Bookings", Prefix: "testall0", Hash: apikeys.Hash(testAPIKey), Scopes: apikeys.Scopes},
+		{Name: "Search", Prefix: "testread", Hash: apikeys.Hash(testReadOnlyAPIKey),
+			Scopes: []string{apikeys.ScopeRoomsRead, apikeys.ScopeAvailabilityRead}},
+		{Name: "Old", Prefix: "testrevk", Hash: apikeys.Hash(testRevokedAPIKey), Scopes: apikeys.Scopes},
+	}
+	for _, k := range keys {
+		k.PartnerID = partnerID
+		if _, err = db.InsertAPIKey(k); err != nil {
+			return err
+		}
+	}
+	if err = db.RevokeAPIKey(3); err != nil {
+		return err
+	}
+
+	_, err = db.CreateBooking(models.Reservation{
+		Code:      "PARTNER1",
+		FirstName: "Jane",
+		LastName:  "Smith",
+		Email:     "jane@smith.com",
+		RoomID:    1,
+		StartDate: dates.New(2050, 7, 1),
+		EndDate:   dates.New(2050, 7, 3),
+		Adults:    2,
+		PartnerID: partnerID,
+	}, models.Payment{Amount: 20000, BaseAmount: 20000, Currency: "USD", ExchangeRate: 1})
+	if err != nil {
+		return err
+	}
+
+	otherID, err := db.InsertPartner(models.Partner{Name: "Other Travel", Email: "api@othertravel.com"})
+	if err != nil {
+		return err
+	}
+	_, err = db.InsertAPIKey(models.APIKey{PartnerID: otherID, Name: "Bookings", Prefix: "testothr",
+		Hash: apikeys.Hash(testOtherAPIKey), Scopes: apikeys.Scopes})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.InsertWebhookSubscription(models.WebhookSubscription{URL: "https://example.com/hooks", Secret: "secret",
+		Events: []string{"reservation.created"}, Active: true})
+
+	return err
 }
 
 func getRoutes() http.Handler {
@@ -72,14 +259,31 @@ func getRoutes() http.Handler {
 	mux.Get("/search-availability", Repo.Availability)
 	mux.Post("/search-availability-json", Repo.AvailabilityJSON)
 	mux.Post("/search-availability", Repo.PostAvailability)
+	mux.Get("/search-availability/results", Repo.AvailabilityResults)
 
-	mux.Get("/generals-quarters", Repo.Generals)
-	mux.Get("/majors-suite", Repo.Majors)
+	mux.Get("/rooms", Repo.Rooms)
+	mux.Get("/rooms/{slug}", Repo.Room)
+	mux.Get("/rooms/{slug}/availability", Repo.RoomAvailability)
 
 	mux.Get("/make-reservation", Repo.Reservation)
 	mux.Get("/reservation-summary", Repo.ReservationSummary)
 	mux.Post("/make-reservation", Repo.PostReservation)
 
+	mux.Post("/set-currency", Repo.SetCurrency)
+
+	mux.Get("/user/login", Repo.ShowLogin)
+	mux.Post("/user/login", Repo.PostShowLogin)
+	mux.Get("/user/logout", Repo.Logout)
+
+	mux.Get("/admin/exchange-rates", Repo.AdminExchangeRates)
+	mux.Get("/admin/rooms", Repo.AdminRooms)
+	mux.Get("/admin/rooms/new", Repo.AdminNewRoom)
+	mux.Get("/admin/rooms/{id}", Repo.AdminShowRoom)
+	mux.Get("/admin/api-keys", Repo.AdminAPIKeys)
+	mux.Get("/admin/webhooks", Repo.AdminWebhooks)
+
+	mux.Get("/api/openapi.json", Repo.APIOpenAPI)
+
 	// serve static files
 	fileServer := http.FileServer(http.Dir("./static/"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
@@ -87,6 +291,55 @@ func getRoutes() http.Handler {
 	return mux
 }
 
+// getAdminRoutes returns a router for the admin handlers that take URL parameters, without authentication
+func getAdminRoutes() http.Handler {
+	mux := chi.NewRouter()
+	mux.Use(SessionLoad)
+
+	mux.Post("/admin/rooms/{id}", Repo.AdminPostShowRoom)
+	mux.Post("/admin/rooms/{id}/retire", Repo.AdminRetireRoom)
+	mux.Get("/admin/rooms/{id}/images", Repo.AdminRoomImages)
+	mux.Post("/admin/rooms/{id}/images", Repo.AdminPostRoomImages)
+	mux.Post("/admin/rooms/{id}/images/{imageID}", Repo.AdminPostRoomImage)
+	mux.Post("/admin/rooms/{id}/images/{imageID}/delete", Repo.AdminDeleteRoomImage)
+	mux.Get("/admin/rooms/{id}/rules", Repo.AdminRoomRules)
+	mux.Post("/admin/rooms/{id}/rules", Repo.AdminPostRoomRule)
+	mux.Post("/admin/rooms/{id}/rules/{ruleID}/delete", Repo.AdminDeleteRoomRule)
+	mux.Post("/admin/rooms/{id}/blocks", Repo.AdminPostRoomBlock)
+	mux.Get("/admin/reservations", Repo.AdminReservations)
+	mux.Get("/admin/reservations/{code}", Repo.AdminReservation)
+	mux.Post("/admin/reservations/{code}", Repo.AdminPostReservation)
+	mux.Post("/admin/reservations/{code}/cancel", Repo.AdminCancelReservation)
+	mux.Post("/admin/api-keys", Repo.AdminPostAPIKey)
+	mux.Post("/admin/api-keys/{id}/revoke", Repo.AdminRevokeAPIKey)
+	mux.Post("/admin/partners", Repo.AdminPostPartner)
+	mux.Post("/admin/webhooks", Repo.AdminPostWebhook)
+	mux.Get("/admin/webhooks/{id}", Repo.AdminWebhook)
+	mux.Post("/admin/webhooks/{id}/delete", Repo.AdminDeleteWebhook)
+	mux.Get("/admin/cache", Repo.AdminCacheStats)
+
+	return mux
+}
+
+// getAPIRoutes returns the API router, which authenticates with API keys instead of sessions
+func getAPIRoutes() http.Handler {
+	mux := chi.NewRouter()
+
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.Use(Repo.APIKeyAuth)
+		mux.NotFound(Repo.APINotFound)
+		mux.MethodNotAllowed(Repo.APIMethodNotAllowed)
+
+		mux.With(RequireScope(apikeys.ScopeRoomsRead)).Get("/rooms", Repo.APIRooms)
+		mux.With(RequireScope(apikeys.ScopeRoomsRead)).Get("/rooms/{id}", Repo.APIRoom)
+		mux.With(RequireScope(apikeys.ScopeAvailabilityRead)).Get("/availability", Repo.APIAvailability)
+		mux.With(RequireScope(apikeys.ScopeReservationsWrite), Repo.APIIdempotency).Post("/reservations", Repo.APICreateReservation)
+		mux.With(RequireScope(apikeys.ScopeReservationsRead)).Get("/reservations/{code}", Repo.APIReservation)
+	})
+
+	return mux
+}
+
 // NoSurf adds CSRF protection to all POST request
 func NoSurf(next http.Handler) http.Handler {
 	csrfHandler := nosurf.New(next)
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/ashrielbrian/go_bookings/internal/events"
+	"github.com/ashrielbrian/go_bookings/internal/models"
+	"github.com/ashrielbrian/go_bookings/internal/repository"
+	"github.com/ashrielbrian/go_bookings/internal/webhooks"
+)
+
+// Subscribe registers the side effects of domain events with the event bus
+func (m *Repository) Subscribe(bus *events.Bus) {
+	bus.Subscribe(events.ReservationCreated, m.reservationWebhook(webhooks.ReservationCreated))
+	bus.Subscribe(events.ReservationUpdated, m.reservationWebhook(webhooks.ReservationUpdated))
+	bus.Subscribe(events.ReservationCancelled, m.reservationWebhook(webhooks.ReservationCancelled))
+	bus.Subscribe(events.BlockCreated, m.blockCreatedWebhook)
+}
+
+// apiBlock is the data of block.created webhooks: nights a room can't be booked that aren't for a reservation
+type apiBlock struct {
+	RoomID    int    `json:"room_id"`
+	RoomName  string `json:"room_name"`
+	StartDate string `json:"start_date" format:"date" doc:"First night blocked"`
+	EndDate   string `json:"end_date" format:"date" doc:"Day after the last night blocked"`
+}
+
+// reservationWebhook returns a handler queueing the webhook of type webhookType for a reservation event. The webhook
+// carries the reservation as it is when the event is handled
+func (m *Repository) reservationWebhook(webhookType string) events.Handler {
+	return func(e models.OutboxEvent) error {
+		var payload events.Reservation
+		err := events.Decode(e, &payload)
+		if err != nil {
+			return err
+		}
+
+		reservation, err := m.DB.GetReservationByCode(payload.Code)
+		if errors.Is(err, repository.ErrNotFound) {
+			// there is nothing to send, and retrying won't change that
+			m.App.ErrorLog.Println("reservation " + payload.Code + " no longer exists")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return m.queueWebhook(e, webhookType, m.apiReservationFrom(reservation))
+	}
+}
+
+// blockCreatedWebhook queues the block.created webhook for a new block
+func (m *Repository) blockCreatedWebhook(e models.OutboxEvent) error {
+	var payload events.Block
+	err := events.Decode(e, &payload)
+	if err != nil {
+		return err
+	}
+
+	room, err := m.DB.GetRoomByID(payload.RoomID)
+	if errors.Is(err, repository.ErrNotFound) {
+		m.App.ErrorLog.Println("room " + strconv.Itoa(payload.RoomID) + " no longer exists")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return m.queueWebhook(e, webhooks.BlockCreated, apiBlock{
+		RoomID:    room.ID,
+		RoomName:  room.RoomName,
+		StartDate: payload.StartDate.String(),
+		EndDate:   payload.EndDate.String(),
+	})
+}
+
+// queueWebhook queues a webhook event for the subscriptions to its type. The webhook event's ID comes from the
+// domain event, so queueing it again when the domain event is redelivered doesn't send it twice
+func (m *Repository) queueWebhook(e models.OutboxEvent, eventType string, data interface{}) error {
+	event := webhooks.Event{
+		ID:        "evt_" + strconv.Itoa(e.ID),
+		Type:      eventType,
+		CreatedAt: e.CreatedAt.UTC(),
+		Data:      data,
+	}
+
+	payload, err := webhooks.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return m.DB.EnqueueWebhookDeliveries(event.ID, event.Type, payload)
+}
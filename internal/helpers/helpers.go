@@ -1,9 +1,12 @@
 package helpers
 
 import (
+	"crypto/rand"
 	"fmt"
 	"net/http"
+	"regexp"
 	"runtime/debug"
+	"strings"
 
 	"github.com/ashrielbrian/go_bookings/internal/config"
 )
@@ -24,3 +27,35 @@ func ServerError(w http.ResponseWriter, err error) {
 	app.ErrorLog.Println(trace)
 	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
+
+// IsAuthenticated returns true if a user is logged in
+func IsAuthenticated(r *http.Request) bool {
+	return app.Session.Exists(r.Context(), "user_id")
+}
+
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Slugify turns a name such as "General's Quarters" into a URL-friendly slug such as "generals-quarters"
+func Slugify(name string) string {
+	slug := strings.ToLower(strings.ReplaceAll(name, "'", ""))
+	slug = nonSlugChars.ReplaceAllString(slug, "-")
+	return strings.Trim(slug, "-")
+}
+
+// reservationCodeChars leaves out characters that are easily confused, such as 0 and O
+const reservationCodeChars = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// NewReservationCode returns a random code guests can use to refer to their reservation
+func NewReservationCode() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+
+	for i := range b {
+		b[i] = reservationCodeChars[int(b[i])%len(reservationCodeChars)]
+	}
+
+	return string(b)
+}
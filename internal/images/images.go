@@ -0,0 +1,181 @@
+package images
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"net/http"
+
+	// register the decoders for the accepted upload formats
+	_ "image/gif"
+	_ "image/png"
+)
+
+// MaxUploadSize is the largest image file accepted, in bytes
+const MaxUploadSize = 8 << 20
+
+// maxPixels guards against images that are small on disk but huge once decoded
+const maxPixels = 40_000_000
+
+var (
+	// ErrTooLarge is returned for files over MaxUploadSize or with too many pixels
+	ErrTooLarge = errors.New("image is too large")
+	// ErrUnsupportedType is returned for files that are not JPEG, PNG or GIF images
+	ErrUnsupportedType = errors.New("image must be a JPEG, PNG or GIF")
+)
+
+// allowedTypes are the sniffed content types accepted for upload
+var allowedTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// Size is a bounding box that an image variant is scaled down to fit within
+type Size struct {
+	Name      string
+	MaxWidth  int
+	MaxHeight int
+}
+
+var (
+	// Thumbnail is used in room listings
+	Thumbnail = Size{Name: "thumb", MaxWidth: 400, MaxHeight: 300}
+	// Web is used on the room page
+	Web = Size{Name: "web", MaxWidth: 1600, MaxHeight: 1200}
+)
+
+// Decode validates and decodes an uploaded image, checking its size and sniffing its type from its contents
+func Decode(r io.Reader) (image.Image, error) {
+	br := bufio.NewReaderSize(io.LimitReader(r, MaxUploadSize+1), 512)
+
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if !allowedTypes[http.DetectContentType(head)] {
+		return nil, ErrUnsupportedType
+	}
+
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(br)
+	if err != nil {
+		return nil, err
+	}
+	if n > MaxUploadSize {
+		return nil, ErrTooLarge
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return nil, ErrUnsupportedType
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return nil, ErrTooLarge
+	}
+
+	img, _, err := image.Decode(&buf)
+	if err != nil {
+		return nil, ErrUnsupportedType
+	}
+
+	return img, nil
+}
+
+// Resize scales img down to fit within size, preserving its aspect ratio. Images that already fit are
+// returned unchanged; images are never scaled up.
+func Resize(img image.Image, size Size) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	if w <= size.MaxWidth && h <= size.MaxHeight {
+		return img
+	}
+
+	dw, dh := size.MaxWidth, h*size.MaxWidth/w
+	if dh > size.MaxHeight {
+		dw, dh = w*size.MaxHeight/h, size.MaxHeight
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	// box filter: each destination pixel is the average of the source pixels it covers
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, (y+1)*h/dh
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, (x+1)*w/dw
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(src.Pix[i])
+					g += uint32(src.Pix[i+1])
+					bl += uint32(src.Pix[i+2])
+					a += uint32(src.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(bl / n), A: uint8(a / n)})
+		}
+	}
+
+	return dst
+}
+
+// EncodeJPEG encodes img as a JPEG, flattening any transparency onto a white background
+func EncodeJPEG(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	flat := image.NewRGBA(b)
+	draw.Draw(flat, b, image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, b, img, b.Min, draw.Over)
+
+	return jpeg.Encode(w, flat, &jpeg.Options{Quality: 85})
+}
+
+// Variants decodes an uploaded image and returns it encoded as a JPEG at each of sizes, keyed by size name
+func Variants(r io.Reader, sizes ...Size) (map[string][]byte, error) {
+	img, err := Decode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	variants := make(map[string][]byte)
+
+	for _, size := range sizes {
+		var buf bytes.Buffer
+
+		err = EncodeJPEG(&buf, Resize(img, size))
+		if err != nil {
+			return nil, err
+		}
+
+		variants[size.Name] = buf.Bytes()
+	}
+
+	return variants, nil
+}
@@ -0,0 +1,81 @@
+package images
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func testPNG(t *testing.T, w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	if _, err := Decode(bytes.NewReader(testPNG(t, 10, 10))); err != nil {
+		t.Errorf("expected png to decode, got %v", err)
+	}
+
+	if _, err := Decode(strings.NewReader("<html>not an image</html>")); err != ErrUnsupportedType {
+		t.Errorf("expected ErrUnsupportedType, got %v", err)
+	}
+
+	big := append(testPNG(t, 1, 1), make([]byte, MaxUploadSize)...)
+	if _, err := Decode(bytes.NewReader(big)); err != ErrTooLarge {
+		t.Errorf("expected ErrTooLarge, got %v", err)
+	}
+}
+
+func TestResize(t *testing.T) {
+	img, _ := Decode(bytes.NewReader(testPNG(t, 800, 400)))
+
+	resized := Resize(img, Size{MaxWidth: 400, MaxHeight: 300})
+	if b := resized.Bounds(); b.Dx() != 400 || b.Dy() != 200 {
+		t.Errorf("expected 400x200, got %dx%d", b.Dx(), b.Dy())
+	}
+
+	r, g, bl, _ := resized.At(10, 10).RGBA()
+	if r>>8 != 200 || g>>8 != 100 || bl>>8 != 50 {
+		t.Errorf("expected colour to be preserved, got %d %d %d", r>>8, g>>8, bl>>8)
+	}
+
+	tall := Resize(img, Size{MaxWidth: 1000, MaxHeight: 100})
+	if b := tall.Bounds(); b.Dx() != 200 || b.Dy() != 100 {
+		t.Errorf("expected 200x100, got %dx%d", b.Dx(), b.Dy())
+	}
+
+	if same := Resize(img, Size{MaxWidth: 1600, MaxHeight: 1200}); same != img {
+		t.Error("expected small image to be returned unchanged")
+	}
+}
+
+func TestVariants(t *testing.T) {
+	variants, err := Variants(bytes.NewReader(testPNG(t, 2000, 1000)), Thumbnail, Web)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []Size{Thumbnail, Web} {
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(variants[size.Name]))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if format != "jpeg" || cfg.Width != size.MaxWidth {
+			t.Errorf("%s: expected %d wide jpeg, got %d wide %s", size.Name, size.MaxWidth, cfg.Width, format)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/clock"
+	"github.com/ashrielbrian/go_bookings/internal/driver"
+)
+
+// ErrModified is returned when a migration that has been applied has since been edited or removed. Migrations
+// must not be changed once applied; add a new one instead
+var ErrModified = errors.New("applied migration has been modified")
+
+// ErrUnknownVersion is returned when asked to migrate to a version that has no migration
+var ErrUnknownVersion = errors.New("no migration with that version")
+
+// Migration is a pair of up and down SQL scripts
+type Migration struct {
+	Version  int64
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// Status describes a migration and whether it has been applied. Migrations that are recorded as applied but
+// no longer exist are included with Missing set
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+	Modified  bool
+	Missing   bool
+}
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Load reads the migrations in the root of fsys, ordered by version. Every migration needs both an up and a
+// down script
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	var haveUp, haveDown = make(map[int64]bool), make(map[int64]bool)
+
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+
+		b, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has scripts named %s and %s", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = string(b)
+			haveUp[version] = true
+		} else {
+			m.Down = string(b)
+			haveDown[version] = true
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for version, m := range byVersion {
+		if !haveUp[version] || !haveDown[version] {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down script", version, m.Name)
+		}
+
+		sum := sha256.Sum256([]byte(m.Up + "\x00" + m.Down))
+		m.Checksum = hex.EncodeToString(sum[:])
+
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Migrator applies migrations to a database, recording them in the schema_migrations table
+type Migrator struct {
+	DB *sql.DB
+	// Dialect is driver.Postgres or driver.SQLite
+	Dialect    string
+	Migrations []Migration
+	InfoLog    *log.Logger
+	// Clock stamps the migrations as they are applied; the system clock is used when it is nil
+	Clock clock.Clock
+}
+
+// New creates a migrator for the migrations in fsys, which must be written for the database's dialect
+func New(db *sql.DB, dialect string, fsys fs.FS, infoLog *log.Logger) (*Migrator, error) {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{DB: db, Dialect: dialect, Migrations: migrations, InfoLog: infoLog, Clock: clock.Real{}}, nil
+}
+
+// now returns the time on the migrator's clock
+func (m *Migrator) now() time.Time {
+	if m.Clock == nil {
+		return time.Now()
+	}
+	return m.Clock.Now()
+}
+
+// applied is a row of the schema_migrations table
+type applied struct {
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+// Status returns every migration, and every applied migration that no longer exists, ordered by version
+func (m *Migrator) Status() ([]Status, error) {
+	done, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []Status
+	known := make(map[int64]bool)
+
+	for _, mig := range m.Migrations {
+		known[mig.Version] = true
+
+		s := Status{Migration: mig}
+		if a, ok := done[mig.Version]; ok {
+			s.Applied = true
+			s.AppliedAt = a.appliedAt
+			s.Modified = a.checksum != mig.Checksum
+		}
+
+		statuses = append(statuses, s)
+	}
+
+	for version, a := range done {
+		if !known[version] {
+			statuses = append(statuses, Status{
+				Migration: Migration{Version: version, Name: a.name, Checksum: a.checksum},
+				Applied:   true,
+				AppliedAt: a.appliedAt,
+				Missing:   true,
+			})
+		}
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+
+	return statuses, nil
+}
+
+// Up applies every pending migration, returning how many were applied
+func (m *Migrator) Up() (int, error) {
+	return m.migrate(func(mig Migration, isApplied bool) bool { return !isApplied })
+}
+
+// Down reverts the latest steps applied migrations, returning how many were reverted
+func (m *Migrator) Down(steps int) (int, error) {
+	done, err := m.check()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i := len(m.Migrations) - 1; i >= 0 && n < steps; i-- {
+		if _, ok := done[m.Migrations[i].Version]; !ok {
+			continue
+		}
+
+		err = m.revert(m.Migrations[i])
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// To applies or reverts migrations until exactly those up to and including version are applied. Version 0
+// reverts every migration. It returns how many migrations were applied or reverted
+func (m *Migrator) To(version int64) (int, error) {
+	if version != 0 && !m.has(version) {
+		return 0, fmt.Errorf("%w: %d", ErrUnknownVersion, version)
+	}
+
+	done, err := m.check()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i := len(m.Migrations) - 1; i >= 0; i-- {
+		mig := m.Migrations[i]
+		if _, ok := done[mig.Version]; !ok || mig.Version <= version {
+			continue
+		}
+
+		err = m.revert(mig)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	applied, err := m.migrate(func(mig Migration, isApplied bool) bool { return !isApplied && mig.Version <= version })
+
+	return n + applied, err
+}
+
+// migrate applies the migrations, in order, for which apply returns true
+func (m *Migrator) migrate(apply func(mig Migration, isApplied bool) bool) (int, error) {
+	done, err := m.check()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, mig := range m.Migrations {
+		_, isApplied := done[mig.Version]
+		if !apply(mig, isApplied) {
+			continue
+		}
+
+		err = m.run(mig, mig.Up, `insert into schema_migrations (version, name, checksum, applied_at) values ($1, $2, $3, $4)`,
+			mig.Version, mig.Name, mig.Checksum, m.now())
+		if err != nil {
+			return n, err
+		}
+
+		m.InfoLog.Printf("Applied migration %d_%s", mig.Version, mig.Name)
+		n++
+	}
+
+	return n, nil
+}
+
+// revert runs a migration's down script
+func (m *Migrator) revert(mig Migration) error {
+	err := m.run(mig, mig.Down, `delete from schema_migrations where version = $1`, mig.Version)
+	if err != nil {
+		return err
+	}
+
+	m.InfoLog.Printf("Reverted migration %d_%s", mig.Version, mig.Name)
+
+	return nil
+}
+
+// run runs a migration script and records it in one transaction, so that a failed migration leaves nothing behind
+func (m *Migrator) run(mig Migration, script, record string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, script)
+	if err != nil {
+		return fmt.Errorf("migration %d_%s: %w", mig.Version, mig.Name, err)
+	}
+
+	_, err = tx.ExecContext(ctx, record, args...)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// check returns the applied migrations, failing if any of them has been modified or removed since
+func (m *Migrator) check() (map[int64]applied, error) {
+	done, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	checksums := make(map[int64]string)
+	for _, mig := range m.Migrations {
+		checksums[mig.Version] = mig.Checksum
+	}
+
+	for version, a := range done {
+		sum, ok := checksums[version]
+		if !ok {
+			return nil, fmt.Errorf("%w: %d_%s no longer exists", ErrModified, version, a.name)
+		}
+		if sum != a.checksum {
+			return nil, fmt.Errorf("%w: %d_%s has been edited", ErrModified, version, a.name)
+		}
+	}
+
+	return done, nil
+}
+
+// applied returns the applied migrations by version, creating the schema_migrations table if needed
+func (m *Migrator) applied() (map[int64]applied, error) {
+	err := m.createTable()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `select version, name, checksum, applied_at from schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	done := make(map[int64]applied)
+	for rows.Next() {
+		var version int64
+		var a applied
+
+		err = rows.Scan(&version, &a.name, &a.checksum, &a.appliedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		done[version] = a
+	}
+
+	return done, rows.Err()
+}
+
+// createTable creates the schema_migrations table. When it doesn't exist yet but the database has been migrated
+// with soda, the first migration, which creates the tables soda did, and any others soda has applied are recorded
+// as applied
+func (m *Migrator) createTable() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	exists, err := m.tableExists(ctx, "schema_migrations")
+	if err != nil || exists {
+		return err
+	}
+
+	latest, found, err := m.sodaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if found && len(m.Migrations) > 0 && latest < m.Migrations[0].Version {
+		latest = m.Migrations[0].Version
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `create table schema_migrations (
+		version bigint primary key,
+		name varchar(255) not null,
+		checksum varchar(64) not null,
+		applied_at timestamp not null
+	)`)
+	if err != nil {
+		return err
+	}
+
+	for _, mig := range m.Migrations {
+		if mig.Version > latest {
+			break
+		}
+
+		_, err = tx.ExecContext(ctx, `insert into schema_migrations (version, name, checksum, applied_at) values ($1, $2, $3, $4)`,
+			mig.Version, mig.Name, mig.Checksum, m.now())
+		if err != nil {
+			return err
+		}
+
+		m.InfoLog.Printf("Adopted migration %d_%s applied by soda", mig.Version, mig.Name)
+	}
+
+	return tx.Commit()
+}
+
+// tableExists reports whether the database has a table with the given name
+func (m *Migrator) tableExists(ctx context.Context, name string) (bool, error) {
+	query := `select exists (select 1 from information_schema.tables where table_schema = current_schema() and table_name = $1)`
+	if m.Dialect == driver.SQLite {
+		query = `select count(*) > 0 from sqlite_master where type = 'table' and name = $1`
+	}
+
+	var exists bool
+	err := m.DB.QueryRowContext(ctx, query, name).Scan(&exists)
+
+	return exists, err
+}
+
+// sodaVersion returns the latest version recorded in soda's schema_migration table, and whether the table exists
+func (m *Migrator) sodaVersion(ctx context.Context) (int64, bool, error) {
+	exists, err := m.tableExists(ctx, "schema_migration")
+	if err != nil || !exists {
+		return 0, false, err
+	}
+
+	var latest sql.NullString
+	err = m.DB.QueryRowContext(ctx, `select max(version) from schema_migration`).Scan(&latest)
+	if err != nil || !latest.Valid {
+		return 0, true, err
+	}
+
+	version, err := strconv.ParseInt(latest.String, 10, 64)
+
+	return version, true, err
+}
+
+// has reports whether there is a migration with the given version
+func (m *Migrator) has(version int64) bool {
+	for _, mig := range m.Migrations {
+		if mig.Version == version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package migrate
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/ashrielbrian/go_bookings/internal/driver"
+	"github.com/ashrielbrian/go_bookings/migrations"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"20240102000000_add_rooms.up.sql":     {Data: []byte("create table rooms ();")},
+		"20240102000000_add_rooms.down.sql":   {Data: []byte("drop table rooms;")},
+		"20240101000000_add_users.up.sql":     {Data: []byte("create table users ();")},
+		"20240101000000_add_users.down.sql":   {Data: []byte("drop table users;")},
+		"migrations.go":                       {Data: []byte("package migrations")},
+		"20240103000000_add_extra.down.sql/x": {Data: []byte("")},
+	}
+
+	migrations, err := Load(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migrations) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(migrations))
+	}
+	if migrations[0].Version != 20240101000000 || migrations[0].Name != "add_users" || migrations[0].Down != "drop table users;" {
+		t.Errorf("unexpected first migration %+v", migrations[0])
+	}
+	if migrations[1].Version != 20240102000000 {
+		t.Errorf("expected the migrations in version order, got %d second", migrations[1].Version)
+	}
+	if migrations[0].Checksum == "" || migrations[0].Checksum == migrations[1].Checksum {
+		t.Error("expected each migration to have its own checksum")
+	}
+
+	// editing either script changes the checksum
+	fsys["20240101000000_add_users.down.sql"] = &fstest.MapFile{Data: []byte("drop table if exists users;")}
+	edited, err := Load(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited[0].Checksum == migrations[0].Checksum {
+		t.Error("expected editing the down script to change the checksum")
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		fsys fstest.MapFS
+	}{
+		{"missing down", fstest.MapFS{
+			"20240101000000_add_users.up.sql": {Data: []byte("create table users ();")},
+		}},
+		{"missing up", fstest.MapFS{
+			"20240101000000_add_users.down.sql": {Data: []byte("drop table users;")},
+		}},
+		{"mismatched names", fstest.MapFS{
+			"20240101000000_add_users.up.sql":  {Data: []byte("create table users ();")},
+			"20240101000000_add_user.down.sql": {Data: []byte("drop table users;")},
+		}},
+	}
+
+	for _, tt := range tests {
+		if _, err := Load(tt.fsys); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestLoad_Embedded(t *testing.T) {
+	for _, dialect := range []string{driver.Postgres, driver.SQLite} {
+		fsys, err := migrations.For(dialect)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		loaded, err := Load(fsys)
+		if err != nil {
+			t.Fatalf("%s: %v", dialect, err)
+		}
+
+		if len(loaded) == 0 {
+			t.Errorf("%s: expected migrations", dialect)
+		}
+	}
+}
+
+// newSQLiteMigrator returns a migrator for a new SQLite database
+func newSQLiteMigrator(t *testing.T, fsys fs.FS) *Migrator {
+	db, err := driver.Connect(driver.SQLite, filepath.Join(t.TempDir(), "test.db"), driver.DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.SQL.Close() })
+
+	m, err := New(db.SQL, driver.SQLite, fsys, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestMigrator_SQLite(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1_add_users.up.sql":   {Data: []byte("create table users (id integer primary key);")},
+		"1_add_users.down.sql": {Data: []byte("drop table users;")},
+		"2_add_rooms.up.sql":   {Data: []byte("create table rooms (id integer primary key);")},
+		"2_add_rooms.down.sql": {Data: []byte("drop table rooms;")},
+		"3_bad.up.sql":         {Data: []byte("create table bad (id integer primary key); select * from nowhere;")},
+		"3_bad.down.sql":       {Data: []byte("drop table bad;")},
+	}
+	m := newSQLiteMigrator(t, fsys)
+
+	n, err := m.To(2)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 migrations applied, got %d, %v", n, err)
+	}
+
+	n, err = m.Up()
+	if err == nil || n != 0 {
+		t.Fatalf("expected the failing migration to apply nothing, got %d, %v", n, err)
+	}
+
+	var tables int
+	err = m.DB.QueryRow(`select count(*) from sqlite_master where type = 'table' and name = 'bad'`).Scan(&tables)
+	if err != nil || tables != 0 {
+		t.Errorf("expected the failed migration to be rolled back, got %d tables, %v", tables, err)
+	}
+
+	n, err = m.Down(1)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 migration reverted, got %d, %v", n, err)
+	}
+
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 3 || !statuses[0].Applied || statuses[1].Applied || statuses[2].Applied {
+		t.Errorf("unexpected statuses %+v", statuses)
+	}
+
+	fsys["1_add_users.up.sql"] = &fstest.MapFile{Data: []byte("create table users (id integer);")}
+	m.Migrations, err = Load(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.Up()
+	if !errors.Is(err, ErrModified) {
+		t.Errorf("expected ErrModified, got %v", err)
+	}
+}
+
+func TestMigrator_SQLiteEmbedded(t *testing.T) {
+	fsys, err := migrations.For(driver.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newSQLiteMigrator(t, fsys)
+
+	_, err = m.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := m.To(0)
+	if err != nil || n != len(m.Migrations) {
+		t.Fatalf("expected every migration reverted, got %d, %v", n, err)
+	}
+}
+
+func TestMigrator_ToUnknownVersion(t *testing.T) {
+	m := &Migrator{Migrations: []Migration{{Version: 1, Name: "add_users"}}}
+
+	_, err := m.To(2)
+	if !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("expected ErrUnknownVersion, got %v", err)
+	}
+}
@@ -1,6 +1,10 @@
 package models
 
-import "time"
+import (
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/dates"
+)
 
 // User is the users model
 type User struct {
@@ -17,12 +21,126 @@ type User struct {
 
 // Room is the rooms model
 type Room struct {
+	ID           int
+	RoomName     string
+	Slug         string
+	Description  string
+	MaxOccupancy int
+	BedTypes     string
+	Price        int // nightly price in the property's base currency, in minor units
+	SizeSqm      int
+	Retired      bool
+	CheckInTime  string // local time at the property guests can arrive from, as HH:MM
+	CheckOutTime string // local time at the property guests must leave by, as HH:MM
+	// EarlyCheckInPrice and LateCheckOutPrice are what the add-ons cost per stay, in the base currency's minor
+	// units; 0 when the room doesn't offer them
+	EarlyCheckInPrice int
+	LateCheckOutPrice int
+	TurnoverDays      int // days kept free for cleaning between stays
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+	Amenities         []Amenity
+	Images            []RoomImage
+}
+
+// TimeLayout is the format of check-in and check-out times
+const TimeLayout = "15:04"
+
+// The check-in and check-out times of rooms that don't set their own
+const (
+	DefaultCheckInTime  = "15:00"
+	DefaultCheckOutTime = "11:00"
+)
+
+// RoomFilter narrows down and orders the rooms returned by an availability search
+type RoomFilter struct {
+	Guests     int
+	AmenityIDs []int  // rooms must have every one of these amenities
+	BedType    string // rooms must have a bed of this type, eg. "King"
+	MinPrice   int    // in the base currency's minor units; 0 for no minimum
+	MaxPrice   int    // in the base currency's minor units; 0 for no maximum
+	Sort       string // one of the RoomSort values; empty sorts by name
+}
+
+// Narrowed reports whether the filter has any condition beyond the number of guests
+func (f RoomFilter) Narrowed() bool {
+	return len(f.AmenityIDs) > 0 || f.BedType != "" || f.MinPrice > 0 || f.MaxPrice > 0
+}
+
+// StayRule limits the stays that can be booked in a room. A rule with dates only applies to stays arriving on
+// StartDate through EndDate; either may be zero to leave that side open
+type StayRule struct {
+	ID        int
+	RoomID    int
+	Type      string // one of the StayRule types
+	Nights    int    // for the minimum and maximum nights rules
+	Weekdays  []time.Weekday
+	StartDate dates.Date
+	EndDate   dates.Date
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// The types of stay rule
+const (
+	// StayRuleMinNights needs stays of at least Nights nights; with Weekdays, only stays including a night on one
+	// of them, eg. a weekend minimum stay
+	StayRuleMinNights = "min_nights"
+	// StayRuleMaxNights allows stays of at most Nights nights
+	StayRuleMaxNights = "max_nights"
+	// StayRuleArrivalDays allows arrivals only on Weekdays
+	StayRuleArrivalDays = "arrival_days"
+	// StayRuleNoArrival closes the room to arrivals; with Weekdays, only on those days
+	StayRuleNoArrival = "no_arrival"
+)
+
+// StayRuleTypes are the types of stay rule
+var StayRuleTypes = []string{StayRuleMinNights, StayRuleMaxNights, StayRuleArrivalDays, StayRuleNoArrival}
+
+// DayAvailability is whether a room is free for the night beginning on Date
+type DayAvailability struct {
+	Date      dates.Date
+	Available bool
+}
+
+// The orders rooms can be sorted in
+const (
+	RoomSortPriceAsc  = "price_asc"
+	RoomSortPriceDesc = "price_desc"
+	RoomSortSizeAsc   = "size_asc"
+	RoomSortSizeDesc  = "size_desc"
+)
+
+// BedTypes are the bed types rooms can be filtered by
+var BedTypes = []string{"King", "Queen", "Double", "Twin", "Single", "Sofa bed"}
+
+// Amenity is the amenities model
+type Amenity struct {
 	ID        int
-	RoomName  string
+	Name      string
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
 
+// RoomImage is the room images model
+type RoomImage struct {
+	ID           int
+	RoomID       int
+	URL          string
+	ThumbnailURL string
+	StorageKey   string // prefix of the stored files; empty for images not uploaded through the admin
+	Caption      string
+	SortOrder    int
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// IDs of the restrictions every database has
+const (
+	RestrictionReservation = 1
+	RestrictionOwnerBlock  = 2
+)
+
 // Restriction is the restriction model
 type Restriction struct {
 	ID              int
@@ -34,24 +152,110 @@ type Restriction struct {
 // Reservation is the reservation model
 type Reservation struct {
 	ID        int
+	Code      string
 	FirstName string
 	LastName  string
 	Email     string
 	Phone     string
 	RoomID    int
-	StartDate time.Time
-	EndDate   time.Time
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	Room      Room
+	StartDate dates.Date
+	EndDate   dates.Date
+	Adults    int
+	Children  int
+	// EarlyCheckIn and LateCheckOut are the paid add-ons: the room is kept empty the night before the stay, so
+	// the guests can arrive at the check-out time, or the night it ends, so they can leave at the check-in time
+	EarlyCheckIn bool
+	LateCheckOut bool
+	// PartnerID is the partner whose API key made the reservation, or 0 for a booking made on the website
+	PartnerID int
+	// CancelledAt is when the reservation was cancelled, freeing its nights, and zero while it stands
+	CancelledAt time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Room        Room
+}
+
+// Cancelled reports whether the reservation has been cancelled
+func (r Reservation) Cancelled() bool {
+	return !r.CancelledAt.IsZero()
+}
+
+// Guests returns the number of people staying
+func (r Reservation) Guests() int {
+	return r.Adults + r.Children
+}
+
+// Nights returns the number of nights in the reservation
+func (r Reservation) Nights() int {
+	return r.EndDate.Sub(r.StartDate)
+}
+
+// Total returns the price of the reservation's nights and add-ons in Room, in the base currency's minor units
+func (r Reservation) Total() int {
+	total := r.Nights() * r.Room.Price
+	if r.EarlyCheckIn {
+		total += r.Room.EarlyCheckInPrice
+	}
+	if r.LateCheckOut {
+		total += r.Room.LateCheckOutPrice
+	}
+	return total
+}
+
+// Held returns the nights the stay needs the room empty for, from the first up to, but not including, the last:
+// its own nights, and the nights before and after it that its add-ons keep empty
+func (r Reservation) Held() (dates.Date, dates.Date) {
+	start, end := r.StartDate, r.EndDate
+	if r.EarlyCheckIn {
+		start = start.AddDate(0, 0, -1)
+	}
+	if r.LateCheckOut {
+		end = end.AddDate(0, 0, 1)
+	}
+	return start, end
+}
+
+// Occupied returns the nights the reservation's room restriction blocks: the nights it holds, widened by the
+// room's turnover days on both sides. A stay that doesn't overlap them is then at least turnoverDays from it
+func (r Reservation) Occupied(turnoverDays int) (dates.Date, dates.Date) {
+	start, end := r.Held()
+	return start.AddDate(0, 0, -turnoverDays), end.AddDate(0, 0, turnoverDays)
+}
+
+// CheckIn returns when the guests can arrive at the room, in loc, the property's time zone
+func (r Reservation) CheckIn(loc *time.Location) time.Time {
+	if r.EarlyCheckIn {
+		return at(r.StartDate, r.Room.CheckOutTime, DefaultCheckOutTime, loc)
+	}
+	return at(r.StartDate, r.Room.CheckInTime, DefaultCheckInTime, loc)
+}
+
+// CheckOut returns when the guests must leave the room, in loc, the property's time zone
+func (r Reservation) CheckOut(loc *time.Location) time.Time {
+	if r.LateCheckOut {
+		return at(r.EndDate, r.Room.CheckInTime, DefaultCheckInTime, loc)
+	}
+	return at(r.EndDate, r.Room.CheckOutTime, DefaultCheckOutTime, loc)
+}
+
+// at returns the time hm, in TimeLayout, on d in loc, or the time def when hm isn't set
+func at(d dates.Date, hm, def string, loc *time.Location) time.Time {
+	t, err := time.Parse(TimeLayout, hm)
+	if err != nil {
+		t, _ = time.Parse(TimeLayout, def)
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	return d.At(t.Hour(), t.Minute(), loc)
 }
 
 // RoomRestriction is the room restriction db model
 type RoomRestriction struct {
 	ID            int
 	RoomID        int
-	StartDate     time.Time
-	EndDate       time.Time
+	StartDate     dates.Date
+	EndDate       dates.Date
 	CreatedAt     time.Time
 	UpdatedAt     time.Time
 	Room          Room
@@ -60,3 +264,135 @@ type RoomRestriction struct {
 	RestrictionID int
 	Restriction   Restriction
 }
+
+// ExchangeRate is the exchange rate model; Rate is the number of units of Currency per unit of the base currency
+type ExchangeRate struct {
+	ID        int
+	Currency  string
+	Rate      float64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Payment is the payment model; Amount is in minor units of Currency
+type Payment struct {
+	ID            int
+	ReservationID int
+	Amount        int
+	Currency      string
+	BaseAmount    int
+	BaseCurrency  string
+	ExchangeRate  float64
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// Partner is a travel agent or other business that books rooms through the API
+type Partner struct {
+	ID        int
+	Name      string
+	Email     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// APIKey is the API key model. Only a hash of the key is stored; Prefix is the public part of the key that
+// identifies it. LastUsedAt and RevokedAt are zero when the key hasn't been used or revoked
+type APIKey struct {
+	ID             int
+	PartnerID      int
+	Partner        Partner
+	Name           string
+	Prefix         string
+	Hash           string
+	Scopes         []string
+	LastUsedAt     time.Time
+	RevokedAt      time.Time
+	Requests       int
+	RecentRequests int
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// Revoked reports whether the key has been revoked
+func (k APIKey) Revoked() bool {
+	return !k.RevokedAt.IsZero()
+}
+
+// HasScope reports whether the key has been granted scope
+func (k APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IdempotencyKey records the outcome of a request made with an idempotency key, so that repeating the request
+// returns the same outcome instead of doing the work again. StatusCode is zero while the first request is in progress
+type IdempotencyKey struct {
+	Scope       string
+	Key         string
+	RequestHash string
+	StatusCode  int
+	Location    string
+	Body        string
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// Completed reports whether the request that claimed the key has finished
+func (k IdempotencyKey) Completed() bool {
+	return k.StatusCode != 0
+}
+
+// WebhookSubscription is an endpoint that is sent the events it subscribes to
+type WebhookSubscription struct {
+	ID        int
+	URL       string
+	Secret    string
+	Events    []string
+	Active    bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Webhook delivery statuses
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed"
+)
+
+// WebhookDelivery is an attempt, or series of attempts, to send an event to a subscription. Payload is the JSON body
+// sent; Subscription holds the URL and secret it is sent with
+type WebhookDelivery struct {
+	ID             int
+	SubscriptionID int
+	Subscription   WebhookSubscription
+	EventID        string
+	EventType      string
+	Payload        string
+	Status         string
+	Attempts       int
+	ResponseCode   int
+	Error          string
+	NextAttemptAt  time.Time
+	LastAttemptAt  time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// OutboxEvent is a domain event recorded in the same transaction as the change it describes, and published to
+// the event bus afterwards. Payload is JSON whose shape depends on Type
+type OutboxEvent struct {
+	ID            int
+	Type          string
+	Payload       string
+	Attempts      int
+	LastError     string
+	NextAttemptAt time.Time
+	PublishedAt   time.Time
+	CreatedAt     time.Time
+}
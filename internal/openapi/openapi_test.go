@@ -0,0 +1,89 @@
+package openapi
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type testPrice struct {
+	Amount int `json:"amount" doc:"Amount in minor units"`
+}
+
+type testThing struct {
+	ID        int               `json:"id"`
+	Day       string            `json:"day" format:"date"`
+	Price     testPrice         `json:"price"`
+	Tags      []string          `json:"tags,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Available *bool             `json:"available,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	Ignored   string            `json:"-"`
+	private   string
+}
+
+func TestDocument_SchemaFor(t *testing.T) {
+	d := New(Info{Title: "Test", Version: "1"})
+	d.Define("Price", testPrice{})
+
+	s := d.SchemaFor(testThing{})
+
+	if s.Type != "object" {
+		t.Fatalf("expected object, got %q", s.Type)
+	}
+
+	expected := map[string]string{"id": "integer", "day": "string", "tags": "array", "labels": "object", "available": "boolean", "created_at": "string"}
+	for name, typ := range expected {
+		if s.Properties[name] == nil || s.Properties[name].Type != typ {
+			t.Errorf("expected %s to be %s, got %+v", name, typ, s.Properties[name])
+		}
+	}
+
+	if s.Properties["day"].Format != "date" || s.Properties["created_at"].Format != "date-time" {
+		t.Error("expected date formats")
+	}
+
+	if s.Properties["price"].Ref != "#/components/schemas/Price" {
+		t.Errorf("expected a reference to Price, got %+v", s.Properties["price"])
+	}
+
+	if d.Components.Schemas["Price"].Properties["amount"].Description != "Amount in minor units" {
+		t.Error("expected the doc tag to describe the field")
+	}
+
+	if _, ok := s.Properties["Ignored"]; ok {
+		t.Error("expected fields tagged - to be skipped")
+	}
+	if _, ok := s.Properties["private"]; ok {
+		t.Error("expected unexported fields to be skipped")
+	}
+
+	required := map[string]bool{}
+	for _, r := range s.Required {
+		required[r] = true
+	}
+	if !required["id"] || required["tags"] || required["available"] {
+		t.Errorf("expected omitempty fields to be optional, got %v", s.Required)
+	}
+}
+
+func TestDocument_Add(t *testing.T) {
+	d := New(Info{Title: "Test", Version: "1"})
+	d.Add("GET", "/things/{id}", &Operation{OperationID: "getThing", Responses: map[string]Response{"200": {Description: "OK"}}})
+
+	if !d.Has("get", "/things/{id}") || d.Has("POST", "/things/{id}") || d.Has("GET", "/things") {
+		t.Error("unexpected operations")
+	}
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out map[string]interface{}
+	json.Unmarshal(b, &out)
+
+	if out["openapi"] != Version {
+		t.Errorf("expected openapi version %s, got %v", Version, out["openapi"])
+	}
+}
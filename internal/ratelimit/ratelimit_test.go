@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMemory_Take(t *testing.T) {
+	m := NewMemory()
+	limit := Every(1, time.Second, 3)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		if ok, _, _ := m.Take("a", limit, now); !ok {
+			t.Fatalf("request %d: expected the burst to be allowed", i+1)
+		}
+	}
+
+	ok, retryAfter, err := m.Take("a", limit, now)
+	if ok || err != nil {
+		t.Fatalf("expected the request after the burst to be refused, got %v (%v)", ok, err)
+	}
+	if retryAfter != time.Second {
+		t.Errorf("expected to retry after 1s, got %s", retryAfter)
+	}
+
+	if ok, _, _ := m.Take("b", limit, now); !ok {
+		t.Error("expected other keys to have their own bucket")
+	}
+
+	if ok, _, _ := m.Take("a", limit, now.Add(500*time.Millisecond)); ok {
+		t.Error("expected the bucket not to have refilled yet")
+	}
+
+	if ok, _, _ := m.Take("a", limit, now.Add(time.Second)); !ok {
+		t.Error("expected a token after a second")
+	}
+}
+
+func TestMemory_Sweep(t *testing.T) {
+	m := NewMemory()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	m.Take("fast", Every(1, time.Second, 2), now)
+	m.Take("slow", Every(1, time.Hour, 2), now)
+
+	// by the next sweep the fast bucket has refilled and is forgotten, the slow one hasn't
+	m.Take("new", Every(1, time.Second, 2), now.Add(sweepInterval))
+
+	if m.Len() != 2 {
+		t.Errorf("expected 2 buckets after the sweep, got %d", m.Len())
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseNetworks([]string{"10.0.0.0/8", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		expected   string
+	}{
+		{"direct", "203.0.113.9:1234", "", "203.0.113.9"},
+		{"untrusted proxy", "203.0.113.9:1234", "198.51.100.1", "203.0.113.9"},
+		{"trusted proxy", "127.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"spoofed header", "127.0.0.1:1234", "1.2.3.4, 198.51.100.1", "198.51.100.1"},
+		{"proxy chain", "127.0.0.1:1234", "198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"only proxies", "127.0.0.1:1234", "10.0.0.2", "10.0.0.2"},
+		{"trusted proxy without header", "127.0.0.1:1234", "", "127.0.0.1"},
+		{"garbage", "127.0.0.1:1234", "nope", "127.0.0.1"},
+	}
+
+	for _, e := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = e.remoteAddr
+		if e.xff != "" {
+			r.Header.Set("X-Forwarded-For", e.xff)
+		}
+
+		if got := ClientIP(r, trusted); got != e.expected {
+			t.Errorf("%s: expected %s, got %s", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	if _, err := ParseNetworks([]string{"::1", "192.168.0.0/16"}); err != nil {
+		t.Error(err)
+	}
+
+	for _, addr := range []string{"nope", "10.0.0.0/99"} {
+		if _, err := ParseNetworks([]string{addr}); err == nil {
+			t.Errorf("%s: expected an error", addr)
+		}
+	}
+}
@@ -10,11 +10,18 @@ import (
 	"path/filepath"
 
 	"github.com/ashrielbrian/go_bookings/internal/config"
+	"github.com/ashrielbrian/go_bookings/internal/currency"
 	"github.com/ashrielbrian/go_bookings/internal/models"
+	"github.com/ashrielbrian/go_bookings/internal/stayrules"
 	"github.com/justinas/nosurf"
 )
 
-var functions = template.FuncMap{}
+var functions = template.FuncMap{
+	"formatCurrency": currency.Format,
+	"displayPrice":   DisplayPrice,
+	"currencies":     currency.Supported,
+	"stayRule":       stayrules.Message,
+}
 var app *config.AppConfig
 var pathToTemplates = "./templates"
 
@@ -29,9 +36,31 @@ func AddDefaultData(td *models.TemplateData, r *http.Request) *models.TemplateDa
 	td.Error = app.Session.PopString(r.Context(), "error")
 
 	td.CSRFToken = nosurf.Token(r)
+
+	if app.Session.Exists(r.Context(), "user_id") {
+		td.IsAuthenticated = 1
+	}
+
+	td.BaseCurrency = app.BaseCurrency
+	td.Currency = app.Session.GetString(r.Context(), "currency")
+	td.ExchangeRate = app.Session.GetFloat(r.Context(), "exchange_rate")
+	if td.Currency == "" || td.ExchangeRate <= 0 {
+		td.Currency = app.BaseCurrency
+		td.ExchangeRate = 1
+	}
+
 	return td
 }
 
+// DisplayPrice formats an amount in the base currency's minor units in the guest's selected currency
+func DisplayPrice(td *models.TemplateData, amount int) string {
+	if td.Currency == "" || td.Currency == td.BaseCurrency {
+		return currency.Format(amount, td.BaseCurrency)
+	}
+
+	return currency.Format(currency.Convert(amount, td.ExchangeRate, td.BaseCurrency, td.Currency), td.Currency)
+}
+
 // Template renders templates using html/template
 func Template(w http.ResponseWriter, r *http.Request, tmpl string, td *models.TemplateData) error {
 
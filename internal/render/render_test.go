@@ -24,6 +24,21 @@ func TestAddDefaultData(t *testing.T) {
 	}
 }
 
+func TestDisplayPrice(t *testing.T) {
+	td := models.TemplateData{BaseCurrency: "USD", Currency: "USD", ExchangeRate: 1}
+
+	if got := DisplayPrice(&td, 12345); got != "$123.45" {
+		t.Errorf("expected $123.45, got %s", got)
+	}
+
+	td.Currency = "EUR"
+	td.ExchangeRate = 0.5
+
+	if got := DisplayPrice(&td, 12345); got != "€61.73" {
+		t.Errorf("expected €61.73, got %s", got)
+	}
+}
+
 func TestRenderTemplate(t *testing.T) {
 	pathToTemplates = "./../../templates"
 	tc, err := CreateTemplateCache()
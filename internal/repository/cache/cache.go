@@ -0,0 +1,443 @@
+// Package cache wraps a repository.DatabaseRepo, caching the availability searches and room lookups made on
+// every room page and search for a short time
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/clock"
+	"github.com/ashrielbrian/go_bookings/internal/dates"
+	"github.com/ashrielbrian/go_bookings/internal/models"
+	"github.com/ashrielbrian/go_bookings/internal/repository"
+)
+
+// Options sets how long results are cached
+type Options struct {
+	// AvailabilityTTL is how long availability searches are cached. Bookings made through the repository
+	// invalidate the searches they affect at once; the TTL bounds how stale results get when the database is
+	// changed some other way, such as by another instance of the application
+	AvailabilityTTL time.Duration
+	// RoomTTL is how long rooms looked up by ID or slug are cached
+	RoomTTL time.Duration
+	// MaxEntries is the number of cached results above which expired ones are swept out
+	MaxEntries int
+	// Clock tells when cached results expire; the system clock is used when it is nil
+	Clock clock.Clock
+}
+
+// DefaultOptions returns the cache settings used unless configured otherwise
+func DefaultOptions() Options {
+	return Options{
+		AvailabilityTTL: 30 * time.Second,
+		RoomTTL:         5 * time.Minute,
+		MaxEntries:      10000,
+	}
+}
+
+// Stats counts how often cached results were used
+type Stats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	// Invalidations counts cached results dropped because the data they came from changed
+	Invalidations int64 `json:"invalidations"`
+	Entries       int   `json:"entries"`
+}
+
+// Repo is a repository.DatabaseRepo that caches SearchAvailabilityByDatesByRoomID, SearchAvailabiltyForAllRooms,
+// RoomAvailabilityByDay, GetRoomByID and GetRoomBySlug. Methods that add room restrictions drop the cached searches
+// for the room and dates they cover, and methods that change rooms drop the cached rooms and searches. Every other
+// method goes straight to the wrapped repository
+type Repo struct {
+	repository.DatabaseRepo
+
+	opts  Options
+	clock clock.Clock
+
+	mu sync.Mutex
+	// generation changes with every invalidation, so that a result read before an invalidation isn't cached
+	// after it
+	generation   int64
+	availability map[availabilityKey]entry
+	calendars    map[availabilityKey]entry
+	searches     map[searchKey]entry
+	roomsByID    map[int]entry
+	roomsBySlug  map[string]entry
+	stats        Stats
+}
+
+// entry is a cached result
+type entry struct {
+	value   interface{}
+	expires time.Time
+	// start and end are the dates searched, for searches
+	start, end dates.Date
+	// roomID is the room the result is about, or 0 for searches of every room
+	roomID int
+}
+
+type availabilityKey struct {
+	roomID     int
+	start, end dates.Date
+}
+
+type searchKey struct {
+	start, end dates.Date
+	filter     string
+}
+
+// New wraps repo in a cache
+func New(repo repository.DatabaseRepo, opts Options) *Repo {
+	clk := opts.Clock
+	if clk == nil {
+		clk = clock.Real{}
+	}
+
+	return &Repo{
+		DatabaseRepo: repo,
+		opts:         opts,
+		clock:        clk,
+		availability: make(map[availabilityKey]entry),
+		calendars:    make(map[availabilityKey]entry),
+		searches:     make(map[searchKey]entry),
+		roomsByID:    make(map[int]entry),
+		roomsBySlug:  make(map[string]entry),
+	}
+}
+
+// Stats returns the cache's statistics since it was created
+func (c *Repo) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.entries()
+
+	return stats
+}
+
+// entries counts the cached results. The caller must hold c.mu
+func (c *Repo) entries() int {
+	return len(c.availability) + len(c.calendars) + len(c.searches) + len(c.roomsByID) + len(c.roomsBySlug)
+}
+
+// lookup returns the unexpired entry found by get, counting a hit or a miss. On a miss it also returns the
+// generation to pass to store
+func (c *Repo) lookup(get func() (entry, bool)) (entry, bool, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := get()
+	if ok && c.clock.Now().Before(e.expires) {
+		c.stats.Hits++
+		return e, true, 0
+	}
+
+	c.stats.Misses++
+
+	return e, false, c.generation
+}
+
+// store caches a result read at generation, unless something has been invalidated since
+func (c *Repo) store(generation int64, set func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if c.entries() >= c.opts.MaxEntries {
+		c.sweep()
+	}
+
+	set()
+}
+
+// sweep drops expired entries. The caller must hold c.mu
+func (c *Repo) sweep() {
+	now := c.clock.Now()
+
+	for k, e := range c.availability {
+		if !now.Before(e.expires) {
+			delete(c.availability, k)
+		}
+	}
+	for k, e := range c.calendars {
+		if !now.Before(e.expires) {
+			delete(c.calendars, k)
+		}
+	}
+	for k, e := range c.searches {
+		if !now.Before(e.expires) {
+			delete(c.searches, k)
+		}
+	}
+	for k, e := range c.roomsByID {
+		if !now.Before(e.expires) {
+			delete(c.roomsByID, k)
+		}
+	}
+	for k, e := range c.roomsBySlug {
+		if !now.Before(e.expires) {
+			delete(c.roomsBySlug, k)
+		}
+	}
+}
+
+// SearchAvailabilityByDatesByRoomID returns true is there is room availability for room ID; returns false otherwise
+func (c *Repo) SearchAvailabilityByDatesByRoomID(start, end dates.Date, roomID int) (bool, error) {
+	key := availabilityKey{roomID: roomID, start: start, end: end}
+
+	e, ok, generation := c.lookup(func() (entry, bool) {
+		e, ok := c.availability[key]
+		return e, ok
+	})
+	if ok {
+		return e.value.(bool), nil
+	}
+
+	available, err := c.DatabaseRepo.SearchAvailabilityByDatesByRoomID(start, end, roomID)
+	if err != nil {
+		return available, err
+	}
+
+	c.store(generation, func() {
+		c.availability[key] = entry{value: available, expires: c.clock.Now().Add(c.opts.AvailabilityTTL), start: start,
+			end: end, roomID: roomID}
+	})
+
+	return available, nil
+}
+
+// SearchAvailabiltyForAllRooms returns a slice of all available rooms, if any, for a given date range
+// that match the filter
+func (c *Repo) SearchAvailabiltyForAllRooms(start, end dates.Date, filter models.RoomFilter) ([]models.Room, error) {
+	key := searchKey{start: start, end: end, filter: fmt.Sprintf("%+v", filter)}
+
+	e, ok, generation := c.lookup(func() (entry, bool) {
+		e, ok := c.searches[key]
+		return e, ok
+	})
+	if ok {
+		return append([]models.Room(nil), e.value.([]models.Room)...), nil
+	}
+
+	rooms, err := c.DatabaseRepo.SearchAvailabiltyForAllRooms(start, end, filter)
+	if err != nil {
+		return rooms, err
+	}
+
+	cached := append([]models.Room(nil), rooms...)
+	c.store(generation, func() {
+		c.searches[key] = entry{value: cached, expires: c.clock.Now().Add(c.opts.AvailabilityTTL), start: start, end: end}
+	})
+
+	return rooms, nil
+}
+
+// RoomAvailabilityByDay returns whether a room is free on each night from start up to, but not including, end
+func (c *Repo) RoomAvailabilityByDay(roomID int, start, end dates.Date) ([]models.DayAvailability, error) {
+	key := availabilityKey{roomID: roomID, start: start, end: end}
+
+	e, ok, generation := c.lookup(func() (entry, bool) {
+		e, ok := c.calendars[key]
+		return e, ok
+	})
+	if ok {
+		return append([]models.DayAvailability(nil), e.value.([]models.DayAvailability)...), nil
+	}
+
+	days, err := c.DatabaseRepo.RoomAvailabilityByDay(roomID, start, end)
+	if err != nil {
+		return days, err
+	}
+
+	cached := append([]models.DayAvailability(nil), days...)
+	c.store(generation, func() {
+		c.calendars[key] = entry{value: cached, expires: c.clock.Now().Add(c.opts.AvailabilityTTL), start: start, end: end,
+			roomID: roomID}
+	})
+
+	return days, nil
+}
+
+// GetRoomByID gets the room details, amenities and images by ID
+func (c *Repo) GetRoomByID(id int) (models.Room, error) {
+	e, ok, generation := c.lookup(func() (entry, bool) {
+		e, ok := c.roomsByID[id]
+		return e, ok
+	})
+	if ok {
+		return e.value.(models.Room), nil
+	}
+
+	room, err := c.DatabaseRepo.GetRoomByID(id)
+	if err != nil {
+		return room, err
+	}
+
+	c.store(generation, func() {
+		c.roomsByID[id] = entry{value: room, expires: c.clock.Now().Add(c.opts.RoomTTL), roomID: room.ID}
+	})
+
+	return room, nil
+}
+
+// GetRoomBySlug gets the room details, amenities and images by the room's slug
+func (c *Repo) GetRoomBySlug(slug string) (models.Room, error) {
+	e, ok, generation := c.lookup(func() (entry, bool) {
+		e, ok := c.roomsBySlug[slug]
+		return e, ok
+	})
+	if ok {
+		return e.value.(models.Room), nil
+	}
+
+	room, err := c.DatabaseRepo.GetRoomBySlug(slug)
+	if err != nil {
+		return room, err
+	}
+
+	c.store(generation, func() {
+		c.roomsBySlug[slug] = entry{value: room, expires: c.clock.Now().Add(c.opts.RoomTTL), roomID: room.ID}
+	})
+
+	return room, nil
+}
+
+// invalidateDates drops the cached searches that a restriction on a room from start to end could change: those
+// for the room, or for every room, whose dates overlap it
+func (c *Repo) invalidateDates(roomID int, start, end dates.Date) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+
+	overlaps := func(e entry) bool {
+		return e.start.Before(end) && e.end.After(start)
+	}
+
+	for k, e := range c.availability {
+		if e.roomID == roomID && overlaps(e) {
+			delete(c.availability, k)
+			c.stats.Invalidations++
+		}
+	}
+	for k, e := range c.calendars {
+		if e.roomID == roomID && overlaps(e) {
+			delete(c.calendars, k)
+			c.stats.Invalidations++
+		}
+	}
+	for k, e := range c.searches {
+		if overlaps(e) {
+			delete(c.searches, k)
+			c.stats.Invalidations++
+		}
+	}
+}
+
+// invalidateRooms drops every cached room and search of every room, which include room details
+func (c *Repo) invalidateRooms() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.stats.Invalidations += int64(len(c.roomsByID) + len(c.roomsBySlug) + len(c.searches))
+
+	c.roomsByID = make(map[int]entry)
+	c.roomsBySlug = make(map[string]entry)
+	c.searches = make(map[searchKey]entry)
+}
+
+// CreateBooking inserts a reservation along with the room restriction blocking its dates and its payment
+func (c *Repo) CreateBooking(res models.Reservation, payment models.Payment) (int, error) {
+	// the restriction blocks the nights the add-ons hold and the room's turnover days as well as the stay's own.
+	// The room is read past the cache, so that its turnover is current
+	room, err := c.DatabaseRepo.GetRoomByID(res.RoomID)
+	if err != nil {
+		return 0, err
+	}
+	start, end := res.Occupied(room.TurnoverDays)
+
+	// invalidated even when the booking fails, since it may have failed after the restriction was stored
+	defer c.invalidateDates(res.RoomID, start, end)
+
+	return c.DatabaseRepo.CreateBooking(res, payment)
+}
+
+// CancelReservation cancels a reservation, freeing the nights its restriction blocked
+func (c *Repo) CancelReservation(code string) error {
+	// the reservation and its room are read past the cache, for the dates its restriction covers
+	res, err := c.DatabaseRepo.GetReservationByCode(code)
+	if err != nil {
+		return err
+	}
+	room, err := c.DatabaseRepo.GetRoomByID(res.RoomID)
+	if err != nil {
+		return err
+	}
+	start, end := res.Occupied(room.TurnoverDays)
+
+	defer c.invalidateDates(res.RoomID, start, end)
+
+	return c.DatabaseRepo.CancelReservation(code)
+}
+
+// InsertRoomRestriction inserts a room restriction
+func (c *Repo) InsertRoomRestriction(r models.RoomRestriction) error {
+	defer c.invalidateDates(r.RoomID, r.StartDate, r.EndDate)
+
+	return c.DatabaseRepo.InsertRoomRestriction(r)
+}
+
+// InsertRoom inserts a room
+func (c *Repo) InsertRoom(room models.Room) (int, error) {
+	defer c.invalidateRooms()
+
+	return c.DatabaseRepo.InsertRoom(room)
+}
+
+// UpdateRoom updates a room's details
+func (c *Repo) UpdateRoom(room models.Room) error {
+	defer c.invalidateRooms()
+
+	return c.DatabaseRepo.UpdateRoom(room)
+}
+
+// SetRoomRetired retires a room, hiding it from guests, or brings it back
+func (c *Repo) SetRoomRetired(id int, retired bool) error {
+	defer c.invalidateRooms()
+
+	return c.DatabaseRepo.SetRoomRetired(id, retired)
+}
+
+// SetRoomAmenities replaces a room's amenities
+func (c *Repo) SetRoomAmenities(roomID int, amenityIDs []int) error {
+	defer c.invalidateRooms()
+
+	return c.DatabaseRepo.SetRoomAmenities(roomID, amenityIDs)
+}
+
+// InsertRoomImage inserts a room image
+func (c *Repo) InsertRoomImage(img models.RoomImage) (int, error) {
+	defer c.invalidateRooms()
+
+	return c.DatabaseRepo.InsertRoomImage(img)
+}
+
+// UpdateRoomImage updates a room image's caption and position
+func (c *Repo) UpdateRoomImage(img models.RoomImage) error {
+	defer c.invalidateRooms()
+
+	return c.DatabaseRepo.UpdateRoomImage(img)
+}
+
+// DeleteRoomImage deletes a room image
+func (c *Repo) DeleteRoomImage(id int) error {
+	defer c.invalidateRooms()
+
+	return c.DatabaseRepo.DeleteRoomImage(id)
+}
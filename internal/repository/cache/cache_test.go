@@ -0,0 +1,322 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/clock"
+	"github.com/ashrielbrian/go_bookings/internal/config"
+	"github.com/ashrielbrian/go_bookings/internal/dates"
+	"github.com/ashrielbrian/go_bookings/internal/models"
+	"github.com/ashrielbrian/go_bookings/internal/repository"
+	"github.com/ashrielbrian/go_bookings/internal/repository/dbrepo"
+	"github.com/ashrielbrian/go_bookings/internal/repository/repotest"
+)
+
+func TestConformance(t *testing.T) {
+	repotest.RunRepoTests(t, func(t *testing.T) repository.DatabaseRepo {
+		return New(dbrepo.NewMemoryRepo(&config.AppConfig{}), DefaultOptions())
+	})
+}
+
+// newTestCache returns a cache over an in-memory repository holding two rooms, and the repository
+func newTestCache(t *testing.T) (*Repo, *dbrepo.MemoryRepo) {
+	t.Helper()
+
+	mem := dbrepo.NewMemoryRepo(&config.AppConfig{})
+	for _, slug := range []string{"first", "second"} {
+		_, err := mem.InsertRoom(models.Room{RoomName: slug, Slug: slug, MaxOccupancy: 2, BedTypes: "1 Queen", Price: 10000})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return New(mem, DefaultOptions()), mem
+}
+
+func date(t *testing.T, s string) dates.Date {
+	t.Helper()
+
+	d, err := dates.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+// available checks a room's availability through the cache, failing the test on an error
+func available(t *testing.T, c *Repo, start, end string, roomID int) bool {
+	t.Helper()
+
+	ok, err := c.SearchAvailabilityByDatesByRoomID(date(t, start), date(t, end), roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ok
+}
+
+func checkStats(t *testing.T, c *Repo, hits, misses int64) {
+	t.Helper()
+
+	stats := c.Stats()
+	if stats.Hits != hits || stats.Misses != misses {
+		t.Errorf("expected %d hits and %d misses, got %d and %d", hits, misses, stats.Hits, stats.Misses)
+	}
+}
+
+func TestRepo_Availability(t *testing.T) {
+	c, _ := newTestCache(t)
+
+	available(t, c, "2026-11-10", "2026-11-12", 1)
+	available(t, c, "2026-11-10", "2026-11-12", 1)
+	available(t, c, "2026-11-10", "2026-11-12", 2)
+	available(t, c, "2026-11-20", "2026-11-22", 1)
+	checkStats(t, c, 1, 3)
+
+	err := c.InsertRoomRestriction(models.RoomRestriction{StartDate: date(t, "2026-11-11"), EndDate: date(t, "2026-11-13"),
+		RoomID: 1, RestrictionID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if available(t, c, "2026-11-10", "2026-11-12", 1) {
+		t.Error("a blocked room was reported available from the cache")
+	}
+	// the other room, and other dates, are still cached
+	available(t, c, "2026-11-10", "2026-11-12", 2)
+	available(t, c, "2026-11-20", "2026-11-22", 1)
+	checkStats(t, c, 3, 4)
+
+	if c.Stats().Invalidations != 1 {
+		t.Errorf("expected 1 invalidation, got %d", c.Stats().Invalidations)
+	}
+}
+
+func TestRepo_CreateBookingInvalidates(t *testing.T) {
+	c, _ := newTestCache(t)
+
+	rooms, err := c.SearchAvailabiltyForAllRooms(date(t, "2026-11-10"), date(t, "2026-11-12"), models.RoomFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 2 {
+		t.Fatalf("expected 2 rooms available, got %d", len(rooms))
+	}
+	if !available(t, c, "2026-11-10", "2026-11-12", 2) {
+		t.Fatal("expected room 2 to be available")
+	}
+
+	_, err = c.CreateBooking(models.Reservation{FirstName: "Jo", LastName: "Guest", Email: "jo@example.com", Adults: 1,
+		Code: "ABC123", StartDate: date(t, "2026-11-11"), EndDate: date(t, "2026-11-12"), RoomID: 2}, models.Payment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rooms, err = c.SearchAvailabiltyForAllRooms(date(t, "2026-11-10"), date(t, "2026-11-12"), models.RoomFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 1 || rooms[0].ID != 1 {
+		t.Errorf("expected only room 1 available after the booking, got %v", rooms)
+	}
+	if available(t, c, "2026-11-10", "2026-11-12", 2) {
+		t.Error("a booked room was reported available from the cache")
+	}
+	checkStats(t, c, 0, 4)
+}
+
+func TestRepo_CancelReservationInvalidates(t *testing.T) {
+	c, _ := newTestCache(t)
+
+	_, err := c.CreateBooking(models.Reservation{FirstName: "Jo", LastName: "Guest", Email: "jo@example.com", Adults: 1,
+		Code: "ABC123", StartDate: date(t, "2026-11-11"), EndDate: date(t, "2026-11-12"), RoomID: 2}, models.Payment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if available(t, c, "2026-11-10", "2026-11-12", 2) {
+		t.Fatal("expected room 2 to be booked")
+	}
+
+	if err = c.CancelReservation("ABC123"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !available(t, c, "2026-11-10", "2026-11-12", 2) {
+		t.Error("a cancelled booking was reported from the cache")
+	}
+
+	if err = c.CancelReservation("MISSING1"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestRepo_CreateBookingInvalidatesHeldNights(t *testing.T) {
+	c, mem := newTestCache(t)
+
+	room, err := mem.GetRoomByID(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room.LateCheckOutPrice = 2000
+	room.TurnoverDays = 1
+	if err := c.UpdateRoom(room); err != nil {
+		t.Fatal(err)
+	}
+
+	// the night late check-out keeps empty, and the turnover day after it
+	for _, start := range []string{"2026-11-12", "2026-11-13"} {
+		if !available(t, c, start, date(t, start).AddDate(0, 0, 1).String(), 2) {
+			t.Fatalf("expected room 2 to be available from %s", start)
+		}
+	}
+	days, err := c.RoomAvailabilityByDay(2, date(t, "2026-11-12"), date(t, "2026-11-14"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !days[0].Available || !days[1].Available {
+		t.Fatalf("expected room 2 to be free on both nights, got %v", days)
+	}
+
+	res := models.Reservation{FirstName: "Jo", LastName: "Guest", Email: "jo@example.com", Adults: 1, Code: "ABC123",
+		StartDate: date(t, "2026-11-10"), EndDate: date(t, "2026-11-12"), RoomID: 2, LateCheckOut: true}
+	if _, err = c.CreateBooking(res, models.Payment{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, start := range []string{"2026-11-12", "2026-11-13"} {
+		if available(t, c, start, date(t, start).AddDate(0, 0, 1).String(), 2) {
+			t.Errorf("the night from %s was reported available from the cache after the booking", start)
+		}
+	}
+	days, err = c.RoomAvailabilityByDay(2, date(t, "2026-11-12"), date(t, "2026-11-14"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if days[0].Available || days[1].Available {
+		t.Errorf("the calendar was reported free from the cache after the booking, got %v", days)
+	}
+}
+
+func TestRepo_Rooms(t *testing.T) {
+	c, _ := newTestCache(t)
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetRoomByID(1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.GetRoomBySlug("second"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkStats(t, c, 2, 2)
+
+	// unknown rooms aren't cached
+	for i := 0; i < 2; i++ {
+		_, err := c.GetRoomBySlug("third")
+		if !errors.Is(err, repository.ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+	}
+	checkStats(t, c, 2, 4)
+
+	room, err := c.GetRoomByID(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room.RoomName = "Renamed"
+	err = c.UpdateRoom(room)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	room, err = c.GetRoomBySlug("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room.RoomName != "Renamed" {
+		t.Errorf("expected the updated room, got %q", room.RoomName)
+	}
+}
+
+func TestRepo_Expiry(t *testing.T) {
+	_, mem := newTestCache(t)
+
+	clk := clock.NewFake(time.Date(2026, 11, 1, 12, 0, 0, 0, time.UTC))
+	opts := DefaultOptions()
+	opts.Clock = clk
+	c := New(mem, opts)
+
+	available(t, c, "2026-11-10", "2026-11-12", 1)
+	clk.Advance(opts.AvailabilityTTL - time.Second)
+	available(t, c, "2026-11-10", "2026-11-12", 1)
+	clk.Advance(time.Second)
+	available(t, c, "2026-11-10", "2026-11-12", 1)
+
+	checkStats(t, c, 1, 2)
+}
+
+func TestRepo_StaleReadNotCached(t *testing.T) {
+	c, mem := newTestCache(t)
+
+	// the booking lands while the search is reading from the database; its result mustn't be cached
+	_, _, generation := c.lookup(func() (entry, bool) { return entry{}, false })
+	ok, err := mem.SearchAvailabilityByDatesByRoomID(date(t, "2026-11-10"), date(t, "2026-11-12"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.InsertRoomRestriction(models.RoomRestriction{StartDate: date(t, "2026-11-10"), EndDate: date(t, "2026-11-12"),
+		RoomID: 1, RestrictionID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.store(generation, func() {
+		c.availability[availabilityKey{roomID: 1, start: date(t, "2026-11-10"), end: date(t, "2026-11-12")}] =
+			entry{value: ok, expires: c.clock.Now().Add(time.Hour)}
+	})
+
+	if available(t, c, "2026-11-10", "2026-11-12", 1) {
+		t.Error("a result read before the restriction was cached after it")
+	}
+}
+
+func TestRepo_AvailabilityByDay(t *testing.T) {
+	c, _ := newTestCache(t)
+
+	days := func() []models.DayAvailability {
+		t.Helper()
+
+		days, err := c.RoomAvailabilityByDay(1, date(t, "2026-11-01"), date(t, "2026-12-01"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return days
+	}
+
+	days()
+	if !days()[10].Available {
+		t.Fatal("expected the 11th to be available")
+	}
+	checkStats(t, c, 1, 1)
+
+	// a block on another room leaves the calendar cached
+	err := c.InsertRoomRestriction(models.RoomRestriction{StartDate: date(t, "2026-11-11"), EndDate: date(t, "2026-11-13"),
+		RoomID: 2, RestrictionID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	days()
+	checkStats(t, c, 2, 1)
+
+	err = c.InsertRoomRestriction(models.RoomRestriction{StartDate: date(t, "2026-11-11"), EndDate: date(t, "2026-11-13"),
+		RoomID: 1, RestrictionID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if days()[10].Available {
+		t.Error("a blocked night was reported available from the cache")
+	}
+	checkStats(t, c, 2, 2)
+}
@@ -0,0 +1,83 @@
+package dbrepo
+
+import (
+	"database/sql"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/ashrielbrian/go_bookings/internal/config"
+	"github.com/ashrielbrian/go_bookings/internal/driver"
+	"github.com/ashrielbrian/go_bookings/internal/migrate"
+	"github.com/ashrielbrian/go_bookings/internal/repository"
+	"github.com/ashrielbrian/go_bookings/internal/repository/repotest"
+	"github.com/ashrielbrian/go_bookings/migrations"
+)
+
+func TestConformance_Memory(t *testing.T) {
+	repotest.RunRepoTests(t, func(t *testing.T) repository.DatabaseRepo {
+		return NewMemoryRepo(&config.AppConfig{})
+	})
+}
+
+func TestConformance_SQLite(t *testing.T) {
+	repotest.RunRepoTests(t, newSQLiteTestRepo)
+}
+
+// postgresTestDSN names the environment variable holding the connection string of a Postgres database the
+// conformance suite may empty and reuse. The suite isn't run against Postgres without it
+const postgresTestDSN = "BOOKINGS_TEST_DSN"
+
+var postgresOnce sync.Once
+var postgresDB *sql.DB
+var postgresErr error
+
+func TestConformance_Postgres(t *testing.T) {
+	dsn := os.Getenv(postgresTestDSN)
+	if dsn == "" {
+		t.Skipf("set %s to run against Postgres", postgresTestDSN)
+	}
+
+	postgresOnce.Do(func() {
+		postgresDB, postgresErr = migratePostgres(dsn)
+	})
+	if postgresErr != nil {
+		t.Fatal(postgresErr)
+	}
+
+	repotest.RunRepoTests(t, func(t *testing.T) repository.DatabaseRepo {
+		// the restriction types and amenities the migrations create are kept
+		_, err := postgresDB.Exec(`truncate users, rooms, room_amenities, room_images, room_stay_rules, reservations,
+			room_restrictions, exchange_rates, payments, partners, api_keys, api_key_usage, idempotency_keys,
+			webhook_subscriptions, webhook_deliveries, outbox_events restart identity`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return NewPostgresRepo(postgresDB, &config.AppConfig{})
+	})
+}
+
+// migratePostgres connects to a Postgres database and applies the migrations
+func migratePostgres(dsn string) (*sql.DB, error) {
+	db, err := driver.ConnectSQL(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	fsys, err := migrations.For(driver.Postgres)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := migrate.New(db.SQL, driver.Postgres, fsys, log.New(io.Discard, "", 0))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = m.Up()
+
+	return db.SQL, err
+}
@@ -12,9 +12,10 @@ type postgresDBRepo struct {
 	DB  *sql.DB
 }
 
-type testDBRepo struct {
-	App *config.AppConfig
-	DB  *sql.DB
+// sqliteDBRepo stores data in SQLite. The schema is the same as in Postgres and most queries are portable, so it
+// runs those of postgresDBRepo and only overrides the ones that aren't
+type sqliteDBRepo struct {
+	postgresDBRepo
 }
 
 func NewPostgresRepo(conn *sql.DB, a *config.AppConfig) repository.DatabaseRepo {
@@ -23,8 +24,14 @@ func NewPostgresRepo(conn *sql.DB, a *config.AppConfig) repository.DatabaseRepo
 		DB:  conn,
 	}
 }
-func NewTestingRepo(a *config.AppConfig) repository.DatabaseRepo {
-	return &testDBRepo{
-		App: a,
+
+// NewSQLiteRepo returns a repository for a database opened with the driver's SQLite dialect, which sets the
+// options its queries rely on
+func NewSQLiteRepo(conn *sql.DB, a *config.AppConfig) repository.DatabaseRepo {
+	return &sqliteDBRepo{
+		postgresDBRepo{
+			App: a,
+			DB:  conn,
+		},
 	}
 }
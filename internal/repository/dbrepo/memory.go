@@ -0,0 +1,1572 @@
+package dbrepo
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/config"
+	"github.com/ashrielbrian/go_bookings/internal/dates"
+	"github.com/ashrielbrian/go_bookings/internal/events"
+	"github.com/ashrielbrian/go_bookings/internal/models"
+	"github.com/ashrielbrian/go_bookings/internal/repository"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MemoryRepo is a repository that keeps its data in memory, for tests that need the repository to behave like
+// the database: what is stored can be read back, bookings block the dates they cover, and the constraints of the
+// schema, such as unique slugs and codes and references to rooms, are enforced. It is safe for concurrent use.
+//
+// It starts out with the restriction types and amenities the migrations create. Users, which can't be created
+// through DatabaseRepo, are added with AddUser
+type MemoryRepo struct {
+	App *config.AppConfig
+
+	mu       sync.Mutex
+	failures map[string]error
+	lastIDs  map[string]int
+
+	users            []models.User
+	rooms            []models.Room
+	amenities        []models.Amenity
+	roomAmenities    map[int][]int
+	images           []models.RoomImage
+	stayRules        []models.StayRule
+	restrictions     []models.Restriction
+	reservations     []models.Reservation
+	roomRestrictions []models.RoomRestriction
+	rates            []models.ExchangeRate
+	payments         []models.Payment
+	partners         []models.Partner
+	apiKeys          []models.APIKey
+	apiKeyUsage      map[int]map[string]int
+	idempotencyKeys  map[string]models.IdempotencyKey
+	subscriptions    []models.WebhookSubscription
+	deliveries       []models.WebhookDelivery
+	outbox           []models.OutboxEvent
+}
+
+var _ repository.DatabaseRepo = (*MemoryRepo)(nil)
+
+// NewMemoryRepo returns an empty in-memory repository
+func NewMemoryRepo(a *config.AppConfig) *MemoryRepo {
+	m := &MemoryRepo{
+		App:             a,
+		failures:        make(map[string]error),
+		lastIDs:         make(map[string]int),
+		roomAmenities:   make(map[int][]int),
+		apiKeyUsage:     make(map[int]map[string]int),
+		idempotencyKeys: make(map[string]models.IdempotencyKey),
+	}
+
+	now := m.App.Now()
+
+	for _, name := range []string{"Reservation", "Owner Block"} {
+		m.restrictions = append(m.restrictions, models.Restriction{ID: m.nextID("restrictions"), RestrictionName: name,
+			CreatedAt: now, UpdatedAt: now})
+	}
+	for _, name := range []string{"Sea view", "Kitchen", "Accessible"} {
+		m.amenities = append(m.amenities, models.Amenity{ID: m.nextID("amenities"), Name: name, CreatedAt: now,
+			UpdatedAt: now})
+	}
+
+	return m
+}
+
+// Fail makes every later call of the named method, eg. "CreateBooking", return err without doing anything. A nil
+// err makes the method work again
+func (m *MemoryRepo) Fail(method string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err == nil {
+		delete(m.failures, method)
+		return
+	}
+	m.failures[method] = err
+}
+
+// failure returns the error method has been told to fail with, if any. The caller must hold m.mu
+func (m *MemoryRepo) failure(method string) error {
+	return m.failures[method]
+}
+
+// recordEvent adds an event to the outbox, as the database repositories do in the transaction making the change it
+// describes. The caller must hold m.mu
+func (m *MemoryRepo) recordEvent(eventType string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	now := m.App.Now()
+	m.outbox = append(m.outbox, models.OutboxEvent{ID: m.nextID("outbox_events"), Type: eventType,
+		Payload: string(b), NextAttemptAt: now, CreatedAt: now})
+
+	return nil
+}
+
+// nextID returns the next ID of a table, like a serial column. The caller must hold m.mu
+func (m *MemoryRepo) nextID(table string) int {
+	m.lastIDs[table]++
+	return m.lastIDs[table]
+}
+
+// AddUser adds a user who can sign in with password, returning the user's ID
+func (m *MemoryRepo) AddUser(u models.User, password string) (int, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.users {
+		if existing.Email == u.Email {
+			return 0, fmt.Errorf("a user with email %s already exists", u.Email)
+		}
+	}
+
+	now := m.App.Now()
+
+	u.ID = m.nextID("users")
+	u.Password = string(hash)
+	u.CreatedAt, u.UpdatedAt = now, now
+	if u.AccessLevel == 0 {
+		u.AccessLevel = 1
+	}
+	m.users = append(m.users, u)
+
+	return u.ID, nil
+}
+
+func (m *MemoryRepo) AllUsers() bool {
+	return true
+}
+
+// InsertReservation inserts a reservation
+func (m *MemoryRepo) InsertReservation(res models.Reservation) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("InsertReservation"); err != nil {
+		return 0, err
+	}
+
+	return m.insertReservation(res)
+}
+
+// insertReservation checks a reservation against the constraints of the reservations table and stores it. The
+// caller must hold m.mu
+func (m *MemoryRepo) insertReservation(res models.Reservation) (int, error) {
+	if _, ok := m.room(res.RoomID); !ok {
+		return 0, fmt.Errorf("room %d does not exist", res.RoomID)
+	}
+	if res.Adults < 1 || res.Children < 0 {
+		return 0, errors.New("a reservation needs at least one adult")
+	}
+	if res.PartnerID != 0 && !m.hasPartner(res.PartnerID) {
+		return 0, fmt.Errorf("partner %d does not exist", res.PartnerID)
+	}
+	for _, r := range m.reservations {
+		if r.Code == res.Code {
+			return 0, fmt.Errorf("a reservation with code %s already exists", res.Code)
+		}
+	}
+
+	now := m.App.Now()
+
+	res.ID = m.nextID("reservations")
+	res.Room = models.Room{}
+	res.CreatedAt, res.UpdatedAt = now, now
+	m.reservations = append(m.reservations, res)
+
+	return res.ID, nil
+}
+
+// CreateBooking inserts a reservation along with the room restriction blocking the nights it occupies and its
+// payment, and records a reservation.created event. Either all of them are stored or, if any is invalid, none
+func (m *MemoryRepo) CreateBooking(res models.Reservation, payment models.Payment) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("CreateBooking"); err != nil {
+		return 0, err
+	}
+
+	room, ok := m.room(res.RoomID)
+	if !ok {
+		return 0, fmt.Errorf("room %d does not exist", res.RoomID)
+	}
+	if heldStart, heldEnd := res.Held(); !m.available(heldStart, heldEnd, res.RoomID) {
+		return 0, repository.ErrUnavailable
+	}
+
+	id, err := m.insertReservation(res)
+	if err != nil {
+		return 0, err
+	}
+
+	start, end := res.Occupied(room.TurnoverDays)
+
+	err = m.insertRoomRestriction(models.RoomRestriction{StartDate: start, EndDate: end,
+		RoomID: res.RoomID, ReservationID: id, RestrictionID: 1})
+	if err != nil {
+		m.reservations = m.reservations[:len(m.reservations)-1]
+		return 0, err
+	}
+
+	payment.ReservationID = id
+	m.insertPayment(payment)
+
+	err = m.recordEvent(events.ReservationCreated, events.Reservation{ReservationID: id, Code: res.Code})
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// GetReservationByCode gets a reservation and its room by the reservation's code
+func (m *MemoryRepo) GetReservationByCode(code string) (models.Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("GetReservationByCode"); err != nil {
+		return models.Reservation{}, err
+	}
+
+	for _, res := range m.reservations {
+		if res.Code == strings.ToUpper(code) {
+			room, _ := m.room(res.RoomID)
+			res.Room = models.Room{ID: room.ID, RoomName: room.RoomName, Slug: room.Slug, Price: room.Price,
+				CheckInTime: room.CheckInTime, CheckOutTime: room.CheckOutTime, EarlyCheckInPrice: room.EarlyCheckInPrice,
+				LateCheckOutPrice: room.LateCheckOutPrice, TurnoverDays: room.TurnoverDays}
+			return res, nil
+		}
+	}
+
+	return models.Reservation{}, repository.ErrNotFound
+}
+
+// UpdateReservation updates the guest details of the reservation with res.Code, and records a reservation.updated
+// event with the change
+func (m *MemoryRepo) UpdateReservation(res models.Reservation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("UpdateReservation"); err != nil {
+		return err
+	}
+
+	for i, existing := range m.reservations {
+		if existing.Code == strings.ToUpper(res.Code) {
+			existing.FirstName, existing.LastName = res.FirstName, res.LastName
+			existing.Email, existing.Phone = res.Email, res.Phone
+			existing.UpdatedAt = m.App.Now()
+			m.reservations[i] = existing
+
+			return m.recordEvent(events.ReservationUpdated, events.Reservation{ReservationID: existing.ID,
+				Code: existing.Code})
+		}
+	}
+
+	return repository.ErrNotFound
+}
+
+// CancelReservation cancels a reservation, freeing the nights its room restrictions held, and records a
+// reservation.cancelled event. Cancelling a reservation that is already cancelled changes nothing
+func (m *MemoryRepo) CancelReservation(code string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("CancelReservation"); err != nil {
+		return err
+	}
+
+	for i, existing := range m.reservations {
+		if existing.Code != strings.ToUpper(code) {
+			continue
+		}
+		if existing.Cancelled() {
+			return nil
+		}
+
+		now := m.App.Now()
+		existing.CancelledAt, existing.UpdatedAt = now, now
+		m.reservations[i] = existing
+
+		kept := m.roomRestrictions[:0]
+		for _, r := range m.roomRestrictions {
+			if r.ReservationID != existing.ID {
+				kept = append(kept, r)
+			}
+		}
+		m.roomRestrictions = kept
+
+		return m.recordEvent(events.ReservationCancelled, events.Reservation{ReservationID: existing.ID,
+			Code: existing.Code})
+	}
+
+	return repository.ErrNotFound
+}
+
+// InsertRoomRestriction inserts a room restriction. A zero ReservationID means the restriction isn't for a
+// reservation, such as an owner block, and a block.created event is recorded with it
+func (m *MemoryRepo) InsertRoomRestriction(r models.RoomRestriction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("InsertRoomRestriction"); err != nil {
+		return err
+	}
+
+	err := m.insertRoomRestriction(r)
+	if err != nil || r.ReservationID != 0 {
+		return err
+	}
+
+	stored := m.roomRestrictions[len(m.roomRestrictions)-1]
+
+	return m.recordEvent(events.BlockCreated, events.Block{RoomRestrictionID: stored.ID, RoomID: r.RoomID,
+		StartDate: r.StartDate, EndDate: r.EndDate})
+}
+
+// insertRoomRestriction checks a room restriction against the constraints of the room_restrictions table and
+// stores it. The caller must hold m.mu
+func (m *MemoryRepo) insertRoomRestriction(r models.RoomRestriction) error {
+	if _, ok := m.room(r.RoomID); !ok {
+		return fmt.Errorf("room %d does not exist", r.RoomID)
+	}
+
+	found := false
+	for _, restriction := range m.restrictions {
+		found = found || restriction.ID == r.RestrictionID
+	}
+	if !found {
+		return fmt.Errorf("restriction %d does not exist", r.RestrictionID)
+	}
+
+	if r.ReservationID != 0 {
+		found = false
+		for _, res := range m.reservations {
+			found = found || res.ID == r.ReservationID
+		}
+		if !found {
+			return fmt.Errorf("reservation %d does not exist", r.ReservationID)
+		}
+	}
+
+	now := m.App.Now()
+
+	r.ID = m.nextID("room_restrictions")
+	r.Room, r.Reservation, r.Restriction = models.Room{}, models.Reservation{}, models.Restriction{}
+	r.CreatedAt, r.UpdatedAt = now, now
+	m.roomRestrictions = append(m.roomRestrictions, r)
+
+	return nil
+}
+
+// SearchAvailabilityByDatesByRoomID returns true is there is room availability for room ID; returns false otherwise
+func (m *MemoryRepo) SearchAvailabilityByDatesByRoomID(start, end dates.Date, roomID int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("SearchAvailabilityByDatesByRoomID"); err != nil {
+		return false, err
+	}
+
+	return m.available(start, end, roomID), nil
+}
+
+// available reports whether no restriction on a room overlaps the dates from start to end. A stay may begin on
+// the day another ends. The caller must hold m.mu
+func (m *MemoryRepo) available(start, end dates.Date, roomID int) bool {
+	for _, r := range m.roomRestrictions {
+		if r.RoomID == roomID && start.Before(r.EndDate) && end.After(r.StartDate) {
+			return false
+		}
+	}
+	return true
+}
+
+// RoomAvailabilityByDay returns whether a room is free on each night from start up to, but not including, end
+func (m *MemoryRepo) RoomAvailabilityByDay(roomID int, start, end dates.Date) ([]models.DayAvailability, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("RoomAvailabilityByDay"); err != nil {
+		return nil, err
+	}
+
+	var restrictions []models.RoomRestriction
+	for _, r := range m.roomRestrictions {
+		if r.RoomID == roomID {
+			restrictions = append(restrictions, r)
+		}
+	}
+
+	return daysAvailable(start, end, restrictions), nil
+}
+
+// SearchAvailabiltyForAllRooms returns a slice of all available rooms, if any, for a given date range
+// that match the filter
+func (m *MemoryRepo) SearchAvailabiltyForAllRooms(start, end dates.Date, filter models.RoomFilter) ([]models.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rooms []models.Room
+
+	if err := m.failure("SearchAvailabiltyForAllRooms"); err != nil {
+		return rooms, err
+	}
+
+	for _, r := range m.rooms {
+		r = m.withDetails(r)
+		if roomMatches(r, filter) && m.available(start, end, r.ID) {
+			rooms = append(rooms, r)
+		}
+	}
+
+	sortRooms(rooms, filter.Sort)
+
+	return rooms, nil
+}
+
+// roomMatches reports whether a room passes every condition of the filter
+func roomMatches(r models.Room, filter models.RoomFilter) bool {
+	if r.Retired || r.MaxOccupancy < filter.Guests {
+		return false
+	}
+
+	if filter.MinPrice > 0 && r.Price < filter.MinPrice {
+		return false
+	}
+
+	if filter.MaxPrice > 0 && r.Price > filter.MaxPrice {
+		return false
+	}
+
+	if filter.BedType != "" && !strings.Contains(strings.ToLower(r.BedTypes), strings.ToLower(filter.BedType)) {
+		return false
+	}
+
+	for _, id := range filter.AmenityIDs {
+		found := false
+		for _, a := range r.Amenities {
+			if a.ID == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sortRooms orders rooms by one of the RoomSort values, or by name
+func sortRooms(rooms []models.Room, order string) {
+	sort.SliceStable(rooms, func(i, j int) bool {
+		switch {
+		case order == models.RoomSortPriceAsc && rooms[i].Price != rooms[j].Price:
+			return rooms[i].Price < rooms[j].Price
+		case order == models.RoomSortPriceDesc && rooms[i].Price != rooms[j].Price:
+			return rooms[i].Price > rooms[j].Price
+		case order == models.RoomSortSizeAsc && rooms[i].SizeSqm != rooms[j].SizeSqm:
+			return rooms[i].SizeSqm < rooms[j].SizeSqm
+		case order == models.RoomSortSizeDesc && rooms[i].SizeSqm != rooms[j].SizeSqm:
+			return rooms[i].SizeSqm > rooms[j].SizeSqm
+		}
+		return rooms[i].RoomName < rooms[j].RoomName
+	})
+}
+
+// room returns the stored room with the given ID. The caller must hold m.mu
+func (m *MemoryRepo) room(id int) (models.Room, bool) {
+	for _, r := range m.rooms {
+		if r.ID == id {
+			return r, true
+		}
+	}
+	return models.Room{}, false
+}
+
+// withDetails returns a copy of a stored room with its amenities, ordered by name, and its images, in display
+// order. The caller must hold m.mu
+func (m *MemoryRepo) withDetails(r models.Room) models.Room {
+	r.Amenities, r.Images = nil, nil
+
+	for _, a := range m.amenities {
+		for _, id := range m.roomAmenities[r.ID] {
+			if a.ID == id {
+				r.Amenities = append(r.Amenities, a)
+			}
+		}
+	}
+	sort.Slice(r.Amenities, func(i, j int) bool { return r.Amenities[i].Name < r.Amenities[j].Name })
+
+	for _, img := range m.images {
+		if img.RoomID == r.ID {
+			r.Images = append(r.Images, img)
+		}
+	}
+	sort.SliceStable(r.Images, func(i, j int) bool { return r.Images[i].SortOrder < r.Images[j].SortOrder })
+
+	return r
+}
+
+// GetRoomByID gets the room details, amenities and images by ID
+func (m *MemoryRepo) GetRoomByID(id int) (models.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("GetRoomByID"); err != nil {
+		return models.Room{}, err
+	}
+
+	r, ok := m.room(id)
+	if !ok {
+		return models.Room{}, repository.ErrNotFound
+	}
+
+	return m.withDetails(r), nil
+}
+
+// GetRoomBySlug gets the room details, amenities and images by the room's slug
+func (m *MemoryRepo) GetRoomBySlug(slug string) (models.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("GetRoomBySlug"); err != nil {
+		return models.Room{}, err
+	}
+
+	for _, r := range m.rooms {
+		if r.Slug == slug {
+			return m.withDetails(r), nil
+		}
+	}
+
+	return models.Room{}, repository.ErrNotFound
+}
+
+// AllRooms returns every room with its amenities and images, optionally including retired rooms
+func (m *MemoryRepo) AllRooms(includeRetired bool) ([]models.Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rooms []models.Room
+
+	if err := m.failure("AllRooms"); err != nil {
+		return rooms, err
+	}
+
+	for _, r := range m.rooms {
+		if includeRetired || !r.Retired {
+			rooms = append(rooms, m.withDetails(r))
+		}
+	}
+
+	sortRooms(rooms, "")
+
+	return rooms, nil
+}
+
+// checkSlug fails if another room than id has slug. The caller must hold m.mu
+func (m *MemoryRepo) checkSlug(id int, slug string) error {
+	for _, r := range m.rooms {
+		if r.Slug == slug && r.ID != id {
+			return fmt.Errorf("a room with slug %s already exists", slug)
+		}
+	}
+	return nil
+}
+
+// InsertRoom inserts a room
+func (m *MemoryRepo) InsertRoom(room models.Room) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("InsertRoom"); err != nil {
+		return 0, err
+	}
+
+	if err := m.checkSlug(0, room.Slug); err != nil {
+		return 0, err
+	}
+
+	now := m.App.Now()
+
+	room.ID = m.nextID("rooms")
+	room.CheckInTime, room.CheckOutTime = roomTimes(room)
+	room.Amenities, room.Images = nil, nil
+	room.CreatedAt, room.UpdatedAt = now, now
+	m.rooms = append(m.rooms, room)
+
+	return room.ID, nil
+}
+
+// UpdateRoom updates a room's details
+func (m *MemoryRepo) UpdateRoom(room models.Room) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("UpdateRoom"); err != nil {
+		return err
+	}
+
+	if err := m.checkSlug(room.ID, room.Slug); err != nil {
+		return err
+	}
+
+	for i, r := range m.rooms {
+		if r.ID == room.ID {
+			r.RoomName, r.Slug, r.Description = room.RoomName, room.Slug, room.Description
+			r.MaxOccupancy, r.BedTypes, r.Price, r.SizeSqm = room.MaxOccupancy, room.BedTypes, room.Price, room.SizeSqm
+			r.CheckInTime, r.CheckOutTime = roomTimes(room)
+			r.EarlyCheckInPrice, r.LateCheckOutPrice = room.EarlyCheckInPrice, room.LateCheckOutPrice
+			r.TurnoverDays = room.TurnoverDays
+			r.UpdatedAt = m.App.Now()
+			m.rooms[i] = r
+		}
+	}
+
+	return nil
+}
+
+// SetRoomRetired retires a room, hiding it from guests, or brings it back
+func (m *MemoryRepo) SetRoomRetired(id int, retired bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("SetRoomRetired"); err != nil {
+		return err
+	}
+
+	for i := range m.rooms {
+		if m.rooms[i].ID == id {
+			m.rooms[i].Retired = retired
+			m.rooms[i].UpdatedAt = m.App.Now()
+		}
+	}
+
+	return nil
+}
+
+// AllAmenities returns every amenity a room can have
+func (m *MemoryRepo) AllAmenities() ([]models.Amenity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("AllAmenities"); err != nil {
+		return nil, err
+	}
+
+	amenities := append([]models.Amenity(nil), m.amenities...)
+	sort.Slice(amenities, func(i, j int) bool { return amenities[i].Name < amenities[j].Name })
+
+	return amenities, nil
+}
+
+// SetRoomAmenities replaces a room's amenities
+func (m *MemoryRepo) SetRoomAmenities(roomID int, amenityIDs []int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("SetRoomAmenities"); err != nil {
+		return err
+	}
+
+	if _, ok := m.room(roomID); !ok && len(amenityIDs) > 0 {
+		return fmt.Errorf("room %d does not exist", roomID)
+	}
+
+	seen := make(map[int]bool)
+	for _, id := range amenityIDs {
+		found := false
+		for _, a := range m.amenities {
+			found = found || a.ID == id
+		}
+		if !found {
+			return fmt.Errorf("amenity %d does not exist", id)
+		}
+		if seen[id] {
+			return fmt.Errorf("amenity %d given twice", id)
+		}
+		seen[id] = true
+	}
+
+	m.roomAmenities[roomID] = append([]int(nil), amenityIDs...)
+
+	return nil
+}
+
+// Authenticate checks the user's credentials, returning the user ID and hashed password on success
+func (m *MemoryRepo) Authenticate(email, testPassword string) (int, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("Authenticate"); err != nil {
+		return 0, "", err
+	}
+
+	for _, u := range m.users {
+		if u.Email != email {
+			continue
+		}
+
+		err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(testPassword))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return 0, "", errors.New("incorrect password")
+		} else if err != nil {
+			return 0, "", err
+		}
+
+		return u.ID, u.Password, nil
+	}
+
+	return 0, "", sql.ErrNoRows
+}
+
+// AllExchangeRates returns every stored exchange rate, ordered by currency
+func (m *MemoryRepo) AllExchangeRates() ([]models.ExchangeRate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("AllExchangeRates"); err != nil {
+		return nil, err
+	}
+
+	rates := append([]models.ExchangeRate(nil), m.rates...)
+	sort.Slice(rates, func(i, j int) bool { return rates[i].Currency < rates[j].Currency })
+
+	return rates, nil
+}
+
+// GetExchangeRate gets the exchange rate from the base currency to currency
+func (m *MemoryRepo) GetExchangeRate(currency string) (models.ExchangeRate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("GetExchangeRate"); err != nil {
+		return models.ExchangeRate{}, err
+	}
+
+	for _, rate := range m.rates {
+		if rate.Currency == strings.ToUpper(currency) {
+			return rate, nil
+		}
+	}
+
+	return models.ExchangeRate{}, errors.New("no exchange rate for " + currency)
+}
+
+// UpsertExchangeRate inserts the exchange rate for currency, or updates it if one already exists
+func (m *MemoryRepo) UpsertExchangeRate(currency string, rate float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("UpsertExchangeRate"); err != nil {
+		return err
+	}
+
+	if rate <= 0 {
+		return errors.New("exchange rates must be positive")
+	}
+
+	now := m.App.Now()
+	currency = strings.ToUpper(currency)
+
+	for i := range m.rates {
+		if m.rates[i].Currency == currency {
+			m.rates[i].Rate = rate
+			m.rates[i].UpdatedAt = now
+			return nil
+		}
+	}
+
+	m.rates = append(m.rates, models.ExchangeRate{ID: m.nextID("exchange_rates"), Currency: currency, Rate: rate,
+		CreatedAt: now, UpdatedAt: now})
+
+	return nil
+}
+
+// InsertPayment records a payment against a reservation, including the currency it was charged in
+func (m *MemoryRepo) InsertPayment(p models.Payment) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("InsertPayment"); err != nil {
+		return 0, err
+	}
+
+	found := false
+	for _, res := range m.reservations {
+		found = found || res.ID == p.ReservationID
+	}
+	if !found {
+		return 0, fmt.Errorf("reservation %d does not exist", p.ReservationID)
+	}
+
+	return m.insertPayment(p), nil
+}
+
+// insertPayment stores a payment. The caller must hold m.mu
+func (m *MemoryRepo) insertPayment(p models.Payment) int {
+	now := m.App.Now()
+
+	p.ID = m.nextID("payments")
+	p.CreatedAt, p.UpdatedAt = now, now
+	m.payments = append(m.payments, p)
+
+	return p.ID
+}
+
+// GetRoomImageByID gets a room image by ID
+func (m *MemoryRepo) GetRoomImageByID(id int) (models.RoomImage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("GetRoomImageByID"); err != nil {
+		return models.RoomImage{}, err
+	}
+
+	for _, img := range m.images {
+		if img.ID == id {
+			return img, nil
+		}
+	}
+
+	return models.RoomImage{}, repository.ErrNotFound
+}
+
+// InsertRoomImage inserts a room image
+func (m *MemoryRepo) InsertRoomImage(img models.RoomImage) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("InsertRoomImage"); err != nil {
+		return 0, err
+	}
+
+	if _, ok := m.room(img.RoomID); !ok {
+		return 0, fmt.Errorf("room %d does not exist", img.RoomID)
+	}
+
+	now := m.App.Now()
+
+	img.ID = m.nextID("room_images")
+	img.CreatedAt, img.UpdatedAt = now, now
+	m.images = append(m.images, img)
+
+	return img.ID, nil
+}
+
+// UpdateRoomImage updates a room image's caption and position
+func (m *MemoryRepo) UpdateRoomImage(img models.RoomImage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("UpdateRoomImage"); err != nil {
+		return err
+	}
+
+	for i := range m.images {
+		if m.images[i].ID == img.ID {
+			m.images[i].Caption = img.Caption
+			m.images[i].SortOrder = img.SortOrder
+			m.images[i].UpdatedAt = m.App.Now()
+		}
+	}
+
+	return nil
+}
+
+// DeleteRoomImage deletes a room image
+func (m *MemoryRepo) DeleteRoomImage(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("DeleteRoomImage"); err != nil {
+		return err
+	}
+
+	for i := range m.images {
+		if m.images[i].ID == id {
+			m.images = append(m.images[:i], m.images[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// AllStayRules returns the stay rules of every room, ordered by room
+func (m *MemoryRepo) AllStayRules() ([]models.StayRule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rules []models.StayRule
+
+	if err := m.failure("AllStayRules"); err != nil {
+		return rules, err
+	}
+
+	rules = append(rules, m.stayRules...)
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].RoomID < rules[j].RoomID })
+
+	return rules, nil
+}
+
+// StayRulesByRoomID returns the stay rules of a room
+func (m *MemoryRepo) StayRulesByRoomID(roomID int) ([]models.StayRule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rules []models.StayRule
+
+	if err := m.failure("StayRulesByRoomID"); err != nil {
+		return rules, err
+	}
+
+	for _, rule := range m.stayRules {
+		if rule.RoomID == roomID {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, nil
+}
+
+// InsertStayRule inserts a stay rule
+func (m *MemoryRepo) InsertStayRule(rule models.StayRule) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("InsertStayRule"); err != nil {
+		return 0, err
+	}
+
+	if _, ok := m.room(rule.RoomID); !ok {
+		return 0, fmt.Errorf("room %d does not exist", rule.RoomID)
+	}
+	if rule.Nights < 0 {
+		return 0, errors.New("a stay rule can't have a negative number of nights")
+	}
+
+	now := m.App.Now()
+
+	rule.ID = m.nextID("room_stay_rules")
+	rule.Weekdays = append([]time.Weekday(nil), rule.Weekdays...)
+	rule.CreatedAt, rule.UpdatedAt = now, now
+	m.stayRules = append(m.stayRules, rule)
+
+	return rule.ID, nil
+}
+
+// DeleteStayRule deletes a stay rule
+func (m *MemoryRepo) DeleteStayRule(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("DeleteStayRule"); err != nil {
+		return err
+	}
+
+	for i := range m.stayRules {
+		if m.stayRules[i].ID == id {
+			m.stayRules = append(m.stayRules[:i], m.stayRules[i+1:]...)
+			return nil
+		}
+	}
+
+	return repository.ErrNotFound
+}
+
+// AllPartners returns every partner, ordered by name
+func (m *MemoryRepo) AllPartners() ([]models.Partner, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("AllPartners"); err != nil {
+		return nil, err
+	}
+
+	partners := append([]models.Partner(nil), m.partners...)
+	sort.Slice(partners, func(i, j int) bool { return partners[i].Name < partners[j].Name })
+
+	return partners, nil
+}
+
+// InsertPartner inserts a partner and returns its ID
+func (m *MemoryRepo) InsertPartner(p models.Partner) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("InsertPartner"); err != nil {
+		return 0, err
+	}
+
+	for _, existing := range m.partners {
+		if existing.Name == p.Name {
+			return 0, fmt.Errorf("a partner named %s already exists", p.Name)
+		}
+	}
+
+	now := m.App.Now()
+
+	p.ID = m.nextID("partners")
+	p.CreatedAt, p.UpdatedAt = now, now
+	m.partners = append(m.partners, p)
+
+	return p.ID, nil
+}
+
+// hasPartner reports whether a partner is stored. The caller must hold m.mu
+func (m *MemoryRepo) hasPartner(id int) bool {
+	for _, p := range m.partners {
+		if p.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKey returns a copy of a stored API key with its partner and usage. The caller must hold m.mu
+func (m *MemoryRepo) apiKey(k models.APIKey) models.APIKey {
+	for _, p := range m.partners {
+		if p.ID == k.PartnerID {
+			k.Partner = p
+		}
+	}
+
+	k.Scopes = append([]string(nil), k.Scopes...)
+
+	recent := m.App.Now().AddDate(0, 0, -30).Format("2006-01-02")
+	k.Requests, k.RecentRequests = 0, 0
+	for day, requests := range m.apiKeyUsage[k.ID] {
+		k.Requests += requests
+		if day > recent {
+			k.RecentRequests += requests
+		}
+	}
+
+	return k
+}
+
+// AllAPIKeys returns every API key with its partner and usage, newest first
+func (m *MemoryRepo) AllAPIKeys() ([]models.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []models.APIKey
+
+	if err := m.failure("AllAPIKeys"); err != nil {
+		return keys, err
+	}
+
+	for _, k := range m.apiKeys {
+		keys = append(keys, m.apiKey(k))
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+
+	return keys, nil
+}
+
+// GetAPIKeyByPrefix gets an API key and its partner by the key's public prefix
+func (m *MemoryRepo) GetAPIKeyByPrefix(prefix string) (models.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("GetAPIKeyByPrefix"); err != nil {
+		return models.APIKey{}, err
+	}
+
+	for _, k := range m.apiKeys {
+		if k.Prefix == prefix {
+			k = m.apiKey(k)
+			k.Requests, k.RecentRequests = 0, 0
+			return k, nil
+		}
+	}
+
+	return models.APIKey{}, repository.ErrNotFound
+}
+
+// InsertAPIKey inserts an API key and returns its ID
+func (m *MemoryRepo) InsertAPIKey(k models.APIKey) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("InsertAPIKey"); err != nil {
+		return 0, err
+	}
+
+	if !m.hasPartner(k.PartnerID) {
+		return 0, fmt.Errorf("partner %d does not exist", k.PartnerID)
+	}
+	for _, existing := range m.apiKeys {
+		if existing.Prefix == k.Prefix {
+			return 0, fmt.Errorf("an API key with prefix %s already exists", k.Prefix)
+		}
+	}
+
+	now := m.App.Now()
+
+	k.ID = m.nextID("api_keys")
+	k.Partner = models.Partner{}
+	k.Scopes = append([]string(nil), k.Scopes...)
+	k.LastUsedAt, k.RevokedAt = time.Time{}, time.Time{}
+	k.Requests, k.RecentRequests = 0, 0
+	k.CreatedAt, k.UpdatedAt = now, now
+	m.apiKeys = append(m.apiKeys, k)
+
+	return k.ID, nil
+}
+
+// RevokeAPIKey stops an API key from being accepted. Revoking a key twice keeps the original revocation time
+func (m *MemoryRepo) RevokeAPIKey(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("RevokeAPIKey"); err != nil {
+		return err
+	}
+
+	for i := range m.apiKeys {
+		if m.apiKeys[i].ID == id {
+			now := m.App.Now()
+			if m.apiKeys[i].RevokedAt.IsZero() {
+				m.apiKeys[i].RevokedAt = now
+			}
+			m.apiKeys[i].UpdatedAt = now
+			return nil
+		}
+	}
+
+	return repository.ErrNotFound
+}
+
+// RecordAPIKeyUsage counts a request made with an API key
+func (m *MemoryRepo) RecordAPIKeyUsage(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("RecordAPIKeyUsage"); err != nil {
+		return err
+	}
+
+	for i := range m.apiKeys {
+		if m.apiKeys[i].ID == id {
+			now := m.App.Now()
+			m.apiKeys[i].LastUsedAt = now
+
+			if m.apiKeyUsage[id] == nil {
+				m.apiKeyUsage[id] = make(map[string]int)
+			}
+			m.apiKeyUsage[id][now.Format("2006-01-02")]++
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("API key %d does not exist", id)
+}
+
+// idempotencyKeyID is the key of an idempotency key in m.idempotencyKeys
+func idempotencyKeyID(scope, key string) string {
+	return scope + "\x00" + key
+}
+
+// ClaimIdempotencyKey stores a new, in progress idempotency key and returns true. If the key is already held
+// it returns the stored key and false instead. Expired keys are replaced
+func (m *MemoryRepo) ClaimIdempotencyKey(k models.IdempotencyKey) (models.IdempotencyKey, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("ClaimIdempotencyKey"); err != nil {
+		return k, false, err
+	}
+
+	now := m.App.Now()
+	id := idempotencyKeyID(k.Scope, k.Key)
+
+	existing, ok := m.idempotencyKeys[id]
+	if ok && existing.ExpiresAt.After(now) {
+		return existing, false, nil
+	}
+
+	m.idempotencyKeys[id] = models.IdempotencyKey{Scope: k.Scope, Key: k.Key, RequestHash: k.RequestHash,
+		CreatedAt: now, ExpiresAt: k.ExpiresAt}
+
+	return k, true, nil
+}
+
+// GetIdempotencyKey gets an unexpired idempotency key
+func (m *MemoryRepo) GetIdempotencyKey(scope, key string) (models.IdempotencyKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("GetIdempotencyKey"); err != nil {
+		return models.IdempotencyKey{}, err
+	}
+
+	k, ok := m.idempotencyKeys[idempotencyKeyID(scope, key)]
+	if !ok || !k.ExpiresAt.After(m.App.Now()) {
+		return k, repository.ErrNotFound
+	}
+
+	return k, nil
+}
+
+// CompleteIdempotencyKey stores the outcome of the request that claimed a key
+func (m *MemoryRepo) CompleteIdempotencyKey(k models.IdempotencyKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("CompleteIdempotencyKey"); err != nil {
+		return err
+	}
+
+	id := idempotencyKeyID(k.Scope, k.Key)
+
+	existing, ok := m.idempotencyKeys[id]
+	if !ok {
+		return nil
+	}
+
+	existing.StatusCode, existing.Location, existing.Body = k.StatusCode, k.Location, k.Body
+	m.idempotencyKeys[id] = existing
+
+	return nil
+}
+
+// ReleaseIdempotencyKey forgets a key, so that a request that failed can be retried with it
+func (m *MemoryRepo) ReleaseIdempotencyKey(scope, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("ReleaseIdempotencyKey"); err != nil {
+		return err
+	}
+
+	delete(m.idempotencyKeys, idempotencyKeyID(scope, key))
+
+	return nil
+}
+
+// DeleteExpiredIdempotencyKeys removes expired idempotency keys, returning how many were removed
+func (m *MemoryRepo) DeleteExpiredIdempotencyKeys() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("DeleteExpiredIdempotencyKeys"); err != nil {
+		return 0, err
+	}
+
+	now := m.App.Now()
+	n := 0
+
+	for id, k := range m.idempotencyKeys {
+		if !k.ExpiresAt.After(now) {
+			delete(m.idempotencyKeys, id)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// AllWebhookSubscriptions returns every webhook subscription
+func (m *MemoryRepo) AllWebhookSubscriptions() ([]models.WebhookSubscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var subscriptions []models.WebhookSubscription
+
+	if err := m.failure("AllWebhookSubscriptions"); err != nil {
+		return subscriptions, err
+	}
+
+	for _, s := range m.subscriptions {
+		s.Events = append([]string(nil), s.Events...)
+		subscriptions = append(subscriptions, s)
+	}
+
+	return subscriptions, nil
+}
+
+// GetWebhookSubscriptionByID gets a webhook subscription
+func (m *MemoryRepo) GetWebhookSubscriptionByID(id int) (models.WebhookSubscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("GetWebhookSubscriptionByID"); err != nil {
+		return models.WebhookSubscription{}, err
+	}
+
+	for _, s := range m.subscriptions {
+		if s.ID == id {
+			s.Events = append([]string(nil), s.Events...)
+			return s, nil
+		}
+	}
+
+	return models.WebhookSubscription{}, repository.ErrNotFound
+}
+
+// InsertWebhookSubscription inserts a webhook subscription and returns its ID
+func (m *MemoryRepo) InsertWebhookSubscription(s models.WebhookSubscription) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("InsertWebhookSubscription"); err != nil {
+		return 0, err
+	}
+
+	now := m.App.Now()
+
+	s.ID = m.nextID("webhook_subscriptions")
+	s.Events = append([]string(nil), s.Events...)
+	s.CreatedAt, s.UpdatedAt = now, now
+	m.subscriptions = append(m.subscriptions, s)
+
+	return s.ID, nil
+}
+
+// DeleteWebhookSubscription deletes a webhook subscription along with its deliveries
+func (m *MemoryRepo) DeleteWebhookSubscription(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("DeleteWebhookSubscription"); err != nil {
+		return err
+	}
+
+	for i := range m.subscriptions {
+		if m.subscriptions[i].ID != id {
+			continue
+		}
+
+		m.subscriptions = append(m.subscriptions[:i], m.subscriptions[i+1:]...)
+
+		var kept []models.WebhookDelivery
+		for _, d := range m.deliveries {
+			if d.SubscriptionID != id {
+				kept = append(kept, d)
+			}
+		}
+		m.deliveries = kept
+
+		return nil
+	}
+
+	return repository.ErrNotFound
+}
+
+// EnqueueWebhookDeliveries queues an event for delivery to every active subscription to its type. An event is
+// only queued once for each subscription
+func (m *MemoryRepo) EnqueueWebhookDeliveries(eventID, eventType, payload string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("EnqueueWebhookDeliveries"); err != nil {
+		return err
+	}
+
+	now := m.App.Now()
+
+	for _, s := range m.subscriptions {
+		subscribed := false
+		for _, e := range s.Events {
+			subscribed = subscribed || e == eventType
+		}
+		if !s.Active || !subscribed {
+			continue
+		}
+
+		queued := false
+		for _, d := range m.deliveries {
+			queued = queued || (d.SubscriptionID == s.ID && d.EventID == eventID)
+		}
+		if queued {
+			continue
+		}
+
+		m.deliveries = append(m.deliveries, models.WebhookDelivery{
+			ID:             m.nextID("webhook_deliveries"),
+			SubscriptionID: s.ID,
+			EventID:        eventID,
+			EventType:      eventType,
+			Payload:        payload,
+			Status:         models.WebhookPending,
+			NextAttemptAt:  now,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		})
+	}
+
+	return nil
+}
+
+// DueWebhookDeliveries returns up to limit pending deliveries that are due, with their subscriptions. The
+// deliveries are leased: they won't be returned again until lease has passed, even if no attempt is recorded
+func (m *MemoryRepo) DueWebhookDeliveries(limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deliveries []models.WebhookDelivery
+
+	if err := m.failure("DueWebhookDeliveries"); err != nil {
+		return deliveries, err
+	}
+
+	now := m.App.Now()
+
+	var due []int
+	for i, d := range m.deliveries {
+		if d.Status == models.WebhookPending && !d.NextAttemptAt.After(now) {
+			due = append(due, i)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return m.deliveries[due[i]].NextAttemptAt.Before(m.deliveries[due[j]].NextAttemptAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	for _, i := range due {
+		m.deliveries[i].NextAttemptAt = now.Add(lease)
+
+		d := m.deliveries[i]
+		d.NextAttemptAt, d.LastAttemptAt = time.Time{}, time.Time{}
+		for _, s := range m.subscriptions {
+			if s.ID == d.SubscriptionID {
+				d.Subscription = models.WebhookSubscription{ID: s.ID, URL: s.URL, Secret: s.Secret}
+			}
+		}
+
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, nil
+}
+
+// RecordWebhookAttempt stores the outcome of an attempt to send a delivery
+func (m *MemoryRepo) RecordWebhookAttempt(d models.WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("RecordWebhookAttempt"); err != nil {
+		return err
+	}
+
+	for i := range m.deliveries {
+		if m.deliveries[i].ID == d.ID {
+			stored := &m.deliveries[i]
+			stored.Status, stored.Attempts, stored.ResponseCode, stored.Error = d.Status, d.Attempts, d.ResponseCode, d.Error
+			stored.NextAttemptAt, stored.LastAttemptAt = d.NextAttemptAt, d.LastAttemptAt
+			stored.UpdatedAt = m.App.Now()
+		}
+	}
+
+	return nil
+}
+
+// WebhookDeliveries returns the most recent deliveries to a subscription, newest first
+func (m *MemoryRepo) WebhookDeliveries(subscriptionID, limit int) ([]models.WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deliveries []models.WebhookDelivery
+
+	if err := m.failure("WebhookDeliveries"); err != nil {
+		return deliveries, err
+	}
+
+	for i := len(m.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		if m.deliveries[i].SubscriptionID == subscriptionID {
+			deliveries = append(deliveries, m.deliveries[i])
+		}
+	}
+
+	return deliveries, nil
+}
+
+// PendingOutboxEvents returns up to limit unpublished events that are due, oldest first. The events are leased:
+// they won't be returned again until lease has passed, unless their outcome is recorded first
+func (m *MemoryRepo) PendingOutboxEvents(limit int, lease time.Duration) ([]models.OutboxEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var pending []models.OutboxEvent
+
+	if err := m.failure("PendingOutboxEvents"); err != nil {
+		return pending, err
+	}
+
+	now := m.App.Now()
+
+	for i := range m.outbox {
+		e := &m.outbox[i]
+		if len(pending) == limit {
+			break
+		}
+		if !e.PublishedAt.IsZero() || e.NextAttemptAt.After(now) {
+			continue
+		}
+
+		e.NextAttemptAt = now.Add(lease)
+		pending = append(pending, models.OutboxEvent{ID: e.ID, Type: e.Type, Payload: e.Payload, Attempts: e.Attempts,
+			LastError: e.LastError, CreatedAt: e.CreatedAt})
+	}
+
+	return pending, nil
+}
+
+// MarkOutboxEventPublished records that an event has been published
+func (m *MemoryRepo) MarkOutboxEventPublished(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("MarkOutboxEventPublished"); err != nil {
+		return err
+	}
+
+	for i := range m.outbox {
+		if m.outbox[i].ID == id {
+			m.outbox[i].PublishedAt = m.App.Now()
+		}
+	}
+
+	return nil
+}
+
+// RetryOutboxEvent records a failed attempt to publish an event, which will be published again at its NextAttemptAt
+func (m *MemoryRepo) RetryOutboxEvent(e models.OutboxEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.failure("RetryOutboxEvent"); err != nil {
+		return err
+	}
+
+	for i := range m.outbox {
+		if m.outbox[i].ID == e.ID {
+			m.outbox[i].Attempts, m.outbox[i].LastError, m.outbox[i].NextAttemptAt = e.Attempts, e.LastError, e.NextAttemptAt
+		}
+	}
+
+	return nil
+}
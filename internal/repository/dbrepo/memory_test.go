@@ -0,0 +1,127 @@
+package dbrepo
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/clock"
+	"github.com/ashrielbrian/go_bookings/internal/config"
+	"github.com/ashrielbrian/go_bookings/internal/models"
+	"github.com/ashrielbrian/go_bookings/internal/repository"
+)
+
+func TestMemoryRepo_Fail(t *testing.T) {
+	m := NewMemoryRepo(&config.AppConfig{})
+
+	injected := errors.New("connection reset")
+	m.Fail("AllRooms", injected)
+
+	_, err := m.AllRooms(true)
+	if err != injected {
+		t.Errorf("expected the injected error, got %v", err)
+	}
+
+	_, err = m.AllAmenities()
+	if err != nil {
+		t.Errorf("expected other methods to work, got %v", err)
+	}
+
+	m.Fail("AllRooms", nil)
+
+	_, err = m.AllRooms(true)
+	if err != nil {
+		t.Errorf("expected the method to work again, got %v", err)
+	}
+}
+
+func TestMemoryRepo_CreateBookingIsAtomic(t *testing.T) {
+	m := NewMemoryRepo(&config.AppConfig{})
+
+	res := models.Reservation{Code: "TESTCODE", FirstName: "John", RoomID: 1, StartDate: date("2050-01-01"),
+		EndDate: date("2050-01-03"), Adults: 1}
+
+	_, err := m.CreateBooking(res, models.Payment{Currency: "USD"})
+	if err == nil {
+		t.Fatal("expected booking a room that doesn't exist to fail")
+	}
+
+	if len(m.reservations) != 0 || len(m.roomRestrictions) != 0 || len(m.payments) != 0 || len(m.outbox) != 0 {
+		t.Errorf("expected nothing to be stored, got %d reservations, %d restrictions, %d payments and %d events",
+			len(m.reservations), len(m.roomRestrictions), len(m.payments), len(m.outbox))
+	}
+}
+
+func TestMemoryRepo_Concurrency(t *testing.T) {
+	m := NewMemoryRepo(&config.AppConfig{})
+
+	roomID, err := m.InsertRoom(models.Room{RoomName: "General's Quarters", Slug: "generals-quarters", MaxOccupancy: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			res := models.Reservation{Code: fmt.Sprintf("CODE%04d", i), RoomID: roomID, Adults: 1,
+				StartDate: date("2050-01-01").AddDate(0, 0, i), EndDate: date("2050-01-02").AddDate(0, 0, i)}
+
+			_, err := m.CreateBooking(res, models.Payment{Currency: "USD"})
+			if err != nil {
+				t.Error(err)
+			}
+
+			_, err = m.SearchAvailabiltyForAllRooms(res.StartDate, res.EndDate, models.RoomFilter{})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	ids := make(map[int]bool)
+	for _, r := range m.reservations {
+		ids[r.ID] = true
+	}
+	if len(ids) != 50 {
+		t.Errorf("expected 50 reservations with distinct IDs, got %d", len(ids))
+	}
+
+	available, err := m.SearchAvailabilityByDatesByRoomID(date("2050-01-01"), date("2050-02-20"), roomID)
+	if err != nil || available {
+		t.Errorf("expected the room to be booked, got %v, %v", available, err)
+	}
+}
+
+func TestMemoryRepo_Clock(t *testing.T) {
+	now := time.Date(2026, 11, 1, 10, 0, 0, 0, time.UTC)
+	c := clock.NewFake(now)
+	m := NewMemoryRepo(&config.AppConfig{Clock: c})
+
+	k := models.IdempotencyKey{Scope: "api", Key: "abc", ExpiresAt: now.Add(time.Hour)}
+	if _, claimed, err := m.ClaimIdempotencyKey(k); err != nil || !claimed {
+		t.Fatalf("expected the key to be claimed, got %v, %v", claimed, err)
+	}
+
+	stored, err := m.GetIdempotencyKey("api", "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.CreatedAt.Equal(now) {
+		t.Errorf("expected the key to be created at %s, got %s", now, stored.CreatedAt)
+	}
+
+	c.Advance(time.Hour)
+
+	if _, err := m.GetIdempotencyKey("api", "abc"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected the key to have expired, got %v", err)
+	}
+	if n, err := m.DeleteExpiredIdempotencyKeys(); err != nil || n != 1 {
+		t.Errorf("expected 1 expired key to be deleted, got %d, %v", n, err)
+	}
+}
@@ -2,9 +2,20 @@ package dbrepo
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/ashrielbrian/go_bookings/internal/dates"
+	"github.com/ashrielbrian/go_bookings/internal/events"
 	"github.com/ashrielbrian/go_bookings/internal/models"
+	"github.com/ashrielbrian/go_bookings/internal/repository"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func (m *postgresDBRepo) AllUsers() bool {
@@ -19,11 +30,12 @@ func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error)
 
 	var newID int
 
-	stmt := `insert into reservations (first_name, last_name, email, phone, start_date,
-		end_date, room_id, created_at, updated_at)
-		values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
+	stmt := `insert into reservations (code, first_name, last_name, email, phone, start_date,
+		end_date, room_id, adults, children, early_check_in, late_check_out, partner_id, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) returning id`
 
 	err := m.DB.QueryRowContext(ctx, stmt,
+		res.Code,
 		res.FirstName,
 		res.LastName,
 		res.Email,
@@ -31,8 +43,13 @@ func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error)
 		res.StartDate,
 		res.EndDate,
 		res.RoomID,
-		time.Now(),
-		time.Now(),
+		res.Adults,
+		res.Children,
+		res.EarlyCheckIn,
+		res.LateCheckOut,
+		sql.NullInt64{Int64: int64(res.PartnerID), Valid: res.PartnerID != 0},
+		m.App.Now(),
+		m.App.Now(),
 	).Scan(&newID)
 
 	if err != nil {
@@ -42,35 +59,319 @@ func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error)
 	return newID, nil
 }
 
-// InsertRoomRestriction inserts a room restriction into the database
+// CreateBooking inserts a reservation along with the room restriction blocking the nights it occupies and its
+// payment, and records a reservation.created event. It all happens in one transaction, so a booking is either made
+// in full with its event or not at all. It returns repository.ErrUnavailable, and books nothing, when a restriction
+// already blocks any of the nights the reservation holds
+func (m *postgresDBRepo) CreateBooking(res models.Reservation, payment models.Payment) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := m.App.Now()
+
+	// the no-op update locks the room's row until the transaction ends, so concurrent bookings of the room check
+	// its restrictions one at a time. SQLite transactions already hold the write lock
+	var turnoverDays int
+	err = tx.QueryRowContext(ctx, `update rooms set turnover_days = turnover_days where id = $1 returning turnover_days`,
+		res.RoomID).Scan(&turnoverDays)
+	if err != nil {
+		return 0, err
+	}
+
+	// restrictions of other reservations are widened by the turnover days, so a stay that holds none of their
+	// nights is far enough from them
+	heldStart, heldEnd := res.Held()
+	var overlapping int
+	err = tx.QueryRowContext(ctx, `select count(id) from room_restrictions
+		where room_id = $1 and $2 < end_date and $3 > start_date`,
+		res.RoomID, heldStart, heldEnd).Scan(&overlapping)
+	if err != nil {
+		return 0, err
+	}
+	if overlapping > 0 {
+		return 0, repository.ErrUnavailable
+	}
+
+	var reservationID int
+
+	err = tx.QueryRowContext(ctx, `insert into reservations (code, first_name, last_name, email, phone, start_date,
+		end_date, room_id, adults, children, early_check_in, late_check_out, partner_id, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) returning id`,
+		res.Code,
+		res.FirstName,
+		res.LastName,
+		res.Email,
+		res.Phone,
+		res.StartDate,
+		res.EndDate,
+		res.RoomID,
+		res.Adults,
+		res.Children,
+		res.EarlyCheckIn,
+		res.LateCheckOut,
+		sql.NullInt64{Int64: int64(res.PartnerID), Valid: res.PartnerID != 0},
+		now,
+		now,
+	).Scan(&reservationID)
+	if err != nil {
+		return 0, err
+	}
+
+	// the restriction blocks the room's turnover days around the stay as well as the nights it holds
+	start, end := res.Occupied(turnoverDays)
+
+	_, err = tx.ExecContext(ctx, `insert into room_restrictions (start_date, end_date, room_id, reservation_id,
+		created_at, updated_at, restriction_id)
+		values ($1, $2, $3, $4, $5, $6, $7)`,
+		start,
+		end,
+		res.RoomID,
+		reservationID,
+		now,
+		now,
+		1,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `insert into payments (reservation_id, amount, currency, base_amount, base_currency,
+		exchange_rate, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		reservationID,
+		payment.Amount,
+		payment.Currency,
+		payment.BaseAmount,
+		payment.BaseCurrency,
+		payment.ExchangeRate,
+		now,
+		now,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.insertOutboxEvent(ctx, tx, events.ReservationCreated, events.Reservation{
+		ReservationID: reservationID,
+		Code:          res.Code,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return reservationID, tx.Commit()
+}
+
+// GetReservationByCode gets a reservation and its room by the reservation's code
+func (m *postgresDBRepo) GetReservationByCode(code string) (models.Reservation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var res models.Reservation
+	var partnerID sql.NullInt64
+	var cancelledAt sql.NullTime
+
+	query := `
+		select
+			r.id, r.code, r.first_name, r.last_name, r.email, r.phone, r.room_id, r.start_date,
+			r.end_date, r.adults, r.children, r.early_check_in, r.late_check_out, r.partner_id, r.cancelled_at,
+			r.created_at, r.updated_at,
+			rm.id, rm.room_name, rm.slug, rm.price, rm.check_in_time, rm.check_out_time, rm.early_check_in_price,
+			rm.late_check_out_price, rm.turnover_days
+		from
+			reservations r
+			inner join rooms rm on rm.id = r.room_id
+		where
+			r.code = $1
+	`
+
+	row := m.DB.QueryRowContext(ctx, query, strings.ToUpper(code))
+
+	err := row.Scan(
+		&res.ID,
+		&res.Code,
+		&res.FirstName,
+		&res.LastName,
+		&res.Email,
+		&res.Phone,
+		&res.RoomID,
+		&res.StartDate,
+		&res.EndDate,
+		&res.Adults,
+		&res.Children,
+		&res.EarlyCheckIn,
+		&res.LateCheckOut,
+		&partnerID,
+		&cancelledAt,
+		&res.CreatedAt,
+		&res.UpdatedAt,
+		&res.Room.ID,
+		&res.Room.RoomName,
+		&res.Room.Slug,
+		&res.Room.Price,
+		&res.Room.CheckInTime,
+		&res.Room.CheckOutTime,
+		&res.Room.EarlyCheckInPrice,
+		&res.Room.LateCheckOutPrice,
+		&res.Room.TurnoverDays,
+	)
+
+	if err == sql.ErrNoRows {
+		return res, repository.ErrNotFound
+	}
+	if err != nil {
+		return res, err
+	}
+	res.PartnerID = int(partnerID.Int64)
+	res.CancelledAt = cancelledAt.Time
+
+	return res, nil
+}
+
+// UpdateReservation updates the guest details of the reservation with res.Code, and records a reservation.updated
+// event with the change
+func (m *postgresDBRepo) UpdateReservation(res models.Reservation) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRowContext(ctx, `update reservations set first_name = $1, last_name = $2, email = $3, phone = $4,
+		updated_at = $5 where code = $6 returning id`,
+		res.FirstName,
+		res.LastName,
+		res.Email,
+		res.Phone,
+		m.App.Now(),
+		strings.ToUpper(res.Code),
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return repository.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	err = m.insertOutboxEvent(ctx, tx, events.ReservationUpdated, events.Reservation{
+		ReservationID: id,
+		Code:          strings.ToUpper(res.Code),
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CancelReservation cancels a reservation, freeing the nights its room restrictions held, and records a
+// reservation.cancelled event. Cancelling a reservation that is already cancelled changes nothing
+func (m *postgresDBRepo) CancelReservation(code string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	code = strings.ToUpper(code)
+
+	var id int
+	err = tx.QueryRowContext(ctx, `update reservations set cancelled_at = $1, updated_at = $1
+		where code = $2 and cancelled_at is null returning id`,
+		m.App.Now(),
+		code,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		var found int
+		err = tx.QueryRowContext(ctx, `select count(id) from reservations where code = $1`, code).Scan(&found)
+		if err != nil {
+			return err
+		}
+		if found == 0 {
+			return repository.ErrNotFound
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from room_restrictions where reservation_id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	err = m.insertOutboxEvent(ctx, tx, events.ReservationCancelled, events.Reservation{
+		ReservationID: id,
+		Code:          code,
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// InsertRoomRestriction inserts a room restriction into the database. A zero ReservationID means the restriction
+// isn't for a reservation, such as an owner block, and a block.created event is recorded with it
 func (m *postgresDBRepo) InsertRoomRestriction(r models.RoomRestriction) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	stmt := `insert into room_restrictions (start_date, end_date, room_id, reservation_id,
 		created_at, updated_at, restriction_id)
-		values ($1, $2, $3, $4, $5, $6, $7)`
+		values ($1, $2, $3, $4, $5, $6, $7) returning id`
 
-	_, err := m.DB.ExecContext(ctx, stmt,
+	var id int
+	err = tx.QueryRowContext(ctx, stmt,
 		r.StartDate,
 		r.EndDate,
 		r.RoomID,
-		r.ReservationID,
-		time.Now(),
-		time.Now(),
+		sql.NullInt64{Int64: int64(r.ReservationID), Valid: r.ReservationID != 0},
+		m.App.Now(),
+		m.App.Now(),
 		r.RestrictionID,
-	)
-
+	).Scan(&id)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if r.ReservationID == 0 {
+		err = m.insertOutboxEvent(ctx, tx, events.BlockCreated, events.Block{
+			RoomRestrictionID: id,
+			RoomID:            r.RoomID,
+			StartDate:         r.StartDate,
+			EndDate:           r.EndDate,
+		})
+		if err != nil {
+			return err
+		}
+	}
 
+	return tx.Commit()
 }
 
 // SearchAvailabilityByDatesByRoomID returns true is there is room availability for room ID; returns false otherwise
-func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(start, end time.Time, roomID int) (bool, error) {
+func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(start, end dates.Date, roomID int) (bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
@@ -101,19 +402,94 @@ func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(start, end time.Time,
 
 }
 
+// roomSortOrders maps the RoomFilter sort values to order by clauses
+var roomSortOrders = map[string]string{
+	models.RoomSortPriceAsc:  "price, room_name",
+	models.RoomSortPriceDesc: "price desc, room_name",
+	models.RoomSortSizeAsc:   "size_sqm, room_name",
+	models.RoomSortSizeDesc:  "size_sqm desc, room_name",
+}
+
+// RoomAvailabilityByDay returns whether a room is free on each night from start up to, but not including, end
+func (m *postgresDBRepo) RoomAvailabilityByDay(roomID int, start, end dates.Date) ([]models.DayAvailability, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select
+			start_date, end_date
+		from
+			room_restrictions
+		where
+			room_id = $1 and
+			$2 < end_date and $3 > start_date
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, roomID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var restrictions []models.RoomRestriction
+	for rows.Next() {
+		var r models.RoomRestriction
+		err = rows.Scan(&r.StartDate, &r.EndDate)
+		if err != nil {
+			return nil, err
+		}
+		restrictions = append(restrictions, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return daysAvailable(start, end, restrictions), nil
+}
+
+// daysAvailable lists the nights from start up to end, each available unless one of the restrictions covers it
+func daysAvailable(start, end dates.Date, restrictions []models.RoomRestriction) []models.DayAvailability {
+	var days []models.DayAvailability
+
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		day := models.DayAvailability{Date: d, Available: true}
+		for _, r := range restrictions {
+			if !d.Before(r.StartDate) && d.Before(r.EndDate) {
+				day.Available = false
+				break
+			}
+		}
+		days = append(days, day)
+	}
+
+	return days
+}
+
 // SearchAvailabiltyForAllRooms returns a slice of all available rooms, if any, for a given date range
-func (m *postgresDBRepo) SearchAvailabiltyForAllRooms(start, end time.Time) ([]models.Room, error) {
+// that match the filter
+func (m *postgresDBRepo) SearchAvailabiltyForAllRooms(start, end dates.Date, filter models.RoomFilter) ([]models.Room, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	var rooms []models.Room
 
+	args := []interface{}{start, end, filter.Guests}
+
+	// arg appends a query argument and returns its placeholder
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
 	query := `
 		select
-			r.id, r.room_name
+			` + roomColumns + `
 		from
 			rooms r
 		where
+			not r.retired and
+			r.max_occupancy >= $3 and
 			r.id not in (
 				select rr.room_id 
 				from room_restrictions rr 
@@ -121,18 +497,45 @@ func (m *postgresDBRepo) SearchAvailabiltyForAllRooms(start, end time.Time) ([]m
 			)
 	`
 
-	rows, err := m.DB.QueryContext(ctx, query, start, end)
+	if filter.MinPrice > 0 {
+		query += ` and r.price >= ` + arg(filter.MinPrice)
+	}
+
+	if filter.MaxPrice > 0 {
+		query += ` and r.price <= ` + arg(filter.MaxPrice)
+	}
+
+	if filter.BedType != "" {
+		query += ` and lower(r.bed_types) like ` + arg("%"+strings.ToLower(filter.BedType)+"%")
+	}
+
+	if len(filter.AmenityIDs) > 0 {
+		placeholders := make([]string, len(filter.AmenityIDs))
+		for i, id := range filter.AmenityIDs {
+			placeholders[i] = arg(id)
+		}
+
+		query += ` and (
+				select count(distinct ra.amenity_id)
+				from room_amenities ra
+				where ra.room_id = r.id and ra.amenity_id in (` + strings.Join(placeholders, ", ") + `)
+			) = ` + arg(len(filter.AmenityIDs))
+	}
+
+	order, ok := roomSortOrders[filter.Sort]
+	if !ok {
+		order = "room_name"
+	}
+	query += ` order by ` + order
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return rooms, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
-		var room models.Room
-		err := rows.Scan(
-			&room.ID,
-			&room.RoomName,
-		)
-
+		room, err := scanRoom(rows)
 		if err != nil {
 			return rooms, err
 		}
@@ -144,32 +547,1518 @@ func (m *postgresDBRepo) SearchAvailabiltyForAllRooms(start, end time.Time) ([]m
 		return rooms, err
 	}
 
+	for i := range rooms {
+		rooms[i].Amenities, err = m.roomAmenities(ctx, rooms[i].ID)
+		if err != nil {
+			return rooms, err
+		}
+
+		rooms[i].Images, err = m.roomImages(ctx, rooms[i].ID)
+		if err != nil {
+			return rooms, err
+		}
+	}
+
 	return rooms, nil
 }
 
-// GetRoomByID gets the room details by ID
-func (m *postgresDBRepo) GetRoomByID(id int) (models.Room, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+// roomColumns are the columns of the rooms table scanned by scanRoom
+const roomColumns = `id, room_name, slug, description, max_occupancy, bed_types, price, size_sqm, retired,
+	check_in_time, check_out_time, early_check_in_price, late_check_out_price, turnover_days, created_at, updated_at`
 
-	var room models.Room
+// roomTimes returns the check-in and check-out times to store for a room, the defaults where it doesn't set them
+func roomTimes(room models.Room) (string, string) {
+	checkIn, checkOut := room.CheckInTime, room.CheckOutTime
+	if checkIn == "" {
+		checkIn = models.DefaultCheckInTime
+	}
+	if checkOut == "" {
+		checkOut = models.DefaultCheckOutTime
+	}
+	return checkIn, checkOut
+}
 
-	query := `
-		select id, room_name, created_at, updated_at from rooms where id = $1
-	`
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
 
-	row := m.DB.QueryRowContext(ctx, query, id)
+// scanRoom scans roomColumns into a room
+func scanRoom(row rowScanner) (models.Room, error) {
+	var room models.Room
 
 	err := row.Scan(
 		&room.ID,
 		&room.RoomName,
+		&room.Slug,
+		&room.Description,
+		&room.MaxOccupancy,
+		&room.BedTypes,
+		&room.Price,
+		&room.SizeSqm,
+		&room.Retired,
+		&room.CheckInTime,
+		&room.CheckOutTime,
+		&room.EarlyCheckInPrice,
+		&room.LateCheckOutPrice,
+		&room.TurnoverDays,
 		&room.CreatedAt,
 		&room.UpdatedAt,
 	)
 
+	return room, err
+}
+
+// GetRoomByID gets the room details, amenities and images by ID
+func (m *postgresDBRepo) GetRoomByID(id int) (models.Room, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select ` + roomColumns + ` from rooms where id = $1`
+
+	row := m.DB.QueryRowContext(ctx, query, id)
+
+	room, err := scanRoom(row)
+	if err == sql.ErrNoRows {
+		return room, repository.ErrNotFound
+	}
+	if err != nil {
+		return room, err
+	}
+
+	room.Amenities, err = m.roomAmenities(ctx, room.ID)
+	if err != nil {
+		return room, err
+	}
+
+	room.Images, err = m.roomImages(ctx, room.ID)
+	if err != nil {
+		return room, err
+	}
+
+	return room, nil
+}
+
+// GetRoomBySlug gets the room details, amenities and images by the room's slug
+func (m *postgresDBRepo) GetRoomBySlug(slug string) (models.Room, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select ` + roomColumns + ` from rooms where slug = $1`
+
+	row := m.DB.QueryRowContext(ctx, query, slug)
+
+	room, err := scanRoom(row)
+	if err == sql.ErrNoRows {
+		return room, repository.ErrNotFound
+	}
+	if err != nil {
+		return room, err
+	}
+
+	room.Amenities, err = m.roomAmenities(ctx, room.ID)
+	if err != nil {
+		return room, err
+	}
+
+	room.Images, err = m.roomImages(ctx, room.ID)
 	if err != nil {
 		return room, err
 	}
 
 	return room, nil
 }
+
+// AllRooms returns every room with its amenities and images, optionally including retired rooms
+func (m *postgresDBRepo) AllRooms(includeRetired bool) ([]models.Room, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rooms []models.Room
+
+	query := `
+		select ` + roomColumns + `
+		from rooms
+		where $1 or not retired
+		order by room_name
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, includeRetired)
+	if err != nil {
+		return rooms, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		room, err := scanRoom(rows)
+		if err != nil {
+			return rooms, err
+		}
+
+		rooms = append(rooms, room)
+	}
+
+	if err = rows.Err(); err != nil {
+		return rooms, err
+	}
+
+	for i := range rooms {
+		rooms[i].Amenities, err = m.roomAmenities(ctx, rooms[i].ID)
+		if err != nil {
+			return rooms, err
+		}
+
+		rooms[i].Images, err = m.roomImages(ctx, rooms[i].ID)
+		if err != nil {
+			return rooms, err
+		}
+	}
+
+	return rooms, nil
+}
+
+// roomAmenities returns the amenities of a room
+func (m *postgresDBRepo) roomAmenities(ctx context.Context, roomID int) ([]models.Amenity, error) {
+	var amenities []models.Amenity
+
+	query := `
+		select a.id, a.name, a.created_at, a.updated_at
+		from amenities a
+		inner join room_amenities ra on ra.amenity_id = a.id
+		where ra.room_id = $1
+		order by a.name
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, roomID)
+	if err != nil {
+		return amenities, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a models.Amenity
+		err := rows.Scan(&a.ID, &a.Name, &a.CreatedAt, &a.UpdatedAt)
+		if err != nil {
+			return amenities, err
+		}
+
+		amenities = append(amenities, a)
+	}
+
+	return amenities, rows.Err()
+}
+
+// roomImages returns the images of a room in display order
+func (m *postgresDBRepo) roomImages(ctx context.Context, roomID int) ([]models.RoomImage, error) {
+	var images []models.RoomImage
+
+	query := `
+		select ` + roomImageColumns + `
+		from room_images
+		where room_id = $1
+		order by sort_order, id
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, roomID)
+	if err != nil {
+		return images, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		img, err := scanRoomImage(rows)
+		if err != nil {
+			return images, err
+		}
+
+		images = append(images, img)
+	}
+
+	return images, rows.Err()
+}
+
+// InsertRoom inserts a room into the database
+func (m *postgresDBRepo) InsertRoom(room models.Room) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+
+	stmt := `insert into rooms (room_name, slug, description, max_occupancy, bed_types, price,
+		size_sqm, retired, check_in_time, check_out_time, early_check_in_price, late_check_out_price, turnover_days,
+		created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) returning id`
+
+	checkIn, checkOut := roomTimes(room)
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		room.RoomName,
+		room.Slug,
+		room.Description,
+		room.MaxOccupancy,
+		room.BedTypes,
+		room.Price,
+		room.SizeSqm,
+		room.Retired,
+		checkIn,
+		checkOut,
+		room.EarlyCheckInPrice,
+		room.LateCheckOutPrice,
+		room.TurnoverDays,
+		m.App.Now(),
+		m.App.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateRoom updates a room's details
+func (m *postgresDBRepo) UpdateRoom(room models.Room) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update rooms set room_name = $1, slug = $2, description = $3, max_occupancy = $4,
+		bed_types = $5, price = $6, size_sqm = $7, check_in_time = $8, check_out_time = $9,
+		early_check_in_price = $10, late_check_out_price = $11, turnover_days = $12, updated_at = $13
+		where id = $14`
+
+	checkIn, checkOut := roomTimes(room)
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		room.RoomName,
+		room.Slug,
+		room.Description,
+		room.MaxOccupancy,
+		room.BedTypes,
+		room.Price,
+		room.SizeSqm,
+		checkIn,
+		checkOut,
+		room.EarlyCheckInPrice,
+		room.LateCheckOutPrice,
+		room.TurnoverDays,
+		m.App.Now(),
+		room.ID,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetRoomRetired retires a room, hiding it from guests, or brings it back
+func (m *postgresDBRepo) SetRoomRetired(id int, retired bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `update rooms set retired = $1, updated_at = $2 where id = $3`,
+		retired,
+		m.App.Now(),
+		id,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AllAmenities returns every amenity a room can have
+func (m *postgresDBRepo) AllAmenities() ([]models.Amenity, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var amenities []models.Amenity
+
+	rows, err := m.DB.QueryContext(ctx, `select id, name, created_at, updated_at from amenities order by name`)
+	if err != nil {
+		return amenities, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a models.Amenity
+		err := rows.Scan(&a.ID, &a.Name, &a.CreatedAt, &a.UpdatedAt)
+		if err != nil {
+			return amenities, err
+		}
+
+		amenities = append(amenities, a)
+	}
+
+	if err = rows.Err(); err != nil {
+		return amenities, err
+	}
+
+	return amenities, nil
+}
+
+// SetRoomAmenities replaces a room's amenities
+func (m *postgresDBRepo) SetRoomAmenities(roomID int, amenityIDs []int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from room_amenities where room_id = $1`, roomID)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into room_amenities (room_id, amenity_id, created_at, updated_at) values ($1, $2, $3, $4)`
+
+	for _, id := range amenityIDs {
+		_, err = tx.ExecContext(ctx, stmt, roomID, id, m.App.Now(), m.App.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Authenticate checks the user's credentials, returning the user ID and hashed password on success
+func (m *postgresDBRepo) Authenticate(email, testPassword string) (int, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	var hashedPassword string
+
+	row := m.DB.QueryRowContext(ctx, "select id, password from users where email = $1", email)
+	err := row.Scan(&id, &hashedPassword)
+	if err != nil {
+		return id, "", err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return 0, "", errors.New("incorrect password")
+	} else if err != nil {
+		return 0, "", err
+	}
+
+	return id, hashedPassword, nil
+}
+
+// AllExchangeRates returns every stored exchange rate, ordered by currency
+func (m *postgresDBRepo) AllExchangeRates() ([]models.ExchangeRate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rates []models.ExchangeRate
+
+	query := `
+		select id, currency, rate, created_at, updated_at
+		from exchange_rates
+		order by currency
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return rates, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rate models.ExchangeRate
+		err := rows.Scan(
+			&rate.ID,
+			&rate.Currency,
+			&rate.Rate,
+			&rate.CreatedAt,
+			&rate.UpdatedAt,
+		)
+
+		if err != nil {
+			return rates, err
+		}
+
+		rates = append(rates, rate)
+	}
+
+	if err = rows.Err(); err != nil {
+		return rates, err
+	}
+
+	return rates, nil
+}
+
+// GetExchangeRate gets the exchange rate from the base currency to currency
+func (m *postgresDBRepo) GetExchangeRate(currency string) (models.ExchangeRate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rate models.ExchangeRate
+
+	query := `
+		select id, currency, rate, created_at, updated_at from exchange_rates where currency = $1
+	`
+
+	row := m.DB.QueryRowContext(ctx, query, strings.ToUpper(currency))
+
+	err := row.Scan(
+		&rate.ID,
+		&rate.Currency,
+		&rate.Rate,
+		&rate.CreatedAt,
+		&rate.UpdatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return rate, errors.New("no exchange rate for " + currency)
+	}
+
+	if err != nil {
+		return rate, err
+	}
+
+	return rate, nil
+}
+
+// UpsertExchangeRate inserts the exchange rate for currency, or updates it if one already exists
+func (m *postgresDBRepo) UpsertExchangeRate(currency string, rate float64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `insert into exchange_rates (currency, rate, created_at, updated_at)
+		values ($1, $2, $3, $4)
+		on conflict (currency) do update set rate = excluded.rate, updated_at = excluded.updated_at`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		strings.ToUpper(currency),
+		rate,
+		m.App.Now(),
+		m.App.Now(),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// InsertPayment records a payment against a reservation, including the currency it was charged in
+func (m *postgresDBRepo) InsertPayment(p models.Payment) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+
+	stmt := `insert into payments (reservation_id, amount, currency, base_amount, base_currency,
+		exchange_rate, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		p.ReservationID,
+		p.Amount,
+		p.Currency,
+		p.BaseAmount,
+		p.BaseCurrency,
+		p.ExchangeRate,
+		m.App.Now(),
+		m.App.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// roomImageColumns are the columns of the room_images table scanned by scanRoomImage
+const roomImageColumns = `id, room_id, url, thumbnail_url, storage_key, caption, sort_order, created_at, updated_at`
+
+// scanRoomImage scans roomImageColumns into a room image
+func scanRoomImage(row rowScanner) (models.RoomImage, error) {
+	var img models.RoomImage
+
+	err := row.Scan(
+		&img.ID,
+		&img.RoomID,
+		&img.URL,
+		&img.ThumbnailURL,
+		&img.StorageKey,
+		&img.Caption,
+		&img.SortOrder,
+		&img.CreatedAt,
+		&img.UpdatedAt,
+	)
+
+	return img, err
+}
+
+// GetRoomImageByID gets a room image by ID
+func (m *postgresDBRepo) GetRoomImageByID(id int) (models.RoomImage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, `select `+roomImageColumns+` from room_images where id = $1`, id)
+
+	img, err := scanRoomImage(row)
+	if err == sql.ErrNoRows {
+		return img, repository.ErrNotFound
+	}
+	if err != nil {
+		return img, err
+	}
+
+	return img, nil
+}
+
+// InsertRoomImage inserts a room image into the database
+func (m *postgresDBRepo) InsertRoomImage(img models.RoomImage) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+
+	stmt := `insert into room_images (room_id, url, thumbnail_url, storage_key, caption, sort_order,
+		created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		img.RoomID,
+		img.URL,
+		img.ThumbnailURL,
+		img.StorageKey,
+		img.Caption,
+		img.SortOrder,
+		m.App.Now(),
+		m.App.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateRoomImage updates a room image's caption and position
+func (m *postgresDBRepo) UpdateRoomImage(img models.RoomImage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update room_images set caption = $1, sort_order = $2, updated_at = $3 where id = $4`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		img.Caption,
+		img.SortOrder,
+		m.App.Now(),
+		img.ID,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteRoomImage deletes a room image from the database
+func (m *postgresDBRepo) DeleteRoomImage(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from room_images where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AllStayRules returns the stay rules of every room, ordered by room
+func (m *postgresDBRepo) AllStayRules() ([]models.StayRule, error) {
+	return m.stayRules(`select id, room_id, rule_type, nights, weekdays, start_date, end_date, created_at, updated_at
+		from room_stay_rules order by room_id, id`)
+}
+
+// StayRulesByRoomID returns the stay rules of a room
+func (m *postgresDBRepo) StayRulesByRoomID(roomID int) ([]models.StayRule, error) {
+	return m.stayRules(`select id, room_id, rule_type, nights, weekdays, start_date, end_date, created_at, updated_at
+		from room_stay_rules where room_id = $1 order by id`, roomID)
+}
+
+// stayRules runs a query selecting stay rules
+func (m *postgresDBRepo) stayRules(query string, args ...interface{}) ([]models.StayRule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rules []models.StayRule
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return rules, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rule models.StayRule
+		var weekdays string
+
+		err := rows.Scan(&rule.ID, &rule.RoomID, &rule.Type, &rule.Nights, &weekdays, &rule.StartDate, &rule.EndDate,
+			&rule.CreatedAt, &rule.UpdatedAt)
+		if err != nil {
+			return rules, err
+		}
+
+		rule.Weekdays = parseWeekdays(weekdays)
+		rules = append(rules, rule)
+	}
+
+	if err = rows.Err(); err != nil {
+		return rules, err
+	}
+
+	return rules, nil
+}
+
+// InsertStayRule inserts a stay rule
+func (m *postgresDBRepo) InsertStayRule(rule models.StayRule) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+
+	stmt := `insert into room_stay_rules (room_id, rule_type, nights, weekdays, start_date, end_date, created_at,
+		updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		rule.RoomID,
+		rule.Type,
+		rule.Nights,
+		formatWeekdays(rule.Weekdays),
+		rule.StartDate,
+		rule.EndDate,
+		m.App.Now(),
+		m.App.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// DeleteStayRule deletes a stay rule
+func (m *postgresDBRepo) DeleteStayRule(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `delete from room_stay_rules where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return repository.ErrNotFound
+	}
+
+	return nil
+}
+
+// formatWeekdays stores weekdays as a space separated list of numbers, 0 for Sunday
+func formatWeekdays(days []time.Weekday) string {
+	numbers := make([]string, len(days))
+	for i, d := range days {
+		numbers[i] = strconv.Itoa(int(d))
+	}
+	return strings.Join(numbers, " ")
+}
+
+// parseWeekdays reads the weekdays stored by formatWeekdays
+func parseWeekdays(s string) []time.Weekday {
+	var days []time.Weekday
+	for _, f := range strings.Fields(s) {
+		n, err := strconv.Atoi(f)
+		if err == nil && n >= 0 && n <= 6 {
+			days = append(days, time.Weekday(n))
+		}
+	}
+	return days
+}
+
+// AllPartners returns every partner, ordered by name
+func (m *postgresDBRepo) AllPartners() ([]models.Partner, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var partners []models.Partner
+
+	rows, err := m.DB.QueryContext(ctx, `select id, name, email, created_at, updated_at from partners order by name`)
+	if err != nil {
+		return partners, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p models.Partner
+		err := rows.Scan(&p.ID, &p.Name, &p.Email, &p.CreatedAt, &p.UpdatedAt)
+		if err != nil {
+			return partners, err
+		}
+
+		partners = append(partners, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return partners, err
+	}
+
+	return partners, nil
+}
+
+// InsertPartner inserts a partner and returns its ID
+func (m *postgresDBRepo) InsertPartner(p models.Partner) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+
+	stmt := `insert into partners (name, email, created_at, updated_at)
+		values ($1, $2, $3, $4) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		p.Name,
+		p.Email,
+		m.App.Now(),
+		m.App.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// apiKeyColumns are the columns read by scanAPIKey; the query must join partners as p
+const apiKeyColumns = `k.id, k.partner_id, k.name, k.prefix, k.key_hash, k.scopes, k.last_used_at, k.revoked_at,
+	k.created_at, k.updated_at, p.id, p.name, p.email, p.created_at, p.updated_at`
+
+// scanAPIKey scans a row selected with apiKeyColumns
+func scanAPIKey(row rowScanner, dest ...interface{}) (models.APIKey, error) {
+	var k models.APIKey
+	var scopes string
+	var lastUsedAt, revokedAt sql.NullTime
+
+	err := row.Scan(append([]interface{}{
+		&k.ID,
+		&k.PartnerID,
+		&k.Name,
+		&k.Prefix,
+		&k.Hash,
+		&scopes,
+		&lastUsedAt,
+		&revokedAt,
+		&k.CreatedAt,
+		&k.UpdatedAt,
+		&k.Partner.ID,
+		&k.Partner.Name,
+		&k.Partner.Email,
+		&k.Partner.CreatedAt,
+		&k.Partner.UpdatedAt,
+	}, dest...)...)
+
+	if err != nil {
+		return k, err
+	}
+
+	k.Scopes = strings.Fields(scopes)
+	k.LastUsedAt = lastUsedAt.Time
+	k.RevokedAt = revokedAt.Time
+
+	return k, nil
+}
+
+// AllAPIKeys returns every API key with its partner and usage, newest first
+func (m *postgresDBRepo) AllAPIKeys() ([]models.APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var keys []models.APIKey
+
+	query := `
+		select
+			` + apiKeyColumns + `,
+			coalesce((select sum(u.requests) from api_key_usage u where u.api_key_id = k.id), 0),
+			coalesce((select sum(u.requests) from api_key_usage u
+				where u.api_key_id = k.id and u.day > $1), 0)
+		from
+			api_keys k
+			inner join partners p on p.id = k.partner_id
+		order by
+			k.created_at desc
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, m.App.Now().AddDate(0, 0, -30).Format("2006-01-02"))
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var requests, recent int
+
+		k, err := scanAPIKey(rows, &requests, &recent)
+		if err != nil {
+			return keys, err
+		}
+
+		k.Requests = requests
+		k.RecentRequests = recent
+		keys = append(keys, k)
+	}
+
+	if err = rows.Err(); err != nil {
+		return keys, err
+	}
+
+	return keys, nil
+}
+
+// GetAPIKeyByPrefix gets an API key and its partner by the key's public prefix
+func (m *postgresDBRepo) GetAPIKeyByPrefix(prefix string) (models.APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select ` + apiKeyColumns + `
+		from
+			api_keys k
+			inner join partners p on p.id = k.partner_id
+		where
+			k.prefix = $1
+	`
+
+	k, err := scanAPIKey(m.DB.QueryRowContext(ctx, query, prefix))
+	if err == sql.ErrNoRows {
+		return k, repository.ErrNotFound
+	}
+	if err != nil {
+		return k, err
+	}
+
+	return k, nil
+}
+
+// InsertAPIKey inserts an API key and returns its ID
+func (m *postgresDBRepo) InsertAPIKey(k models.APIKey) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+
+	stmt := `insert into api_keys (partner_id, name, prefix, key_hash, scopes, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		k.PartnerID,
+		k.Name,
+		k.Prefix,
+		k.Hash,
+		strings.Join(k.Scopes, " "),
+		m.App.Now(),
+		m.App.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// RevokeAPIKey stops an API key from being accepted. Revoking a key twice keeps the original revocation time
+func (m *postgresDBRepo) RevokeAPIKey(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `update api_keys set revoked_at = coalesce(revoked_at, $1), updated_at = $1 where id = $2`,
+		m.App.Now(),
+		id,
+	)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return repository.ErrNotFound
+	}
+
+	return nil
+}
+
+// RecordAPIKeyUsage counts a request made with an API key
+func (m *postgresDBRepo) RecordAPIKeyUsage(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := m.App.Now()
+
+	_, err := m.DB.ExecContext(ctx, `update api_keys set last_used_at = $1 where id = $2`, now, id)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into api_key_usage (api_key_id, day, requests)
+		values ($1, $2, 1)
+		on conflict (api_key_id, day) do update set requests = api_key_usage.requests + 1`
+
+	_, err = m.DB.ExecContext(ctx, stmt, id, now.Format("2006-01-02"))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ClaimIdempotencyKey stores a new, in progress idempotency key and returns true. If the key is already held
+// it returns the stored key and false instead. Expired keys are replaced
+func (m *postgresDBRepo) ClaimIdempotencyKey(k models.IdempotencyKey) (models.IdempotencyKey, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return k, false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from idempotency_keys where scope = $1 and idempotency_key = $2 and expires_at <= $3`,
+		k.Scope,
+		k.Key,
+		m.App.Now(),
+	)
+	if err != nil {
+		return k, false, err
+	}
+
+	stmt := `insert into idempotency_keys (scope, idempotency_key, request_hash, created_at, expires_at)
+		values ($1, $2, $3, $4, $5)
+		on conflict (scope, idempotency_key) do nothing`
+
+	res, err := tx.ExecContext(ctx, stmt,
+		k.Scope,
+		k.Key,
+		k.RequestHash,
+		m.App.Now(),
+		k.ExpiresAt,
+	)
+	if err != nil {
+		return k, false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return k, false, err
+	}
+
+	if n == 1 {
+		return k, true, tx.Commit()
+	}
+
+	existing, err := scanIdempotencyKey(tx.QueryRowContext(ctx, idempotencyKeyQuery, k.Scope, k.Key))
+	if err != nil {
+		return k, false, err
+	}
+
+	return existing, false, tx.Commit()
+}
+
+// idempotencyKeyQuery selects the columns read by scanIdempotencyKey
+const idempotencyKeyQuery = `
+	select scope, idempotency_key, request_hash, status_code, location, body, created_at, expires_at
+	from idempotency_keys
+	where scope = $1 and idempotency_key = $2
+`
+
+// scanIdempotencyKey scans a row selected with idempotencyKeyQuery
+func scanIdempotencyKey(row rowScanner) (models.IdempotencyKey, error) {
+	var k models.IdempotencyKey
+
+	err := row.Scan(
+		&k.Scope,
+		&k.Key,
+		&k.RequestHash,
+		&k.StatusCode,
+		&k.Location,
+		&k.Body,
+		&k.CreatedAt,
+		&k.ExpiresAt,
+	)
+
+	return k, err
+}
+
+// GetIdempotencyKey gets an unexpired idempotency key
+func (m *postgresDBRepo) GetIdempotencyKey(scope, key string) (models.IdempotencyKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	k, err := scanIdempotencyKey(m.DB.QueryRowContext(ctx, idempotencyKeyQuery, scope, key))
+	if err == sql.ErrNoRows || (err == nil && !k.ExpiresAt.After(m.App.Now())) {
+		return k, repository.ErrNotFound
+	}
+	if err != nil {
+		return k, err
+	}
+
+	return k, nil
+}
+
+// CompleteIdempotencyKey stores the outcome of the request that claimed a key
+func (m *postgresDBRepo) CompleteIdempotencyKey(k models.IdempotencyKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update idempotency_keys set status_code = $1, location = $2, body = $3
+		where scope = $4 and idempotency_key = $5`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		k.StatusCode,
+		k.Location,
+		k.Body,
+		k.Scope,
+		k.Key,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReleaseIdempotencyKey forgets a key, so that a request that failed can be retried with it
+func (m *postgresDBRepo) ReleaseIdempotencyKey(scope, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from idempotency_keys where scope = $1 and idempotency_key = $2`, scope, key)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteExpiredIdempotencyKeys removes expired idempotency keys, returning how many were removed
+func (m *postgresDBRepo) DeleteExpiredIdempotencyKeys() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `delete from idempotency_keys where expires_at <= $1`, m.App.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// webhookSubscriptionColumns are the columns read by scanWebhookSubscription
+const webhookSubscriptionColumns = `id, url, secret, events, active, created_at, updated_at`
+
+// scanWebhookSubscription scans a row selected with webhookSubscriptionColumns
+func scanWebhookSubscription(row rowScanner) (models.WebhookSubscription, error) {
+	var s models.WebhookSubscription
+	var events string
+
+	err := row.Scan(&s.ID, &s.URL, &s.Secret, &events, &s.Active, &s.CreatedAt, &s.UpdatedAt)
+	s.Events = strings.Fields(events)
+
+	return s, err
+}
+
+// AllWebhookSubscriptions returns every webhook subscription
+func (m *postgresDBRepo) AllWebhookSubscriptions() ([]models.WebhookSubscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var subscriptions []models.WebhookSubscription
+
+	rows, err := m.DB.QueryContext(ctx, `select `+webhookSubscriptionColumns+` from webhook_subscriptions order by id`)
+	if err != nil {
+		return subscriptions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		s, err := scanWebhookSubscription(rows)
+		if err != nil {
+			return subscriptions, err
+		}
+
+		subscriptions = append(subscriptions, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return subscriptions, err
+	}
+
+	return subscriptions, nil
+}
+
+// GetWebhookSubscriptionByID gets a webhook subscription
+func (m *postgresDBRepo) GetWebhookSubscriptionByID(id int) (models.WebhookSubscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, `select `+webhookSubscriptionColumns+` from webhook_subscriptions where id = $1`, id)
+
+	s, err := scanWebhookSubscription(row)
+	if err == sql.ErrNoRows {
+		return s, repository.ErrNotFound
+	}
+	if err != nil {
+		return s, err
+	}
+
+	return s, nil
+}
+
+// InsertWebhookSubscription inserts a webhook subscription and returns its ID
+func (m *postgresDBRepo) InsertWebhookSubscription(s models.WebhookSubscription) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+
+	stmt := `insert into webhook_subscriptions (url, secret, events, active, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		s.URL,
+		s.Secret,
+		strings.Join(s.Events, " "),
+		s.Active,
+		m.App.Now(),
+		m.App.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// DeleteWebhookSubscription deletes a webhook subscription along with its deliveries
+func (m *postgresDBRepo) DeleteWebhookSubscription(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `delete from webhook_subscriptions where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return repository.ErrNotFound
+	}
+
+	return nil
+}
+
+// EnqueueWebhookDeliveries queues an event for delivery to every active subscription to its type
+func (m *postgresDBRepo) EnqueueWebhookDeliveries(eventID, eventType, payload string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		insert into webhook_deliveries (subscription_id, event_id, event_type, payload, status,
+			next_attempt_at, created_at, updated_at)
+		select id, $1, $2, $3, $4, $5, $5, $5
+		from webhook_subscriptions
+		where active and ' ' || events || ' ' like $6
+		on conflict (subscription_id, event_id) do nothing
+	`
+
+	_, err := m.DB.ExecContext(ctx, stmt, eventID, eventType, payload, models.WebhookPending, m.App.Now(),
+		"% "+eventType+" %")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DueWebhookDeliveries returns up to limit pending deliveries that are due, with their subscriptions. The
+// deliveries are leased: they won't be returned again until lease has passed, even if no attempt is recorded
+func (m *postgresDBRepo) DueWebhookDeliveries(limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var deliveries []models.WebhookDelivery
+
+	now := m.App.Now()
+
+	query := `
+		with due as (
+			select id from webhook_deliveries
+			where status = $1 and next_attempt_at <= $2
+			order by next_attempt_at
+			limit $3
+			for update skip locked
+		)
+		update webhook_deliveries d set next_attempt_at = $4
+		from due, webhook_subscriptions s
+		where d.id = due.id and s.id = d.subscription_id
+		returning d.id, d.subscription_id, d.event_id, d.event_type, d.payload, d.status, d.attempts,
+			d.response_code, d.error, d.created_at, d.updated_at, s.url, s.secret
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, models.WebhookPending, now, limit, now.Add(lease))
+	if err != nil {
+		return deliveries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d models.WebhookDelivery
+		err := rows.Scan(
+			&d.ID,
+			&d.SubscriptionID,
+			&d.EventID,
+			&d.EventType,
+			&d.Payload,
+			&d.Status,
+			&d.Attempts,
+			&d.ResponseCode,
+			&d.Error,
+			&d.CreatedAt,
+			&d.UpdatedAt,
+			&d.Subscription.URL,
+			&d.Subscription.Secret,
+		)
+		if err != nil {
+			return deliveries, err
+		}
+
+		d.Subscription.ID = d.SubscriptionID
+		deliveries = append(deliveries, d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return deliveries, err
+	}
+
+	return deliveries, nil
+}
+
+// RecordWebhookAttempt stores the outcome of an attempt to send a delivery
+func (m *postgresDBRepo) RecordWebhookAttempt(d models.WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update webhook_deliveries set status = $1, attempts = $2, response_code = $3, error = $4,
+		next_attempt_at = $5, last_attempt_at = $6, updated_at = $7
+		where id = $8`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		d.Status,
+		d.Attempts,
+		d.ResponseCode,
+		d.Error,
+		d.NextAttemptAt,
+		d.LastAttemptAt,
+		m.App.Now(),
+		d.ID,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// WebhookDeliveries returns the most recent deliveries to a subscription, newest first
+func (m *postgresDBRepo) WebhookDeliveries(subscriptionID, limit int) ([]models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var deliveries []models.WebhookDelivery
+
+	query := `
+		select id, subscription_id, event_id, event_type, payload, status, attempts, response_code, error,
+			next_attempt_at, last_attempt_at, created_at, updated_at
+		from webhook_deliveries
+		where subscription_id = $1
+		order by created_at desc, id desc
+		limit $2
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, subscriptionID, limit)
+	if err != nil {
+		return deliveries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d models.WebhookDelivery
+		var lastAttemptAt sql.NullTime
+
+		err := rows.Scan(
+			&d.ID,
+			&d.SubscriptionID,
+			&d.EventID,
+			&d.EventType,
+			&d.Payload,
+			&d.Status,
+			&d.Attempts,
+			&d.ResponseCode,
+			&d.Error,
+			&d.NextAttemptAt,
+			&lastAttemptAt,
+			&d.CreatedAt,
+			&d.UpdatedAt,
+		)
+		if err != nil {
+			return deliveries, err
+		}
+
+		d.LastAttemptAt = lastAttemptAt.Time
+		deliveries = append(deliveries, d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return deliveries, err
+	}
+
+	return deliveries, nil
+}
+
+// insertOutboxEvent records an event in the outbox as part of tx, to be published once tx is committed
+func (m *postgresDBRepo) insertOutboxEvent(ctx context.Context, tx *sql.Tx, eventType string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	now := m.App.Now()
+
+	_, err = tx.ExecContext(ctx, `insert into outbox_events (event_type, payload, next_attempt_at, created_at)
+		values ($1, $2, $3, $4)`, eventType, string(b), now, now)
+
+	return err
+}
+
+// PendingOutboxEvents returns up to limit unpublished events that are due, oldest first. The events are leased:
+// they won't be returned again until lease has passed, unless their outcome is recorded first
+func (m *postgresDBRepo) PendingOutboxEvents(limit int, lease time.Duration) ([]models.OutboxEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var pending []models.OutboxEvent
+
+	now := m.App.Now()
+
+	query := `
+		with due as (
+			select id from outbox_events
+			where published_at is null and next_attempt_at <= $1
+			order by id
+			limit $2
+			for update skip locked
+		)
+		update outbox_events e set next_attempt_at = $3
+		from due
+		where e.id = due.id
+		returning e.id, e.event_type, e.payload, e.attempts, e.last_error, e.created_at
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, now, limit, now.Add(lease))
+	if err != nil {
+		return pending, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e models.OutboxEvent
+		err := rows.Scan(
+			&e.ID,
+			&e.Type,
+			&e.Payload,
+			&e.Attempts,
+			&e.LastError,
+			&e.CreatedAt,
+		)
+		if err != nil {
+			return pending, err
+		}
+
+		pending = append(pending, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return pending, err
+	}
+
+	// update ... returning doesn't keep the order of the select
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ID < pending[j].ID })
+
+	return pending, nil
+}
+
+// MarkOutboxEventPublished records that an event has been published
+func (m *postgresDBRepo) MarkOutboxEventPublished(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `update outbox_events set published_at = $1 where id = $2`, m.App.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RetryOutboxEvent records a failed attempt to publish an event, which will be published again at its NextAttemptAt
+func (m *postgresDBRepo) RetryOutboxEvent(e models.OutboxEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update outbox_events set attempts = $1, last_error = $2, next_attempt_at = $3 where id = $4`
+
+	_, err := m.DB.ExecContext(ctx, stmt, e.Attempts, e.LastError, e.NextAttemptAt, e.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
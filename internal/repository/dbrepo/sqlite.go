@@ -0,0 +1,144 @@
+package dbrepo
+
+import (
+	"context"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/models"
+)
+
+// SQLite has no row locks, so instead of selecting with "for update skip locked" the methods below lease rows in a
+// transaction. The driver begins transactions with the write lock, so no other worker can lease the same rows
+// before the transaction commits
+
+// DueWebhookDeliveries returns up to limit pending deliveries that are due, with their subscriptions. The
+// deliveries are leased: they won't be returned again until lease has passed, even if no attempt is recorded
+func (m *sqliteDBRepo) DueWebhookDeliveries(limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var deliveries []models.WebhookDelivery
+
+	now := m.App.Now()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return deliveries, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		select d.id, d.subscription_id, d.event_id, d.event_type, d.payload, d.status, d.attempts,
+			d.response_code, d.error, d.created_at, d.updated_at, s.url, s.secret
+		from webhook_deliveries d
+			inner join webhook_subscriptions s on s.id = d.subscription_id
+		where d.status = $1 and d.next_attempt_at <= $2
+		order by d.next_attempt_at
+		limit $3
+	`
+
+	rows, err := tx.QueryContext(ctx, query, models.WebhookPending, now, limit)
+	if err != nil {
+		return deliveries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d models.WebhookDelivery
+		err := rows.Scan(
+			&d.ID,
+			&d.SubscriptionID,
+			&d.EventID,
+			&d.EventType,
+			&d.Payload,
+			&d.Status,
+			&d.Attempts,
+			&d.ResponseCode,
+			&d.Error,
+			&d.CreatedAt,
+			&d.UpdatedAt,
+			&d.Subscription.URL,
+			&d.Subscription.Secret,
+		)
+		if err != nil {
+			return deliveries, err
+		}
+
+		d.Subscription.ID = d.SubscriptionID
+		deliveries = append(deliveries, d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return deliveries, err
+	}
+
+	for _, d := range deliveries {
+		_, err = tx.ExecContext(ctx, `update webhook_deliveries set next_attempt_at = $1 where id = $2`, now.Add(lease), d.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return deliveries, tx.Commit()
+}
+
+// PendingOutboxEvents returns up to limit unpublished events that are due, oldest first. The events are leased:
+// they won't be returned again until lease has passed, unless their outcome is recorded first
+func (m *sqliteDBRepo) PendingOutboxEvents(limit int, lease time.Duration) ([]models.OutboxEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var pending []models.OutboxEvent
+
+	now := m.App.Now()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return pending, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		select id, event_type, payload, attempts, last_error, created_at
+		from outbox_events
+		where published_at is null and next_attempt_at <= $1
+		order by id
+		limit $2
+	`
+
+	rows, err := tx.QueryContext(ctx, query, now, limit)
+	if err != nil {
+		return pending, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e models.OutboxEvent
+		err := rows.Scan(
+			&e.ID,
+			&e.Type,
+			&e.Payload,
+			&e.Attempts,
+			&e.LastError,
+			&e.CreatedAt,
+		)
+		if err != nil {
+			return pending, err
+		}
+
+		pending = append(pending, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return pending, err
+	}
+
+	for _, e := range pending {
+		_, err = tx.ExecContext(ctx, `update outbox_events set next_attempt_at = $1 where id = $2`, now.Add(lease), e.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pending, tx.Commit()
+}
@@ -0,0 +1,210 @@
+package dbrepo
+
+import (
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/config"
+	"github.com/ashrielbrian/go_bookings/internal/dates"
+	"github.com/ashrielbrian/go_bookings/internal/driver"
+	"github.com/ashrielbrian/go_bookings/internal/migrate"
+	"github.com/ashrielbrian/go_bookings/internal/models"
+	"github.com/ashrielbrian/go_bookings/internal/repository"
+	"github.com/ashrielbrian/go_bookings/migrations"
+)
+
+// newSQLiteTestRepo returns a repository for a new, migrated SQLite database
+func newSQLiteTestRepo(t *testing.T) repository.DatabaseRepo {
+	db, err := driver.Connect(driver.SQLite, filepath.Join(t.TempDir(), "test.db"), driver.DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.SQL.Close() })
+
+	fsys, err := migrations.For(driver.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := migrate.New(db.SQL, driver.SQLite, fsys, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewSQLiteRepo(db.SQL, &config.AppConfig{})
+}
+
+func date(s string) dates.Date {
+	d, _ := dates.Parse(s)
+	return d
+}
+
+func TestSQLiteRepo_Availability(t *testing.T) {
+	repo := newSQLiteTestRepo(t)
+
+	roomID, err := repo.InsertRoom(models.Room{RoomName: "General's Quarters", Slug: "generals-quarters",
+		MaxOccupancy: 2, BedTypes: "King", Price: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.InsertRoom(models.Room{RoomName: "Major's Suite", Slug: "majors-suite", MaxOccupancy: 4,
+		BedTypes: "Twin", Price: 8000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := models.Reservation{Code: "TESTCODE", FirstName: "John", LastName: "Smith", Email: "john@smith.com",
+		RoomID: roomID, StartDate: date("2050-01-10"), EndDate: date("2050-01-15"), Adults: 2}
+	payment := models.Payment{Amount: 50000, Currency: "USD", BaseAmount: 50000, BaseCurrency: "USD", ExchangeRate: 1}
+
+	_, err = repo.CreateBooking(res, payment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		start, end string
+		available  bool
+	}{
+		{"2050-01-01", "2050-01-10", true},
+		{"2050-01-15", "2050-01-20", true},
+		{"2050-01-09", "2050-01-11", false},
+		{"2050-01-14", "2050-01-16", false},
+		{"2050-01-11", "2050-01-12", false},
+		{"2050-01-01", "2050-01-31", false},
+	}
+
+	for _, tt := range tests {
+		available, err := repo.SearchAvailabilityByDatesByRoomID(date(tt.start), date(tt.end), roomID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if available != tt.available {
+			t.Errorf("%s to %s: expected available %v, got %v", tt.start, tt.end, tt.available, available)
+		}
+	}
+
+	rooms, err := repo.SearchAvailabiltyForAllRooms(date("2050-01-12"), date("2050-01-13"), models.RoomFilter{Guests: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 1 || rooms[0].Slug != "majors-suite" {
+		t.Errorf("expected only the major's suite to be available, got %+v", rooms)
+	}
+
+	rooms, err = repo.SearchAvailabiltyForAllRooms(date("2050-02-01"), date("2050-02-03"), models.RoomFilter{Guests: 1, BedType: "king"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 1 || rooms[0].ID != roomID {
+		t.Errorf("expected the bed type filter to ignore case, got %+v", rooms)
+	}
+
+	found, err := repo.GetReservationByCode("TESTCODE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found.StartDate.Equal(res.StartDate) || found.Room.Slug != "generals-quarters" {
+		t.Errorf("unexpected reservation %+v", found)
+	}
+
+	_, err = repo.GetReservationByCode("MISSING")
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestSQLiteRepo_Leases(t *testing.T) {
+	repo := newSQLiteTestRepo(t)
+
+	roomID, err := repo.InsertRoom(models.Room{RoomName: "General's Quarters", Slug: "generals-quarters", MaxOccupancy: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := models.Reservation{Code: "TESTCODE", FirstName: "John", LastName: "Smith", Email: "john@smith.com",
+		RoomID: roomID, StartDate: date("2050-01-10"), EndDate: date("2050-01-15"), Adults: 1}
+
+	_, err = repo.CreateBooking(res, models.Payment{Currency: "USD", BaseCurrency: "USD", ExchangeRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := repo.PendingOutboxEvents(10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("expected 1 pending event, got %d", len(pending))
+	}
+
+	leased, err := repo.PendingOutboxEvents(10, time.Minute)
+	if err != nil || len(leased) != 0 {
+		t.Errorf("expected the event to be leased, got %d events, %v", len(leased), err)
+	}
+
+	_, err = repo.InsertWebhookSubscription(models.WebhookSubscription{URL: "https://example.com/hook", Secret: "whsec_test",
+		Events: []string{"reservation.created"}, Active: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = repo.EnqueueWebhookDeliveries("evt_1", "reservation.created", "{}")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	due, err := repo.DueWebhookDeliveries(10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 1 || due[0].Subscription.URL != "https://example.com/hook" {
+		t.Fatalf("expected 1 delivery queued once for the event, got %+v", due)
+	}
+
+	due, err = repo.DueWebhookDeliveries(10, time.Minute)
+	if err != nil || len(due) != 0 {
+		t.Errorf("expected the delivery to be leased, got %d deliveries, %v", len(due), err)
+	}
+}
+
+func TestSQLiteRepo_APIKeyUsage(t *testing.T) {
+	repo := newSQLiteTestRepo(t)
+
+	partnerID, err := repo.InsertPartner(models.Partner{Name: "Travel Co", Email: "api@travel.co"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyID, err := repo.InsertAPIKey(models.APIKey{PartnerID: partnerID, Name: "production", Prefix: "bk_test",
+		Hash: "hash", Scopes: []string{"rooms:read"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = repo.RecordAPIKeyUsage(keyID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := repo.AllAPIKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Requests != 3 || keys[0].RecentRequests != 3 || keys[0].LastUsedAt.IsZero() {
+		t.Errorf("unexpected keys %+v", keys)
+	}
+}
@@ -1,16 +1,80 @@
 package repository
 
 import (
+	"errors"
 	"time"
 
+	"github.com/ashrielbrian/go_bookings/internal/dates"
 	"github.com/ashrielbrian/go_bookings/internal/models"
 )
 
+// ErrNotFound is returned when a requested record does not exist
+var ErrNotFound = errors.New("record not found")
+
+// ErrUnavailable is returned by CreateBooking when the room is no longer free for the nights the booking holds
+var ErrUnavailable = errors.New("room is not available")
+
 type DatabaseRepo interface {
 	AllUsers() bool
 	InsertReservation(res models.Reservation) (int, error)
+	CreateBooking(res models.Reservation, payment models.Payment) (int, error)
+	GetReservationByCode(code string) (models.Reservation, error)
+	UpdateReservation(res models.Reservation) error
+	CancelReservation(code string) error
 	InsertRoomRestriction(r models.RoomRestriction) error
-	SearchAvailabilityByDatesByRoomID(start, end time.Time, roomID int) (bool, error)
-	SearchAvailabiltyForAllRooms(start, end time.Time) ([]models.Room, error)
+	SearchAvailabilityByDatesByRoomID(start, end dates.Date, roomID int) (bool, error)
+	SearchAvailabiltyForAllRooms(start, end dates.Date, filter models.RoomFilter) ([]models.Room, error)
+	RoomAvailabilityByDay(roomID int, start, end dates.Date) ([]models.DayAvailability, error)
 	GetRoomByID(id int) (models.Room, error)
+	GetRoomBySlug(slug string) (models.Room, error)
+	AllRooms(includeRetired bool) ([]models.Room, error)
+	InsertRoom(room models.Room) (int, error)
+	UpdateRoom(room models.Room) error
+	SetRoomRetired(id int, retired bool) error
+	AllAmenities() ([]models.Amenity, error)
+	SetRoomAmenities(roomID int, amenityIDs []int) error
+
+	GetRoomImageByID(id int) (models.RoomImage, error)
+	InsertRoomImage(img models.RoomImage) (int, error)
+	UpdateRoomImage(img models.RoomImage) error
+	DeleteRoomImage(id int) error
+
+	AllStayRules() ([]models.StayRule, error)
+	StayRulesByRoomID(roomID int) ([]models.StayRule, error)
+	InsertStayRule(rule models.StayRule) (int, error)
+	DeleteStayRule(id int) error
+
+	Authenticate(email, testPassword string) (int, string, error)
+
+	AllExchangeRates() ([]models.ExchangeRate, error)
+	GetExchangeRate(currency string) (models.ExchangeRate, error)
+	UpsertExchangeRate(currency string, rate float64) error
+	InsertPayment(p models.Payment) (int, error)
+
+	AllPartners() ([]models.Partner, error)
+	InsertPartner(p models.Partner) (int, error)
+	AllAPIKeys() ([]models.APIKey, error)
+	GetAPIKeyByPrefix(prefix string) (models.APIKey, error)
+	InsertAPIKey(k models.APIKey) (int, error)
+	RevokeAPIKey(id int) error
+	RecordAPIKeyUsage(id int) error
+
+	ClaimIdempotencyKey(k models.IdempotencyKey) (models.IdempotencyKey, bool, error)
+	GetIdempotencyKey(scope, key string) (models.IdempotencyKey, error)
+	CompleteIdempotencyKey(k models.IdempotencyKey) error
+	ReleaseIdempotencyKey(scope, key string) error
+	DeleteExpiredIdempotencyKeys() (int, error)
+
+	AllWebhookSubscriptions() ([]models.WebhookSubscription, error)
+	GetWebhookSubscriptionByID(id int) (models.WebhookSubscription, error)
+	InsertWebhookSubscription(s models.WebhookSubscription) (int, error)
+	DeleteWebhookSubscription(id int) error
+	EnqueueWebhookDeliveries(eventID, eventType, payload string) error
+	DueWebhookDeliveries(limit int, lease time.Duration) ([]models.WebhookDelivery, error)
+	RecordWebhookAttempt(d models.WebhookDelivery) error
+	WebhookDeliveries(subscriptionID, limit int) ([]models.WebhookDelivery, error)
+
+	PendingOutboxEvents(limit int, lease time.Duration) ([]models.OutboxEvent, error)
+	MarkOutboxEventPublished(id int) error
+	RetryOutboxEvent(e models.OutboxEvent) error
 }
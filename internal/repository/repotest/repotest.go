@@ -0,0 +1,641 @@
+// Package repotest is a conformance suite for implementations of repository.DatabaseRepo, so that the database
+// backed repositories and the in-memory one used by handler tests are known to agree
+package repotest
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/dates"
+	"github.com/ashrielbrian/go_bookings/internal/events"
+	"github.com/ashrielbrian/go_bookings/internal/models"
+	"github.com/ashrielbrian/go_bookings/internal/repository"
+)
+
+// Factory returns a repository with an empty database: no rooms, reservations or other records besides the
+// restriction types and amenities that the migrations create
+type Factory func(t *testing.T) repository.DatabaseRepo
+
+// RunRepoTests runs the conformance suite against the repositories returned by newRepo. Each test asks for a new
+// repository
+func RunRepoTests(t *testing.T, newRepo Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, repo repository.DatabaseRepo)
+	}{
+		{"Rooms", testRooms},
+		{"Reservations", testReservations},
+		{"ReservationChanges", testReservationChanges},
+		{"Availability", testAvailability},
+		{"AvailabilityForAllRooms", testAvailabilityForAllRooms},
+		{"AvailabilityByDay", testAvailabilityByDay},
+		{"RestrictionTypes", testRestrictionTypes},
+		{"StayRules", testStayRules},
+		{"TurnoverAndAddOns", testTurnoverAndAddOns},
+		{"Errors", testErrors},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newRepo(t))
+		})
+	}
+}
+
+// date parses a date in the dates.Layout
+func date(t *testing.T, s string) dates.Date {
+	t.Helper()
+
+	d, err := dates.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+// insertRoom inserts a room that sleeps two, failing the test if it can't
+func insertRoom(t *testing.T, repo repository.DatabaseRepo, slug string) int {
+	t.Helper()
+
+	id, err := repo.InsertRoom(models.Room{RoomName: slug, Slug: slug, MaxOccupancy: 2, BedTypes: "1 Queen", Price: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+// book books a room for the nights from start to end, failing the test if it can't
+func book(t *testing.T, repo repository.DatabaseRepo, code string, roomID int, start, end string) int {
+	t.Helper()
+
+	id, err := repo.CreateBooking(reservation(t, code, roomID, start, end), payment())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+func reservation(t *testing.T, code string, roomID int, start, end string) models.Reservation {
+	return models.Reservation{
+		Code:      code,
+		FirstName: "John",
+		LastName:  "Smith",
+		Email:     "john@smith.com",
+		RoomID:    roomID,
+		StartDate: date(t, start),
+		EndDate:   date(t, end),
+		Adults:    2,
+	}
+}
+
+func payment() models.Payment {
+	return models.Payment{Amount: 20000, Currency: "USD", BaseAmount: 20000, BaseCurrency: "USD", ExchangeRate: 1}
+}
+
+func testRooms(t *testing.T, repo repository.DatabaseRepo) {
+	amenities, err := repo.AllAmenities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(amenities) == 0 {
+		t.Fatal("expected the amenities created by the migrations")
+	}
+
+	id, err := repo.InsertRoom(models.Room{RoomName: "Major's Suite", Slug: "majors-suite", Description: "A suite",
+		MaxOccupancy: 4, BedTypes: "1 King", Price: 15000, SizeSqm: 45})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo.SetRoomAmenities(id, []int{amenities[0].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repo.InsertRoomImage(models.RoomImage{RoomID: id, URL: "/static/images/b.png", SortOrder: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.InsertRoomImage(models.RoomImage{RoomID: id, URL: "/static/images/a.png", SortOrder: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	room, err := repo.GetRoomByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room.Slug != "majors-suite" || room.MaxOccupancy != 4 || room.Price != 15000 || room.SizeSqm != 45 {
+		t.Errorf("unexpected room %+v", room)
+	}
+	if len(room.Amenities) != 1 || room.Amenities[0].ID != amenities[0].ID {
+		t.Errorf("expected the room's amenity, got %+v", room.Amenities)
+	}
+	if len(room.Images) != 2 || room.Images[0].URL != "/static/images/a.png" {
+		t.Errorf("expected the room's images in display order, got %+v", room.Images)
+	}
+
+	bySlug, err := repo.GetRoomBySlug("majors-suite")
+	if err != nil || bySlug.ID != id {
+		t.Errorf("expected room %d by slug, got %+v, %v", id, bySlug, err)
+	}
+
+	room.Price = 17000
+	err = repo.UpdateRoom(room)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo.SetRoomRetired(id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rooms, err := repo.AllRooms(false)
+	if err != nil || len(rooms) != 0 {
+		t.Errorf("expected retired rooms to be left out, got %d rooms, %v", len(rooms), err)
+	}
+
+	rooms, err = repo.AllRooms(true)
+	if err != nil || len(rooms) != 1 || rooms[0].Price != 17000 || !rooms[0].Retired {
+		t.Errorf("expected the updated, retired room, got %+v, %v", rooms, err)
+	}
+}
+
+func testReservations(t *testing.T, repo repository.DatabaseRepo) {
+	roomID := insertRoom(t, repo, "generals-quarters")
+
+	id := book(t, repo, "ABCD1234", roomID, "2050-01-01", "2050-01-03")
+
+	res, err := repo.GetReservationByCode("abcd1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ID != id || res.RoomID != roomID || res.Room.Slug != "generals-quarters" || res.Adults != 2 {
+		t.Errorf("unexpected reservation %+v", res)
+	}
+	if !res.StartDate.Equal(date(t, "2050-01-01")) || !res.EndDate.Equal(date(t, "2050-01-03")) {
+		t.Errorf("expected the booked dates, got %s to %s", res.StartDate, res.EndDate)
+	}
+
+	events, err := repo.PendingOutboxEvents(10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Type != "reservation.created" {
+		t.Errorf("expected a reservation.created event, got %+v", events)
+	}
+	if res.PartnerID != 0 {
+		t.Errorf("expected a booking made without a partner, got partner %d", res.PartnerID)
+	}
+
+	// a booking made through the API keeps the partner that made it
+	partnerID, err := repo.InsertPartner(models.Partner{Name: "Test Travel", Email: "api@testtravel.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	partnerRes := reservation(t, "PART1234", roomID, "2050-02-01", "2050-02-03")
+	partnerRes.PartnerID = partnerID
+	if _, err = repo.CreateBooking(partnerRes, payment()); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = repo.GetReservationByCode("PART1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.PartnerID != partnerID {
+		t.Errorf("expected the reservation of partner %d, got %d", partnerID, res.PartnerID)
+	}
+}
+
+func testReservationChanges(t *testing.T, repo repository.DatabaseRepo) {
+	roomID := insertRoom(t, repo, "generals-quarters")
+	book(t, repo, "ABCD1234", roomID, "2050-01-01", "2050-01-03")
+
+	changed := reservation(t, "abcd1234", roomID, "2050-01-01", "2050-01-03")
+	changed.FirstName, changed.Email, changed.Phone = "Jonathan", "jonathan@smith.com", "555-0100"
+	if err := repo.UpdateReservation(changed); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := repo.GetReservationByCode("ABCD1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.FirstName != "Jonathan" || res.Email != "jonathan@smith.com" || res.Phone != "555-0100" || res.Cancelled() {
+		t.Errorf("unexpected reservation after the update %+v", res)
+	}
+
+	if err = repo.CancelReservation("abcd1234"); err != nil {
+		t.Fatal(err)
+	}
+	// cancelling again changes nothing
+	if err = repo.CancelReservation("ABCD1234"); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = repo.GetReservationByCode("ABCD1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Cancelled() {
+		t.Error("expected the reservation to be cancelled")
+	}
+
+	free, err := repo.SearchAvailabilityByDatesByRoomID(date(t, "2050-01-01"), date(t, "2050-01-03"), roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !free {
+		t.Error("expected the cancelled reservation's nights to be free")
+	}
+
+	events, err := repo.PendingOutboxEvents(10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	if strings.Join(types, " ") != "reservation.created reservation.updated reservation.cancelled" {
+		t.Errorf("expected an event for each change, got %v", types)
+	}
+
+	if err = repo.UpdateReservation(reservation(t, "MISSING1", roomID, "2050-01-01", "2050-01-03")); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("UpdateReservation: expected ErrNotFound, got %v", err)
+	}
+	if err = repo.CancelReservation("MISSING1"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("CancelReservation: expected ErrNotFound, got %v", err)
+	}
+}
+
+func testAvailability(t *testing.T, repo repository.DatabaseRepo) {
+	roomID := insertRoom(t, repo, "generals-quarters")
+	otherID := insertRoom(t, repo, "majors-suite")
+
+	// booked for the nights of the 10th to the 14th, leaving on the 15th
+	book(t, repo, "BOOKED01", roomID, "2050-01-10", "2050-01-15")
+
+	tests := []struct {
+		name       string
+		start, end string
+		available  bool
+	}{
+		{"leaving the day the booking arrives", "2050-01-05", "2050-01-10", true},
+		{"arriving the day the booking leaves", "2050-01-15", "2050-01-20", true},
+		{"well before", "2050-01-01", "2050-01-05", true},
+		{"well after", "2050-01-20", "2050-01-25", true},
+		{"overlapping the first night", "2050-01-08", "2050-01-11", false},
+		{"overlapping the last night", "2050-01-14", "2050-01-18", false},
+		{"the same nights", "2050-01-10", "2050-01-15", false},
+		{"within", "2050-01-11", "2050-01-13", false},
+		{"around", "2050-01-01", "2050-01-31", false},
+		{"a single night", "2050-01-12", "2050-01-13", false},
+	}
+
+	for _, tt := range tests {
+		available, err := repo.SearchAvailabilityByDatesByRoomID(date(t, tt.start), date(t, tt.end), roomID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if available != tt.available {
+			t.Errorf("%s (%s to %s): expected available %v, got %v", tt.name, tt.start, tt.end, tt.available, available)
+		}
+
+		available, err = repo.SearchAvailabilityByDatesByRoomID(date(t, tt.start), date(t, tt.end), otherID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !available {
+			t.Errorf("%s: expected another room to be unaffected", tt.name)
+		}
+	}
+
+	// a turnover day can be booked from both sides
+	book(t, repo, "BOOKED02", roomID, "2050-01-15", "2050-01-17")
+	book(t, repo, "BOOKED03", roomID, "2050-01-08", "2050-01-10")
+
+	available, err := repo.SearchAvailabilityByDatesByRoomID(date(t, "2050-01-16"), date(t, "2050-01-18"), roomID)
+	if err != nil || available {
+		t.Errorf("expected the new booking to block its nights, got %v, %v", available, err)
+	}
+}
+
+func testAvailabilityForAllRooms(t *testing.T, repo repository.DatabaseRepo) {
+	bookedID := insertRoom(t, repo, "generals-quarters")
+	freeID := insertRoom(t, repo, "majors-suite")
+	retiredID := insertRoom(t, repo, "old-wing")
+
+	err := repo.SetRoomRetired(retiredID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	book(t, repo, "BOOKED01", bookedID, "2050-01-10", "2050-01-15")
+
+	rooms, err := repo.SearchAvailabiltyForAllRooms(date(t, "2050-01-12"), date(t, "2050-01-20"), models.RoomFilter{Guests: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 1 || rooms[0].ID != freeID {
+		t.Errorf("expected only room %d, got %+v", freeID, rooms)
+	}
+
+	rooms, err = repo.SearchAvailabiltyForAllRooms(date(t, "2050-01-15"), date(t, "2050-01-20"), models.RoomFilter{Guests: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 2 || rooms[0].Slug != "generals-quarters" || rooms[1].Slug != "majors-suite" {
+		t.Errorf("expected both rooms in use, by name, got %+v", rooms)
+	}
+
+	rooms, err = repo.SearchAvailabiltyForAllRooms(date(t, "2050-01-15"), date(t, "2050-01-20"), models.RoomFilter{Guests: 3})
+	if err != nil || len(rooms) != 0 {
+		t.Errorf("expected no room to sleep 3, got %d rooms, %v", len(rooms), err)
+	}
+
+	rooms, err = repo.SearchAvailabiltyForAllRooms(date(t, "2050-01-15"), date(t, "2050-01-20"), models.RoomFilter{Guests: 1, BedType: "queen"})
+	if err != nil || len(rooms) != 2 {
+		t.Errorf("expected the bed type to match regardless of case, got %d rooms, %v", len(rooms), err)
+	}
+}
+
+func testAvailabilityByDay(t *testing.T, repo repository.DatabaseRepo) {
+	roomID := insertRoom(t, repo, "generals-quarters")
+	otherID := insertRoom(t, repo, "majors-suite")
+
+	book(t, repo, "BOOKED01", roomID, "2050-01-03", "2050-01-05")
+	book(t, repo, "BOOKED02", roomID, "2050-01-06", "2050-01-07")
+	book(t, repo, "BOOKED03", otherID, "2050-01-01", "2050-01-08")
+
+	days, err := repo.RoomAvailabilityByDay(roomID, date(t, "2050-01-01"), date(t, "2050-01-08"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []bool{true, true, false, false, true, false, true}
+	if len(days) != len(expected) {
+		t.Fatalf("expected %d days, got %d", len(expected), len(days))
+	}
+	for i, day := range days {
+		want := date(t, "2050-01-01").AddDate(0, 0, i)
+		if !day.Date.Equal(want) || day.Available != expected[i] {
+			t.Errorf("expected %s available %v, got %s %v", want.Format("2006-01-02"), expected[i],
+				day.Date.Format("2006-01-02"), day.Available)
+		}
+	}
+
+	days, err = repo.RoomAvailabilityByDay(roomID, date(t, "2050-02-01"), date(t, "2050-02-01"))
+	if err != nil || len(days) != 0 {
+		t.Errorf("expected no days for an empty range, got %d, %v", len(days), err)
+	}
+}
+
+func testRestrictionTypes(t *testing.T, repo repository.DatabaseRepo) {
+	roomID := insertRoom(t, repo, "generals-quarters")
+
+	// an owner block, restriction type 2, has no reservation but blocks the room all the same
+	err := repo.InsertRoomRestriction(models.RoomRestriction{RoomID: roomID, RestrictionID: 2,
+		StartDate: date(t, "2050-03-01"), EndDate: date(t, "2050-03-08")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	available, err := repo.SearchAvailabilityByDatesByRoomID(date(t, "2050-03-07"), date(t, "2050-03-09"), roomID)
+	if err != nil || available {
+		t.Errorf("expected the owner block to make the room unavailable, got %v, %v", available, err)
+	}
+
+	pending, err := repo.PendingOutboxEvents(10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Type != events.BlockCreated {
+		t.Fatalf("expected a block.created event, got %+v", pending)
+	}
+	var block events.Block
+	if err := events.Decode(pending[0], &block); err != nil {
+		t.Fatal(err)
+	}
+	if block.RoomRestrictionID == 0 || block.RoomID != roomID || !block.StartDate.Equal(date(t, "2050-03-01")) ||
+		!block.EndDate.Equal(date(t, "2050-03-08")) {
+		t.Errorf("expected the block in the event, got %+v", block)
+	}
+
+	available, err = repo.SearchAvailabilityByDatesByRoomID(date(t, "2050-03-08"), date(t, "2050-03-09"), roomID)
+	if err != nil || !available {
+		t.Errorf("expected the room to be free once the owner block ends, got %v, %v", available, err)
+	}
+
+	err = repo.InsertRoomRestriction(models.RoomRestriction{RoomID: roomID, RestrictionID: 999,
+		StartDate: date(t, "2050-04-01"), EndDate: date(t, "2050-04-02")})
+	if err == nil {
+		t.Error("expected an unknown restriction type to be refused")
+	}
+
+	err = repo.InsertRoomRestriction(models.RoomRestriction{RoomID: roomID + 1000, RestrictionID: 2,
+		StartDate: date(t, "2050-04-01"), EndDate: date(t, "2050-04-02")})
+	if err == nil {
+		t.Error("expected a restriction for an unknown room to be refused")
+	}
+}
+
+func testStayRules(t *testing.T, repo repository.DatabaseRepo) {
+	roomID := insertRoom(t, repo, "generals-quarters")
+	otherID := insertRoom(t, repo, "majors-suite")
+
+	weekend := models.StayRule{RoomID: roomID, Type: models.StayRuleMinNights, Nights: 2,
+		Weekdays: []time.Weekday{time.Friday, time.Saturday}}
+	july := models.StayRule{RoomID: roomID, Type: models.StayRuleArrivalDays, Weekdays: []time.Weekday{time.Saturday},
+		StartDate: date(t, "2050-07-01"), EndDate: date(t, "2050-07-31")}
+	longest := models.StayRule{RoomID: otherID, Type: models.StayRuleMaxNights, Nights: 14}
+
+	var ids []int
+	for _, rule := range []models.StayRule{longest, weekend, july} {
+		id, err := repo.InsertStayRule(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	rules, err := repo.StayRulesByRoomID(roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules, got %d", len(rules))
+	}
+	for i, want := range []models.StayRule{weekend, july} {
+		got := rules[i]
+		if got.ID != ids[i+1] || got.Type != want.Type || got.Nights != want.Nights ||
+			!reflect.DeepEqual(got.Weekdays, want.Weekdays) || !got.StartDate.Equal(want.StartDate) ||
+			!got.EndDate.Equal(want.EndDate) {
+			t.Errorf("expected rule %+v, got %+v", want, got)
+		}
+	}
+	if !rules[0].StartDate.IsZero() || !rules[0].EndDate.IsZero() {
+		t.Errorf("expected a rule without dates to have none, got %v and %v", rules[0].StartDate, rules[0].EndDate)
+	}
+
+	all, err := repo.AllStayRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 || all[0].RoomID != roomID || all[2].RoomID != otherID {
+		t.Errorf("expected 3 rules ordered by room, got %+v", all)
+	}
+
+	if err := repo.DeleteStayRule(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.DeleteStayRule(ids[1]); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected deleting a deleted rule to give ErrNotFound, got %v", err)
+	}
+	rules, err = repo.StayRulesByRoomID(roomID)
+	if err != nil || len(rules) != 1 || rules[0].ID != ids[2] {
+		t.Errorf("expected only the July rule to be left, got %+v, %v", rules, err)
+	}
+
+	if _, err := repo.InsertStayRule(models.StayRule{RoomID: roomID + 1000, Type: models.StayRuleMaxNights, Nights: 7}); err == nil {
+		t.Error("expected a rule for an unknown room to be refused")
+	}
+}
+
+func testTurnoverAndAddOns(t *testing.T, repo repository.DatabaseRepo) {
+	roomID := insertRoom(t, repo, "generals-quarters")
+
+	room, err := repo.GetRoomByID(roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room.CheckInTime != models.DefaultCheckInTime || room.CheckOutTime != models.DefaultCheckOutTime {
+		t.Errorf("expected the default check-in and check-out times, got %q and %q", room.CheckInTime, room.CheckOutTime)
+	}
+
+	room.CheckInTime, room.CheckOutTime = "14:00", "10:30"
+	room.EarlyCheckInPrice, room.LateCheckOutPrice = 2500, 2000
+	room.TurnoverDays = 1
+	if err := repo.UpdateRoom(room); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stay holds the night before it for early check-in, and the room needs a day's cleaning either side
+	res := reservation(t, "ADDONS01", roomID, "2050-03-10", "2050-03-12")
+	res.EarlyCheckIn = true
+	if _, err := repo.CreateBooking(res, payment()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		start, end string
+		available  bool
+	}{
+		{"leaving the day before the turnover day", "2050-03-05", "2050-03-08", true},
+		{"leaving on the turnover day", "2050-03-05", "2050-03-09", false},
+		{"the night kept for early check-in", "2050-03-09", "2050-03-10", false},
+		{"arriving the day the stay leaves", "2050-03-12", "2050-03-14", false},
+		{"arriving after the turnover day", "2050-03-13", "2050-03-15", true},
+	}
+
+	for _, tt := range tests {
+		available, err := repo.SearchAvailabilityByDatesByRoomID(date(t, tt.start), date(t, tt.end), roomID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if available != tt.available {
+			t.Errorf("%s (%s to %s): expected available %v, got %v", tt.name, tt.start, tt.end, tt.available, available)
+		}
+	}
+
+	// bookings are refused when they hold a night that is blocked, late check-out's extra night included
+	clash := reservation(t, "ADDONS02", roomID, "2050-03-12", "2050-03-14")
+	if _, err := repo.CreateBooking(clash, payment()); !errors.Is(err, repository.ErrUnavailable) {
+		t.Errorf("expected a booking on the turnover day to be refused with ErrUnavailable, got %v", err)
+	}
+	clash = reservation(t, "ADDONS03", roomID, "2050-03-05", "2050-03-08")
+	clash.LateCheckOut = true
+	if _, err := repo.CreateBooking(clash, payment()); !errors.Is(err, repository.ErrUnavailable) {
+		t.Errorf("expected a late check-out on the turnover day to be refused with ErrUnavailable, got %v", err)
+	}
+	for _, code := range []string{"ADDONS02", "ADDONS03"} {
+		if _, err := repo.GetReservationByCode(code); !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("expected no reservation %s to be made, got %v", code, err)
+		}
+	}
+
+	got, err := repo.GetReservationByCode("ADDONS01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.EarlyCheckIn || got.LateCheckOut || !got.StartDate.Equal(res.StartDate) || !got.EndDate.Equal(res.EndDate) {
+		t.Errorf("expected the stay's own dates and early check-in, got %+v", got)
+	}
+	if got.Room.CheckInTime != "14:00" || got.Room.CheckOutTime != "10:30" || got.Room.EarlyCheckInPrice != 2500 ||
+		got.Room.LateCheckOutPrice != 2000 {
+		t.Errorf("expected the room's times and add-ons, got %+v", got.Room)
+	}
+	if got.Total() != 2*10000+2500 {
+		t.Errorf("expected the nights and early check-in to be charged, got %d", got.Total())
+	}
+}
+
+func testErrors(t *testing.T, repo repository.DatabaseRepo) {
+	roomID := insertRoom(t, repo, "generals-quarters")
+
+	if _, err := repo.GetRoomByID(roomID + 1000); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetRoomByID: expected ErrNotFound, got %v", err)
+	}
+	if _, err := repo.GetRoomBySlug("missing"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetRoomBySlug: expected ErrNotFound, got %v", err)
+	}
+	if _, err := repo.GetReservationByCode("MISSING1"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetReservationByCode: expected ErrNotFound, got %v", err)
+	}
+	if _, err := repo.GetRoomImageByID(1000); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetRoomImageByID: expected ErrNotFound, got %v", err)
+	}
+	if _, err := repo.GetAPIKeyByPrefix("missing"); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetAPIKeyByPrefix: expected ErrNotFound, got %v", err)
+	}
+	if err := repo.RevokeAPIKey(1000); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("RevokeAPIKey: expected ErrNotFound, got %v", err)
+	}
+	if _, err := repo.GetWebhookSubscriptionByID(1000); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("GetWebhookSubscriptionByID: expected ErrNotFound, got %v", err)
+	}
+	if err := repo.DeleteWebhookSubscription(1000); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("DeleteWebhookSubscription: expected ErrNotFound, got %v", err)
+	}
+
+	if _, err := repo.InsertRoom(models.Room{RoomName: "Copy", Slug: "generals-quarters", MaxOccupancy: 2}); err == nil {
+		t.Error("expected a duplicate slug to be refused")
+	}
+
+	book(t, repo, "BOOKED01", roomID, "2050-01-10", "2050-01-15")
+
+	// a failed booking leaves nothing behind, including the restriction that would block its dates
+	_, err := repo.CreateBooking(reservation(t, "BOOKED01", roomID, "2050-02-01", "2050-02-05"), payment())
+	if err == nil {
+		t.Error("expected a duplicate reservation code to be refused")
+	}
+
+	available, err := repo.SearchAvailabilityByDatesByRoomID(date(t, "2050-02-01"), date(t, "2050-02-05"), roomID)
+	if err != nil || !available {
+		t.Errorf("expected the failed booking not to block its dates, got %v, %v", available, err)
+	}
+
+	if _, err := repo.CreateBooking(reservation(t, "BOOKED02", roomID+1000, "2050-02-01", "2050-02-05"), payment()); err == nil {
+		t.Error("expected a booking for an unknown room to be refused")
+	}
+}
@@ -0,0 +1,449 @@
+package seed
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/clock"
+	"github.com/ashrielbrian/go_bookings/internal/dates"
+	"github.com/ashrielbrian/go_bookings/internal/driver"
+	"github.com/ashrielbrian/go_bookings/internal/helpers"
+	"github.com/ashrielbrian/go_bookings/internal/models"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// Fixture is the data loaded by Seed. Records are matched to existing ones by a natural key, so loading a
+// fixture again updates what it describes instead of duplicating it
+type Fixture struct {
+	Restrictions []Restriction `json:"restrictions" yaml:"restrictions"`
+	Amenities    []string      `json:"amenities" yaml:"amenities"`
+	Rooms        []Room        `json:"rooms" yaml:"rooms"`
+	Users        []User        `json:"users" yaml:"users"`
+	Reservations []Reservation `json:"reservations" yaml:"reservations"`
+}
+
+// Restriction is a restriction type, matched by ID since the handlers refer to restriction types by ID
+type Restriction struct {
+	ID   int    `json:"id" yaml:"id"`
+	Name string `json:"name" yaml:"name"`
+}
+
+// Room is matched by its slug, which defaults to one made from its name
+type Room struct {
+	Name         string   `json:"name" yaml:"name"`
+	Slug         string   `json:"slug" yaml:"slug"`
+	Description  string   `json:"description" yaml:"description"`
+	MaxOccupancy int      `json:"max_occupancy" yaml:"max_occupancy"`
+	BedTypes     string   `json:"bed_types" yaml:"bed_types"`
+	SizeSqm      int      `json:"size_sqm" yaml:"size_sqm"`
+	Price        int      `json:"price" yaml:"price"`
+	Amenities    []string `json:"amenities" yaml:"amenities"`
+	Images       []Image  `json:"images" yaml:"images"`
+}
+
+// Image is a room image, matched by its room and URL
+type Image struct {
+	URL     string `json:"url" yaml:"url"`
+	Caption string `json:"caption" yaml:"caption"`
+}
+
+// User is matched by email. Existing users are left alone, so that a password changed since isn't reset
+type User struct {
+	FirstName   string `json:"first_name" yaml:"first_name"`
+	LastName    string `json:"last_name" yaml:"last_name"`
+	Email       string `json:"email" yaml:"email"`
+	Password    string `json:"password" yaml:"password"`
+	AccessLevel int    `json:"access_level" yaml:"access_level"`
+}
+
+// Reservation is matched by its code. Room is the room's slug. Dates are either YYYY-MM-DD or +N, meaning N days
+// after the day the fixture is loaded, so that sample reservations can stay in the future
+type Reservation struct {
+	Code      string `json:"code" yaml:"code"`
+	Room      string `json:"room" yaml:"room"`
+	FirstName string `json:"first_name" yaml:"first_name"`
+	LastName  string `json:"last_name" yaml:"last_name"`
+	Email     string `json:"email" yaml:"email"`
+	Phone     string `json:"phone" yaml:"phone"`
+	Start     string `json:"start" yaml:"start"`
+	End       string `json:"end" yaml:"end"`
+	Adults    int    `json:"adults" yaml:"adults"`
+	Children  int    `json:"children" yaml:"children"`
+}
+
+// Result counts the records a seed created; records that already existed are not counted
+type Result struct {
+	Restrictions int
+	Amenities    int
+	Rooms        int
+	Users        int
+	Reservations int
+}
+
+// Load reads a fixture from a .yml, .yaml or .json file
+func Load(path string) (Fixture, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Fixture{}, err
+	}
+
+	return Parse(b, filepath.Ext(path))
+}
+
+// Parse decodes a fixture in the format named by a file extension, and checks that it is complete
+func Parse(b []byte, ext string) (Fixture, error) {
+	var f Fixture
+	var err error
+
+	switch strings.ToLower(ext) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	case ".yml", ".yaml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		err = dec.Decode(&f)
+	default:
+		return f, fmt.Errorf("fixtures must be .yml, .yaml or .json, not %q", ext)
+	}
+	if err != nil {
+		return f, err
+	}
+
+	return f, f.validate()
+}
+
+// validate checks that every record has the fields it is matched by, and that reservations refer to rooms in
+// the fixture
+func (f Fixture) validate() error {
+	for _, r := range f.Restrictions {
+		if r.ID == 0 || r.Name == "" {
+			return errors.New("restrictions need an id and a name")
+		}
+	}
+
+	rooms := make(map[string]bool)
+	for i, r := range f.Rooms {
+		if r.Name == "" {
+			return fmt.Errorf("room %d has no name", i+1)
+		}
+		rooms[r.slug()] = true
+	}
+
+	for _, u := range f.Users {
+		if u.Email == "" || u.Password == "" {
+			return errors.New("users need an email and a password")
+		}
+	}
+
+	for _, r := range f.Reservations {
+		if r.Code == "" {
+			return errors.New("reservations need a code")
+		}
+		if !rooms[r.Room] {
+			return fmt.Errorf("reservation %s is for room %q, which is not in the fixture", r.Code, r.Room)
+		}
+		// relative dates are only resolved when the fixture is seeded, which checks the dates again, so here they
+		// are taken from an arbitrary day
+		if _, _, err := r.dates(time.Time{}); err != nil {
+			return fmt.Errorf("reservation %s: %w", r.Code, err)
+		}
+	}
+
+	return nil
+}
+
+func (r Room) slug() string {
+	if r.Slug != "" {
+		return r.Slug
+	}
+	return helpers.Slugify(r.Name)
+}
+
+// dates returns a reservation's start and end dates, taking relative dates from today
+func (r Reservation) dates(today time.Time) (dates.Date, dates.Date, error) {
+	start, err := parseDate(r.Start, today)
+	if err != nil {
+		return start, start, err
+	}
+
+	end, err := parseDate(r.End, today)
+	if err != nil {
+		return start, end, err
+	}
+
+	if !end.After(start) {
+		return start, end, errors.New("end must be after start")
+	}
+
+	return start, end, nil
+}
+
+func parseDate(s string, today time.Time) (dates.Date, error) {
+	if strings.HasPrefix(s, "+") {
+		days, err := strconv.Atoi(s[1:])
+		if err != nil {
+			return dates.Date{}, fmt.Errorf("invalid relative date %q", s)
+		}
+
+		return dates.Of(today).AddDate(0, 0, days), nil
+	}
+
+	date, err := dates.Parse(s)
+	if err != nil {
+		return date, fmt.Errorf("invalid date %q", s)
+	}
+
+	return date, nil
+}
+
+// Seed loads a fixture into a database of the given dialect in one transaction. Payments for reservations are
+// recorded in baseCurrency, and relative dates are taken from today on clk
+func Seed(db *sql.DB, dialect string, f Fixture, baseCurrency string, clk clock.Clock, infoLog *log.Logger) (Result, error) {
+	var res Result
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	s := seeder{ctx: ctx, tx: tx, dialect: dialect, now: clk.Now()}
+
+	for _, r := range f.Restrictions {
+		n, err := s.restriction(r)
+		if err != nil {
+			return res, fmt.Errorf("restriction %s: %w", r.Name, err)
+		}
+		res.Restrictions += n
+	}
+
+	for _, name := range f.Amenities {
+		n, err := s.amenity(name)
+		if err != nil {
+			return res, fmt.Errorf("amenity %s: %w", name, err)
+		}
+		res.Amenities += n
+	}
+
+	prices := make(map[string]int)
+	for _, r := range f.Rooms {
+		n, err := s.room(r)
+		if err != nil {
+			return res, fmt.Errorf("room %s: %w", r.Name, err)
+		}
+		res.Rooms += n
+		prices[r.slug()] = r.Price
+	}
+
+	for _, u := range f.Users {
+		n, err := s.user(u)
+		if err != nil {
+			return res, fmt.Errorf("user %s: %w", u.Email, err)
+		}
+		res.Users += n
+	}
+
+	for _, r := range f.Reservations {
+		n, err := s.reservation(r, prices[r.Room], baseCurrency)
+		if err != nil {
+			return res, fmt.Errorf("reservation %s: %w", r.Code, err)
+		}
+		res.Reservations += n
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return res, err
+	}
+
+	infoLog.Printf("Seeded %d restrictions, %d amenities, %d rooms, %d users and %d reservations",
+		res.Restrictions, res.Amenities, res.Rooms, res.Users, res.Reservations)
+
+	return res, nil
+}
+
+// seeder writes fixture records as part of a transaction. Each method returns 1 if it created its record and 0 if
+// the record already existed
+type seeder struct {
+	ctx     context.Context
+	tx      *sql.Tx
+	dialect string
+	now     time.Time
+}
+
+func (s seeder) restriction(r Restriction) (int, error) {
+	var inserted bool
+	err := s.tx.QueryRowContext(s.ctx, `insert into restrictions (id, restriction_name, created_at, updated_at)
+		values ($1, $2, $3, $3)
+		on conflict (id) do update set restriction_name = excluded.restriction_name, updated_at = excluded.updated_at
+		returning created_at = updated_at`, r.ID, r.Name, s.now).Scan(&inserted)
+	if err != nil || s.dialect == driver.SQLite {
+		return created(inserted), err
+	}
+
+	// keep the sequence ahead of the IDs given, so that restrictions added later don't collide with them. SQLite
+	// does this by itself
+	_, err = s.tx.ExecContext(s.ctx, `select setval('restrictions_id_seq', (select max(id) from restrictions))`)
+
+	return created(inserted), err
+}
+
+func (s seeder) amenity(name string) (int, error) {
+	result, err := s.tx.ExecContext(s.ctx, `insert into amenities (name, created_at, updated_at) values ($1, $2, $2)
+		on conflict (name) do nothing`, name, s.now)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+
+	return int(n), err
+}
+
+func (s seeder) room(r Room) (int, error) {
+	maxOccupancy := r.MaxOccupancy
+	if maxOccupancy == 0 {
+		maxOccupancy = 2
+	}
+
+	var roomID int
+	var inserted bool
+	err := s.tx.QueryRowContext(s.ctx, `insert into rooms (room_name, slug, description, max_occupancy, bed_types,
+			size_sqm, price, retired, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, false, $8, $8)
+		on conflict (slug) do update set room_name = excluded.room_name, description = excluded.description,
+			max_occupancy = excluded.max_occupancy, bed_types = excluded.bed_types, size_sqm = excluded.size_sqm,
+			price = excluded.price, updated_at = excluded.updated_at
+		returning id, created_at = updated_at`,
+		r.Name, r.slug(), r.Description, maxOccupancy, r.BedTypes, r.SizeSqm, r.Price, s.now,
+	).Scan(&roomID, &inserted)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = s.tx.ExecContext(s.ctx, `delete from room_amenities where room_id = $1`, roomID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, name := range r.Amenities {
+		result, err := s.tx.ExecContext(s.ctx, `insert into room_amenities (room_id, amenity_id, created_at, updated_at)
+			select $1, id, $3, $3 from amenities where name = $2`, roomID, name, s.now)
+		if err != nil {
+			return 0, err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return 0, fmt.Errorf("unknown amenity %q", name)
+		}
+	}
+
+	for i, img := range r.Images {
+		_, err = s.tx.ExecContext(s.ctx, `insert into room_images (room_id, url, caption, sort_order, created_at, updated_at)
+			select $1, $2, $3, $4, $5, $5
+			where not exists (select 1 from room_images where room_id = $1 and url = $2)`,
+			roomID, img.URL, img.Caption, i, s.now)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return created(inserted), nil
+}
+
+func (s seeder) user(u User) (int, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(u.Password), 12)
+	if err != nil {
+		return 0, err
+	}
+
+	accessLevel := u.AccessLevel
+	if accessLevel == 0 {
+		accessLevel = 1
+	}
+
+	result, err := s.tx.ExecContext(s.ctx, `insert into users (first_name, last_name, email, password, access_level,
+			created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $6)
+		on conflict (email) do nothing`,
+		u.FirstName, u.LastName, u.Email, string(hash), accessLevel, s.now)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+
+	return int(n), err
+}
+
+func (s seeder) reservation(r Reservation, price int, baseCurrency string) (int, error) {
+	var exists bool
+	err := s.tx.QueryRowContext(s.ctx, `select exists (select 1 from reservations where code = $1)`, r.Code).Scan(&exists)
+	if err != nil || exists {
+		return 0, err
+	}
+
+	start, end, err := r.dates(s.now)
+	if err != nil {
+		return 0, err
+	}
+
+	adults := r.Adults
+	if adults == 0 {
+		adults = 1
+	}
+
+	var roomID, reservationID int
+	err = s.tx.QueryRowContext(s.ctx, `select id from rooms where slug = $1`, r.Room).Scan(&roomID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.tx.QueryRowContext(s.ctx, `insert into reservations (code, first_name, last_name, email, phone,
+			start_date, end_date, room_id, adults, children, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $11) returning id`,
+		r.Code, r.FirstName, r.LastName, r.Email, r.Phone, start, end, roomID, adults, r.Children, s.now,
+	).Scan(&reservationID)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = s.tx.ExecContext(s.ctx, `insert into room_restrictions (start_date, end_date, room_id, reservation_id,
+			restriction_id, created_at, updated_at)
+		values ($1, $2, $3, $4, 1, $5, $5)`, start, end, roomID, reservationID, s.now)
+	if err != nil {
+		return 0, err
+	}
+
+	total := models.Reservation{StartDate: start, EndDate: end}.Nights() * price
+	_, err = s.tx.ExecContext(s.ctx, `insert into payments (reservation_id, amount, currency, base_amount,
+			base_currency, exchange_rate, created_at, updated_at)
+		values ($1, $2, $3, $2, $3, 1, $4, $4)`, reservationID, total, baseCurrency, s.now)
+	if err != nil {
+		return 0, err
+	}
+
+	return 1, nil
+}
+
+func created(inserted bool) int {
+	if inserted {
+		return 1
+	}
+	return 0
+}
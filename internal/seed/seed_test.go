@@ -0,0 +1,135 @@
+package seed
+
+import (
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/clock"
+	"github.com/ashrielbrian/go_bookings/internal/dates"
+	"github.com/ashrielbrian/go_bookings/internal/driver"
+	"github.com/ashrielbrian/go_bookings/internal/migrate"
+	"github.com/ashrielbrian/go_bookings/migrations"
+)
+
+func TestLoad_DevFixture(t *testing.T) {
+	f, err := Load("../../fixtures/dev.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.Restrictions) != 2 || len(f.Rooms) != 2 || len(f.Users) != 1 || len(f.Reservations) != 2 {
+		t.Errorf("unexpected fixture %+v", f)
+	}
+	if f.Rooms[1].Amenities[1] != "Kitchen" || f.Reservations[1].Children != 2 {
+		t.Errorf("expected nested fields to be decoded, got %+v", f)
+	}
+}
+
+func TestParse_JSON(t *testing.T) {
+	f, err := Parse([]byte(`{
+		"rooms": [{"name": "General's Quarters", "price": 15000}],
+		"reservations": [{"code": "SAMPLE01", "room": "generals-quarters", "start": "2050-01-01", "end": "2050-01-03"}]
+	}`), ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Rooms[0].slug() != "generals-quarters" {
+		t.Errorf("expected the slug to be made from the name, got %s", f.Rooms[0].slug())
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		ext      string
+		data     string
+		expected string
+	}{
+		{"unknown format", ".toml", ``, "fixtures must be"},
+		{"unknown field", ".yml", "room:\n  - name: x", "field room not found"},
+		{"unknown json field", ".json", `{"room": []}`, "unknown field"},
+		{"restriction without id", ".yml", "restrictions:\n  - name: Reservation", "need an id"},
+		{"room without name", ".yml", "rooms:\n  - slug: x", "has no name"},
+		{"user without password", ".yml", "users:\n  - email: a@example.com", "need an email and a password"},
+		{"reservation for unknown room", ".yml", "reservations:\n  - {code: A, room: x, start: '+1', end: '+2'}", "not in the fixture"},
+		{"reservation with bad date", ".yml", "rooms: [{name: x}]\nreservations:\n  - {code: A, room: x, start: soon, end: '+2'}", "invalid date"},
+		{"reservation ending first", ".yml", "rooms: [{name: x}]\nreservations:\n  - {code: A, room: x, start: '+2', end: '+1'}", "end must be after start"},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.data), tt.ext)
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.expected, err)
+		}
+	}
+}
+
+func TestReservation_Dates(t *testing.T) {
+	today := time.Date(2026, 10, 30, 15, 0, 0, 0, time.UTC)
+
+	start, end, err := Reservation{Start: "+2", End: "2026-11-05"}.dates(today)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if start != dates.New(2026, 11, 1) {
+		t.Errorf("expected a relative start of 2026-11-01, got %s", start)
+	}
+	if end != dates.New(2026, 11, 5) {
+		t.Errorf("expected an end of 2026-11-05, got %s", end)
+	}
+}
+
+func TestSeed_SQLite(t *testing.T) {
+	db, err := driver.Connect(driver.SQLite, filepath.Join(t.TempDir(), "test.db"), driver.DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.SQL.Close()
+
+	fsys, err := migrations.For(driver.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	discard := log.New(io.Discard, "", 0)
+
+	m, err := migrate.New(db.SQL, driver.SQLite, fsys, discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Load("../../fixtures/dev.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clk := clock.NewFake(time.Date(2026, 10, 30, 15, 0, 0, 0, time.UTC))
+
+	res, err := Seed(db.SQL, driver.SQLite, f, "USD", clk, discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Rooms != 2 || res.Users != 1 || res.Reservations != 2 {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	// rows are told apart as inserted or updated by their timestamps, so the clock must have moved on
+	clk.Advance(time.Minute)
+	res, err = Seed(db.SQL, driver.SQLite, f, "USD", clk, discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (Result{}) {
+		t.Errorf("expected seeding again to create nothing, got %+v", res)
+	}
+}
@@ -0,0 +1,143 @@
+// Package stayrules checks stays against the rules owners set on their rooms, such as a minimum stay over
+// weekends or arrivals only on Saturdays
+package stayrules
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/dates"
+	"github.com/ashrielbrian/go_bookings/internal/models"
+)
+
+// DateLayout is how the dates of a rule's season are shown in its message
+const DateLayout = "2 Jan 2006"
+
+// Applies reports whether a rule applies to a stay arriving on start, which is whether start is in its season
+func Applies(rule models.StayRule, start dates.Date) bool {
+	if !rule.StartDate.IsZero() && start.Before(rule.StartDate) {
+		return false
+	}
+	if !rule.EndDate.IsZero() && start.After(rule.EndDate) {
+		return false
+	}
+	return true
+}
+
+// Broken reports whether a stay from start to end breaks a rule. Rules that don't apply to the stay are never
+// broken
+func Broken(rule models.StayRule, start, end dates.Date) bool {
+	if !Applies(rule, start) {
+		return false
+	}
+
+	n := end.Sub(start)
+
+	switch rule.Type {
+	case models.StayRuleMinNights:
+		if len(rule.Weekdays) > 0 && !includesNight(start, end, rule.Weekdays) {
+			return false
+		}
+		return n < rule.Nights
+	case models.StayRuleMaxNights:
+		return n > rule.Nights
+	case models.StayRuleArrivalDays:
+		return !hasWeekday(rule.Weekdays, start.Weekday())
+	case models.StayRuleNoArrival:
+		return len(rule.Weekdays) == 0 || hasWeekday(rule.Weekdays, start.Weekday())
+	}
+
+	return false
+}
+
+// Check returns the messages of the rules a stay from start to end breaks, in the order of rules
+func Check(rules []models.StayRule, start, end dates.Date) []string {
+	var messages []string
+	for _, rule := range rules {
+		if Broken(rule, start, end) {
+			messages = append(messages, Message(rule))
+		}
+	}
+	return messages
+}
+
+// Message describes a rule to guests, eg. "Stays must be at least 2 nights when including a Friday or Saturday
+// night"
+func Message(rule models.StayRule) string {
+	var msg string
+
+	switch rule.Type {
+	case models.StayRuleMinNights:
+		msg = fmt.Sprintf("Stays must be at least %s", plural(rule.Nights, "night"))
+		if len(rule.Weekdays) > 0 {
+			msg += fmt.Sprintf(" when including a %s night", join(rule.Weekdays, ""))
+		}
+	case models.StayRuleMaxNights:
+		msg = fmt.Sprintf("Stays can be at most %s", plural(rule.Nights, "night"))
+	case models.StayRuleArrivalDays:
+		msg = fmt.Sprintf("Arrivals are only allowed on %s", join(rule.Weekdays, "s"))
+	case models.StayRuleNoArrival:
+		msg = "No arrivals"
+		if len(rule.Weekdays) > 0 {
+			msg += " on " + join(rule.Weekdays, "s")
+		}
+		return msg + season(rule, "")
+	default:
+		msg = "Stays must follow the room's rules"
+	}
+
+	return msg + season(rule, " for arrivals")
+}
+
+// season describes the dates a rule applies to, after prefix
+func season(rule models.StayRule, prefix string) string {
+	switch {
+	case !rule.StartDate.IsZero() && !rule.EndDate.IsZero():
+		return fmt.Sprintf("%s from %s to %s", prefix, rule.StartDate.Format(DateLayout), rule.EndDate.Format(DateLayout))
+	case !rule.StartDate.IsZero():
+		return fmt.Sprintf("%s from %s", prefix, rule.StartDate.Format(DateLayout))
+	case !rule.EndDate.IsZero():
+		return fmt.Sprintf("%s until %s", prefix, rule.EndDate.Format(DateLayout))
+	}
+	return ""
+}
+
+// includesNight reports whether a stay from start to end includes a night beginning on one of days
+func includesNight(start, end dates.Date, days []time.Weekday) bool {
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		if hasWeekday(days, d.Weekday()) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasWeekday(days []time.Weekday, day time.Weekday) bool {
+	for _, d := range days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// join lists days, each followed by suffix, eg. "Fridays or Saturdays"
+func join(days []time.Weekday, suffix string) string {
+	names := make([]string, len(days))
+	for i, d := range days {
+		names[i] = d.String() + suffix
+	}
+
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, word)
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
@@ -0,0 +1,110 @@
+package stayrules
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/dates"
+	"github.com/ashrielbrian/go_bookings/internal/models"
+)
+
+func date(t *testing.T, s string) dates.Date {
+	t.Helper()
+
+	d, err := dates.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+var weekend = []time.Weekday{time.Friday, time.Saturday}
+
+func TestBroken(t *testing.T) {
+	july := func(rule models.StayRule) models.StayRule {
+		rule.StartDate, rule.EndDate = date(t, "2027-07-01"), date(t, "2027-07-31")
+		return rule
+	}
+
+	var tests = []struct {
+		name     string
+		rule     models.StayRule
+		start    string
+		end      string
+		expected bool
+	}{
+		{"min nights", models.StayRule{Type: models.StayRuleMinNights, Nights: 2}, "2027-07-05", "2027-07-06", true},
+		{"min nights met", models.StayRule{Type: models.StayRuleMinNights, Nights: 2}, "2027-07-05", "2027-07-07", false},
+		{"weekend min nights", models.StayRule{Type: models.StayRuleMinNights, Nights: 2, Weekdays: weekend},
+			"2027-07-02", "2027-07-03", true},
+		{"weekend min nights on weekdays", models.StayRule{Type: models.StayRuleMinNights, Nights: 2, Weekdays: weekend},
+			"2027-07-05", "2027-07-06", false},
+		{"max nights", models.StayRule{Type: models.StayRuleMaxNights, Nights: 14}, "2027-07-01", "2027-07-16", true},
+		{"max nights met", models.StayRule{Type: models.StayRuleMaxNights, Nights: 14}, "2027-07-01", "2027-07-15", false},
+		{"saturday arrivals in july", july(models.StayRule{Type: models.StayRuleArrivalDays, Weekdays: []time.Weekday{time.Saturday}}),
+			"2027-07-05", "2027-07-10", true},
+		{"saturday arrival in july", july(models.StayRule{Type: models.StayRuleArrivalDays, Weekdays: []time.Weekday{time.Saturday}}),
+			"2027-07-03", "2027-07-10", false},
+		{"arrival in august", july(models.StayRule{Type: models.StayRuleArrivalDays, Weekdays: []time.Weekday{time.Saturday}}),
+			"2027-08-02", "2027-08-04", false},
+		{"arrival on the last day of july", july(models.StayRule{Type: models.StayRuleArrivalDays, Weekdays: []time.Weekday{time.Saturday}}),
+			"2027-07-31", "2027-08-02", false},
+		{"closed", july(models.StayRule{Type: models.StayRuleNoArrival}), "2027-07-10", "2027-07-12", true},
+		{"closed before", july(models.StayRule{Type: models.StayRuleNoArrival}), "2027-06-28", "2027-07-12", false},
+		{"no sunday arrivals", models.StayRule{Type: models.StayRuleNoArrival, Weekdays: []time.Weekday{time.Sunday}},
+			"2027-07-04", "2027-07-06", true},
+		{"monday arrival", models.StayRule{Type: models.StayRuleNoArrival, Weekdays: []time.Weekday{time.Sunday}},
+			"2027-07-05", "2027-07-06", false},
+	}
+
+	for _, e := range tests {
+		if got := Broken(e.rule, date(t, e.start), date(t, e.end)); got != e.expected {
+			t.Errorf("%s: expected %v, got %v", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	var tests = []struct {
+		rule     models.StayRule
+		expected string
+	}{
+		{models.StayRule{Type: models.StayRuleMinNights, Nights: 2, Weekdays: weekend},
+			"Stays must be at least 2 nights when including a Friday or Saturday night"},
+		{models.StayRule{Type: models.StayRuleMaxNights, Nights: 1}, "Stays can be at most 1 night"},
+		{models.StayRule{Type: models.StayRuleArrivalDays, Weekdays: []time.Weekday{time.Saturday},
+			StartDate: date(t, "2027-07-01"), EndDate: date(t, "2027-07-31")},
+			"Arrivals are only allowed on Saturdays for arrivals from 1 Jul 2027 to 31 Jul 2027"},
+		{models.StayRule{Type: models.StayRuleArrivalDays, Weekdays: []time.Weekday{time.Friday, time.Saturday, time.Sunday}},
+			"Arrivals are only allowed on Fridays, Saturdays or Sundays"},
+		{models.StayRule{Type: models.StayRuleNoArrival, StartDate: date(t, "2027-12-24")}, "No arrivals from 24 Dec 2027"},
+		{models.StayRule{Type: models.StayRuleNoArrival, Weekdays: []time.Weekday{time.Sunday}, EndDate: date(t, "2027-01-31")},
+			"No arrivals on Sundays until 31 Jan 2027"},
+	}
+
+	for _, e := range tests {
+		if got := Message(e.rule); got != e.expected {
+			t.Errorf("expected %q, got %q", e.expected, got)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	rules := []models.StayRule{
+		{Type: models.StayRuleMinNights, Nights: 3},
+		{Type: models.StayRuleMaxNights, Nights: 14},
+		{Type: models.StayRuleArrivalDays, Weekdays: []time.Weekday{time.Saturday}},
+	}
+
+	got := Check(rules, date(t, "2027-07-05"), date(t, "2027-07-06"))
+	expected := []string{"Stays must be at least 3 nights", "Arrivals are only allowed on Saturdays"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	if got := Check(rules, date(t, "2027-07-03"), date(t, "2027-07-10")); len(got) != 0 {
+		t.Errorf("expected no broken rules, got %q", got)
+	}
+}
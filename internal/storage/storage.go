@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrInvalidKey is returned for keys that are empty or would escape the storage root
+var ErrInvalidKey = errors.New("invalid storage key")
+
+// Storage stores uploaded files under slash-separated keys such as "rooms/1/abc-web.jpg"
+type Storage interface {
+	// Save stores the contents of r under key and returns the URL it is served from
+	Save(key string, r io.Reader) (string, error)
+	// Delete removes the file stored under key; deleting a missing file is not an error
+	Delete(key string) error
+}
+
+// Local stores files on the local disk under Dir, served from BaseURL
+type Local struct {
+	Dir     string
+	BaseURL string
+}
+
+// NewLocal creates a storage backed by the directory dir, whose files are served from baseURL
+func NewLocal(dir, baseURL string) *Local {
+	return &Local{
+		Dir:     dir,
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// Save stores the contents of r under key and returns the URL it is served from
+func (l *Local) Save(key string, r io.Reader) (string, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	// write to a temporary file first so a failed upload never leaves a partial file behind
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return "", err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Rename(tmp.Name(), p)
+	if err != nil {
+		return "", err
+	}
+
+	return l.BaseURL + "/" + path.Clean(key), nil
+}
+
+// Delete removes the file stored under key; deleting a missing file is not an error
+func (l *Local) Delete(key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// path returns the file path of key, rejecting keys outside of Dir
+func (l *Local) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if key == "" || clean == "/" || clean != "/"+key {
+		return "", ErrInvalidKey
+	}
+
+	return filepath.Join(l.Dir, filepath.FromSlash(clean)), nil
+}
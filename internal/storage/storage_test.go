@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocal_SaveAndDelete(t *testing.T) {
+	dir := t.TempDir()
+	s := NewLocal(dir, "/uploads/")
+
+	url, err := s.Save("rooms/1/photo.jpg", strings.NewReader("image data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if url != "/uploads/rooms/1/photo.jpg" {
+		t.Errorf("expected url /uploads/rooms/1/photo.jpg, got %s", url)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "rooms", "1", "photo.jpg"))
+	if err != nil || string(b) != "image data" {
+		t.Errorf("expected saved file contents, got %q (%v)", b, err)
+	}
+
+	if err := s.Delete("rooms/1/photo.jpg"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "rooms", "1", "photo.jpg")); !os.IsNotExist(err) {
+		t.Error("expected file to be deleted")
+	}
+
+	if err := s.Delete("rooms/1/photo.jpg"); err != nil {
+		t.Errorf("expected deleting a missing file to succeed, got %v", err)
+	}
+}
+
+func TestLocal_InvalidKeys(t *testing.T) {
+	s := NewLocal(t.TempDir(), "/uploads")
+
+	for _, key := range []string{"", "/", "../secret", "rooms/../../secret", "/rooms/1.jpg"} {
+		if _, err := s.Save(key, strings.NewReader("x")); err != ErrInvalidKey {
+			t.Errorf("key %q: expected ErrInvalidKey, got %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/clock"
+	"github.com/ashrielbrian/go_bookings/internal/models"
+)
+
+// Event types that can be subscribed to
+const (
+	ReservationCreated   = "reservation.created"
+	ReservationUpdated   = "reservation.updated"
+	ReservationCancelled = "reservation.cancelled"
+	BlockCreated         = "block.created"
+)
+
+// EventTypes lists every event type, in the order they are shown to admins. Only types the application sends
+// belong here, so that nobody subscribes to an event that never comes
+var EventTypes = []string{ReservationCreated, ReservationUpdated, ReservationCancelled, BlockCreated}
+
+// IsEventType reports whether s is a known event type
+func IsEventType(s string) bool {
+	for _, t := range EventTypes {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is the JSON body sent to subscribers
+type Event struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// NewSecret returns a random secret for signing a subscription's payloads
+func NewSecret() string {
+	return "whsec_" + randomHex(24)
+}
+
+// Sign returns the signature of a payload sent at timestamp. Subscribers verify a request by computing the
+// HMAC-SHA256 of "<timestamp>.<body>" with their secret and comparing it to the v1 value of the signature header
+func Sign(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(payload)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Store is the part of the repository used to deliver webhooks
+type Store interface {
+	DueWebhookDeliveries(limit int, lease time.Duration) ([]models.WebhookDelivery, error)
+	RecordWebhookAttempt(d models.WebhookDelivery) error
+}
+
+// Delivery settings
+const (
+	// MaxAttempts is how many times a delivery is tried before it is marked as failed
+	MaxAttempts = 12
+	// backoffBase is the wait after the first failed attempt; it doubles after each further failure
+	backoffBase = 30 * time.Second
+	// maxBackoff caps the wait between attempts
+	maxBackoff = 6 * time.Hour
+	// batchSize is how many deliveries are sent each time the worker polls
+	batchSize = 20
+	// lease is how long a delivery is held by the worker sending it
+	lease = 5 * time.Minute
+	// maxErrorLength limits how much of a failed response body is kept in the delivery log
+	maxErrorLength = 500
+	userAgent      = "go_bookings-webhooks/1"
+)
+
+// Backoff returns how long to wait before retrying a delivery that has failed attempts times
+func Backoff(attempts int) time.Duration {
+	if attempts < 1 {
+		return 0
+	}
+
+	wait := backoffBase
+	for i := 1; i < attempts; i++ {
+		wait *= 2
+		if wait >= maxBackoff {
+			return maxBackoff
+		}
+	}
+
+	return wait
+}
+
+// Worker sends pending deliveries in the background
+type Worker struct {
+	Store    Store
+	Client   *http.Client
+	ErrorLog *log.Logger
+	// Clock dates and signs attempts and schedules their retries
+	Clock clock.Clock
+}
+
+// NewWorker creates a worker that sends the deliveries in store
+func NewWorker(store Store, errorLog *log.Logger) *Worker {
+	return &Worker{
+		Store:    store,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+		ErrorLog: errorLog,
+		Clock:    clock.Real{},
+	}
+}
+
+// Run sends due deliveries every interval until done is closed
+func (wk *Worker) Run(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			wk.RunOnce()
+		}
+	}
+}
+
+// RunOnce sends the deliveries that are due now
+func (wk *Worker) RunOnce() {
+	deliveries, err := wk.Store.DueWebhookDeliveries(batchSize, lease)
+	if err != nil {
+		wk.ErrorLog.Println(err)
+		return
+	}
+
+	for _, d := range deliveries {
+		err = wk.Store.RecordWebhookAttempt(wk.Deliver(d))
+		if err != nil {
+			wk.ErrorLog.Println(err)
+		}
+	}
+}
+
+// Deliver makes one attempt to send a delivery, returning it updated with the outcome. A delivery that fails is
+// retried with exponential backoff until it has been tried MaxAttempts times
+func (wk *Worker) Deliver(d models.WebhookDelivery) models.WebhookDelivery {
+	now := wk.Clock.Now()
+
+	d.Attempts++
+	d.LastAttemptAt = now
+	d.ResponseCode, d.Error = 0, ""
+
+	code, err := wk.send(d, now)
+	d.ResponseCode = code
+
+	switch {
+	case err == nil:
+		d.Status = models.WebhookDelivered
+	case d.Attempts >= MaxAttempts:
+		d.Status = models.WebhookFailed
+		d.Error = err.Error()
+	default:
+		d.Status = models.WebhookPending
+		d.Error = err.Error()
+		d.NextAttemptAt = now.Add(Backoff(d.Attempts))
+	}
+
+	return d
+}
+
+// send posts a delivery's payload to its subscription, returning the response code if there was a response
+func (wk *Worker) send(d models.WebhookDelivery, now time.Time) (int, error) {
+	payload := []byte(d.Payload)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	req, err := http.NewRequest("POST", d.Subscription.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("X-Webhook-ID", d.EventID)
+	req.Header.Set("X-Webhook-Event", d.EventType)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "t="+timestamp+",v1="+Sign(d.Subscription.Secret, now.Unix(), payload))
+
+	resp, err := wk.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorLength))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with %d: %s", resp.StatusCode, body)
+	}
+
+	return resp.StatusCode, nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// Marshal encodes an event as the payload stored with its deliveries
+func Marshal(e Event) (string, error) {
+	b, err := json.Marshal(e)
+	return string(b), err
+}
@@ -0,0 +1,234 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ashrielbrian/go_bookings/internal/clock"
+	"github.com/ashrielbrian/go_bookings/internal/config"
+	"github.com/ashrielbrian/go_bookings/internal/models"
+	"github.com/ashrielbrian/go_bookings/internal/repository/dbrepo"
+)
+
+func TestSign(t *testing.T) {
+	payload := []byte(`{"id":"evt_1"}`)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1700000000." + string(payload)))
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	if got := Sign("secret", 1700000000, payload); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	if Sign("other", 1700000000, payload) == expected {
+		t.Error("expected a different secret to give a different signature")
+	}
+	if Sign("secret", 1700000001, payload) == expected {
+		t.Error("expected a different timestamp to give a different signature")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{0, 0},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{9, 2*time.Hour + 8*time.Minute},
+		{10, 4*time.Hour + 16*time.Minute},
+		{11, 6 * time.Hour},
+		{50, 6 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := Backoff(tt.attempts); got != tt.expected {
+			t.Errorf("Backoff(%d): expected %s, got %s", tt.attempts, tt.expected, got)
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	payload, err := Marshal(Event{ID: "evt_1", Type: ReservationCreated, Data: map[string]string{"code": "TESTCODE"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(payload), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["id"] != "evt_1" || decoded["type"] != ReservationCreated || decoded["data"].(map[string]interface{})["code"] != "TESTCODE" {
+		t.Errorf("unexpected payload %s", payload)
+	}
+}
+
+func TestIsEventType(t *testing.T) {
+	for _, eventType := range []string{ReservationCreated, ReservationUpdated, ReservationCancelled, BlockCreated} {
+		if !IsEventType(eventType) {
+			t.Errorf("expected %s to be an event type", eventType)
+		}
+	}
+	if IsEventType("reservation.deleted") {
+		t.Error("expected reservation.deleted not to be an event type")
+	}
+}
+
+type fakeStore struct {
+	due      []models.WebhookDelivery
+	recorded []models.WebhookDelivery
+}
+
+func (s *fakeStore) DueWebhookDeliveries(limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	due := s.due
+	s.due = nil
+	return due, nil
+}
+
+func (s *fakeStore) RecordWebhookAttempt(d models.WebhookDelivery) error {
+	s.recorded = append(s.recorded, d)
+	return nil
+}
+
+func TestWorker_RunOnce(t *testing.T) {
+	var received *http.Request
+	var body []byte
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = io.ReadAll(r.Body)
+
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("boom"))
+		}
+	}))
+	defer srv.Close()
+
+	store := &fakeStore{due: []models.WebhookDelivery{{
+		ID:           1,
+		EventID:      "evt_1",
+		EventType:    ReservationCreated,
+		Payload:      `{"id":"evt_1"}`,
+		Subscription: models.WebhookSubscription{URL: srv.URL + "/hooks", Secret: "secret"},
+	}}}
+
+	now := time.Date(2026, 11, 1, 10, 0, 0, 0, time.UTC)
+	wk := NewWorker(store, log.New(os.Stdout, "", 0))
+	wk.Clock = clock.NewFake(now)
+	wk.RunOnce()
+
+	if len(store.recorded) != 1 {
+		t.Fatalf("expected 1 recorded attempt, got %d", len(store.recorded))
+	}
+
+	d := store.recorded[0]
+	if d.Status != models.WebhookDelivered || d.Attempts != 1 || d.ResponseCode != http.StatusOK {
+		t.Errorf("expected a delivered first attempt, got %+v", d)
+	}
+	if !d.LastAttemptAt.Equal(now) {
+		t.Errorf("expected the attempt at %s, got %s", now, d.LastAttemptAt)
+	}
+
+	if received.Header.Get("X-Webhook-Event") != ReservationCreated || received.Header.Get("X-Webhook-ID") != "evt_1" {
+		t.Errorf("unexpected headers %v", received.Header)
+	}
+
+	timestamp, _ := strconv.ParseInt(received.Header.Get("X-Webhook-Timestamp"), 10, 64)
+	if timestamp != now.Unix() {
+		t.Errorf("expected timestamp %d, got %d", now.Unix(), timestamp)
+	}
+	expected := "t=" + strconv.FormatInt(timestamp, 10) + ",v1=" + Sign("secret", timestamp, body)
+	if received.Header.Get("X-Webhook-Signature") != expected {
+		t.Errorf("expected signature %s, got %s", expected, received.Header.Get("X-Webhook-Signature"))
+	}
+
+	// a failing endpoint is retried later
+	d = wk.Deliver(models.WebhookDelivery{
+		Payload:      "{}",
+		Attempts:     2,
+		Subscription: models.WebhookSubscription{URL: srv.URL + "/broken"},
+	})
+	if d.Status != models.WebhookPending || d.ResponseCode != http.StatusInternalServerError || !strings.Contains(d.Error, "boom") {
+		t.Errorf("expected a pending delivery recording the failure, got %+v", d)
+	}
+	if wait := d.NextAttemptAt.Sub(now); wait != Backoff(3) {
+		t.Errorf("expected the next attempt in %s, got %s", Backoff(3), wait)
+	}
+
+	// and given up on after the last attempt
+	d = wk.Deliver(models.WebhookDelivery{
+		Payload:      "{}",
+		Attempts:     MaxAttempts - 1,
+		Subscription: models.WebhookSubscription{URL: srv.URL + "/broken"},
+	})
+	if d.Status != models.WebhookFailed {
+		t.Errorf("expected the delivery to have failed, got %s", d.Status)
+	}
+}
+
+func TestWorker_Retry(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	// the repository and the worker share the clock, so that moving it on makes the retry due
+	clk := clock.NewFake(time.Date(2026, 11, 1, 10, 0, 0, 0, time.UTC))
+	store := dbrepo.NewMemoryRepo(&config.AppConfig{Clock: clk})
+
+	subscriptionID, err := store.InsertWebhookSubscription(models.WebhookSubscription{URL: srv.URL, Secret: "secret",
+		Events: []string{ReservationCreated}, Active: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.EnqueueWebhookDeliveries("evt_1", ReservationCreated, `{"id":"evt_1"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	wk := NewWorker(store, log.New(io.Discard, "", 0))
+	wk.Clock = clk
+
+	wk.RunOnce()
+	if requests != 1 {
+		t.Fatalf("expected the first attempt to be sent, got %d requests", requests)
+	}
+
+	clk.Advance(Backoff(1) - time.Second)
+	wk.RunOnce()
+	if requests != 1 {
+		t.Errorf("expected no retry before the backoff has passed, got %d requests", requests)
+	}
+
+	clk.Advance(time.Second)
+	wk.RunOnce()
+	if requests != 2 {
+		t.Fatalf("expected the retry once the backoff has passed, got %d requests", requests)
+	}
+
+	deliveries, err := store.WebhookDeliveries(subscriptionID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Status != models.WebhookDelivered || deliveries[0].Attempts != 2 {
+		t.Errorf("expected the delivery to succeed on its second attempt, got %+v", deliveries)
+	}
+}
@@ -0,0 +1,24 @@
+package migrations
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+)
+
+// files holds the migration files, named <version>_<name>.up.sql and <version>_<name>.down.sql, in a directory per
+// SQL dialect, so that the binary can apply them without the files being deployed alongside it
+//
+//go:embed postgres/*.sql sqlite/*.sql
+var files embed.FS
+
+// For returns the migrations for a dialect, "postgres" or "sqlite". A change to the schema needs a migration for
+// each of them
+func For(dialect string) (fs.FS, error) {
+	switch dialect {
+	case "postgres", "sqlite":
+		return fs.Sub(files, dialect)
+	}
+
+	return nil, fmt.Errorf("no migrations for dialect %q", dialect)
+}
@@ -0,0 +1,3 @@
+drop table if exists payments;
+drop table if exists exchange_rates;
+alter table rooms drop column if exists price;
@@ -0,0 +1,23 @@
+alter table rooms add column price integer not null default 0;
+
+create table exchange_rates (
+    id serial primary key,
+    currency varchar(3) not null unique,
+    rate numeric(18, 8) not null check (rate > 0),
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create table payments (
+    id serial primary key,
+    reservation_id integer not null references reservations (id) on delete cascade on update cascade,
+    amount integer not null,
+    currency varchar(3) not null,
+    base_amount integer not null,
+    base_currency varchar(3) not null,
+    exchange_rate numeric(18, 8) not null,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index payments_reservation_id_idx on payments (reservation_id);
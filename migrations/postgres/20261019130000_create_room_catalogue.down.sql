@@ -0,0 +1,10 @@
+drop table if exists room_images;
+drop table if exists room_amenities;
+drop table if exists amenities;
+
+drop index if exists rooms_slug_idx;
+alter table rooms drop column if exists retired;
+alter table rooms drop column if exists bed_types;
+alter table rooms drop column if exists max_occupancy;
+alter table rooms drop column if exists description;
+alter table rooms drop column if exists slug;
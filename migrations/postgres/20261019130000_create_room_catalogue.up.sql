@@ -0,0 +1,51 @@
+alter table rooms add column slug varchar(255);
+alter table rooms add column description text not null default '';
+alter table rooms add column max_occupancy integer not null default 2;
+alter table rooms add column bed_types varchar(255) not null default '';
+alter table rooms add column retired boolean not null default false;
+
+update rooms set slug = trim(both '-' from lower(regexp_replace(replace(room_name, '''', ''), '[^a-zA-Z0-9]+', '-', 'g')));
+
+alter table rooms alter column slug set not null;
+create unique index rooms_slug_idx on rooms (slug);
+
+create table amenities (
+    id serial primary key,
+    name varchar(255) not null unique,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create table room_amenities (
+    room_id integer not null references rooms (id) on delete cascade on update cascade,
+    amenity_id integer not null references amenities (id) on delete cascade on update cascade,
+    created_at timestamp not null,
+    updated_at timestamp not null,
+    primary key (room_id, amenity_id)
+);
+
+create table room_images (
+    id serial primary key,
+    room_id integer not null references rooms (id) on delete cascade on update cascade,
+    url varchar(255) not null,
+    caption varchar(255) not null default '',
+    sort_order integer not null default 0,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index room_images_room_id_idx on room_images (room_id);
+
+insert into amenities (name, created_at, updated_at) values
+    ('Sea view', now(), now()),
+    ('Kitchen', now(), now()),
+    ('Accessible', now(), now());
+
+-- carry over the content of the old hand-written room pages
+insert into room_images (room_id, url, created_at, updated_at)
+    select id, '/static/images/generals-quarters.png', now(), now() from rooms where slug = 'generals-quarters';
+insert into room_images (room_id, url, created_at, updated_at)
+    select id, '/static/images/marjors-suite.png', now(), now() from rooms where slug = 'majors-suite';
+
+update rooms set description = 'Your home away from home, set on the majestic waters of the Atlantic Ocean, this will be a vacation to remember.'
+    where slug in ('generals-quarters', 'majors-suite') and description = '';
@@ -0,0 +1,2 @@
+alter table room_images drop column if exists storage_key;
+alter table room_images drop column if exists thumbnail_url;
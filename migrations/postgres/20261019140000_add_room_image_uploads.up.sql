@@ -0,0 +1,2 @@
+alter table room_images add column thumbnail_url varchar(255) not null default '';
+alter table room_images add column storage_key varchar(255) not null default '';
@@ -0,0 +1,2 @@
+alter table reservations drop column if exists children;
+alter table reservations drop column if exists adults;
@@ -0,0 +1,2 @@
+alter table reservations add column adults integer not null default 1 check (adults >= 1);
+alter table reservations add column children integer not null default 0 check (children >= 0);
@@ -0,0 +1,2 @@
+drop index if exists room_amenities_amenity_id_idx;
+alter table rooms drop column if exists size_sqm;
@@ -0,0 +1,3 @@
+alter table rooms add column size_sqm integer not null default 0 check (size_sqm >= 0);
+
+create index room_amenities_amenity_id_idx on room_amenities (amenity_id);
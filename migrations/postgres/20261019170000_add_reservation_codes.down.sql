@@ -0,0 +1,2 @@
+drop index if exists reservations_code_idx;
+alter table reservations drop column if exists code;
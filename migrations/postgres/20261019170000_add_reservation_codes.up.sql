@@ -0,0 +1,4 @@
+alter table reservations add column code varchar(16);
+update reservations set code = upper(substr(md5(id::text || clock_timestamp()::text), 1, 8)) where code is null;
+alter table reservations alter column code set not null;
+create unique index reservations_code_idx on reservations (code);
@@ -0,0 +1,3 @@
+drop table if exists api_key_usage;
+drop table if exists api_keys;
+drop table if exists partners;
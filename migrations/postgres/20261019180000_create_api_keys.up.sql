@@ -0,0 +1,29 @@
+create table partners (
+    id serial primary key,
+    name varchar(255) not null unique,
+    email varchar(255) not null,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create table api_keys (
+    id serial primary key,
+    partner_id integer not null references partners (id) on delete cascade on update cascade,
+    name varchar(255) not null,
+    prefix varchar(16) not null unique,
+    key_hash varchar(64) not null,
+    scopes text not null default '',
+    last_used_at timestamp,
+    revoked_at timestamp,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index api_keys_partner_id_idx on api_keys (partner_id);
+
+create table api_key_usage (
+    api_key_id integer not null references api_keys (id) on delete cascade on update cascade,
+    day date not null,
+    requests integer not null default 0,
+    primary key (api_key_id, day)
+);
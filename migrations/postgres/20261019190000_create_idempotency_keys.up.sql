@@ -0,0 +1,13 @@
+create table idempotency_keys (
+    scope varchar(64) not null,
+    idempotency_key varchar(255) not null,
+    request_hash varchar(64) not null default '',
+    status_code integer not null default 0,
+    location text not null default '',
+    body text not null default '',
+    created_at timestamp not null,
+    expires_at timestamp not null,
+    primary key (scope, idempotency_key)
+);
+
+create index idempotency_keys_expires_at_idx on idempotency_keys (expires_at);
@@ -0,0 +1,28 @@
+create table webhook_subscriptions (
+    id serial primary key,
+    url text not null,
+    secret varchar(64) not null,
+    events text not null,
+    active boolean not null default true,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create table webhook_deliveries (
+    id serial primary key,
+    subscription_id integer not null references webhook_subscriptions (id) on delete cascade on update cascade,
+    event_id varchar(64) not null,
+    event_type varchar(64) not null,
+    payload text not null,
+    status varchar(16) not null default 'pending',
+    attempts integer not null default 0,
+    response_code integer not null default 0,
+    error text not null default '',
+    next_attempt_at timestamp not null,
+    last_attempt_at timestamp,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index webhook_deliveries_due_idx on webhook_deliveries (next_attempt_at) where status = 'pending';
+create index webhook_deliveries_subscription_id_idx on webhook_deliveries (subscription_id, created_at);
@@ -0,0 +1,2 @@
+drop index if exists webhook_deliveries_subscription_id_event_id_idx;
+drop table if exists outbox_events;
@@ -0,0 +1,15 @@
+create table outbox_events (
+    id serial primary key,
+    event_type varchar(64) not null,
+    payload text not null,
+    attempts integer not null default 0,
+    last_error text not null default '',
+    next_attempt_at timestamp not null,
+    published_at timestamp,
+    created_at timestamp not null
+);
+
+create index outbox_events_pending_idx on outbox_events (next_attempt_at) where published_at is null;
+
+-- events are published at least once, so a webhook delivery may be queued for the same event more than once
+create unique index webhook_deliveries_subscription_id_event_id_idx on webhook_deliveries (subscription_id, event_id);
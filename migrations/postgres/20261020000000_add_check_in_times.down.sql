@@ -0,0 +1,8 @@
+alter table reservations drop column if exists late_check_out;
+alter table reservations drop column if exists early_check_in;
+
+alter table rooms drop column if exists turnover_days;
+alter table rooms drop column if exists late_check_out_price;
+alter table rooms drop column if exists early_check_in_price;
+alter table rooms drop column if exists check_out_time;
+alter table rooms drop column if exists check_in_time;
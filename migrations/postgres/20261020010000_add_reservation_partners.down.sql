@@ -0,0 +1,3 @@
+drop index if exists reservations_partner_id_idx;
+
+alter table reservations drop column if exists partner_id;
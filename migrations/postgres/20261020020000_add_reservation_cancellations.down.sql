@@ -0,0 +1 @@
+alter table reservations drop column if exists cancelled_at;
@@ -0,0 +1,17 @@
+drop table outbox_events;
+drop table webhook_deliveries;
+drop table webhook_subscriptions;
+drop table idempotency_keys;
+drop table api_key_usage;
+drop table api_keys;
+drop table partners;
+drop table room_images;
+drop table room_amenities;
+drop table amenities;
+drop table payments;
+drop table exchange_rates;
+drop table room_restrictions;
+drop table reservations;
+drop table restrictions;
+drop table rooms;
+drop table users;
@@ -0,0 +1,223 @@
+-- the SQLite schema matches the Postgres one after all of its migrations up to 20261019210000. Postgres types are
+-- kept where SQLite accepts them so that the two read alike; dates and timestamps are stored as text, which the
+-- driver writes in a single format so that they compare correctly
+create table users (
+    id integer primary key autoincrement,
+    first_name varchar(255) not null default '',
+    last_name varchar(255) not null default '',
+    email varchar(255) not null,
+    password varchar(60) not null,
+    access_level integer not null default 1,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create unique index users_email_idx on users (email);
+
+create table rooms (
+    id integer primary key autoincrement,
+    room_name varchar(255) not null,
+    price integer not null default 0,
+    slug varchar(255) not null,
+    description text not null default '',
+    max_occupancy integer not null default 2,
+    bed_types varchar(255) not null default '',
+    retired boolean not null default false,
+    size_sqm integer not null default 0 check (size_sqm >= 0),
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create unique index rooms_slug_idx on rooms (slug);
+
+create table restrictions (
+    id integer primary key autoincrement,
+    restriction_name varchar(255) not null,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create table reservations (
+    id integer primary key autoincrement,
+    code varchar(16) not null,
+    first_name varchar(255) not null,
+    last_name varchar(255) not null,
+    email varchar(255) not null,
+    phone varchar(255) not null default '',
+    start_date date not null,
+    end_date date not null,
+    room_id integer not null references rooms (id) on delete cascade on update cascade,
+    adults integer not null default 1 check (adults >= 1),
+    children integer not null default 0 check (children >= 0),
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index reservations_email_idx on reservations (email);
+create index reservations_last_name_idx on reservations (last_name);
+create unique index reservations_code_idx on reservations (code);
+
+create table room_restrictions (
+    id integer primary key autoincrement,
+    start_date date not null,
+    end_date date not null,
+    room_id integer not null references rooms (id) on delete cascade on update cascade,
+    reservation_id integer references reservations (id) on delete cascade on update cascade,
+    restriction_id integer not null references restrictions (id) on delete cascade on update cascade,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index room_restrictions_dates_idx on room_restrictions (start_date, end_date);
+create index room_restrictions_room_id_idx on room_restrictions (room_id);
+create index room_restrictions_reservation_id_idx on room_restrictions (reservation_id);
+
+create table exchange_rates (
+    id integer primary key autoincrement,
+    currency varchar(3) not null unique,
+    rate numeric(18, 8) not null check (rate > 0),
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create table payments (
+    id integer primary key autoincrement,
+    reservation_id integer not null references reservations (id) on delete cascade on update cascade,
+    amount integer not null,
+    currency varchar(3) not null,
+    base_amount integer not null,
+    base_currency varchar(3) not null,
+    exchange_rate numeric(18, 8) not null,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index payments_reservation_id_idx on payments (reservation_id);
+
+create table amenities (
+    id integer primary key autoincrement,
+    name varchar(255) not null unique,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create table room_amenities (
+    room_id integer not null references rooms (id) on delete cascade on update cascade,
+    amenity_id integer not null references amenities (id) on delete cascade on update cascade,
+    created_at timestamp not null,
+    updated_at timestamp not null,
+    primary key (room_id, amenity_id)
+);
+
+create index room_amenities_amenity_id_idx on room_amenities (amenity_id);
+
+create table room_images (
+    id integer primary key autoincrement,
+    room_id integer not null references rooms (id) on delete cascade on update cascade,
+    url varchar(255) not null,
+    caption varchar(255) not null default '',
+    sort_order integer not null default 0,
+    thumbnail_url varchar(255) not null default '',
+    storage_key varchar(255) not null default '',
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index room_images_room_id_idx on room_images (room_id);
+
+create table partners (
+    id integer primary key autoincrement,
+    name varchar(255) not null unique,
+    email varchar(255) not null,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create table api_keys (
+    id integer primary key autoincrement,
+    partner_id integer not null references partners (id) on delete cascade on update cascade,
+    name varchar(255) not null,
+    prefix varchar(16) not null unique,
+    key_hash varchar(64) not null,
+    scopes text not null default '',
+    last_used_at timestamp,
+    revoked_at timestamp,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index api_keys_partner_id_idx on api_keys (partner_id);
+
+create table api_key_usage (
+    api_key_id integer not null references api_keys (id) on delete cascade on update cascade,
+    day date not null,
+    requests integer not null default 0,
+    primary key (api_key_id, day)
+);
+
+create table idempotency_keys (
+    scope varchar(64) not null,
+    idempotency_key varchar(255) not null,
+    request_hash varchar(64) not null default '',
+    status_code integer not null default 0,
+    location text not null default '',
+    body text not null default '',
+    created_at timestamp not null,
+    expires_at timestamp not null,
+    primary key (scope, idempotency_key)
+);
+
+create index idempotency_keys_expires_at_idx on idempotency_keys (expires_at);
+
+create table webhook_subscriptions (
+    id integer primary key autoincrement,
+    url text not null,
+    secret varchar(64) not null,
+    events text not null,
+    active boolean not null default true,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create table webhook_deliveries (
+    id integer primary key autoincrement,
+    subscription_id integer not null references webhook_subscriptions (id) on delete cascade on update cascade,
+    event_id varchar(64) not null,
+    event_type varchar(64) not null,
+    payload text not null,
+    status varchar(16) not null default 'pending',
+    attempts integer not null default 0,
+    response_code integer not null default 0,
+    error text not null default '',
+    next_attempt_at timestamp not null,
+    last_attempt_at timestamp,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index webhook_deliveries_due_idx on webhook_deliveries (next_attempt_at) where status = 'pending';
+create index webhook_deliveries_subscription_id_idx on webhook_deliveries (subscription_id, created_at);
+create unique index webhook_deliveries_subscription_id_event_id_idx on webhook_deliveries (subscription_id, event_id);
+
+create table outbox_events (
+    id integer primary key autoincrement,
+    event_type varchar(64) not null,
+    payload text not null,
+    attempts integer not null default 0,
+    last_error text not null default '',
+    next_attempt_at timestamp not null,
+    published_at timestamp,
+    created_at timestamp not null
+);
+
+create index outbox_events_pending_idx on outbox_events (next_attempt_at) where published_at is null;
+
+-- the handlers refer to these by ID
+insert into restrictions (id, restriction_name, created_at, updated_at) values
+    (1, 'Reservation', datetime('now'), datetime('now')),
+    (2, 'Owner Block', datetime('now'), datetime('now'));
+
+insert into amenities (name, created_at, updated_at) values
+    ('Sea view', datetime('now'), datetime('now')),
+    ('Kitchen', datetime('now'), datetime('now')),
+    ('Accessible', datetime('now'), datetime('now'));
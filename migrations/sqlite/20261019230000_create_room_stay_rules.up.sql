@@ -0,0 +1,15 @@
+-- weekdays holds a space separated list of days, 0 for Sunday to 6 for Saturday; start_date and end_date, when set,
+-- limit the rule to stays arriving from start_date up to end_date
+create table room_stay_rules (
+    id integer primary key autoincrement,
+    room_id integer not null references rooms (id) on delete cascade on update cascade,
+    rule_type varchar(32) not null,
+    nights integer not null default 0 check (nights >= 0),
+    weekdays varchar(32) not null default '',
+    start_date date,
+    end_date date,
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index room_stay_rules_room_id_idx on room_stay_rules (room_id);
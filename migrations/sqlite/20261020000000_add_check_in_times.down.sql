@@ -0,0 +1,8 @@
+alter table reservations drop column late_check_out;
+alter table reservations drop column early_check_in;
+
+alter table rooms drop column turnover_days;
+alter table rooms drop column late_check_out_price;
+alter table rooms drop column early_check_in_price;
+alter table rooms drop column check_out_time;
+alter table rooms drop column check_in_time;
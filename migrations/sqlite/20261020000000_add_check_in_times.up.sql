@@ -0,0 +1,10 @@
+-- check_in_time and check_out_time are local times at the property, as HH:MM; an add-on price of 0 means the
+-- add-on isn't offered. turnover_days are kept free for cleaning between stays
+alter table rooms add column check_in_time varchar(5) not null default '15:00';
+alter table rooms add column check_out_time varchar(5) not null default '11:00';
+alter table rooms add column early_check_in_price integer not null default 0 check (early_check_in_price >= 0);
+alter table rooms add column late_check_out_price integer not null default 0 check (late_check_out_price >= 0);
+alter table rooms add column turnover_days integer not null default 0 check (turnover_days >= 0);
+
+alter table reservations add column early_check_in boolean not null default false;
+alter table reservations add column late_check_out boolean not null default false;
@@ -0,0 +1,3 @@
+drop index reservations_partner_id_idx;
+
+alter table reservations drop column partner_id;
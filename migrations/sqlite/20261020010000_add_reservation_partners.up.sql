@@ -0,0 +1,4 @@
+-- partner_id is the partner whose API key made the reservation, and null for bookings made on the website
+alter table reservations add column partner_id integer references partners (id) on delete set null on update cascade;
+
+create index reservations_partner_id_idx on reservations (partner_id);
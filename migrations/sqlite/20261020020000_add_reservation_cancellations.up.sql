@@ -0,0 +1,2 @@
+-- a cancelled reservation is kept, with the time it was cancelled, but its room restrictions are removed
+alter table reservations add column cancelled_at timestamp;
@@ -1,3 +1,3 @@
 #!/bin/bash
 
-go build -o go_bookings cmd/web/*.go && ./go_bookings
\ No newline at end of file
+go build -o go_bookings cmd/web/*.go && ./go_bookings -auto-migrate